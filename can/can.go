@@ -57,6 +57,11 @@ type Writer interface {
 	Write([]byte) (int, error)
 }
 
+// Sender is implemented by interfaces which can transmit messages on the bus
+type Sender interface {
+	Send(*RawMessage) (int, error)
+}
+
 type ReadWriter interface {
 	Reader
 	Writer
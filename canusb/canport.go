@@ -33,20 +33,24 @@ type CanPort struct {
 	p      io.ReadWriteCloser
 	a      uint8
 	IsOpen bool
+
+	// Instances sent in the address claim, changed with SetInstance
+	deviceInstance uint8
+	systemInstance uint8
 }
 
 var group byte = 0
 
-// Send a 60928 ISO Address Claim parameter group
-func (p *CanPort) AddressClaim(preferredAddress uint8) uint8 {
-	buf := make([]byte, 8)
+// Name returns the 64 bit ISO NAME of the adapter, which it claims its
+// address with and which identifies it in messages such as Alert Response
+func (p *CanPort) Name() uint64 {
 	unique := uint32(0x1fffff)
 	manufacturer := uint32(100)
-	lower_instance := uint32(0)
-	upper_instance := uint32(0)
+	lower_instance := uint32(p.deviceInstance & 0x7)
+	upper_instance := uint32(p.deviceInstance >> 3)
 	function := uint32(25)
 	class := uint32(25)
-	instance := uint32(0)
+	instance := uint32(p.systemInstance & 0xF)
 	industry_code := uint32(4)
 	arb_addr := uint32(1)
 
@@ -63,8 +67,13 @@ func (p *CanPort) AddressClaim(preferredAddress uint8) uint8 {
 	i1 += industry_code << 28
 	i1 += arb_addr << 31
 
-	binary.LittleEndian.PutUint32(buf[0:4], i0)
-	binary.LittleEndian.PutUint32(buf[4:8], i1)
+	return uint64(i1)<<32 | uint64(i0)
+}
+
+// Send a 60928 ISO Address Claim parameter group
+func (p *CanPort) AddressClaim(preferredAddress uint8) uint8 {
+	buf := make([]byte, 8)
+	binary.LittleEndian.PutUint64(buf, p.Name())
 
 	addr_claim := can.RawMessage{
 		Timestamp:   time.Now(),
@@ -82,6 +91,19 @@ func (p *CanPort) AddressClaim(preferredAddress uint8) uint8 {
 	return preferredAddress
 }
 
+// SetInstance changes the device and system instances of the adapter and
+// claims its address again so other devices see the change.
+func (p *CanPort) SetInstance(device, system uint8) {
+	p.deviceInstance = device
+	p.systemInstance = system & 0xF
+	p.AddressClaim(p.a)
+}
+
+// Instance returns the device and system instances of the adapter.
+func (p *CanPort) Instance() (device, system uint8) {
+	return p.deviceInstance, p.systemInstance
+}
+
 // OpenChannel opens the CAN bus port of the CANUSB adapter for communication.
 // This must be called after opening the serial port, but before beginning
 // communication with the CAN bus network. No harm will come from calling this
@@ -222,7 +244,7 @@ func (p *CanPort) Send(frame *can.RawMessage) (int, error) {
 
 	dataLen := len(frame.Data)
 
-	if dataLen <= 8 {
+	if dataLen <= 8 && !isFastPacket(frame.Pgn) {
 		buf[5] = frame.Length
 		n := copy(buf[6:], frame.Data)
 
@@ -233,7 +255,7 @@ func (p *CanPort) Send(frame *can.RawMessage) (int, error) {
 		return p.Write(buf)
 	}
 
-	if dataLen > 8 && dataLen <= 223 {
+	if dataLen <= 223 {
 		chunksize := 6
 		tmp := make([]byte, 8)
 		seq := 0
@@ -23,17 +23,28 @@ import (
 	"bytes"
 	"github.com/burntsushi/toml"
 	"github.com/imdario/mergo"
+	"github.com/timmathews/argo/signalk"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 )
 
 type TomlConfig struct {
-	LogLevel   string
-	MapFile    string
-	Server     serverConfig
-	Mqtt       mqttConfig
-	Interfaces map[string]InterfaceConfig
-	Vessel     VesselConfig
+	LogLevel       string
+	MapFile        string
+	PgnDefinitions string
+	Server         serverConfig
+	Mqtt           mqttConfig
+	Interfaces     map[string]InterfaceConfig
+	Vessel         VesselConfig
+	Meta           map[string]signalk.Meta
+	MetaFile       string
+	History        historyConfig
+	Calculators    map[string]signalk.CalculatorConfig
+	Outputs        map[string]OutputConfig
+	Upstream       upstreamConfig
 }
 
 type serverConfig struct {
@@ -47,15 +58,68 @@ type serverConfig struct {
 	PrivateKeyFile   string
 }
 
+// Transport is tcp or ws, over TLS if UseTls is set. Layout is delta, for
+// every delta on Channel, or paths, for the latest value of each path on a
+// topic of its own below Channel. Writes are taken on PutTopic if it is set.
 type mqttConfig struct {
-	Enable   bool
-	UseTls   bool
-	Port     int
-	Host     string
-	ClientId string
-	Username string
-	Password string
-	Channel  string
+	Enable        bool
+	UseTls        bool
+	Transport     string
+	Port          int
+	Host          string
+	WebsocketPath string
+	ClientId      string
+	Username      string
+	Password      string
+	Channel       string
+	Layout        string
+	Qos           int
+	PutTopic      string
+}
+
+// Durations are given as in "90s", "12h" or "30d"
+type historyConfig struct {
+	Enable    bool
+	Directory string
+	Retention string
+	Interval  string
+	Paths     []HistoryPath
+}
+
+// HistoryPath keeps the paths which match Path for longer or shorter than
+// the rest, or less often. Retention and Interval default to those of the
+// history.
+type HistoryPath struct {
+	Path      string
+	Retention string
+	Interval  string
+}
+
+// Url is a ws:// or wss:// stream, or an http:// or https:// endpoint
+// deltas are posted to. BufferLimit is in megabytes.
+type upstreamConfig struct {
+	Enable      bool
+	Url         string
+	Token       string
+	Directory   string
+	BufferLimit int64
+}
+
+// OutputConfig sets when values are sent to an output, such as Websocket,
+// Mqtt or History. Values are sent together every Batch if it is given.
+type OutputConfig struct {
+	Batch    string
+	Policies []OutputPolicy
+}
+
+// OutputPolicy sets when values of the paths which match Path are sent. See
+// signalk.EmissionPolicy.
+type OutputPolicy struct {
+	Path             string
+	Deadband         float64
+	RelativeDeadband float64
+	MinInterval      string
+	MaxSilence       string
 }
 
 type InterfaceConfig struct {
@@ -72,6 +136,10 @@ type VesselConfig struct {
 	Mmsi         int
 	Callsign     string
 	Registration string
+	Length       float64
+	Beam         float64
+	Draft        float64
+	AirHeight    float64
 	Uuid         string
 	Uuid0        string `toml:"-"`
 	Uuid1        string `toml:"-"`
@@ -83,34 +151,55 @@ type VesselConfig struct {
 var defaultConfig = TomlConfig{
 	LogLevel: "INFO",
 	MapFile:  "map.xml",
+	MetaFile: "meta.json",
 	Server: serverConfig{
 		AssetPath:        "./assets",
 		EnableWebsockets: true,
 		Port:             8080,
 	},
 	Mqtt: mqttConfig{
-		Enable:   false,
-		UseTls:   true,
-		Host:     "localhost",
-		Port:     8883,
-		ClientId: "argo",
-		Username: "signalk",
-		Password: "signalk",
-		Channel:  "signalk/argo",
+		Enable:        false,
+		UseTls:        true,
+		Transport:     "tcp",
+		Host:          "localhost",
+		Port:          8883,
+		WebsocketPath: "/mqtt",
+		ClientId:      "argo",
+		Username:      "signalk",
+		Password:      "signalk",
+		Channel:       "signalk/argo",
+		Layout:        "delta",
+	},
+	History: historyConfig{
+		Directory: "history",
+		Retention: "30d",
+	},
+	Upstream: upstreamConfig{
+		Directory:   "upstream",
+		BufferLimit: 100,
 	},
 }
 
 func ReadConfig(path string) (TomlConfig, error) {
 	var config TomlConfig
 
-	if _, err := toml.DecodeFile(path, &config); err != nil {
+	md, err := toml.DecodeFile(path, &config)
+	if err != nil {
 		return defaultConfig, err
 	}
 
+	// Defaults fill in what is false as well as what is missing, so a false
+	// UseTls which is given is put back
+	useTls := config.Mqtt.UseTls
+
 	if err := mergo.Merge(&config, defaultConfig); err != nil {
 		return defaultConfig, err
 	}
 
+	if md.IsDefined("Mqtt", "UseTls") {
+		config.Mqtt.UseTls = useTls
+	}
+
 	u := strings.Split(config.Vessel.Uuid, "-")
 	if len(u) == 5 {
 		config.Vessel.Uuid0 = u[0]
@@ -138,3 +227,77 @@ func WriteConfig(path string, config TomlConfig) error {
 
 	return nil
 }
+
+// SetString sets one string in the config file at path and leaves the rest of
+// the file, including its comments and layout, as it is. The key is replaced
+// if the table has it, added at the top of the table if not, and the table is
+// added at the end of the file if it is missing.
+func SetString(path, table, key, value string) error {
+	b, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	line := key + " = " + strconv.Quote(value)
+	lines := strings.Split(strings.TrimRight(string(b), "\n"), "\n")
+	if len(b) == 0 {
+		lines = nil
+	}
+
+	start := -1
+	for i, l := range lines {
+		l = strings.TrimSpace(l)
+		if strings.HasPrefix(l, "["+table+"]") {
+			start = i
+			continue
+		}
+		if start < 0 {
+			continue
+		}
+		if strings.HasPrefix(l, "[") {
+			break
+		}
+		if k := strings.SplitN(l, "=", 2); len(k) == 2 && strings.TrimSpace(k[0]) == key {
+			lines[i] = line
+			return ReplaceFile(path, []byte(strings.Join(lines, "\n")+"\n"))
+		}
+	}
+
+	if start < 0 {
+		lines = append(lines, "", "["+table+"]", line)
+	} else {
+		lines = append(lines[:start+1], append([]string{line}, lines[start+1:]...)...)
+	}
+
+	return ReplaceFile(path, []byte(strings.Join(lines, "\n")+"\n"))
+}
+
+// ReplaceFile replaces the file at path with b, through a temporary file so
+// the file is never left half written. The file keeps its permissions.
+func ReplaceFile(path string, b []byte) error {
+	mode := os.FileMode(0644)
+	if info, err := os.Stat(path); err == nil {
+		mode = info.Mode()
+	}
+
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Chmod(mode)
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(f.Name(), path)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+	}
+
+	return err
+}
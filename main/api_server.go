@@ -23,12 +23,14 @@ import (
 	"encoding/json"
 	"encoding/xml"
 	"fmt"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
 
 	"github.com/gorilla/mux"
 	"github.com/timmathews/argo/nmea2k"
+	"github.com/timmathews/argo/signalk"
 )
 
 type IndexEntry struct {
@@ -42,9 +44,63 @@ type IndexEntry struct {
 	Details         string `json:"@Details"`
 }
 
+// CommandRequest asks another device on the bus to send a PGN or change its
+// fields. RequestType is one of iso_request, request or command. Parameters
+// select the fields of a request and set the fields of a command.
 type CommandRequest struct {
-	RequestType  string `json:"req_type"`
-	RequestedPgn uint32 `json:"req_pgn"`
+	RequestType  string             `json:"req_type"`
+	RequestedPgn uint32             `json:"req_pgn"`
+	Destination  uint8              `json:"dst"`
+	Interface    string             `json:"interface"`
+	Parameters   []CommandParameter `json:"params"`
+
+	reply chan CommandResponse
+}
+
+// CommandParameter is a field of the requested PGN, by name or index
+type CommandParameter struct {
+	Field interface{} `json:"field"`
+	Value interface{} `json:"value"`
+}
+
+// CommandResponse is how the device answered. Data is the requested PGN for
+// a successful request. Otherwise the error codes of the acknowledgement are
+// given.
+type CommandResponse struct {
+	Result          string                `json:"result"`
+	Message         string                `json:"message,omitempty"`
+	PgnError        uint8                 `json:"pgn_error"`
+	IntervalError   uint8                 `json:"interval_error"`
+	ParameterErrors []uint8               `json:"parameter_errors,omitempty"`
+	Data            *nmea2k.ParsedMessage `json:"data,omitempty"`
+}
+
+// parameters converts the parameters of the request into group function
+// parameters, looking fields up by name in the definition of the PGN
+func (c *CommandRequest) parameters() ([]nmea2k.GroupFunctionParameter, error) {
+	var params []nmea2k.GroupFunctionParameter
+
+	_, def := nmea2k.PgnList.First(c.RequestedPgn)
+	if def.Pgn != c.RequestedPgn {
+		return nil, fmt.Errorf("unknown PGN %v", c.RequestedPgn)
+	}
+
+	data := make(nmea2k.DataMap, len(c.Parameters))
+
+	for _, p := range c.Parameters {
+		idx, err := def.FieldIndex(fmt.Sprint(p.Field))
+		if err != nil {
+			return nil, err
+		}
+
+		params = append(params, nmea2k.GroupFunctionParameter{Field: idx, Value: p.Value})
+
+		// Later fields may only exist in a proprietary variant
+		data[idx] = p.Value
+		_, def = nmea2k.PgnList.Resolve(c.RequestedPgn, data)
+	}
+
+	return params, nil
 }
 
 func GetPGNSummary(i int) IndexEntry {
@@ -71,8 +127,109 @@ func GetPGNSummary(i int) IndexEntry {
 	return p
 }
 
-func HomeHandler(w http.ResponseWriter, r *http.Request) {
-	fmt.Fprintf(w, "<html><head><title>Pyxis API</title></head><body><h1>Pyxis API</h1><a href=\"messages\">Messages</a></body></html>")
+// Discovery is served at /signalk and tells clients where to find the API
+// and the stream of each version of Signal K we support
+type Discovery struct {
+	Endpoints map[string]DiscoveryEndpoint `json:"endpoints"`
+	Server    DiscoveryServer              `json:"server"`
+}
+
+type DiscoveryEndpoint struct {
+	Version string `json:"version"`
+	Http    string `json:"signalk-http"`
+	Ws      string `json:"signalk-ws"`
+}
+
+type DiscoveryServer struct {
+	Id      string `json:"id"`
+	Version string `json:"version"`
+}
+
+// version of Argo, set at build time with -ldflags "-X main.version=..."
+var version = "dev"
+
+// DiscoveryHandler lists our endpoints. They are on the host the client used
+// to reach us, unless the server is configured to listen on a single address.
+func DiscoveryHandler(w http.ResponseWriter, r *http.Request) {
+	host := sysconf.Server.ListenOn
+	if host == "" || host == "0.0.0.0" || host == "::" {
+		host = r.Host
+		if h, _, err := net.SplitHostPort(r.Host); err == nil {
+			host = h
+		}
+	}
+	host = net.JoinHostPort(host, strconv.Itoa(sysconf.Server.Port))
+
+	scheme := "http"
+	if sysconf.Server.UseTls {
+		scheme = "https"
+	}
+
+	d := Discovery{
+		Endpoints: map[string]DiscoveryEndpoint{
+			"v1": {
+				Version: signalk.Version,
+				Http:    fmt.Sprintf("%v://%v/signalk/v1/api/", scheme, host),
+				Ws:      fmt.Sprintf("ws%v://%v/signalk/v1/stream", scheme[4:], host),
+			},
+		},
+		Server: DiscoveryServer{"argo", version},
+	}
+
+	b, err := json.MarshalIndent(d, "", "  ")
+	if err != nil {
+		log.Error("Marshalling failed:", err)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
+
+// ModelHandler serves the Signal K full model, or the part of it below the
+// requested path, such as /signalk/v1/api/vessels/self/navigation/position
+func ModelHandler(model *signalk.Model) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		p := strings.TrimPrefix(r.URL.Path, "/signalk/v1/api")
+
+		b, ok := model.Get(p)
+		if !ok {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(b)
+	}
+}
+
+// PutHandler changes a value of our own vessel, such as
+// /signalk/v1/api/vessels/self/electrical/switches/bank/1/3/state, by sending
+// it onto the bus. The body gives the value and optionally the source to send
+// it to, as in {"value": "On", "source": "n2k-port.43"}. A PUT to the meta of
+// a path, such as .../belowKeel/meta/displayName, changes the meta instead.
+func PutHandler(model *signalk.Model, mappings *mappingStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var req signalk.PutRequest
+		if err := json.NewDecoder(r.Body).Decode(&req.Put); err != nil {
+			http.Error(w, "Invalid JSON", http.StatusBadRequest)
+			return
+		}
+
+		keys := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/signalk/v1/api"), "/"), "/")
+		if len(keys) < 3 {
+			http.Error(w, "Not found", http.StatusNotFound)
+			return
+		}
+
+		req.Context = keys[0] + "." + keys[1]
+		req.Put.Path = strings.Join(keys[2:], ".")
+
+		res := handlePut(model, mappings, &req)
+
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(res.StatusCode)
+		json.NewEncoder(w).Encode(res)
+	}
 }
 
 func MessagesIndex(w http.ResponseWriter, r *http.Request) {
@@ -148,25 +305,46 @@ func SendMessageHandler(cmd chan CommandRequest) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if r.Method == "POST" {
 			decoder := json.NewDecoder(r.Body)
-			var b CommandRequest
+			b := CommandRequest{Destination: 255}
 			err := decoder.Decode(&b)
 			if err != nil {
+				w.WriteHeader(http.StatusBadRequest)
 				fmt.Fprintf(w, "Invalid JSON")
+				return
 			}
 			log.Debugf("Request Type: %v", b.RequestType)
 			log.Debugf("Requested PGN: %v", b.RequestedPgn)
+			b.reply = make(chan CommandResponse, 1)
 			cmd <- b
+
+			res := <-b.reply
+			if res.Result == "timeout" {
+				w.WriteHeader(http.StatusGatewayTimeout)
+			}
+
+			enc, err := json.MarshalIndent(res, "", "  ")
+			if err != nil {
+				log.Error("Marshalling failed:", err)
+			}
+			fmt.Fprint(w, string(enc))
 		}
 	}
 }
 
-func ApiServer(addr *string, cmd chan CommandRequest) {
+func ApiServer(addr *string, cmd chan CommandRequest, model *signalk.Model, mappings *mappingStore) {
 	r := mux.NewRouter()
 	s := r.PathPrefix("/signalk/v1/api").Subrouter()
-	s.HandleFunc("/", HomeHandler)
+	s.HandleFunc("/", ModelHandler(model))
+	s.PathPrefix("/vessels").Methods("GET").HandlerFunc(ModelHandler(model))
+	s.PathPrefix("/vessels").Methods("PUT").HandlerFunc(PutHandler(model, mappings))
+	s.PathPrefix("/sources").Methods("GET").HandlerFunc(ModelHandler(model))
+	s.HandleFunc("/notifications/history", NotificationHistoryHandler)
 	s.HandleFunc("/messages", MessagesIndex)
 	s.HandleFunc("/messages/", MessagesIndex)
 	s.HandleFunc("/messages/{key}", MessageDetailsHandler)
 	s.HandleFunc("/control/send", http.HandlerFunc(SendMessageHandler(cmd)))
 	http.Handle("/signalk/v1/api/", r)
+	http.HandleFunc("/signalk/v1/history/values", HistoryValuesHandler(model))
+	http.HandleFunc("/signalk/v1/history/paths", HistoryPathsHandler(model))
+	http.HandleFunc("/signalk", DiscoveryHandler)
 }
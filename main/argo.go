@@ -21,11 +21,11 @@ package main
 
 import (
 	"bufio"
-	"crypto/tls"
 	"encoding/json"
 	"fmt"
 	"io"
 	"io/ioutil"
+	"net"
 	"os"
 	"os/signal"
 	"sort"
@@ -33,9 +33,9 @@ import (
 	"syscall"
 	"time"
 
-	mqtt "github.com/eclipse/paho.mqtt.golang"
 	"github.com/jacobsa/go-serial/serial"
 	"github.com/op/go-logging"
+	uuid "github.com/satori/go.uuid"
 	"github.com/timmathews/argo/actisense"
 	"github.com/timmathews/argo/canusb"
 	"github.com/timmathews/argo/config"
@@ -71,6 +71,21 @@ func main() {
 		return
 	}
 
+	var err error
+	sysconf, err = config.ReadConfig(opts.ConfigFile)
+
+	// User definitions must be loaded before -explain and before any
+	// interface is opened, since both use the final list of PGNs
+	if sysconf.PgnDefinitions != "" {
+		for _, e := range nmea2k.LoadDefinitions(sysconf.PgnDefinitions) {
+			log.Warning("PGN definitions:", e)
+		}
+	}
+
+	if len(opts.Command) > 0 {
+		os.Exit(runCommand(opts.Command))
+	}
+
 	if opts.Explain {
 		bytes, err := json.MarshalIndent(nmea2k.PgnList, "", "  ")
 		if err == nil {
@@ -81,8 +96,6 @@ func main() {
 		return
 	}
 
-	var err error
-	sysconf, err = config.ReadConfig(opts.ConfigFile)
 	if err != nil {
 		log.Fatalf("could not read config file. %v", err)
 	}
@@ -108,38 +121,84 @@ func main() {
 
 	log.Noticef("log level set to %v", logging.GetLevel(""))
 
-	txch := make(chan nmea2k.ParsedMessage)
+	txch := make(chan *nmea2k.DecodedMessage)
 	cmdch := make(chan CommandRequest)
 
 	statLog := make(map[string]uint64)
 	var statPgns StringSlice
 
-	mapData, err := signalk.ParseMappings(sysconf.MapFile)
+	// Our identity must not change between runs, so a generated UUID is saved.
+	// Only the UUID is written, the rest of the config file is left alone.
+	if sysconf.Vessel.Uuid == "" {
+		sysconf.Vessel.Uuid = uuid.NewV4().String()
+		if err := config.SetString(opts.ConfigFile, "Vessel", "Uuid", sysconf.Vessel.Uuid); err != nil {
+			log.Warningf("could not save vessel UUID to %v: %v", opts.ConfigFile, err)
+		} else {
+			log.Noticef("generated vessel UUID %v", sysconf.Vessel.Uuid)
+			sysconf, _ = config.ReadConfig(opts.ConfigFile)
+		}
+	}
+
+	self := vessel()
+	model := signalk.NewModel(self.Context())
+	model.Apply(self.Delta())
+
+	readEditedMeta()
+
+	mapData, err := loadMappings(sysconf.MapFile, self.Context())
 	if err != nil {
 		log.Fatalf("could not read XML map file %v: %v", sysconf.MapFile, err)
 	}
 
-	// Set up MQTT Client
-	var mqttClient mqtt.Client
+	// Changes to the mappings are picked up without a restart
+	mappings := &mappingStore{}
+	mappings.Store(mapData)
+	go watchMappings(sysconf.MapFile, mappings)
+
+	if sysconf.History.Enable {
+		if history, err = openHistory(); err != nil {
+			log.Fatalf("could not open history in %v: %v", sysconf.History.Directory, err)
+		}
+	}
+
+	if calculator, err = signalk.NewCalculator(model.Self(), sysconf.Calculators); err != nil {
+		log.Fatalf("could not set up calculators: %v", err)
+	}
+
+	// Deltas go to the history, the stream clients and the MQTT broker,
+	// each with its own emission policies
+	if err := checkOutputs(); err != nil {
+		log.Fatal(err)
+	}
+	if history != nil {
+		err = addOutput("History", func(d signalk.Delta) {
+			if err := history.Record(d); err != nil {
+				log.Warning("History:", err)
+			}
+		})
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	if sysconf.Server.EnableWebsockets {
+		if err := addOutput("Websocket", func(d signalk.Delta) { websocket_hub.deltas <- d }); err != nil {
+			log.Fatal(err)
+		}
+	}
 	if sysconf.Mqtt.Enable {
-		mqttOpts := mqtt.NewClientOptions().AddBroker(
-			fmt.Sprintf("ssl://%v:%v", sysconf.Mqtt.Host, sysconf.Mqtt.Port),
-		)
-		mqttOpts.SetClientID(sysconf.Mqtt.ClientId)
-		mqttOpts.SetUsername(sysconf.Mqtt.Username)
-		mqttOpts.SetPassword(sysconf.Mqtt.Password)
-		if sysconf.Mqtt.UseTls {
-			mqttOpts.SetTLSConfig(&tls.Config{MinVersion: tls.VersionTLS12})
+		if err := openMqtt(model, mappings, self); err != nil {
+			log.Fatal("MQTT:", err)
 		}
-		mqttClient = mqtt.NewClient(mqttOpts)
-		if token := mqttClient.Connect(); token.Wait() && token.Error() != nil {
-			log.Fatal("MQTT:", token.Error())
+	}
+	if sysconf.Upstream.Enable {
+		if err := openUpstream(); err != nil {
+			log.Fatalf("could not forward to %v: %v", sysconf.Upstream.Url, err)
 		}
 	}
+	go tickOutputs()
 
-	// Convert the port int to a string starting with :
-	// TODO: specify interfaces to listen on
-	addr := fmt.Sprintf(":%v", sysconf.Server.Port)
+	// Listen on all interfaces unless ListenOn is set
+	addr := net.JoinHostPort(sysconf.Server.ListenOn, strconv.Itoa(sysconf.Server.Port))
 
 	if sysconf.Server.EnableWebsockets {
 		// Start up the WebSockets hub
@@ -147,25 +206,44 @@ func main() {
 
 		go statistics_hub.run()
 
-		go WebSocketServer(&addr, log)
+		go WebSocketServer(&addr, log, model, mappings)
 	}
 
-	go ApiServer(&addr, cmdch)
+	go processCommands(cmdch)
+	go ApiServer(&addr, cmdch, model, mappings)
 	go UiServer(&addr, cmdch)
 
 	// Print and transmit received messages
 	go func() {
 		verbose := logging.GetLevel("") == logging.DEBUG
 
+		send := func(d signalk.Delta) {
+			publish(model, d)
+		}
+
 		for {
 			res := <-txch
 
+			groupFunctions.ReceiveDecoded(res)
+			model.DecodedDevice(res)
+
 			if (opts.Pgn == 0 || int(res.Header.Pgn) == opts.Pgn) &&
 				(opts.Src == 255 || int(res.Header.Source) == opts.Src) &&
 				(opts.Dst == 255 || int(res.Header.Destination) == opts.Dst) &&
 				!opts.Stats {
-				log.Debug(res.Header.Print(verbose))
-				log.Info(res.Print(verbose))
+				// Converting the message to print it is expensive, so
+				// only do it if it will be printed
+				if opts.CanBoat {
+					if b, err := res.Parsed().CanBoat(); err == nil {
+						fmt.Println(string(b))
+					} else {
+						log.Errorf("CANboat %v", err)
+					}
+				} else if log.IsEnabledFor(logging.INFO) {
+					parsed := res.Parsed()
+					log.Debug(parsed.Header.Print(verbose))
+					log.Info(parsed.Print(verbose))
+				}
 			}
 
 			pgn := strconv.Itoa(int(res.Header.Pgn))
@@ -193,25 +271,33 @@ func main() {
 				}
 			}
 
-			bj, err := mapData.Delta(&res)
-			if err == nil {
-				bytes, err := json.Marshal(bj)
-				if err == nil {
-					if sysconf.Server.EnableWebsockets {
-						websocket_hub.broadcast <- bytes
-					}
+			if bj, err := mappings.Load().DecodedDelta(res); err == nil {
+				send(bj)
+
+				if nd, ok := notifications.Process(bj); ok {
+					send(nd)
+				}
+
+				if cd, ok := calculator.Process(bj); ok {
+					send(cd)
 
-					if sysconf.Mqtt.Enable {
-						mqttClient.Publish(sysconf.Mqtt.Channel, 0, false, bytes)
+					if nd, ok := notifications.Process(cd); ok {
+						send(nd)
 					}
 				}
 			}
+
+			if nd, ok := notifications.DecodedAlert(model.Self(), res); ok {
+				send(nd)
+			}
+
+			res.Release()
 		}
 	}()
 
 	for k, i := range sysconf.Interfaces {
 		log.Noticef("opening %v at %v", k, i.Path)
-		go processInterface(i, txch)
+		go processInterface(k, i, txch)
 	}
 
 	exitc := make(chan os.Signal, 1)
@@ -220,9 +306,32 @@ func main() {
 	sig := <-exitc
 
 	log.Notice("cleaning up and exiting with %v", sig)
+
+	if history != nil {
+		history.Close()
+	}
+	if upstreamQueue != nil {
+		upstreamQueue.Close()
+	}
+}
+
+// vessel returns the static data of our own vessel from the configuration
+func vessel() signalk.Vessel {
+	v := sysconf.Vessel
+
+	return signalk.Vessel{
+		Name:      v.Name,
+		Mmsi:      v.Mmsi,
+		Uuid:      v.Uuid,
+		Callsign:  v.Callsign,
+		Length:    v.Length,
+		Beam:      v.Beam,
+		Draft:     v.Draft,
+		AirHeight: v.AirHeight,
+	}
 }
 
-func processInterface(iface config.InterfaceConfig, txch chan nmea2k.ParsedMessage) {
+func processInterface(name string, iface config.InterfaceConfig, txch chan *nmea2k.DecodedMessage) {
 	var stat syscall.Stat_t
 	var port io.ReadWriteCloser
 
@@ -264,18 +373,35 @@ func processInterface(iface config.InterfaceConfig, txch chan nmea2k.ParsedMessa
 			}
 		}
 
+		// Group functions are always sent as fast packets
+		canusb.AddFastPacket(nmea2k.GroupFunctionPgn)
+
 		// Read from hardware
 		log.Debug("opening channel")
 
 		canport, _ := canusb.OpenChannel(port, 221)
 
+		tx := &transmitter{
+			port: canport,
+			handlers: nmea2k.CommandHandlers{
+				60928: instanceHandler(canport),
+			},
+		}
+		addTransmitter(name, tx)
+
 		for {
 			raw, err := canport.Read()
 			if err == nil {
 				if raw.Pgn == 60928 && raw.Source == canport.Address() {
 					canport.AddressClaim(canport.Address() + 1)
 				}
-				txch <- *(nmea2k.ParsePacket(raw))
+				msg := nmea2k.NewDecodedMessage()
+				nmea2k.DefaultDecoder().Decode(raw, msg)
+				msg.Interface, msg.InterfaceType = name, iface.Type
+				if raw.Pgn == nmea2k.GroupFunctionPgn && raw.Destination == canport.Address() {
+					go tx.respond(msg.Parsed())
+				}
+				txch <- msg
 			} else {
 				log.Warning("canport:", err)
 			}
@@ -288,10 +414,16 @@ func processInterface(iface config.InterfaceConfig, txch chan nmea2k.ParsedMessa
 
 		canport.GetOperatingMode()
 
+		// The NGT-1 answers group functions addressed to it by itself
+		addTransmitter(name, &transmitter{port: canport})
+
 		for {
 			raw, err := canport.Read()
 			if err == nil {
-				txch <- *(nmea2k.ParsePacket(raw))
+				msg := nmea2k.NewDecodedMessage()
+				nmea2k.DefaultDecoder().Decode(raw, msg)
+				msg.Interface, msg.InterfaceType = name, iface.Type
+				txch <- msg
 			} else {
 				log.Warning("canport:", err)
 			}
@@ -305,7 +437,9 @@ func processInterface(iface config.InterfaceConfig, txch chan nmea2k.ParsedMessa
 			txt := fileScanner.Text()
 			pgn, err := nmea2k.FromCanBoat(txt)
 			if err == nil {
-				txch <- *pgn
+				msg := nmea2k.DecodedFrom(pgn)
+				msg.Interface, msg.InterfaceType = name, iface.Type
+				txch <- msg
 			} else {
 				log.Warning("filescanner:", err)
 			}
@@ -0,0 +1,76 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/timmathews/argo/signalk"
+)
+
+// Derives values, such as the true wind, from those of our own vessel
+var calculator *signalk.Calculator
+
+// listCalculators prints the calculations which can be turned on, with their
+// inputs and outputs and whether the configuration turns them on
+func listCalculators() int {
+	for _, c := range signalk.Calculations {
+		conf := sysconf.Calculators[c.Name]
+
+		state := "off"
+		if conf.Enable {
+			state = "on"
+		}
+		fmt.Printf("%v (%v)\n  %v\n", c.Name, state, c.Description)
+
+		for _, in := range c.Inputs {
+			path := in.Path
+			if p, ok := conf.Inputs[in.Name]; ok {
+				path = p
+			}
+			if in.Optional {
+				path += ", optional"
+			}
+			fmt.Printf("  in   %-12v %v\n", in.Name, path)
+		}
+
+		for _, out := range c.Outputs {
+			fmt.Printf("  out  %v\n", out.Path)
+		}
+
+		var params []string
+		for k, v := range c.Parameters {
+			if p, ok := conf.Parameters[k]; ok {
+				v = p
+			}
+			params = append(params, fmt.Sprintf("%v=%v", k, v))
+		}
+		if len(params) > 0 {
+			sort.Strings(params)
+			fmt.Printf("  with %v\n", strings.Join(params, " "))
+		}
+
+		fmt.Println()
+	}
+
+	return 0
+}
@@ -29,11 +29,15 @@ type commandArgs struct {
 	Help       bool
 	Explain    bool
 	Stats      bool
+	CanBoat    bool
 	Pgn        int
 	Src        int
 	Dst        int
 	LogLevel   string
 	ConfigFile string
+
+	// A command such as mappings check, instead of running the server
+	Command []string
 }
 
 func GetCommandLineOptions() commandArgs {
@@ -42,6 +46,7 @@ func GetCommandLineOptions() commandArgs {
 	flag.BoolVar(&args.Help, "help", false, "This help message")
 	flag.BoolVar(&args.Explain, "explain", false, "Dump PGNs as JSON")
 	flag.BoolVar(&args.Stats, "statistic", false, "Display live statistics")
+	flag.BoolVar(&args.CanBoat, "canboat", false, "Print received PGNs as CANboat JSON")
 	flag.IntVar(&args.Pgn, "pgn", 0, "Display only this PGN")
 	flag.IntVar(&args.Src, "source", 255, "Display PGNs from this source only")
 	flag.IntVar(&args.Dst, "dest", 255, "Display PGNs for this destination only")
@@ -51,6 +56,7 @@ func GetCommandLineOptions() commandArgs {
 	flag.Parse()
 
 	args.LogLevel = strings.ToUpper(args.LogLevel)
+	args.Command = flag.Args()
 
 	return args
 }
@@ -58,5 +64,16 @@ func GetCommandLineOptions() commandArgs {
 func (c *commandArgs) PrintHelp() {
 	fmt.Println("Argo Copyright (C) 2016 Tim Mathews <tim@signalk.org>")
 	fmt.Println()
+	fmt.Println("Usage: argo [options] [command]")
+	fmt.Println()
+	fmt.Println("Commands:")
+	fmt.Println("  mappings check [file]")
+	fmt.Println("    \tCheck map.xml against the PGN definitions and report coverage")
+	fmt.Println("  mappings unmapped [file]")
+	fmt.Println("    \tList the PGNs which neither map.xml nor the PGN definitions give a path")
+	fmt.Println("  calculators")
+	fmt.Println("    \tList the calculations, their inputs and outputs and which are turned on")
+	fmt.Println()
+	fmt.Println("Options:")
 	flag.PrintDefaults()
 }
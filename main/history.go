@@ -0,0 +1,275 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/timmathews/argo/signalk"
+)
+
+// Keeps the values of every delta, if enabled
+var history *signalk.History
+
+// parseDuration reads a duration of the configuration, which may also be
+// given in days, as in "30d"
+func parseDuration(s string) (time.Duration, error) {
+	if strings.HasSuffix(s, "d") {
+		n, err := strconv.ParseFloat(strings.TrimSuffix(s, "d"), 64)
+		if err != nil {
+			return 0, fmt.Errorf("invalid duration %q", s)
+		}
+		return time.Duration(n * float64(24*time.Hour)), nil
+	}
+
+	return time.ParseDuration(s)
+}
+
+// openHistory opens the history store of the configuration. Paths given in
+// the configuration have their own retention and interval, everything else
+// those of the history.
+func openHistory() (*signalk.History, error) {
+	conf := sysconf.History
+
+	def := signalk.HistoryRule{Path: "*"}
+	var err error
+	if def.Retention, err = parseDuration(conf.Retention); err != nil {
+		return nil, err
+	}
+	if conf.Interval != "" {
+		if def.Interval, err = parseDuration(conf.Interval); err != nil {
+			return nil, err
+		}
+	}
+
+	var rules []signalk.HistoryRule
+
+	for _, p := range conf.Paths {
+		r := def
+		r.Path = p.Path
+		if p.Retention != "" {
+			if r.Retention, err = parseDuration(p.Retention); err != nil {
+				return nil, fmt.Errorf("%v: %v", p.Path, err)
+			}
+		}
+		if p.Interval != "" {
+			if r.Interval, err = parseDuration(p.Interval); err != nil {
+				return nil, fmt.Errorf("%v: %v", p.Path, err)
+			}
+		}
+		rules = append(rules, r)
+	}
+
+	return signalk.NewHistory(conf.Directory, append(rules, def))
+}
+
+// historyRange reads the from and to parameters of a history request. To
+// defaults to now.
+func historyRange(q url.Values) (from, to time.Time, err error) {
+	to = time.Now()
+	if s := q.Get("to"); s != "" {
+		if to, err = time.Parse(time.RFC3339, s); err != nil {
+			return
+		}
+	}
+
+	from, err = time.Parse(time.RFC3339, q.Get("from"))
+
+	return
+}
+
+// historyContext is the context of a history request, our own vessel by
+// default
+func historyContext(self string, q url.Values) string {
+	if c := q.Get("context"); c != "" && c != "vessels.self" {
+		return c
+	}
+
+	return self
+}
+
+// HistoryValuesHandler answers queries of the history, such as
+// /signalk/v1/history/values?paths=propulsion.port.temperature:max&from=2019-06-01T00:00:00Z&resolution=60
+// Resolution is in seconds, or a duration such as 5m.
+func HistoryValuesHandler(model *signalk.Model) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if history == nil {
+			http.Error(w, "History is not enabled", http.StatusServiceUnavailable)
+			return
+		}
+
+		q := r.URL.Query()
+
+		var query signalk.HistoryQuery
+		var err error
+
+		query.Context = historyContext(model.Self(), q)
+
+		if query.From, query.To, err = historyRange(q); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if query.Paths, err = signalk.ParseHistoryPaths(q.Get("paths")); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		if s := q.Get("resolution"); s != "" {
+			if n, e := strconv.ParseFloat(s, 64); e == nil {
+				query.Resolution = time.Duration(n * float64(time.Second))
+			} else if query.Resolution, err = parseDuration(s); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
+
+		res, err := history.Query(query)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(res)
+	}
+}
+
+// HistoryPathsHandler lists the paths the history has values of, such as
+// /signalk/v1/history/paths?from=2019-06-01T00:00:00Z
+func HistoryPathsHandler(model *signalk.Model) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if history == nil {
+			http.Error(w, "History is not enabled", http.StatusServiceUnavailable)
+			return
+		}
+
+		q := r.URL.Query()
+
+		from, to, err := historyRange(q)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(history.Paths(historyContext(model.Self(), q), from, to))
+	}
+}
+
+// playbackParams reads the startTime and playbackRate of a playback stream
+func playbackParams(q url.Values) (start time.Time, rate float64, err error) {
+	if history == nil {
+		err = fmt.Errorf("history is not enabled")
+		return
+	}
+
+	if start, err = time.Parse(time.RFC3339, q.Get("startTime")); err != nil {
+		return
+	}
+
+	rate = 1
+	if s := q.Get("playbackRate"); s != "" {
+		if rate, err = strconv.ParseFloat(s, 64); err == nil && rate <= 0 {
+			err = fmt.Errorf("invalid playbackRate %v", s)
+		}
+	}
+
+	return
+}
+
+// playback streams the deltas of the history from start onwards, as fast
+// as they were recorded times rate. The client may change its
+// subscriptions as on a live stream; their periods are in playback time.
+func playback(ws *websocket.Conn, sub *signalk.Subscriber, self string, start time.Time, rate float64) {
+	c := &connection{ws: ws}
+	defer ws.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ws.SetReadLimit(maxMessageSize)
+		for {
+			_, msg, err := ws.ReadMessage()
+			if err != nil {
+				return
+			}
+			if err := sub.Handle(msg); err != nil {
+				log.Warning("Subscription:", err)
+			}
+		}
+	}()
+
+	send := func(v interface{}) bool {
+		b, err := json.Marshal(v)
+		if err != nil {
+			log.Errorf("JSON.Marshal %v", err)
+			return true
+		}
+		return c.write(websocket.TextMessage, b) == nil
+	}
+
+	if !send(hello{
+		Name:         "argo",
+		Version:      signalk.Version,
+		Self:         self,
+		Roles:        []string{"master", "main"},
+		Timestamp:    time.Now().UTC(),
+		StartTime:    &start,
+		PlaybackRate: rate,
+	}) {
+		return
+	}
+
+	var last time.Time
+
+	history.Replay(start, func(d signalk.Delta) bool {
+		ts := d.Updates[0].Timestamp
+
+		if !last.IsZero() && ts.After(last) {
+			select {
+			case <-time.After(time.Duration(float64(ts.Sub(last)) / rate)):
+			case <-done:
+				return false
+			}
+		}
+		last = ts
+
+		if out, ok := sub.Filter(d, ts); ok && !send(out) {
+			return false
+		}
+		for _, out := range sub.Tick(ts) {
+			if !send(out) {
+				return false
+			}
+		}
+
+		return true
+	})
+
+	c.write(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseNormalClosure, "end of history"))
+}
@@ -0,0 +1,221 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/signal"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/timmathews/argo/nmea2k"
+	"github.com/timmathews/argo/signalk"
+)
+
+// How often the mapping file is checked for changes
+const mappingPoll = 2 * time.Second
+
+// mappingStore holds the mappings in use. They are replaced as a whole when
+// the mapping file is reloaded, so a reader never sees half of each.
+// Changes go through Update, one at a time, so none is lost.
+type mappingStore struct {
+	v  atomic.Value
+	mu sync.Mutex
+}
+
+func (s *mappingStore) Load() *signalk.Mappings {
+	return s.v.Load().(*signalk.Mappings)
+}
+
+func (s *mappingStore) Store(m *signalk.Mappings) {
+	s.v.Store(m)
+}
+
+// Update replaces the mappings with those fn makes of them, and returns them
+func (s *mappingStore) Update(fn func(*signalk.Mappings) *signalk.Mappings) *signalk.Mappings {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	m := fn(s.Load())
+	s.v.Store(m)
+
+	return m
+}
+
+// loadMappings reads a mapping file for the given context, warning about
+// mappings which can never produce a value, and adds the meta of the
+// configuration
+func loadMappings(file, context string) (*signalk.Mappings, error) {
+	m, err := signalk.ParseMappings(file)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, e := range m.Check() {
+		log.Warning("mappings:", e)
+	}
+
+	m.Context = context
+	m.Meta = metaConfig()
+	m.Compile()
+
+	return &m, nil
+}
+
+// watchMappings reloads the mapping file when it changes or argo is sent
+// SIGHUP. A file which cannot be read leaves the old mappings in place.
+func watchMappings(file string, store *mappingStore) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+
+	ticker := time.NewTicker(mappingPoll)
+	defer ticker.Stop()
+
+	last := modTime(file)
+
+	for {
+		select {
+		case <-hup:
+		case <-ticker.C:
+			t := modTime(file)
+			if t.Equal(last) {
+				continue
+			}
+			last = t
+		}
+
+		store.Update(func(old *signalk.Mappings) *signalk.Mappings {
+			m, err := loadMappings(file, old.Context)
+			if err != nil {
+				log.Errorf("could not reload %v: %v", file, err)
+				return old
+			}
+
+			log.Noticef("reloaded %v", file)
+			return m
+		})
+	}
+}
+
+func modTime(file string) time.Time {
+	fi, err := os.Stat(file)
+	if err != nil {
+		return time.Time{}
+	}
+
+	return fi.ModTime()
+}
+
+// runCommand runs a command given on the command line and returns the exit
+// status
+func runCommand(args []string) int {
+	if len(args) == 1 && args[0] == "calculators" {
+		return listCalculators()
+	}
+
+	if len(args) >= 2 && len(args) <= 3 && args[0] == "mappings" {
+		file := sysconf.MapFile
+		if len(args) == 3 {
+			file = args[2]
+		}
+
+		switch args[1] {
+		case "check":
+			return checkMappings(file)
+		case "unmapped":
+			return unmappedPgns(file)
+		}
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown command %q\n", strings.Join(args, " "))
+
+	return 2
+}
+
+// checkMappings prints the problems with a mapping file and which fields of
+// which PGNs it maps
+func checkMappings(file string) int {
+	if file == "" {
+		fmt.Fprintln(os.Stderr, "no mapping file given or configured")
+		return 2
+	}
+
+	m, err := signalk.ParseMappings(file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v: %v\n", file, err)
+		return 1
+	}
+
+	errs := m.Check()
+	for _, e := range errs {
+		fmt.Println(e)
+	}
+	if len(errs) > 0 {
+		fmt.Println()
+	}
+
+	cov := m.Coverage()
+	for _, c := range cov {
+		fmt.Printf("%6d %-40s %2d of %2d fields  %v\n",
+			c.Pgn, c.Description, len(c.Mapped), c.Fields, strings.Join(c.Mapped, ", "))
+	}
+
+	known := make(map[uint32]bool)
+	for _, p := range nmea2k.PgnList {
+		known[p.Pgn] = true
+	}
+
+	fmt.Printf("\n%v mappings, %v of %v PGNs mapped, %v problems\n",
+		len(m.Mappings), len(cov), len(known), len(errs))
+
+	if len(errs) > 0 {
+		return 1
+	}
+
+	return 0
+}
+
+// unmappedPgns prints the PGNs which neither a mapping file nor the
+// SignalkPath of a field gives a path
+func unmappedPgns(file string) int {
+	if file == "" {
+		fmt.Fprintln(os.Stderr, "no mapping file given or configured")
+		return 2
+	}
+
+	m, err := signalk.ParseMappings(file)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "%v: %v\n", file, err)
+		return 1
+	}
+
+	pgns := m.Unmapped()
+	for _, p := range pgns {
+		fmt.Printf("%6d %v\n", p.Pgn, p.Description)
+	}
+
+	fmt.Printf("\n%v PGNs have no path\n", len(pgns))
+
+	return 0
+}
@@ -0,0 +1,175 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sync"
+
+	"github.com/timmathews/argo/config"
+	"github.com/timmathews/argo/signalk"
+)
+
+// Guards the meta changed by PUTs
+var metaMu sync.Mutex
+
+// Meta changed by PUTs, kept in MetaFile, which takes precedence over the
+// meta in the configuration. A nil entry removes the meta the configuration
+// gives a path.
+var editedMeta map[string]*signalk.Meta
+
+// readEditedMeta reads the meta changed by PUTs from MetaFile
+func readEditedMeta() {
+	metaMu.Lock()
+	defer metaMu.Unlock()
+
+	b, err := ioutil.ReadFile(sysconf.MetaFile)
+	if os.IsNotExist(err) {
+		return
+	}
+	if err == nil {
+		err = json.Unmarshal(b, &editedMeta)
+	}
+	if err != nil {
+		log.Warningf("could not read meta from %v: %v", sysconf.MetaFile, err)
+	}
+}
+
+// metaConfig returns a copy of the meta given in the configuration and
+// changed by PUTs, leaving out any which makes no sense
+func metaConfig() map[string]signalk.Meta {
+	metaMu.Lock()
+	defer metaMu.Unlock()
+
+	meta := make(map[string]signalk.Meta, len(sysconf.Meta)+len(editedMeta))
+	for p, m := range sysconf.Meta {
+		meta[p] = m
+	}
+	for p, m := range editedMeta {
+		if m == nil {
+			delete(meta, p)
+		} else {
+			meta[p] = *m
+		}
+	}
+
+	for p, m := range meta {
+		if err := m.Check(); err != nil {
+			log.Warningf("meta of %v: %v", p, err)
+			delete(meta, p)
+		}
+	}
+
+	return meta
+}
+
+// handlePut answers a Signal K PUT request, either to a notification, to the
+// meta of a path or to a value which is sent onto the bus
+func handlePut(model *signalk.Model, mappings *mappingStore, req *signalk.PutRequest) signalk.PutResponse {
+	if path, action, ok := signalk.NotificationAction(req.Put.Path); ok {
+		return putNotification(model, req, path, action)
+	}
+
+	if path, key, ok := signalk.MetaPath(req.Put.Path); ok {
+		return putMeta(model, mappings, req, path, key)
+	}
+
+	return putValue(mappings.Load(), model.Self(), req)
+}
+
+// putMeta changes the meta of a path of our own vessel, or one property of
+// it, such as its displayName. The meta is saved in MetaFile and sent to
+// clients. A null value removes it.
+func putMeta(model *signalk.Model, mappings *mappingStore, req *signalk.PutRequest, path, key string) signalk.PutResponse {
+	res := signalk.PutResponse{RequestId: req.RequestId, State: signalk.StateFailed}
+
+	self := model.Self()
+	if req.Context != "" && req.Context != "vessels.self" && req.Context != self {
+		res.StatusCode = http.StatusBadRequest
+		res.Message = fmt.Sprintf("cannot put to %v", req.Context)
+		return res
+	}
+
+	metaMu.Lock()
+
+	meta := sysconf.Meta[path]
+	if m, ok := editedMeta[path]; ok {
+		meta = signalk.Meta{}
+		if m != nil {
+			meta = *m
+		}
+	}
+
+	var err error
+	switch {
+	case key != "":
+		err = meta.Set(key, req.Put.Value)
+	case req.Put.Value != nil:
+		b, _ := json.Marshal(req.Put.Value)
+		meta = signalk.Meta{}
+		err = json.Unmarshal(b, &meta)
+	default:
+		meta = signalk.Meta{}
+	}
+	if err == nil {
+		err = meta.Check()
+	}
+	if err != nil {
+		metaMu.Unlock()
+		res.StatusCode = http.StatusBadRequest
+		res.Message = err.Error()
+		return res
+	}
+
+	if editedMeta == nil {
+		editedMeta = make(map[string]*signalk.Meta)
+	}
+	if key == "" && req.Put.Value == nil {
+		editedMeta[path] = nil
+	} else {
+		editedMeta[path] = &meta
+	}
+
+	b, _ := json.MarshalIndent(editedMeta, "", "  ")
+	if err := config.ReplaceFile(sysconf.MetaFile, b); err != nil {
+		log.Warningf("could not save meta to %v: %v", sysconf.MetaFile, err)
+	}
+
+	metaMu.Unlock()
+
+	// The meta is read again under the lock of the store, so the last
+	// change is the one which stays
+	m := mappings.Update(func(old *signalk.Mappings) *signalk.Mappings {
+		return old.WithMeta(metaConfig())
+	})
+
+	d := signalk.MetaDelta(self, path, m.MetaOf(path))
+	publish(model, d)
+	notifications.Process(d)
+
+	res.State = signalk.StateCompleted
+	res.StatusCode = http.StatusOK
+
+	return res
+}
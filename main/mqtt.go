@@ -0,0 +1,233 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"crypto/tls"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	mqtt "github.com/eclipse/paho.mqtt.golang"
+	"github.com/timmathews/argo/signalk"
+)
+
+// Longest wait between attempts to connect to the broker
+const mqttMaxBackoff = time.Minute
+
+// mqttBroker returns the address of the broker in the configuration, with
+// the scheme of its transport
+func mqttBroker() (string, error) {
+	conf := sysconf.Mqtt
+
+	u := url.URL{Host: fmt.Sprintf("%v:%v", conf.Host, conf.Port)}
+
+	switch strings.ToLower(conf.Transport) {
+	case "tcp":
+		u.Scheme = "tcp"
+		if conf.UseTls {
+			u.Scheme = "ssl"
+		}
+	case "ws":
+		u.Scheme, u.Path = "ws", conf.WebsocketPath
+		if conf.UseTls {
+			u.Scheme = "wss"
+		}
+	default:
+		return "", fmt.Errorf("unknown MQTT transport %q, not tcp or ws", conf.Transport)
+	}
+
+	return u.String(), nil
+}
+
+// openMqtt connects to the MQTT broker in the background and adds it as an
+// output. The client connects again whenever the connection is lost. Each
+// time it connects it publishes who we are, retained, and subscribes to the
+// topic for writes.
+func openMqtt(model *signalk.Model, mappings *mappingStore, self signalk.Vessel) error {
+	conf := sysconf.Mqtt
+
+	broker, err := mqttBroker()
+	if err != nil {
+		return err
+	}
+	if conf.Qos < 0 || conf.Qos > 2 {
+		return fmt.Errorf("MQTT QoS %v is not 0, 1 or 2", conf.Qos)
+	}
+	qos := byte(conf.Qos)
+
+	layout := strings.ToLower(conf.Layout)
+	if layout != "delta" && layout != "paths" {
+		return fmt.Errorf("unknown MQTT layout %q, not delta or paths", conf.Layout)
+	}
+
+	// Otherwise what we publish would be taken as writes, or the responses
+	// to writes as values
+	if conf.PutTopic != "" && (topicWithin(conf.PutTopic, conf.Channel) || topicWithin(conf.Channel, conf.PutTopic)) {
+		return fmt.Errorf("MQTT PutTopic %q and Channel %q must not be one within the other", conf.PutTopic, conf.Channel)
+	}
+
+	opts := mqtt.NewClientOptions().AddBroker(broker)
+	opts.SetClientID(conf.ClientId)
+	opts.SetUsername(conf.Username)
+	opts.SetPassword(conf.Password)
+	if conf.UseTls {
+		opts.SetTLSConfig(&tls.Config{MinVersion: tls.VersionTLS12})
+	}
+	opts.SetAutoReconnect(true)
+	opts.SetMaxReconnectInterval(mqttMaxBackoff)
+
+	opts.SetOnConnectHandler(func(c mqtt.Client) {
+		log.Noticef("MQTT: connected to %v", broker)
+
+		// Retained, so a shore server knows which boat this is as soon as
+		// it subscribes
+		if b, err := json.Marshal(self.Delta()); err == nil {
+			c.Publish(conf.Channel, qos, true, b)
+		}
+
+		if conf.PutTopic != "" {
+			// A # also matches the topic itself
+			t := c.Subscribe(conf.PutTopic+"/#", qos, mqttPut(model, mappings))
+			if t.Wait() && t.Error() != nil {
+				log.Warning("MQTT:", t.Error())
+			}
+		}
+	})
+	opts.SetConnectionLostHandler(func(c mqtt.Client, err error) {
+		log.Warningf("MQTT: lost %v: %v", broker, err)
+	})
+
+	client := mqtt.NewClient(opts)
+	go connectMqtt(client, broker)
+
+	return addOutput("Mqtt", func(d signalk.Delta) {
+		// Values are not kept while the broker is away
+		if !client.IsConnected() {
+			return
+		}
+
+		if layout == "delta" {
+			if b, err := json.Marshal(d); err == nil {
+				client.Publish(conf.Channel, qos, false, b)
+			}
+			return
+		}
+
+		// The latest value of each path is retained on its own topic
+		for _, v := range d.PathValues() {
+			if b, err := json.Marshal(v); err == nil {
+				client.Publish(mqttTopic(conf.Channel, model.Self(), v.Context, v.Path), qos, true, b)
+			}
+		}
+	})
+}
+
+// connectMqtt tries to connect to the broker until it can. Once connected,
+// the client connects again by itself.
+func connectMqtt(client mqtt.Client, broker string) {
+	backoff := time.Second
+
+	for {
+		t := client.Connect()
+		if t.Wait() && t.Error() == nil {
+			return
+		}
+
+		log.Warningf("MQTT: could not connect to %v: %v", broker, t.Error())
+
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > mqttMaxBackoff {
+			backoff = mqttMaxBackoff
+		}
+	}
+}
+
+// topicWithin says whether a topic is parent or one below it
+func topicWithin(topic, parent string) bool {
+	return topic == parent || strings.HasPrefix(topic, parent+"/")
+}
+
+// mqttTopic is the topic of a path, below the channel, such as
+// signalk/argo/vessels/self/navigation/speedOverGround
+func mqttTopic(channel, self, context, path string) string {
+	if context == self {
+		context = "vessels.self"
+	}
+
+	topic := channel + "/" + strings.Replace(context, ".", "/", 1)
+	if path != "" {
+		topic += "/" + strings.Replace(path, ".", "/", -1)
+	}
+
+	return topic
+}
+
+// mqttPut takes writes to our own vessel. A message on the topic for writes
+// is a Signal K PUT request. A message on a topic below it, such as
+// .../navigation/anchor/position, sets that path, and is a value and
+// optionally a source, as in {"value": "On", "source": "n2k-port.43"}. The
+// response is published on the topic for writes followed by /response.
+func mqttPut(model *signalk.Model, mappings *mappingStore) mqtt.MessageHandler {
+	return func(c mqtt.Client, msg mqtt.Message) {
+		topic := sysconf.Mqtt.PutTopic
+		resTopic := topic + "/response"
+
+		if msg.Topic() == resTopic {
+			return
+		}
+
+		var req signalk.PutRequest
+		var err error
+		if msg.Topic() == topic {
+			err = json.Unmarshal(msg.Payload(), &req)
+		} else {
+			err = json.Unmarshal(msg.Payload(), &req.Put)
+			req.Context = "vessels.self"
+			req.Put.Path = strings.Replace(strings.TrimPrefix(msg.Topic(), topic+"/"), "/", ".", -1)
+		}
+
+		// Writes may wait for the bus, which must not hold up the client
+		go func() {
+			var res signalk.PutResponse
+			if err != nil {
+				res = signalk.PutResponse{
+					RequestId:  req.RequestId,
+					State:      signalk.StateFailed,
+					StatusCode: http.StatusBadRequest,
+					Message:    "invalid JSON: " + err.Error(),
+				}
+			} else {
+				res = handlePut(model, mappings, &req)
+			}
+
+			if res.StatusCode >= 400 {
+				log.Warningf("MQTT: put to %v: %v %v", msg.Topic(), res.StatusCode, res.Message)
+			}
+
+			if b, err := json.Marshal(res); err == nil {
+				c.Publish(resTopic, byte(sysconf.Mqtt.Qos), false, b)
+			}
+		}()
+	}
+}
@@ -0,0 +1,131 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/timmathews/argo/signalk"
+)
+
+// Raises notifications for values in the zones of their meta and for alerts
+// on the bus
+var notifications = signalk.NewNotifier()
+
+// publish applies a delta to the model and sends it to the outputs, such as
+// the history and stream clients
+func publish(model *signalk.Model, d signalk.Delta) {
+	model.Apply(d)
+	emit(d)
+}
+
+// putNotification silences or acknowledges a notification of our own vessel
+func putNotification(model *signalk.Model, req *signalk.PutRequest, path, action string) signalk.PutResponse {
+	res := signalk.PutResponse{RequestId: req.RequestId, State: signalk.StateFailed}
+
+	self := model.Self()
+	if req.Context != "" && req.Context != "vessels.self" && req.Context != self {
+		res.StatusCode = http.StatusBadRequest
+		res.Message = fmt.Sprintf("cannot put to %v", req.Context)
+		return res
+	}
+
+	if b, ok := req.Put.Value.(bool); !ok || !b {
+		res.StatusCode = http.StatusBadRequest
+		res.Message = fmt.Sprintf("%v takes true", action)
+		return res
+	}
+
+	// Alerts of other devices are answered on the bus, and change when the
+	// device sends them again
+	if iface, ok := notifications.AlertInterface(self, path); ok {
+		return respondToAlert(req, self, path, action, iface)
+	}
+
+	d, err := notifications.Respond(self, path, action)
+	if err != nil {
+		res.StatusCode = http.StatusBadRequest
+		res.Message = err.Error()
+		return res
+	}
+
+	publish(model, d)
+
+	res.State = signalk.StateCompleted
+	res.StatusCode = http.StatusOK
+
+	return res
+}
+
+// respondToAlert sends an Alert Response for an alert raised by another
+// device onto the interface the alert came in on
+func respondToAlert(req *signalk.PutRequest, self, path, action, iface string) signalk.PutResponse {
+	res := signalk.PutResponse{RequestId: req.RequestId, State: signalk.StateFailed}
+
+	// An alert read from an interface which cannot transmit, such as a
+	// recording, is answered on the first one which can
+	tx, err := getTransmitter(iface)
+	if err != nil {
+		if tx, err = getTransmitter(""); err != nil {
+			res.StatusCode = http.StatusServiceUnavailable
+			res.Message = err.Error()
+			return res
+		}
+	}
+
+	// The response carries the NAME of the device which sends it
+	var name uint64
+	if p, ok := tx.port.(interface{ Name() uint64 }); ok {
+		name = p.Name()
+	}
+
+	raw, err := notifications.AlertResponse(self, path, action, name)
+	if err != nil {
+		res.StatusCode = http.StatusBadRequest
+		res.Message = err.Error()
+		return res
+	}
+
+	if _, err := tx.port.Send(raw); err != nil {
+		res.StatusCode = http.StatusBadGateway
+		res.Message = err.Error()
+		return res
+	}
+
+	res.State = signalk.StateCompleted
+	res.StatusCode = http.StatusOK
+
+	return res
+}
+
+// NotificationHistoryHandler serves the changes to notifications, oldest
+// first
+func NotificationHistoryHandler(w http.ResponseWriter, r *http.Request) {
+	b, err := json.Marshal(notifications.History())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(b)
+}
@@ -0,0 +1,132 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/timmathews/argo/signalk"
+)
+
+// How often values held back by the emission policies of outputs are sent
+const outputTick = 100 * time.Millisecond
+
+// Outputs which can be configured
+var outputNames = []string{"Websocket", "Mqtt", "History", "Upstream"}
+
+// output is somewhere deltas are sent, such as the websocket streams
+type output struct {
+	name    string
+	emitter *signalk.Emitter // Nil if every value is sent
+	send    func(signalk.Delta)
+}
+
+// The outputs deltas are published to
+var outputs []*output
+
+// addOutput adds an output, with the emission policies of its configuration
+func addOutput(name string, send func(signalk.Delta)) error {
+	o := &output{name: name, send: send}
+
+	for k, conf := range sysconf.Outputs {
+		if !strings.EqualFold(k, name) {
+			continue
+		}
+
+		var batch time.Duration
+		var err error
+		if conf.Batch != "" {
+			if batch, err = parseDuration(conf.Batch); err != nil {
+				return fmt.Errorf("%v: %v", name, err)
+			}
+		}
+
+		var policies []signalk.EmissionPolicy
+		for _, p := range conf.Policies {
+			ep := signalk.EmissionPolicy{Path: p.Path, Deadband: p.Deadband, RelativeDeadband: p.RelativeDeadband}
+			if p.MinInterval != "" {
+				if ep.MinInterval, err = parseDuration(p.MinInterval); err != nil {
+					return fmt.Errorf("%v, %v: %v", name, p.Path, err)
+				}
+			}
+			if p.MaxSilence != "" {
+				if ep.MaxSilence, err = parseDuration(p.MaxSilence); err != nil {
+					return fmt.Errorf("%v, %v: %v", name, p.Path, err)
+				}
+			}
+			policies = append(policies, ep)
+		}
+
+		if o.emitter, err = signalk.NewEmitter(policies, batch); err != nil {
+			return fmt.Errorf("%v: %v", name, err)
+		}
+	}
+
+	outputs = append(outputs, o)
+
+	return nil
+}
+
+// checkOutputs reports outputs in the configuration which do not exist
+func checkOutputs() error {
+outer:
+	for k := range sysconf.Outputs {
+		for _, name := range outputNames {
+			if strings.EqualFold(k, name) {
+				continue outer
+			}
+		}
+		return fmt.Errorf("unknown output %q, not one of %v", k, strings.Join(outputNames, ", "))
+	}
+
+	return nil
+}
+
+// emit sends a delta to every output, as far as their policies allow
+func emit(d signalk.Delta) {
+	for _, o := range outputs {
+		if o.emitter == nil {
+			o.send(d)
+			continue
+		}
+
+		for _, od := range o.emitter.Process(d, time.Now()) {
+			o.send(od)
+		}
+	}
+}
+
+// tickOutputs sends the values which outputs have held back once they are
+// due
+func tickOutputs() {
+	for now := range time.Tick(outputTick) {
+		for _, o := range outputs {
+			if o.emitter == nil {
+				continue
+			}
+
+			for _, od := range o.emitter.Tick(now) {
+				o.send(od)
+			}
+		}
+	}
+}
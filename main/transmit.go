@@ -0,0 +1,335 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/timmathews/argo/can"
+	"github.com/timmathews/argo/canusb"
+	"github.com/timmathews/argo/nmea2k"
+	"github.com/timmathews/argo/signalk"
+)
+
+// How long to wait for another device to answer a request or command
+const commandTimeout = 2 * time.Second
+
+// transmitter is an interface which can send messages onto the bus
+type transmitter struct {
+	port     can.Sender
+	handlers nmea2k.CommandHandlers
+}
+
+var transmitters = struct {
+	sync.Mutex
+	m map[string]*transmitter
+}{m: make(map[string]*transmitter)}
+
+// Matches responses from other devices with the group functions we sent
+var groupFunctions = nmea2k.NewGroupFunctionTracker()
+
+func addTransmitter(name string, tx *transmitter) {
+	transmitters.Lock()
+	transmitters.m[name] = tx
+	transmitters.Unlock()
+}
+
+// getTransmitter returns the named transmitter or, if name is empty, the
+// first one in alphabetical order.
+func getTransmitter(name string) (*transmitter, error) {
+	transmitters.Lock()
+	defer transmitters.Unlock()
+
+	if name == "" {
+		var names []string
+		for k := range transmitters.m {
+			names = append(names, k)
+		}
+		if len(names) == 0 {
+			return nil, fmt.Errorf("no interface can transmit")
+		}
+		sort.Strings(names)
+		name = names[0]
+	}
+
+	tx, ok := transmitters.m[name]
+	if !ok {
+		return nil, fmt.Errorf("interface %v cannot transmit", name)
+	}
+
+	return tx, nil
+}
+
+// respond answers a group function sent to one of our addresses
+func (tx *transmitter) respond(msg *nmea2k.ParsedMessage) {
+	gf, err := nmea2k.GroupFunctionFromMessage(msg)
+	if err != nil {
+		log.Warning("group function:", err)
+		return
+	}
+
+	ack := tx.handlers.Respond(gf)
+	if ack == nil {
+		return
+	}
+
+	raw, err := ack.Message(msg.Header.Source)
+	if err == nil {
+		_, err = tx.port.Send(raw)
+	}
+
+	if err != nil {
+		log.Warning("group function:", err)
+	}
+}
+
+// instanceHandler handles Commands to change the device and system instances
+// in the ISO Address Claim of a CANUSB adapter.
+func instanceHandler(canport *canusb.CanPort) nmea2k.CommandHandler {
+	return func(gf *nmea2k.GroupFunction) *nmea2k.GroupFunction {
+		ack := gf.Acknowledge()
+		device, system := canport.Instance()
+
+		for i, p := range gf.Parameters {
+			var n uint8
+			if _, err := fmt.Sscan(fmt.Sprint(p.Value), &n); err != nil {
+				ack.ParameterErrors[i] = nmea2k.ParameterErrorOutOfRange
+				continue
+			}
+
+			switch p.Field {
+			case 2: // Device Instance Lower
+				device = device&^0x07 | n&0x07
+			case 3: // Device Instance Upper
+				device = device&0x07 | n<<3
+			case 7: // System Instance
+				system = n & 0x0F
+			default:
+				ack.ParameterErrors[i] = nmea2k.ParameterErrorAccessDenied
+			}
+		}
+
+		if ack.Err() == nil {
+			canport.SetInstance(device, system)
+		} else {
+			ack.PgnError = nmea2k.PgnErrorAccessDenied
+		}
+
+		return ack
+	}
+}
+
+// processCommands sends requests and commands received by the API to other
+// devices and replies with their responses.
+func processCommands(cmdch chan CommandRequest) {
+	for req := range cmdch {
+		// Each command waits for its own response, so a device which is
+		// slow to answer doesn't hold up commands to the others
+		go func(req CommandRequest) {
+			res := sendCommand(&req)
+			if req.reply != nil {
+				req.reply <- res
+			}
+		}(req)
+	}
+}
+
+func sendCommand(req *CommandRequest) CommandResponse {
+	tx, err := getTransmitter(req.Interface)
+	if err != nil {
+		return CommandResponse{Result: "error", Message: err.Error()}
+	}
+
+	var gf *nmea2k.GroupFunction
+	var raw *can.RawMessage
+
+	switch req.RequestType {
+	case "iso_request":
+		// Responses to an ISO Request are matched the same way as a Request
+		// group function without parameters
+		gf = nmea2k.NewRequest(req.RequestedPgn)
+		raw = &can.RawMessage{
+			Timestamp:   time.Now(),
+			Priority:    6,
+			Pgn:         59904,
+			Destination: req.Destination,
+			Length:      3,
+			Data: []byte{
+				byte(req.RequestedPgn),
+				byte(req.RequestedPgn >> 8),
+				byte(req.RequestedPgn >> 16),
+			},
+		}
+	case "request", "command":
+		params, err := req.parameters()
+		if err != nil {
+			return CommandResponse{Result: "error", Message: err.Error()}
+		}
+
+		if req.RequestType == "request" {
+			gf = nmea2k.NewRequest(req.RequestedPgn, params...)
+		} else {
+			gf = nmea2k.NewCommand(req.RequestedPgn, params...)
+		}
+
+		raw, err = gf.Message(req.Destination)
+		if err != nil {
+			return CommandResponse{Result: "error", Message: err.Error()}
+		}
+	default:
+		return CommandResponse{
+			Result:  "error",
+			Message: fmt.Sprintf("unknown request type %v", req.RequestType),
+		}
+	}
+
+	pending := groupFunctions.Expect(req.Destination, gf)
+
+	if _, err := tx.port.Send(raw); err != nil {
+		pending.Cancel()
+		return CommandResponse{Result: "error", Message: err.Error()}
+	}
+
+	answer, err := pending.Wait(commandTimeout)
+	if err != nil {
+		return CommandResponse{Result: "timeout", Message: err.Error()}
+	}
+
+	return newCommandResponse(answer)
+}
+
+func newCommandResponse(answer nmea2k.GroupFunctionResponse) CommandResponse {
+	if answer.Message != nil {
+		return CommandResponse{Result: "ok", Data: answer.Message}
+	}
+
+	if answer.IsoAcknowledgement != nil {
+		if err := answer.IsoAcknowledgement.Err(); err != nil {
+			return CommandResponse{Result: "error", Message: err.Error()}
+		}
+		return CommandResponse{Result: "ok"}
+	}
+
+	ack := answer.Acknowledge
+	res := CommandResponse{
+		Result:          "ok",
+		PgnError:        ack.PgnError,
+		IntervalError:   ack.IntervalError,
+		ParameterErrors: ack.ParameterErrors,
+	}
+
+	if err := ack.Err(); err != nil {
+		res.Result = "error"
+		res.Message = err.Error()
+	}
+
+	return res
+}
+
+// putValue sends a Signal K PUT request onto the bus as the PGN its path is
+// mapped to and returns the final state of the request. An ISO Request is
+// completed when it is answered, anything else once it has been sent.
+func putValue(mappings *signalk.Mappings, self string, req *signalk.PutRequest) signalk.PutResponse {
+	res := signalk.PutResponse{RequestId: req.RequestId, State: signalk.StateFailed}
+
+	if req.Context != "" && req.Context != "vessels.self" && req.Context != self {
+		res.StatusCode = http.StatusBadRequest
+		res.Message = fmt.Sprintf("cannot put to %v", req.Context)
+		return res
+	}
+
+	if req.Put.Path == "" {
+		res.StatusCode = http.StatusBadRequest
+		res.Message = "put without a path"
+		return res
+	}
+
+	// The source is the device to send to, such as n2k-port.43
+	var iface string
+	var dst uint8 = 255
+	if src := req.Put.Source; src != "" {
+		i := strings.LastIndex(src, ".")
+		n, err := strconv.ParseUint(src[i+1:], 10, 8)
+		if i < 0 || err != nil {
+			res.StatusCode = http.StatusBadRequest
+			res.Message = fmt.Sprintf("invalid source %q", src)
+			return res
+		}
+		iface, dst = src[:i], uint8(n)
+	}
+
+	raw, err := mappings.Pack(req.Put.Path, req.Put.Value)
+	if err != nil {
+		res.StatusCode = http.StatusMethodNotAllowed
+		res.Message = err.Error()
+		return res
+	}
+	raw.Destination = dst
+
+	tx, err := getTransmitter(iface)
+	if err != nil {
+		res.StatusCode = http.StatusServiceUnavailable
+		res.Message = err.Error()
+		return res
+	}
+
+	var pending *nmea2k.PendingGroupFunction
+	if raw.Pgn == 59904 {
+		pgn := uint32(raw.Data[0]) | uint32(raw.Data[1])<<8 | uint32(raw.Data[2])<<16
+		pending = groupFunctions.Expect(dst, nmea2k.NewRequest(pgn))
+	}
+
+	if _, err := tx.port.Send(raw); err != nil {
+		if pending != nil {
+			pending.Cancel()
+		}
+		res.StatusCode = http.StatusBadGateway
+		res.Message = err.Error()
+		return res
+	}
+
+	if pending != nil {
+		answer, err := pending.Wait(commandTimeout)
+		if err != nil {
+			res.StatusCode = http.StatusGatewayTimeout
+			res.Message = err.Error()
+			return res
+		}
+
+		if answer.IsoAcknowledgement != nil {
+			if err := answer.IsoAcknowledgement.Err(); err != nil {
+				res.StatusCode = http.StatusBadGateway
+				res.Message = err.Error()
+				return res
+			}
+		}
+	}
+
+	res.State = signalk.StateCompleted
+	res.StatusCode = http.StatusOK
+
+	return res
+}
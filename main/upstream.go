@@ -0,0 +1,286 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/timmathews/argo/signalk"
+)
+
+const (
+	// Time allowed to deliver a delta upstream
+	upstreamTimeout = 30 * time.Second
+
+	// Longest wait before connecting again
+	upstreamMaxBackoff = time.Minute
+)
+
+// Deltas waiting to be forwarded to the upstream server
+var upstreamQueue *signalk.DeltaQueue
+
+// upstreamLink is a connection to the upstream server
+type upstreamLink interface {
+	Send(b []byte) error
+	Close() error
+
+	// Closed is closed when the server closes the link
+	Closed() <-chan struct{}
+}
+
+// errRejected is a delta the server will never take, which is dropped
+// rather than sent again
+type errRejected struct {
+	status string
+}
+
+func (e errRejected) Error() string {
+	return "delta rejected: " + e.status
+}
+
+// openUpstream opens the queue of deltas for the upstream server, adds it
+// as an output and starts forwarding
+func openUpstream() error {
+	conf := sysconf.Upstream
+
+	u, err := url.Parse(conf.Url)
+	if err != nil {
+		return err
+	}
+	switch u.Scheme {
+	case "ws", "wss", "http", "https":
+	default:
+		return fmt.Errorf("upstream URL %q is not ws, wss, http or https", conf.Url)
+	}
+
+	if upstreamQueue, err = signalk.OpenDeltaQueue(conf.Directory, conf.BufferLimit<<20); err != nil {
+		return err
+	}
+
+	err = addOutput("Upstream", func(d signalk.Delta) {
+		if err := upstreamQueue.Push(d); err != nil {
+			log.Warning("Upstream:", err)
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	go forwardUpstream(u, conf.Token)
+
+	return nil
+}
+
+// forwardUpstream delivers the queued deltas in order, connecting again
+// whenever the link is lost. A delta is only removed from the queue once it
+// has been sent. A websocket server does not acknowledge deltas, so those
+// written just as the link fails can be lost; a server posted to confirms
+// each one.
+func forwardUpstream(u *url.URL, token string) {
+	backoff := time.Second
+
+	for {
+		if link, err := dialUpstream(u, token); err != nil {
+			log.Warningf("Upstream: could not connect to %v: %v", u.Host, err)
+		} else {
+			log.Noticef("Upstream: connected to %v", u.Host)
+
+			n, err := sendQueued(link)
+			link.Close()
+			log.Warningf("Upstream: lost %v after %v deltas: %v", u.Host, n, err)
+
+			if n > 0 {
+				backoff = time.Second
+			}
+		}
+
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > upstreamMaxBackoff {
+			backoff = upstreamMaxBackoff
+		}
+	}
+}
+
+// sendQueued sends deltas as they are queued until the link fails, and
+// returns how many it sent
+func sendQueued(link upstreamLink) (int, error) {
+	n := 0
+
+	for {
+		if dropped := upstreamQueue.Dropped(); dropped > 0 {
+			log.Warningf("Upstream: buffer full, dropped %v files of the oldest deltas", dropped)
+		}
+
+		d, ok, err := upstreamQueue.Peek()
+		if err != nil {
+			return n, err
+		}
+		if !ok {
+			select {
+			case <-upstreamQueue.Ready():
+			case <-link.Closed():
+				return n, io.ErrClosedPipe
+			}
+			continue
+		}
+
+		b, err := json.Marshal(d)
+		if err != nil {
+			return n, err
+		}
+
+		if err := link.Send(b); err != nil {
+			if _, ok := err.(errRejected); !ok {
+				return n, err
+			}
+			log.Warning("Upstream:", err)
+		}
+
+		if err := upstreamQueue.Pop(); err != nil {
+			return n, err
+		}
+		n++
+	}
+}
+
+// dialUpstream connects to the upstream server. The token, if any, is sent
+// as a bearer token.
+func dialUpstream(u *url.URL, token string) (upstreamLink, error) {
+	header := http.Header{}
+	if token != "" {
+		header.Set("Authorization", "Bearer "+token)
+	}
+
+	if u.Scheme == "http" || u.Scheme == "https" {
+		return &httpLink{url: u.String(), header: header, client: &http.Client{Timeout: upstreamTimeout}}, nil
+	}
+
+	// We only send, so the server need not send us its own deltas
+	ws := *u
+	q := ws.Query()
+	if q.Get("subscribe") == "" {
+		q.Set("subscribe", "none")
+		ws.RawQuery = q.Encode()
+	}
+
+	dialer := websocket.Dialer{HandshakeTimeout: upstreamTimeout}
+	conn, _, err := dialer.Dial(ws.String(), header)
+	if err != nil {
+		return nil, err
+	}
+
+	l := &wsLink{conn: conn, closed: make(chan struct{})}
+	go l.read()
+
+	return l, nil
+}
+
+// wsLink sends deltas on a websocket stream
+type wsLink struct {
+	conn   *websocket.Conn
+	closed chan struct{}
+}
+
+// read discards what the server sends, such as its hello, and notices when
+// the connection closes
+func (l *wsLink) read() {
+	defer close(l.closed)
+
+	for {
+		if _, _, err := l.conn.NextReader(); err != nil {
+			return
+		}
+	}
+}
+
+func (l *wsLink) Send(b []byte) error {
+	select {
+	case <-l.closed:
+		return io.ErrClosedPipe
+	default:
+	}
+
+	l.conn.SetWriteDeadline(time.Now().Add(upstreamTimeout))
+
+	return l.conn.WriteMessage(websocket.TextMessage, b)
+}
+
+func (l *wsLink) Close() error {
+	return l.conn.Close()
+}
+
+func (l *wsLink) Closed() <-chan struct{} {
+	return l.closed
+}
+
+// httpLink posts each delta to the server
+type httpLink struct {
+	url    string
+	header http.Header
+	client *http.Client
+}
+
+func (l *httpLink) Send(b []byte) error {
+	req, err := http.NewRequest("POST", l.url, bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	for k, v := range l.header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	res, err := l.client.Do(req)
+	if err != nil {
+		return err
+	}
+	body, _ := ioutil.ReadAll(io.LimitReader(res.Body, 512))
+	res.Body.Close()
+
+	switch {
+	case res.StatusCode/100 == 2:
+		return nil
+	case res.StatusCode == http.StatusUnauthorized, res.StatusCode == http.StatusForbidden,
+		res.StatusCode == http.StatusRequestTimeout, res.StatusCode == http.StatusTooManyRequests,
+		res.StatusCode >= 500:
+		// Worth trying again once the token or the server is fixed
+		return fmt.Errorf("%v %v", res.Status, strings.TrimSpace(string(body)))
+	}
+
+	return errRejected{res.Status}
+}
+
+func (l *httpLink) Close() error {
+	return nil
+}
+
+// Closed never fires, since each delta is sent on a request of its own
+func (l *httpLink) Closed() <-chan struct{} {
+	return nil
+}
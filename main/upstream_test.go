@@ -0,0 +1,263 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/timmathews/argo/signalk"
+)
+
+const testToken = "secret"
+
+// openTestQueue makes upstreamQueue a new queue in a temporary directory
+func openTestQueue(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "upstream")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if upstreamQueue, err = signalk.OpenDeltaQueue(dir, 1<<20); err != nil {
+		t.Fatal(err)
+	}
+
+	return func() {
+		upstreamQueue.Close()
+		os.RemoveAll(dir)
+	}
+}
+
+// pushDeltas queues a delta for each of seq, whose value is its number
+func pushDeltas(t *testing.T, seq ...int) {
+	for _, i := range seq {
+		var d signalk.Delta
+		err := json.Unmarshal([]byte(fmt.Sprintf(`{"context":"vessels.self","updates":[
+			{"timestamp":"2016-01-01T00:00:00Z","values":[{"path":"a","value":%v}]}]}`, i)), &d)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := upstreamQueue.Push(d); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// deltaNumber returns the value of a delta queued by pushDeltas
+func deltaNumber(b []byte) int {
+	var d struct {
+		Updates []struct {
+			Values []struct {
+				Value int
+			}
+		}
+	}
+	if json.Unmarshal(b, &d) != nil || len(d.Updates) != 1 || len(d.Updates[0].Values) != 1 {
+		return -1
+	}
+
+	return d.Updates[0].Values[0].Value
+}
+
+// upstreamServer records the deltas it is sent, in order
+type upstreamServer struct {
+	mu     sync.Mutex
+	got    []int
+	header http.Header
+	query  url.Values
+}
+
+func (s *upstreamServer) add(b []byte, r *http.Request) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.got = append(s.got, deltaNumber(b))
+	s.header = r.Header
+	s.query = r.URL.Query()
+}
+
+func (s *upstreamServer) deltas() []int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]int(nil), s.got...)
+}
+
+// waitFor waits for the server to have been sent n deltas
+func (s *upstreamServer) waitFor(t *testing.T, n int) {
+	for start := time.Now(); len(s.deltas()) < n; time.Sleep(time.Millisecond) {
+		if time.Since(start) > 5*time.Second {
+			t.Fatalf("Got %v, want %v deltas", s.deltas(), n)
+		}
+	}
+}
+
+// stoppedLink is a link which is closed by the test, as an httpLink never is
+type stoppedLink struct {
+	upstreamLink
+	stop chan struct{}
+}
+
+func (l stoppedLink) Closed() <-chan struct{} {
+	return l.stop
+}
+
+func TestUpstreamWebsocket(t *testing.T) {
+	defer openTestQueue(t)()
+
+	s := &upstreamServer{}
+	conns := make(chan *websocket.Conn, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := (&websocket.Upgrader{}).Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		conns <- conn
+		for {
+			_, b, err := conn.ReadMessage()
+			if err != nil {
+				return
+			}
+			s.add(b, r)
+		}
+	}))
+	defer srv.Close()
+
+	u, _ := url.Parse("ws" + strings.TrimPrefix(srv.URL, "http"))
+
+	// Deltas queued while the link is down are sent in order once it is
+	// up again
+	for _, seq := range [][]int{{1, 2, 3}, {4, 5, 6}} {
+		pushDeltas(t, seq...)
+
+		link, err := dialUpstream(u, testToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan int)
+		go func() {
+			n, _ := sendQueued(link)
+			link.Close()
+			done <- n
+		}()
+
+		s.waitFor(t, seq[len(seq)-1])
+		(<-conns).Close()
+		if n := <-done; n != len(seq) {
+			t.Errorf("Sent %v deltas, want %v", n, len(seq))
+		}
+	}
+
+	if want := []int{1, 2, 3, 4, 5, 6}; !reflect.DeepEqual(s.deltas(), want) {
+		t.Errorf("Got %v, want %v", s.deltas(), want)
+	}
+	if a := s.header.Get("Authorization"); a != "Bearer "+testToken {
+		t.Errorf("Got Authorization %q", a)
+	}
+	if q := s.query.Get("subscribe"); q != "none" {
+		t.Errorf("Got subscribe=%q", q)
+	}
+}
+
+func TestUpstreamHTTP(t *testing.T) {
+	defer openTestQueue(t)()
+
+	// The status of the first and any later attempt to post each delta
+	status := map[int][]int{
+		1: {http.StatusInternalServerError, http.StatusOK},
+		2: {http.StatusUnauthorized, http.StatusOK},
+		3: {http.StatusBadRequest},
+		4: {http.StatusOK},
+	}
+	tries := make(map[int]int)
+
+	s := &upstreamServer{}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		s.add(b, r)
+
+		s.mu.Lock()
+		i := deltaNumber(b)
+		codes := status[i]
+		code := codes[len(codes)-1]
+		if tries[i] < len(codes) {
+			code = codes[tries[i]]
+		}
+		tries[i]++
+		s.mu.Unlock()
+
+		w.WriteHeader(code)
+	}))
+	defer srv.Close()
+
+	u, _ := url.Parse(srv.URL)
+	pushDeltas(t, 1, 2, 3, 4)
+
+	// A 5xx or 401 ends the link so the delta is sent again, and a 4xx
+	// drops it
+	var sent []int
+	for i := 0; i < 3; i++ {
+		link, err := dialUpstream(u, testToken)
+		if err != nil {
+			t.Fatal(err)
+		}
+		stop := make(chan struct{})
+		done := make(chan int)
+		go func() {
+			n, _ := sendQueued(stoppedLink{link, stop})
+			done <- n
+		}()
+
+		if i == 2 {
+			s.waitFor(t, 6)
+			close(stop)
+		}
+		select {
+		case n := <-done:
+			sent = append(sent, n)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("Got %v", s.deltas())
+		}
+	}
+
+	if want := []int{1, 1, 2, 2, 3, 4}; !reflect.DeepEqual(s.deltas(), want) {
+		t.Errorf("Got %v, want %v", s.deltas(), want)
+	}
+	if want := []int{0, 1, 3}; !reflect.DeepEqual(sent, want) {
+		t.Errorf("Sent %v", sent)
+	}
+	if a := s.header.Get("Authorization"); a != "Bearer "+testToken {
+		t.Errorf("Got Authorization %q", a)
+	}
+	if _, ok, _ := upstreamQueue.Peek(); ok {
+		t.Error("Deltas were left in the queue")
+	}
+}
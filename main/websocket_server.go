@@ -20,18 +20,43 @@
 package main
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"time"
 
 	"github.com/gorilla/websocket"
 	"github.com/op/go-logging"
+	"github.com/timmathews/argo/signalk"
 )
 
+// hello is the first message on the stream, telling the client who we are
+type hello struct {
+	Name      string    `json:"name"`
+	Version   string    `json:"version"`
+	Self      string    `json:"self"`
+	Roles     []string  `json:"roles"`
+	Timestamp time.Time `json:"timestamp"`
+
+	// Where a playback stream starts and how fast it goes
+	StartTime    *time.Time `json:"startTime,omitempty"`
+	PlaybackRate float64    `json:"playbackRate,omitempty"`
+}
+
 type connection struct {
 	ws *websocket.Conn
 
 	send chan []byte
+
+	// Subscriptions of a stream client, nil for other connections
+	sub *signalk.Subscriber
+
+	// States of the PUT requests of a stream client
+	replies chan signalk.PutResponse
+
+	// Where PUT requests of a stream client are sent
+	model    *signalk.Model
+	mappings *mappingStore
 }
 
 type hub struct {
@@ -41,6 +66,9 @@ type hub struct {
 	// Messages for the connections
 	broadcast chan []byte
 
+	// Deltas for the connections, filtered by their subscriptions
+	deltas chan signalk.Delta
+
 	// Register requests from new connections
 	register chan *connection
 
@@ -58,12 +86,16 @@ const (
 	// Send pings to receivers
 	pingPeriod = 56 * time.Second
 
-	// Max message size
-	maxMessageSize = 512
+	// Max message size, large enough for a subscription to many paths
+	maxMessageSize = 4096
+
+	// How often subscriptions with a period are checked for values to send
+	tickPeriod = 100 * time.Millisecond
 )
 
 var websocket_hub = hub{
 	broadcast:   make(chan []byte),
+	deltas:      make(chan signalk.Delta),
 	register:    make(chan *connection),
 	unregister:  make(chan *connection),
 	connections: make(map[*connection]bool),
@@ -83,13 +115,38 @@ func (c *connection) write(mt int, payload []byte) error {
 
 func (c *connection) writePump() {
 	ticker := time.NewTicker(pingPeriod)
+	subTicker := time.NewTicker(tickPeriod)
 	defer func() {
 		ticker.Stop()
+		subTicker.Stop()
 		c.ws.Close()
 	}()
 
 	for {
 		select {
+		case now := <-subTicker.C:
+			if c.sub == nil {
+				continue
+			}
+			for _, d := range c.sub.Tick(now) {
+				b, err := json.Marshal(d)
+				if err != nil {
+					log.Errorf("JSON.Marshal %v", err)
+					continue
+				}
+				if err := c.write(websocket.TextMessage, b); err != nil {
+					return
+				}
+			}
+		case res := <-c.replies:
+			b, err := json.Marshal(res)
+			if err != nil {
+				log.Errorf("JSON.Marshal %v", err)
+				continue
+			}
+			if err := c.write(websocket.TextMessage, b); err != nil {
+				return
+			}
 		case message, ok := <-c.send:
 			if !ok {
 				c.write(websocket.CloseMessage, []byte{})
@@ -106,14 +163,103 @@ func (c *connection) writePump() {
 	}
 }
 
+// readPump handles subscription and PUT messages from a stream client until
+// it goes away
+func (c *connection) readPump(h *hub) {
+	defer func() {
+		h.unregister <- c
+	}()
+
+	c.ws.SetReadLimit(maxMessageSize)
+	c.ws.SetReadDeadline(time.Now().Add(pongWait))
+	c.ws.SetPongHandler(func(string) error {
+		c.ws.SetReadDeadline(time.Now().Add(pongWait))
+		return nil
+	})
+
+	for {
+		_, msg, err := c.ws.ReadMessage()
+		if err != nil {
+			return
+		}
+
+		var probe struct {
+			Put json.RawMessage `json:"put"`
+		}
+		json.Unmarshal(msg, &probe)
+
+		if probe.Put != nil {
+			c.put(msg)
+		} else if err := c.sub.Handle(msg); err != nil {
+			log.Warning("Subscription:", err)
+		}
+	}
+}
+
+// put answers a PUT request from a stream client with PENDING, and then with
+// its final state once it has been sent
+func (c *connection) put(msg []byte) {
+	var req signalk.PutRequest
+	if err := json.Unmarshal(msg, &req); err != nil {
+		c.reply(signalk.PutResponse{
+			State:      signalk.StateFailed,
+			StatusCode: http.StatusBadRequest,
+			Message:    err.Error(),
+		})
+		return
+	}
+
+	c.reply(signalk.PutResponse{
+		RequestId:  req.RequestId,
+		State:      signalk.StatePending,
+		StatusCode: http.StatusAccepted,
+	})
+
+	go func() {
+		c.reply(handlePut(c.model, c.mappings, &req))
+	}()
+}
+
+// reply queues the state of a PUT request, dropping it if the client is not
+// keeping up or has gone away
+func (c *connection) reply(res signalk.PutResponse) {
+	select {
+	case c.replies <- res:
+	default:
+		log.Warning("PUT: dropped reply to", c.ws.RemoteAddr())
+	}
+}
+
 func (h *hub) run() {
 	for {
 		select {
 		case c := <-h.register:
 			h.connections[c] = true
 		case c := <-h.unregister:
-			delete(h.connections, c)
-			close(c.send)
+			// The connection may already have been dropped for being slow
+			if h.connections[c] {
+				delete(h.connections, c)
+				close(c.send)
+			}
+		case d := <-h.deltas:
+			now := time.Now()
+			for c := range h.connections {
+				out, ok := c.sub.Filter(d, now)
+				if !ok {
+					continue
+				}
+				b, err := json.Marshal(out)
+				if err != nil {
+					log.Errorf("JSON.Marshal %v", err)
+					continue
+				}
+				select {
+				case c.send <- b:
+				default:
+					close(c.send)
+					delete(h.connections, c)
+				}
+			}
 		case m := <-h.broadcast:
 			for c := range h.connections {
 				select {
@@ -127,29 +273,75 @@ func (h *hub) run() {
 	}
 }
 
-func serveWs(w http.ResponseWriter, r *http.Request) {
-	if r.Method != "GET" {
-		http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
-		return
-	}
+func serveWs(model *signalk.Model, mappings *mappingStore) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != "GET" {
+			http.Error(w, "Method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
 
-	// TODO: Add origin check / CORS support
+		// TODO: Add origin check / CORS support
 
-	ws, err := websocket.Upgrade(w, r, nil, 1024, 1024)
-	if _, ok := err.(websocket.HandshakeError); ok {
-		http.Error(w, "Not a websocket handshake", http.StatusBadRequest)
-		return
-	} else if err != nil {
-		log.Error("Websocket:", err)
-		return
-	}
+		sub, err := signalk.NewSubscriber(model.Self(), r.URL.Query().Get("subscribe"))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+
+		var start time.Time
+		var rate float64
+		if r.URL.Path == "/signalk/v1/playback" {
+			if start, rate, err = playbackParams(r.URL.Query()); err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+		}
 
-	if r.URL.Path == "/signalk/v1/stream" {
-		c := &connection{send: make(chan []byte, 256), ws: ws}
-		websocket_hub.register <- c
-		go c.writePump()
-	} else if r.URL.Path == "/signalk/v1/control" {
-		fmt.Println("Got registration")
+		ws, err := websocket.Upgrade(w, r, nil, 1024, 1024)
+		if _, ok := err.(websocket.HandshakeError); ok {
+			http.Error(w, "Not a websocket handshake", http.StatusBadRequest)
+			return
+		} else if err != nil {
+			log.Error("Websocket:", err)
+			return
+		}
+
+		if r.URL.Path == "/signalk/v1/playback" {
+			go playback(ws, sub, model.Self(), start, rate)
+		} else if r.URL.Path == "/signalk/v1/stream" {
+			c := &connection{
+				send:     make(chan []byte, 256),
+				ws:       ws,
+				sub:      sub,
+				replies:  make(chan signalk.PutResponse, 16),
+				model:    model,
+				mappings: mappings,
+			}
+
+			b, err := json.Marshal(hello{
+				Name:      "argo",
+				Version:   signalk.Version,
+				Self:      model.Self(),
+				Roles:     []string{"master", "main"},
+				Timestamp: time.Now().UTC(),
+			})
+			if err == nil {
+				c.send <- b
+			}
+
+			// Then who the vessel is, if the client wants to know
+			if d, ok := sub.Filter(vessel().Delta(), time.Now()); ok {
+				if b, err := json.Marshal(d); err == nil {
+					c.send <- b
+				}
+			}
+
+			websocket_hub.register <- c
+			go c.writePump()
+			go c.readPump(&websocket_hub)
+		} else if r.URL.Path == "/signalk/v1/control" {
+			fmt.Println("Got registration")
+		}
 	}
 }
 
@@ -180,10 +372,17 @@ func loggingHandler(handler http.Handler, log *logging.Logger) http.Handler {
 	})
 }
 
-func WebSocketServer(addr *string, log *logging.Logger) {
-	http.HandleFunc("/signalk/v1/", serveWs)
+func WebSocketServer(addr *string, log *logging.Logger, model *signalk.Model, mappings *mappingStore) {
+	http.HandleFunc("/signalk/v1/", serveWs(model, mappings))
 	http.HandleFunc("/ws/stats", handleStats)
-	err := http.ListenAndServe(*addr, loggingHandler(http.DefaultServeMux, log))
+
+	var err error
+	if sysconf.Server.UseTls {
+		err = http.ListenAndServeTLS(*addr, sysconf.Server.PublicKeyFile,
+			sysconf.Server.PrivateKeyFile, loggingHandler(http.DefaultServeMux, log))
+	} else {
+		err = http.ListenAndServe(*addr, loggingHandler(http.DefaultServeMux, log))
+	}
 	if err != nil {
 		log.Fatal("ListenAndServe: ", err)
 	}
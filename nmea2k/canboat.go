@@ -0,0 +1,364 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nmea2k
+
+import (
+	"bytes"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/timmathews/argo/can"
+)
+
+// CanBoatMessage is one line of CANboat analyzer JSON. Field values are in
+// the units CANboat prints: degrees, Celsius, and dates and times as strings.
+type CanBoatMessage struct {
+	Timestamp   string                 `json:"timestamp"`
+	Priority    uint8                  `json:"prio"`
+	Source      uint8                  `json:"src"`
+	Destination uint8                  `json:"dst"`
+	Pgn         uint32                 `json:"pgn"`
+	Description string                 `json:"description"`
+	Fields      map[string]interface{} `json:"fields"`
+}
+
+// Timestamp formats used by different versions of CANboat. The first is the
+// one we write.
+var canBoatTimestamps = []string{
+	"2006-01-02T15:04:05.000Z",
+	"2006-01-02T15:04:05.999Z07:00",
+	"2006-01-02T15:04:05.999",
+	"2006-01-02-15:04:05.999",
+}
+
+const (
+	canBoatDate = "2006.01.02"
+	canBoatTime = "15:04:05.99999"
+)
+
+// FromCanBoat reads a line of CANboat analyzer JSON. Proprietary variants of
+// a PGN are told apart by their match fields, and field values are converted
+// to the same types ParsePacket produces. The payload is rebuilt from the
+// fields where possible.
+func FromCanBoat(data string) (*ParsedMessage, error) {
+	var cbm CanBoatMessage
+	if err := json.Unmarshal([]byte(data), &cbm); err != nil {
+		return nil, err
+	}
+
+	hdr := RawMessage{new(can.RawMessage)}
+
+	var err error
+	for _, layout := range canBoatTimestamps {
+		if hdr.Timestamp, err = time.Parse(layout, cbm.Timestamp); err == nil {
+			break
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("invalid timestamp %q", cbm.Timestamp)
+	}
+
+	hdr.Priority = cbm.Priority
+	hdr.Pgn = cbm.Pgn
+	hdr.Source = cbm.Source
+	hdr.Destination = cbm.Destination
+
+	i, def := cbm.definition()
+
+	dd := make(DataMap)
+	rpt := def.FirstRepeatingField()
+	last := len(def.FieldList)
+	if rpt >= 0 {
+		last = rpt
+	}
+
+	// CANboat leaves out fields which are not available, ParsePacket has them
+	// as nil
+	for idx := 0; idx < last; idx++ {
+		dd[idx] = fromCanBoatValue(&def, idx, cbm.Fields[def.FieldList[idx].Name], dd)
+	}
+
+	// CANboat puts repeating fields in a list of objects
+	if list, ok := cbm.Fields["list"].([]interface{}); ok && rpt >= 0 {
+		grp := RepeatingGroup{}
+		for _, item := range list {
+			if obj, ok := item.(map[string]interface{}); ok {
+				rec := canBoatFields(def.FieldList, rpt, obj)
+				for idx, v := range rec {
+					rec[idx] = fromCanBoatValue(&def, idx, v, rec)
+				}
+				grp.Records = append(grp.Records, rec)
+			}
+		}
+		grp.Count = len(grp.Records)
+		dd[rpt] = grp
+	}
+
+	if b, err := def.Encode(dd); err == nil {
+		hdr.Data = b
+		hdr.Length = uint8(len(b))
+	}
+
+	return &ParsedMessage{Header: hdr, Index: i, Data: dd}, nil
+}
+
+// definition picks the definition of the PGN whose match fields agree with
+// the fields of the message, preferring one with the same description.
+func (cbm *CanBoatMessage) definition() (int, Pgn) {
+	first, def := PgnList.First(cbm.Pgn)
+	last, _ := PgnList.Last(cbm.Pgn)
+	match := -1
+
+	for i := first; i <= last; i++ {
+		p := &PgnList[i]
+		if !p.Matches(canBoatFields(p.FieldList, 0, cbm.Fields)) {
+			continue
+		}
+		if p.Description == cbm.Description {
+			return i, *p
+		}
+		if match < 0 || (p.IsProprietary() && !PgnList[match].IsProprietary()) {
+			match = i
+		}
+	}
+
+	if match >= 0 {
+		return match, PgnList[match]
+	}
+
+	return first, def
+}
+
+// canBoatFields maps the named fields of a CANboat message, or of one of its
+// repeating sets, onto the field indexes of the PGN, starting at first.
+func canBoatFields(fields []Field, first int, obj map[string]interface{}) DataMap {
+	rec := make(DataMap)
+	for k, v := range obj {
+		for i := first; i < len(fields); i++ {
+			if fields[i].Name == k {
+				rec[i] = v
+				break
+			}
+		}
+	}
+
+	return rec
+}
+
+// fromCanBoatValue converts a field value from CANboat JSON to the type and
+// resolution ParsePacket would have produced for it.
+func fromCanBoatValue(def *Pgn, idx int, v interface{}, data DataMap) interface{} {
+	field := &def.FieldList[idx]
+
+	if v == nil {
+		return nil
+	}
+
+	switch field.Resolution {
+	case RES_ASCII, RES_STRING, RES_STRINGLZ, RES_STRINGLAU, RES_6BITASCII:
+		return fmt.Sprint(v)
+	case RES_BINARY:
+		if s, ok := v.(string); ok {
+			if b, err := hex.DecodeString(strings.Replace(s, " ", "", -1)); err == nil {
+				return b
+			}
+			return v
+		}
+	case RES_LOOKUP2:
+		// The lookup depends on a field which may not be decoded yet
+		if n, err := toFloat(v); err == nil {
+			return uint64(n)
+		}
+		return v
+	case RES_DATE:
+		if s, ok := v.(string); ok {
+			t, err := time.Parse(canBoatDate, s)
+			if err != nil {
+				t, err = time.Parse("2006-01-02", s)
+			}
+			if err != nil {
+				return v
+			}
+			v = t
+		}
+	case RES_TIME:
+		if s, ok := v.(string); ok {
+			t, err := time.ParseInLocation("15:04:05", s, time.Local)
+			if err != nil {
+				return v
+			}
+			v = t
+		}
+	case RES_TEMPERATURE:
+		if c, err := toFloat(v); err == nil {
+			v = c + 273.15
+		}
+	}
+
+	n, err := EncodeValue(field, v, data)
+	if err != nil {
+		// Most likely a lookup name we don't know, so keep it as it is
+		return v
+	}
+
+	buf := putBits(nil, 0, field.Size, n)
+	raw := RawMessage{&can.RawMessage{Data: buf}}
+
+	res, err := raw.extractField(def, field, 0, uint32(len(buf)), 0, field.Size)
+	if err != nil {
+		return nil
+	}
+
+	return res
+}
+
+// CanBoat formats the message as a line of CANboat analyzer JSON. Fields are
+// written in the order of the PGN definition and reserved fields are left out,
+// like CANboat does.
+func (msg *ParsedMessage) CanBoat() ([]byte, error) {
+	def := PgnList[msg.Index]
+
+	buf := new(bytes.Buffer)
+
+	hdr, err := json.Marshal(struct {
+		Timestamp   string `json:"timestamp"`
+		Priority    uint8  `json:"prio"`
+		Source      uint8  `json:"src"`
+		Destination uint8  `json:"dst"`
+		Pgn         uint32 `json:"pgn"`
+		Description string `json:"description"`
+	}{
+		msg.Header.Timestamp.UTC().Format(canBoatTimestamps[0]),
+		msg.Header.Priority,
+		msg.Header.Source,
+		msg.Header.Destination,
+		msg.Header.Pgn,
+		def.Description,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// Replace the closing brace with the fields
+	buf.Write(hdr[:len(hdr)-1])
+	buf.WriteString(`,"fields":{`)
+
+	rpt := def.FirstRepeatingField()
+	last := len(def.FieldList)
+	if rpt >= 0 {
+		last = rpt
+	}
+
+	sep, err := writeCanBoatFields(buf, &def, msg.Data, 0, last, "")
+	if err != nil {
+		return nil, err
+	}
+
+	if grp, ok := msg.Data[rpt].(RepeatingGroup); ok && rpt >= 0 {
+		buf.WriteString(sep + `"list":[`)
+		for n, rec := range grp.Records {
+			if n > 0 {
+				buf.WriteString(",")
+			}
+			buf.WriteString("{")
+			if _, err := writeCanBoatFields(buf, &def, rec, rpt, len(def.FieldList), ""); err != nil {
+				return nil, err
+			}
+			buf.WriteString("}")
+		}
+		buf.WriteString("]")
+	}
+
+	buf.WriteString("}}")
+
+	return buf.Bytes(), nil
+}
+
+// writeCanBoatFields writes the fields from first up to last as JSON object
+// members and returns the separator for the next member.
+func writeCanBoatFields(buf *bytes.Buffer, def *Pgn, data DataMap, first, last int, sep string) (string, error) {
+	for i := first; i < last; i++ {
+		field := &def.FieldList[i]
+		v := toCanBoatValue(field, data[i])
+
+		if v == nil || field.Name == "Reserved" {
+			continue
+		}
+
+		name, _ := json.Marshal(field.Name)
+		value, err := json.Marshal(v)
+		if err != nil {
+			return sep, err
+		}
+
+		buf.WriteString(sep)
+		buf.Write(name)
+		buf.WriteString(":")
+		buf.Write(value)
+		sep = ","
+	}
+
+	return sep, nil
+}
+
+// toCanBoatValue converts a decoded field value to the form CANboat prints.
+// Numbers are rounded to the resolution of the field.
+func toCanBoatValue(field *Field, v interface{}) interface{} {
+	switch t := v.(type) {
+	case nil:
+		return nil
+	case time.Time:
+		if field.Resolution == RES_DATE {
+			return t.UTC().Format(canBoatDate)
+		}
+		return t.Format(canBoatTime)
+	case []byte:
+		return fmt.Sprintf("% x", t)
+	case float32:
+		if field.Resolution == RES_TEMPERATURE {
+			return json.Number(strconv.FormatFloat(float64(t)-273.15, 'f', 2, 64))
+		}
+		// Only print the digits a float32 actually holds
+		return json.Number(strconv.FormatFloat(float64(t), 'f', -1, 32))
+	case float64:
+		digits := -1
+
+		switch field.Resolution {
+		case RES_DEGREES:
+			// CANboat prints angles to a tenth of a degree
+			digits = 1
+		case RES_LATITUDE, RES_LONGITUDE:
+			digits = 16
+		default:
+			if field.Resolution > 0 && field.Resolution < 1 {
+				digits = int(math.Ceil(-math.Log10(field.Resolution)))
+			}
+		}
+
+		return json.Number(strconv.FormatFloat(t, 'f', digits, 64))
+	}
+
+	return v
+}
@@ -0,0 +1,93 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nmea2k
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+)
+
+var canBoatLog = []string{
+	`{"timestamp":"2016-03-14T15:09:26.535Z","prio":2,"src":204,"dst":255,"pgn":127250,"description":"Vessel Heading","fields":{"SID":0,"Heading":129.7,"Deviation":0.0,"Variation":-5.2,"Reference":"Magnetic"}}`,
+	`{"timestamp":"2016-03-14T15:09:26.611Z","prio":5,"src":35,"dst":255,"pgn":130312,"description":"Temperature","fields":{"SID":1,"Temperature Instance":0,"Temperature Source":"Sea Temperature","Actual Temperature":13.25}}`,
+	`{"timestamp":"2016-03-14T15:09:26.700Z","prio":2,"src":3,"dst":255,"pgn":129025,"description":"Position, Rapid Update","fields":{"Latitude":42.3601,"Longitude":-71.0589}}`,
+	`{"timestamp":"2016-03-14T15:09:27.002Z","prio":3,"src":17,"dst":255,"pgn":127501,"description":"Binary Switch Bank Status","fields":{"Indicator Bank Instance":3,"list":[{"Indicator":"On"},{"Indicator":"Off"},{"Indicator":"On"}]}}`,
+	`{"timestamp":"2016-03-14T15:09:27.150Z","prio":7,"src":41,"dst":255,"pgn":126720,"description":"Attitude Offset","fields":{"Manufacturer Code":"Airmar","Industry Code":"Marine","Proprietary ID":32,"Azimuth offset":1.5,"Pitch offset":-0.3,"Roll offset":0.0}}`,
+}
+
+func TestCanBoatRoundTrip(t *testing.T) {
+	for _, line := range canBoatLog {
+		msg, err := FromCanBoat(line)
+		if err != nil {
+			t.Errorf("FromCanBoat(%v) failed: %v", line, err)
+			continue
+		}
+
+		b, err := msg.CanBoat()
+		if err != nil {
+			t.Errorf("CanBoat() failed: %v", err)
+			continue
+		}
+
+		var in, out map[string]interface{}
+		json.Unmarshal([]byte(line), &in)
+		if err := json.Unmarshal(b, &out); err != nil {
+			t.Errorf("CanBoat() = %s is not valid JSON: %v", b, err)
+			continue
+		}
+
+		if !reflect.DeepEqual(in, out) {
+			t.Errorf("CanBoat() = %s, expected %s", b, line)
+		}
+	}
+}
+
+func TestFromCanBoatNativeValues(t *testing.T) {
+	msg, err := FromCanBoat(canBoatLog[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Rebuilding the payload and decoding it must give the same values
+	parsed := ParsePacket(msg.Header.RawMessage)
+	if !reflect.DeepEqual(parsed.Data, msg.Data) {
+		t.Errorf("FromCanBoat() = %#v, ParsePacket() = %#v", msg.Data, parsed.Data)
+	}
+
+	if v, ok := msg.Data[3].(float32); !ok || v != 286.4 {
+		t.Errorf("Actual Temperature = %#v, expected 286.4K", msg.Data[3])
+	}
+}
+
+func TestFromCanBoatProprietary(t *testing.T) {
+	msg, err := FromCanBoat(canBoatLog[4])
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if def := PgnList[msg.Index]; def.Description != "Attitude Offset" {
+		t.Errorf("FromCanBoat() used %q, expected Attitude Offset", def.Description)
+	}
+
+	if _, err := FromCanBoat(`{"pgn": 127250, "fields": [`); err == nil {
+		t.Error("FromCanBoat() accepted invalid JSON")
+	}
+}
@@ -0,0 +1,646 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nmea2k
+
+import (
+	"math"
+	"sync"
+	"time"
+	"unicode/utf16"
+
+	"github.com/timmathews/argo/can"
+)
+
+// ValueKind says which member of a Value holds the decoded field.
+type ValueKind uint8
+
+const (
+	KindNone         ValueKind = iota // Field is not decoded
+	KindNumber                        // Float holds the value times the resolution
+	KindInteger                       // Uint holds the raw value
+	KindLookup                        // Uint holds the raw value, Name() its name
+	KindLookup2                       // Uint holds the raw value, Name() its name
+	KindManufacturer                  // Uint holds the company code, Name() its name
+	KindPosition                      // Float holds degrees of latitude or longitude
+	KindDate                          // Uint holds days since January 1, 1970
+	KindTime                          // Uint holds 1/10000 seconds since midnight
+	KindTemperature                   // Float holds Kelvin
+	KindPressure                      // Float holds the pressure
+	KindFloat                         // Float holds an IEEE 754 single
+	KindString                        // Bytes holds the text, without padding
+	KindBinary                        // Bytes holds the raw data
+)
+
+// Value is one decoded field. Values are plain structs so decoding does not
+// allocate; Bytes shares the data of the CAN message.
+type Value struct {
+	Field  *Field
+	Index  int // Index of the field in the PGN definition
+	Record int // Repetition of a repeating field, -1 for fixed fields
+	Kind   ValueKind
+	Valid  bool // False if the data is missing or marked not available
+	Uint   uint64
+	Float  float64
+	Bytes  []byte
+
+	super uint64 // Raw value of the field a RES_LOOKUP2 field depends on
+}
+
+// DecodedMessage is a CAN message decoded by a Decoder. Get one from
+// NewDecodedMessage and Release it when done so its values can be reused.
+type DecodedMessage struct {
+	Header can.RawMessage
+	Index  int  // Index of the definition in the Decoder's PgnArray
+	Pgn    *Pgn // The definition
+	Values []Value
+
+	// Name and type of the interface the message was received on, as in
+	// ParsedMessage
+	Interface     string
+	InterfaceType string
+
+	// The message given to DecodedFrom, whose fields are there rather than
+	// in Values
+	From *ParsedMessage
+}
+
+var decodedMessages = sync.Pool{
+	New: func() interface{} {
+		return &DecodedMessage{Values: make([]Value, 0, 32)}
+	},
+}
+
+// NewDecodedMessage returns an empty message from a pool.
+func NewDecodedMessage() *DecodedMessage {
+	return decodedMessages.Get().(*DecodedMessage)
+}
+
+// DecodedFrom wraps a message which was not decoded from the bus, such as one
+// read from a CANboat log, so it can go where decoded messages go. Its fields
+// are kept as they are instead of being encoded and decoded again.
+func DecodedFrom(p *ParsedMessage) *DecodedMessage {
+	m := NewDecodedMessage()
+	m.Header = *p.Header.RawMessage
+	m.Index = p.Index
+	m.Pgn = &PgnList[p.Index]
+	m.Interface, m.InterfaceType = p.Interface, p.InterfaceType
+	m.From = p
+
+	return m
+}
+
+// Release returns the message to the pool. Neither the message nor its values
+// may be used afterwards.
+func (m *DecodedMessage) Release() {
+	m.Header = can.RawMessage{}
+	m.Pgn = nil
+	m.Values = m.Values[:0]
+	m.Interface, m.InterfaceType = "", ""
+	m.From = nil
+	decodedMessages.Put(m)
+}
+
+// Decoder decodes CAN messages using a PgnArray. The position and type of
+// every field is worked out once, when the Decoder is created, rather than
+// for every message. A Decoder may be used from several goroutines.
+type Decoder struct {
+	pgns    PgnArray
+	layouts []pgnLayout
+	byPgn   map[uint32][]int
+}
+
+type pgnLayout struct {
+	fields      []fieldLayout
+	rpt         int // First repeating field or -1
+	proprietary bool
+}
+
+type fieldLayout struct {
+	field   *Field
+	kind    ValueKind
+	bits    uint32
+	bytes   uint32
+	match   uint64
+	isMatch bool
+
+	// Position of a match field, from the start of the message
+	matchStart, matchEnd, matchBits uint32
+
+	// Position of the field the lookup of a RES_LOOKUP2 field depends on
+	superStart, superEnd, superBits uint32
+}
+
+// NewDecoder prepares a Decoder for the definitions in pp.
+func NewDecoder(pp PgnArray) *Decoder {
+	d := &Decoder{
+		pgns:    pp,
+		layouts: make([]pgnLayout, len(pp)),
+		byPgn:   make(map[uint32][]int),
+	}
+
+	for i := range pp {
+		p := &pp[i]
+		l := &d.layouts[i]
+		l.rpt = p.FirstRepeatingField()
+		l.fields = make([]fieldLayout, len(p.FieldList))
+
+		for j := range p.FieldList {
+			f := &p.FieldList[j]
+			fl := &l.fields[j]
+			fl.field = f
+			fl.kind = fieldKind(f)
+			fl.bits = f.Size
+			fl.bytes = (f.Size + 7) / 8
+			if f.Resolution == RES_STRINGLZ || f.Resolution == RES_STRINGLAU {
+				// Only the length byte has to be there, the size is a maximum
+				fl.bytes = 1
+			}
+			fl.match, fl.isMatch = f.Match()
+			if fl.isMatch {
+				sb, se, sbit, sbits := p.FieldOffsets(int32(j))
+				if se-sb > 8 {
+					sbits = 65 // Never matches
+				}
+				fl.matchStart, fl.matchEnd, fl.matchBits = sb*8+sbit, se, sbits
+				l.proprietary = true
+			}
+
+			if fl.kind == KindLookup2 && int(f.Offset) < len(p.FieldList) {
+				sb, se, sbit, sbits := p.FieldOffsets(f.Offset)
+				fl.superStart, fl.superEnd, fl.superBits = sb*8+sbit, se, sbits
+			}
+		}
+
+		if i > 0 || p.Pgn != 0 {
+			d.byPgn[p.Pgn] = append(d.byPgn[p.Pgn], i)
+		}
+	}
+
+	return d
+}
+
+// Kind returns the kind of the values the Decoder gives the field.
+func (f *Field) Kind() ValueKind {
+	return fieldKind(f)
+}
+
+func fieldKind(f *Field) ValueKind {
+	switch f.Resolution {
+	case RES_LATITUDE, RES_LONGITUDE:
+		return KindPosition
+	case RES_DATE:
+		return KindDate
+	case RES_TIME:
+		return KindTime
+	case RES_TEMPERATURE:
+		return KindTemperature
+	case RES_PRESSURE:
+		return KindPressure
+	case RES_INTEGER, 1:
+		return KindInteger
+	case RES_LOOKUP:
+		return KindLookup
+	case RES_LOOKUP2:
+		return KindLookup2
+	case RES_MANUFACTURER:
+		return KindManufacturer
+	case RES_FLOAT:
+		return KindFloat
+	case RES_ASCII, RES_STRING, RES_STRINGLZ, RES_STRINGLAU:
+		return KindString
+	case RES_6BITASCII, RES_NOTUSED:
+		return KindNone
+	}
+
+	if f.Resolution < 0 {
+		return KindBinary
+	}
+
+	return KindNumber
+}
+
+var defaultDecoder struct {
+	sync.Mutex
+	d *Decoder
+}
+
+// DefaultDecoder returns a Decoder for PgnList, creating a new one if PgnList
+// has been changed, for example by LoadDefinitions.
+func DefaultDecoder() *Decoder {
+	defaultDecoder.Lock()
+	defer defaultDecoder.Unlock()
+
+	d := defaultDecoder.d
+	if d == nil || len(d.pgns) != len(PgnList) || &d.pgns[0] != &PgnList[0] {
+		d = NewDecoder(PgnList)
+		defaultDecoder.d = d
+	}
+
+	return d
+}
+
+// variant picks the definition for a message. A proprietary variant whose
+// match fields, such as the manufacturer code, agree with the data is
+// preferred over a generic definition without match fields.
+func (d *Decoder) variant(raw *can.RawMessage) int {
+	variants := d.byPgn[raw.Pgn]
+
+	switch len(variants) {
+	case 0:
+		return 0
+	case 1:
+		return variants[0]
+	}
+
+	fallback := -1
+
+	for _, i := range variants {
+		l := &d.layouts[i]
+
+		if !l.proprietary {
+			if fallback < 0 {
+				fallback = i
+			}
+			continue
+		}
+
+		matches := true
+		for j := range l.fields {
+			fl := &l.fields[j]
+			if !fl.isMatch {
+				continue
+			}
+			if int(fl.matchEnd) > len(raw.Data) || fl.matchBits > 64 ||
+				readBits(raw.Data, fl.matchStart, fl.matchBits) != fl.match {
+				matches = false
+				break
+			}
+		}
+
+		if matches {
+			return i
+		}
+	}
+
+	if fallback >= 0 {
+		return fallback
+	}
+
+	return variants[0]
+}
+
+// Decode decodes raw into msg, reusing its values. The values share the data
+// of raw, which must not be changed while msg is in use.
+func (d *Decoder) Decode(raw *can.RawMessage, msg *DecodedMessage) {
+	msg.Header = *raw
+	msg.Index = d.variant(raw)
+	msg.Pgn = &d.pgns[msg.Index]
+	msg.Values = msg.Values[:0]
+
+	l := &d.layouts[msg.Index]
+	data := raw.Data
+	n := uint32(len(data))
+
+	var pos uint32
+	record := -1
+	recordStart := uint32(0)
+
+	for idx := 0; idx < len(l.fields); idx++ {
+		fl := &l.fields[idx]
+
+		if idx == l.rpt {
+			record++
+			recordStart = pos
+		}
+
+		start := pos / 8
+		width := fl.bytes
+		if width > n {
+			width = n
+		}
+		if start+width > n {
+			break
+		}
+
+		bits := fl.bits
+		if width*8 < bits {
+			bits = width * 8
+		}
+
+		v := Value{
+			Field:  fl.field,
+			Index:  idx,
+			Record: -1,
+			Kind:   fl.kind,
+		}
+		if idx >= l.rpt && l.rpt >= 0 {
+			v.Record = record
+		}
+
+		pos += decodeField(fl, &v, data, pos, width, bits)
+		msg.Values = append(msg.Values, v)
+
+		if idx == len(l.fields)-1 && l.rpt >= 0 && pos/8 < n && pos > recordStart {
+			idx = l.rpt - 1
+		}
+	}
+}
+
+// decodeField fills in v from the field at bit pos and returns the number
+// of bits the field takes up.
+func decodeField(fl *fieldLayout, v *Value, data []byte, pos, width, bits uint32) uint32 {
+	start := pos / 8
+	end := start + width
+
+	switch fl.kind {
+	case KindNumber, KindInteger, KindLookup, KindManufacturer, KindLookup2:
+		if width > 8 || bits == 0 {
+			break
+		}
+		v.Valid = true
+		v.Uint = readBits(data, pos, bits)
+
+		if fl.kind == KindNumber {
+			v.Float = float64(signed(fl.field, v.Uint)) * fl.field.Resolution
+			if !fl.field.Signed {
+				v.Float = float64(v.Uint) * fl.field.Resolution
+			}
+		} else if fl.kind == KindLookup2 {
+			v.Valid = int(fl.superEnd) <= len(data)
+			v.super = readBits(data, fl.superStart, fl.superBits)
+		}
+	case KindPosition:
+		if width == 4 {
+			n := int32(readBits(data, pos, 32))
+			v.Valid = n <= 0x7FFFFFFD
+			v.Float = float64(float32(n) / 1e+7)
+		} else if width == 8 {
+			n := int64(readBits(data, pos, 64))
+			v.Valid = n <= 0x7FFFFFFFFFFFFFFD
+			v.Float = float64(n) / 1e+16
+		}
+	case KindDate:
+		v.Uint = readBits(data, pos, 16)
+		v.Valid = width == 2 && v.Uint != 0xFFFF
+	case KindTime:
+		v.Uint = readBits(data, pos, 32)
+		v.Valid = width == 4 && v.Uint != 0xFFFFFFFF
+	case KindTemperature:
+		n := readBits(data, pos, 16)
+		v.Valid = width == 2 && n < 0xFFFD
+		v.Float = float64(float32(n) / 100.0)
+	case KindPressure:
+		n := readBits(data, pos, 16)
+		v.Valid = width == 2 && n < 0xFFFD
+		v.Float = float64(float32(n) / 1000.0)
+	case KindFloat:
+		v.Valid = width == 4
+		v.Float = float64(math.Float32frombits(uint32(readBits(data, pos, 32))))
+	case KindString:
+		switch fl.field.Resolution {
+		case RES_STRINGLZ:
+			// The length byte counts itself, the string takes up no more room
+			// than it needs
+			l := uint32(data[start])
+			if l == 0 {
+				return 8
+			}
+			if start+l <= uint32(len(data)) {
+				v.Bytes = data[start+1 : start+l]
+				v.Valid = len(v.Bytes) > 0
+			}
+			return l * 8
+		case RES_STRINGLAU:
+			// The length byte counts itself and the encoding byte after it,
+			// which is 0 for UTF-16 and 1 for ASCII. The encoding is kept in
+			// Uint.
+			l := uint32(data[start])
+			if l < 2 {
+				return 16
+			}
+			if start+l <= uint32(len(data)) {
+				v.Uint = uint64(data[start+1])
+				v.Bytes = data[start+2 : start+l]
+				v.Valid = len(v.Bytes) > 0
+			}
+			return l * 8
+		case RES_STRING:
+			v.Bytes = data[start:end]
+			v.Valid = true
+		default:
+			i := start
+			for i < end && data[i] != 0 && data[i] != 0xFF {
+				i++
+			}
+			v.Bytes = data[start:i]
+			v.Valid = len(v.Bytes) > 0
+		}
+	case KindBinary:
+		if fl.bits == LEN_VARIABLE {
+			// Variable length data takes up the rest of the message
+			v.Bytes = data[start:]
+			v.Valid = true
+			return uint32(len(v.Bytes)) * 8
+		}
+		v.Bytes = data[start:end]
+		v.Valid = true
+	}
+
+	return bits
+}
+
+// readBits returns width bits of data starting at bit pos, least significant
+// bit first. Bits past the end of data are zero.
+func readBits(data []byte, pos, width uint32) uint64 {
+	var v uint64
+
+	start := pos / 8
+	shift := pos % 8
+	end := (pos + width + 7) / 8
+
+	for i := start; i < end && int(i) < len(data); i++ {
+		s := int((i-start)*8) - int(shift)
+		if s < 0 {
+			v |= uint64(data[i]) >> uint(-s)
+		} else if s < 64 {
+			v |= uint64(data[i]) << uint(s)
+		}
+	}
+
+	if width < 64 {
+		v &= 1<<width - 1
+	}
+
+	return v
+}
+
+// signed converts the raw value of a signed field to an integer the same
+// width as the field's storage.
+func signed(f *Field, n uint64) int64 {
+	switch {
+	case f.Size <= 8:
+		return int64(int8(n))
+	case f.Size <= 16:
+		return int64(int16(n))
+	case f.Size <= 32:
+		return int64(int32(n))
+	}
+
+	return int64(n)
+}
+
+// utf16String converts little-endian UTF-16 text to a string
+func utf16String(b []byte) string {
+	u := make([]uint16, len(b)/2)
+	for i := range u {
+		u[i] = uint16(b[2*i]) | uint16(b[2*i+1])<<8
+	}
+
+	return string(utf16.Decode(u))
+}
+
+// Name returns the name of a lookup or manufacturer value, or an empty
+// string if it has none.
+func (v *Value) Name() string {
+	switch v.Kind {
+	case KindLookup:
+		if u, ok := v.Field.Units.(PgnLookup); ok {
+			return u[int(v.Uint)]
+		}
+	case KindLookup2:
+		if u, ok := v.Field.Units.(PgnSubLookup); ok {
+			return u[int(v.super)][int(v.Uint)]
+		}
+	case KindManufacturer:
+		return lookupCompanyCode[int(v.Uint)]
+	}
+
+	return ""
+}
+
+// Int returns the value of a signed integer field.
+func (v *Value) Int() int64 {
+	return signed(v.Field, v.Uint)
+}
+
+// Interface returns the value as the type ParsePacket stores in a DataMap,
+// or nil if it is not valid.
+func (v *Value) Interface() interface{} {
+	if !v.Valid {
+		return nil
+	}
+
+	switch v.Kind {
+	case KindNumber:
+		return v.Float
+	case KindInteger:
+		if v.Field.Signed {
+			switch {
+			case v.Field.Size <= 8:
+				return int8(v.Uint)
+			case v.Field.Size <= 16:
+				return int16(v.Uint)
+			case v.Field.Size <= 32:
+				return int32(v.Uint)
+			}
+			return int64(v.Uint)
+		}
+		return v.Uint
+	case KindLookup, KindLookup2, KindManufacturer:
+		if name := v.Name(); name != "" {
+			return name
+		}
+		return v.Uint
+	case KindPosition:
+		if v.Field.Size == 64 {
+			return v.Float
+		}
+		return float32(v.Float)
+	case KindDate:
+		return time.Unix(int64(v.Uint)*86400, 0)
+	case KindTime:
+		seconds := v.Uint / 10000
+		units := v.Uint % 10000
+		return time.Date(1970, time.January, 1, int(seconds/3600), int(seconds/60%60),
+			int(seconds%60), int(units*10000), time.Local)
+	case KindTemperature, KindPressure, KindFloat:
+		return float32(v.Float)
+	case KindString:
+		if v.Field.Resolution == RES_STRINGLAU && v.Uint == 0 {
+			return utf16String(v.Bytes)
+		}
+		return string(v.Bytes)
+	case KindBinary:
+		return v.Bytes
+	}
+
+	return nil
+}
+
+// parsed converts the message into a ParsedMessage with the given header.
+func (m *DecodedMessage) parsed(hdr *can.RawMessage) *ParsedMessage {
+	p := &ParsedMessage{
+		Header: RawMessage{hdr},
+		Index:  m.Index,
+		Data:   make(DataMap, len(m.Values)),
+
+		Interface:     m.Interface,
+		InterfaceType: m.InterfaceType,
+	}
+
+	var grp *RepeatingGroup
+
+	for i := range m.Values {
+		v := &m.Values[i]
+
+		if v.Record < 0 {
+			p.Data[v.Index] = v.Interface()
+			continue
+		}
+
+		if grp == nil {
+			grp = new(RepeatingGroup)
+		}
+		for len(grp.Records) <= v.Record {
+			grp.Records = append(grp.Records, make(DataMap))
+		}
+		grp.Records[v.Record][v.Index] = v.Interface()
+	}
+
+	if grp != nil {
+		grp.Count = len(grp.Records)
+		p.Data[m.Pgn.FirstRepeatingField()] = *grp
+	}
+
+	return p
+}
+
+// Parsed converts the message into a ParsedMessage, which does not depend on
+// the message and so may be kept after it is released.
+func (m *DecodedMessage) Parsed() *ParsedMessage {
+	if m.From != nil {
+		p := *m.From
+		p.Interface, p.InterfaceType = m.Interface, m.InterfaceType
+		return &p
+	}
+
+	hdr := m.Header
+	return m.parsed(&hdr)
+}
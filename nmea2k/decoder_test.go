@@ -0,0 +1,134 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nmea2k
+
+import (
+	"testing"
+
+	"github.com/timmathews/argo/can"
+)
+
+func TestDecoderFieldLayout(t *testing.T) {
+	d := NewDecoder(PgnArray{{
+		Description: "Test",
+		Pgn:         65000,
+		FieldList: []Field{
+			{"A", 4, 1, false, nil, "", "", 0},
+			{"B", 12, 1, false, nil, "", "", 0},
+			{"Name", 80, RES_STRINGLZ, false, nil, "", "", 0},
+			{"C", 8, 1, false, nil, "", "", 0},
+		},
+	}})
+
+	// B crosses a byte boundary and the string is shorter than its field
+	raw := &can.RawMessage{Pgn: 65000, Data: []byte{0xC5, 0xAB, 0x03, 'h', 'i', 0x2A}}
+
+	msg := NewDecodedMessage()
+	defer msg.Release()
+	d.Decode(raw, msg)
+
+	expected := []interface{}{uint64(5), uint64(0xABC), "hi", uint64(42)}
+	if len(msg.Values) != len(expected) {
+		t.Fatalf("Decode() = %v values, expected %v", len(msg.Values), len(expected))
+	}
+
+	for i, e := range expected {
+		if v := msg.Values[i].Interface(); v != e {
+			t.Errorf("Values[%v] = %#v, expected %#v", i, v, e)
+		}
+	}
+}
+
+func TestDecoderAllocations(t *testing.T) {
+	frames := benchmarkFrames(t)
+	d := DefaultDecoder()
+	msg := NewDecodedMessage()
+	defer msg.Release()
+
+	for _, raw := range frames {
+		if n := testing.AllocsPerRun(100, func() { d.Decode(raw, msg) }); n != 0 {
+			t.Errorf("Decode(%v) made %v allocations, expected none", raw.Pgn, n)
+		}
+	}
+}
+
+// benchmarkFrames returns the messages of the CANboat test log as they would
+// arrive from the bus.
+func benchmarkFrames(tb testing.TB) []*can.RawMessage {
+	var frames []*can.RawMessage
+
+	for _, line := range canBoatLog {
+		msg, err := FromCanBoat(line)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		frames = append(frames, msg.Header.RawMessage)
+	}
+
+	return frames
+}
+
+func BenchmarkDecode(b *testing.B) {
+	frames := benchmarkFrames(b)
+	d := DefaultDecoder()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		msg := NewDecodedMessage()
+		d.Decode(frames[i%len(frames)], msg)
+		msg.Release()
+	}
+
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "frames/s")
+}
+
+func BenchmarkParsePacket(b *testing.B) {
+	frames := benchmarkFrames(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		ParsePacket(frames[i%len(frames)])
+	}
+
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "frames/s")
+}
+
+func TestDecoderStringLAU(t *testing.T) {
+	_, def := PgnList.First(126985)
+
+	for _, text := range []string{"Low oil pressure", "Öldruck niedrig"} {
+		b, err := def.Encode(DataMap{4: 1001, 9: "German", 10: text, 11: "Engine room"})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		msg := ParsePacket(&can.RawMessage{Pgn: 126985, Length: uint8(len(b)), Data: b})
+		if msg.Data[10] != text || msg.Data[11] != "Engine room" {
+			t.Errorf("ParsePacket(% x) = %v and %v, expected %v and Engine room", b, msg.Data[10], msg.Data[11], text)
+		}
+		if msg.Data[4] != uint64(1001) || msg.Data[9] != "German" {
+			t.Errorf("ParsePacket(% x) = %v, %v", b, msg.Data[4], msg.Data[9])
+		}
+	}
+}
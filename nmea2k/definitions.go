@@ -0,0 +1,495 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nmea2k
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/burntsushi/toml"
+)
+
+// User definition files have the same shape as Pgn and Field. They are either
+// a list of PGNs, as printed by argo -explain, or an object with the list
+// under "Pgns". In TOML use [[Pgns]] and [[Pgns.FieldList]] tables.
+//
+// Resolution is a number or the name of one of the RES_ constants, such as
+// "lookup" or "RES_LOOKUP". Units is a string, a list of {Value, Name}
+// objects or a table of names keyed by value, the last two giving a PgnLookup.
+// A table of such tables gives a PgnSubLookup. A lookup whose values are
+// unknown has null units. Definitions of PGN 0, the placeholder for unknown
+// PGNs, are skipped.
+type definitionFile struct {
+	Pgns []pgnDefinition
+}
+
+type pgnDefinition struct {
+	Description     string
+	Category        string
+	Pgn             *uint32
+	IsKnown         bool
+	Size            uint32
+	RepeatingFields uint32
+	FieldList       []fieldDefinition
+}
+
+type fieldDefinition struct {
+	Name        string
+	Size        uint32
+	Resolution  json.RawMessage
+	Signed      bool
+	Units       json.RawMessage
+	Description string
+	SignalkPath string
+	Offset      int32
+}
+
+var resolutionNames = map[string]float64{
+	"ascii":        RES_ASCII,
+	"latitude":     RES_LATITUDE,
+	"longitude":    RES_LONGITUDE,
+	"date":         RES_DATE,
+	"time":         RES_TIME,
+	"temperature":  RES_TEMPERATURE,
+	"6bitascii":    RES_6BITASCII,
+	"integer":      RES_INTEGER,
+	"lookup":       RES_LOOKUP,
+	"lookup2":      RES_LOOKUP2,
+	"binary":       RES_BINARY,
+	"manufacturer": RES_MANUFACTURER,
+	"string":       RES_STRING,
+	"float":        RES_FLOAT,
+	"pressure":     RES_PRESSURE,
+	"stringlz":     RES_STRINGLZ,
+	"stringlau":    RES_STRINGLAU,
+	"degrees":      RES_DEGREES,
+	"rotation":     RES_ROTATION,
+	"lat_long":     RES_LAT_LONG,
+	"lat_long_64":  RES_LAT_LONG_64,
+}
+
+// DefinitionConflict is reported when a user definition replaces another
+// definition with the same PGN and match field values.
+type DefinitionConflict struct {
+	File     string
+	Pgn      Pgn
+	Replaced Pgn
+	Origin   string // File the replaced definition came from, empty if built in
+}
+
+// DefinitionError is reported for a definition which cannot be used. The other
+// definitions in its file are still read.
+type DefinitionError struct {
+	File        string
+	Pgn         uint32
+	Description string
+	Err         error
+}
+
+func (e *DefinitionError) Error() string {
+	return fmt.Sprintf("%v: PGN %v %q: %v", e.File, e.Pgn, e.Description, e.Err)
+}
+
+// DefinitionErrors are the invalid definitions of a file.
+type DefinitionErrors []*DefinitionError
+
+func (errs DefinitionErrors) Error() string {
+	s := make([]string, len(errs))
+	for i, e := range errs {
+		s[i] = e.Error()
+	}
+	return strings.Join(s, "\n")
+}
+
+func (c *DefinitionConflict) Error() string {
+	origin := "built-in definition"
+	if c.Origin != "" {
+		origin = "definition from " + c.Origin
+	}
+
+	return fmt.Sprintf("%v: PGN %v %q replaces %v %q",
+		c.File, c.Pgn.Pgn, c.Pgn.Description, origin, c.Replaced.Description)
+}
+
+// ReadDefinitions reads the PGN definitions in a JSON or TOML file. If some of
+// the definitions are invalid the others are returned along with
+// DefinitionErrors listing them.
+func ReadDefinitions(path string) (PgnArray, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var file definitionFile
+
+	if strings.EqualFold(filepath.Ext(path), ".toml") {
+		// Decode generically and convert to JSON, so both formats share the
+		// handling of resolutions and lookups below
+		var tree map[string]interface{}
+		if _, err = toml.Decode(string(b), &tree); err == nil {
+			b, err = json.Marshal(tree)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", path, err)
+		}
+	}
+
+	if b = bytes.TrimSpace(b); len(b) > 0 && b[0] == '[' {
+		err = json.Unmarshal(b, &file.Pgns)
+	} else {
+		err = json.Unmarshal(b, &file)
+	}
+
+	if err != nil {
+		return nil, fmt.Errorf("%v: %v", path, err)
+	}
+
+	var pgns PgnArray
+	var errs DefinitionErrors
+
+	for _, d := range file.Pgns {
+		if d.Pgn != nil && *d.Pgn == 0 {
+			continue
+		}
+
+		p, err := d.pgn()
+		if err == nil {
+			err = p.Validate()
+		}
+		if err != nil {
+			errs = append(errs, &DefinitionError{path, p.Pgn, d.Description, err})
+			continue
+		}
+		pgns = append(pgns, p)
+	}
+
+	if len(errs) > 0 {
+		return pgns, errs
+	}
+
+	return pgns, nil
+}
+
+// LoadDefinitions merges user definitions over PgnList. The path may be a
+// single file or a directory, in which case every .json and .toml file in it
+// is read in alphabetical order. Files which cannot be read are skipped.
+// Read errors and conflicts are returned so they can be reported.
+func LoadDefinitions(path string) []error {
+	var errs []error
+
+	files := []string{path}
+
+	if info, err := os.Stat(path); err != nil {
+		return []error{err}
+	} else if info.IsDir() {
+		files = nil
+		for _, ext := range []string{"*.json", "*.toml"} {
+			m, _ := filepath.Glob(filepath.Join(path, ext))
+			files = append(files, m...)
+		}
+		sort.Strings(files)
+	}
+
+	origins := make(map[string]string)
+
+	for _, f := range files {
+		defs, err := ReadDefinitions(f)
+		if invalid, ok := err.(DefinitionErrors); ok {
+			for _, e := range invalid {
+				errs = append(errs, e)
+			}
+		} else if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		var conflicts []*DefinitionConflict
+		PgnList, conflicts = PgnList.Merge(defs)
+
+		for _, c := range conflicts {
+			c.File = f
+			c.Origin = origins[c.Pgn.key()]
+			errs = append(errs, c)
+		}
+
+		for _, p := range defs {
+			origins[p.key()] = f
+		}
+	}
+
+	return errs
+}
+
+// Merge returns a copy of the array with defs layered over it. A definition
+// replaces an existing one with the same PGN and match field values, such as
+// the manufacturer code, and the replacement is reported as a conflict. Other
+// definitions are added after the existing variants of their PGN, or in PGN
+// order if the PGN is new.
+func (pp PgnArray) Merge(defs PgnArray) (PgnArray, []*DefinitionConflict) {
+	var conflicts []*DefinitionConflict
+
+	merged := make(PgnArray, len(pp), len(pp)+len(defs))
+	copy(merged, pp)
+
+	for _, p := range defs {
+		k := p.key()
+		first, def := merged.First(p.Pgn)
+
+		if def.Pgn != p.Pgn {
+			i := 1
+			for i < len(merged) && merged[i].Pgn < p.Pgn {
+				i++
+			}
+			merged = append(merged, Pgn{})
+			copy(merged[i+1:], merged[i:])
+			merged[i] = p
+			continue
+		}
+
+		last, _ := merged.Last(p.Pgn)
+		replaced := false
+
+		for i := first; i <= last; i++ {
+			if merged[i].key() == k {
+				conflicts = append(conflicts, &DefinitionConflict{Pgn: p, Replaced: merged[i]})
+				merged[i] = p
+				replaced = true
+				break
+			}
+		}
+
+		if !replaced {
+			merged = append(merged, Pgn{})
+			copy(merged[last+2:], merged[last+1:])
+			merged[last+1] = p
+		}
+	}
+
+	return merged, conflicts
+}
+
+// Validate checks that a definition can be used to decode messages.
+func (p *Pgn) Validate() error {
+	if p.Pgn == 0 {
+		return fmt.Errorf("missing PGN")
+	}
+
+	if len(p.FieldList) == 0 {
+		return fmt.Errorf("no fields")
+	}
+
+	if int(p.RepeatingFields) > len(p.FieldList) {
+		return fmt.Errorf("%v repeating fields but only %v fields",
+			p.RepeatingFields, len(p.FieldList))
+	}
+
+	// The parameters repeated by group functions take the size of the field
+	// they refer to, so repeating fields may have a variable size
+	repeating := len(p.FieldList) - int(p.RepeatingFields)
+
+	for i, f := range p.FieldList {
+		if f.Name == "" {
+			return fmt.Errorf("field %v has no name", i)
+		}
+
+		switch f.Resolution {
+		case RES_STRINGLZ, RES_STRINGLAU, RES_STRING, RES_BINARY:
+		default:
+			if f.Size == LEN_VARIABLE && i < repeating {
+				return fmt.Errorf("field %q has no size", f.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// key identifies a definition by its PGN and the values of its match fields
+func (p *Pgn) key() string {
+	k := strconv.FormatUint(uint64(p.Pgn), 10)
+
+	for i := range p.FieldList {
+		if m, ok := p.FieldList[i].Match(); ok {
+			k += fmt.Sprintf(" %v=%v", i, m)
+		}
+	}
+
+	return k
+}
+
+func (d *pgnDefinition) pgn() (Pgn, error) {
+	p := Pgn{
+		Description:     d.Description,
+		Category:        d.Category,
+		IsKnown:         d.IsKnown,
+		Size:            d.Size,
+		RepeatingFields: d.RepeatingFields,
+	}
+
+	if d.Pgn == nil {
+		return p, fmt.Errorf("missing PGN")
+	}
+	p.Pgn = *d.Pgn
+
+	var bits uint32
+
+	for _, fd := range d.FieldList {
+		f := Field{
+			Name:        fd.Name,
+			Size:        fd.Size,
+			Signed:      fd.Signed,
+			Description: fd.Description,
+			SignalkPath: fd.SignalkPath,
+			Offset:      fd.Offset,
+		}
+
+		var err error
+
+		if f.Resolution, err = parseResolution(fd.Resolution); err != nil {
+			return p, fmt.Errorf("field %q: %v", fd.Name, err)
+		}
+
+		if f.Units, err = parseUnits(fd.Units); err != nil {
+			return p, fmt.Errorf("field %q: %v", fd.Name, err)
+		}
+
+		// A lookup must list its values, or have null units, as argo
+		// -explain prints lookups whose values are unknown
+		if f.Resolution == RES_LOOKUP && len(fd.Units) == 0 {
+			return p, fmt.Errorf("field %q is a lookup without values", fd.Name)
+		}
+
+		bits += f.Size
+		p.FieldList = append(p.FieldList, f)
+	}
+
+	// The size decides whether the PGN is sent as a fast packet
+	if p.Size == 0 {
+		p.Size = (bits + 7) / 8
+	}
+
+	return p, nil
+}
+
+func parseResolution(raw json.RawMessage) (float64, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return 1, nil
+	}
+
+	var n float64
+	if err := json.Unmarshal(raw, &n); err == nil {
+		return n, nil
+	}
+
+	var s string
+	if err := json.Unmarshal(raw, &s); err != nil {
+		return 0, fmt.Errorf("invalid resolution %s", raw)
+	}
+
+	name := strings.TrimPrefix(strings.ToLower(strings.TrimSpace(s)), "res_")
+	if n, ok := resolutionNames[name]; ok {
+		return n, nil
+	}
+
+	if n, err := strconv.ParseFloat(s, 64); err == nil {
+		return n, nil
+	}
+
+	return 0, fmt.Errorf("unknown resolution %q", s)
+}
+
+func parseUnits(raw json.RawMessage) (interface{}, error) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return nil, nil
+	}
+
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		if s == "" {
+			return nil, nil
+		}
+		return s, nil
+	}
+
+	if lookup, err := parseLookup(raw); err == nil {
+		return lookup, nil
+	}
+
+	var tables map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &tables); err == nil {
+		sub := make(PgnSubLookup, len(tables))
+		for k, t := range tables {
+			n, err := strconv.Atoi(k)
+			if err != nil {
+				return nil, fmt.Errorf("lookup value %q is not a number", k)
+			}
+			if sub[n], err = parseLookup(t); err != nil {
+				return nil, err
+			}
+		}
+		return sub, nil
+	}
+
+	// Built-in definitions sometimes have a number here, which means nothing
+	var n float64
+	if err := json.Unmarshal(raw, &n); err == nil {
+		return nil, nil
+	}
+
+	return nil, fmt.Errorf("invalid units %s", raw)
+}
+
+// parseLookup reads a list of {Value, Name} objects or a table of names keyed
+// by value.
+func parseLookup(raw json.RawMessage) (PgnLookup, error) {
+	var list []struct {
+		Value int
+		Name  string
+	}
+	if err := json.Unmarshal(raw, &list); err == nil {
+		lookup := make(PgnLookup, len(list))
+		for _, v := range list {
+			lookup[v.Value] = v.Name
+		}
+		return lookup, nil
+	}
+
+	var table map[string]string
+	if err := json.Unmarshal(raw, &table); err != nil {
+		return nil, fmt.Errorf("invalid lookup %s", raw)
+	}
+
+	lookup := make(PgnLookup, len(table))
+	for k, v := range table {
+		n, err := strconv.Atoi(k)
+		if err != nil {
+			return nil, fmt.Errorf("lookup value %q is not a number", k)
+		}
+		lookup[n] = v
+	}
+	return lookup, nil
+}
@@ -0,0 +1,219 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nmea2k
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/timmathews/argo/can"
+)
+
+const acmePumpToml = `
+[[Pgns]]
+Description = "Acme: Bilge Pump"
+Category = "Acme"
+Pgn = 65285
+
+  [[Pgns.FieldList]]
+  Name = "Manufacturer Code"
+  Size = 11
+  Resolution = "manufacturer"
+  Units = "=999"
+
+  [[Pgns.FieldList]]
+  Name = "Reserved"
+  Size = 2
+
+  [[Pgns.FieldList]]
+  Name = "Industry Code"
+  Size = 3
+  Resolution = "RES_LOOKUP"
+  [Pgns.FieldList.Units]
+  4 = "Marine Industry"
+
+  [[Pgns.FieldList]]
+  Name = "Pump State"
+  Size = 8
+  Resolution = "lookup"
+  [Pgns.FieldList.Units]
+  0 = "Off"
+  1 = "On"
+
+  [[Pgns.FieldList]]
+  Name = "Run Time"
+  Size = 16
+  Units = "s"
+`
+
+const waterDepthJson = `[{
+  "Description": "Water Depth",
+  "Category": "Navigation",
+  "Pgn": 128267,
+  "IsKnown": true,
+  "FieldList": [
+    {"Name": "SID", "Size": 8, "Resolution": 1},
+    {"Name": "Depth", "Size": 32, "Resolution": 0.001, "Units": "m"},
+    {"Name": "Offset", "Size": 16, "Resolution": 0.001, "Signed": true, "Units": "m"}
+  ]
+}]`
+
+func writeDefinitions(t *testing.T) string {
+	dir, err := ioutil.TempDir("", "argo")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for name, s := range map[string]string{"acme.toml": acmePumpToml, "depth.json": waterDepthJson} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(s), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return dir
+}
+
+func TestLoadDefinitions(t *testing.T) {
+	dir := writeDefinitions(t)
+	defer os.RemoveAll(dir)
+
+	builtin := PgnList
+	defer func() { PgnList = builtin }()
+
+	errs := LoadDefinitions(dir)
+
+	// The depth definition replaces the built-in one, the pump is a new variant
+	if len(errs) != 1 {
+		t.Fatalf("LoadDefinitions() = %v, expected one conflict", errs)
+	}
+	if c, ok := errs[0].(*DefinitionConflict); !ok || c.Pgn.Pgn != 128267 || c.Origin != "" {
+		t.Errorf("LoadDefinitions() = %v, expected a conflict with built-in PGN 128267", errs[0])
+	}
+
+	if len(PgnList) != len(builtin)+1 {
+		t.Errorf("len(PgnList) = %v, expected %v", len(PgnList), len(builtin)+1)
+	}
+
+	first, _ := PgnList.First(65285)
+	last, def := PgnList.Last(65285)
+	if last-first != 2 || def.Description != "Acme: Bilge Pump" {
+		t.Errorf("PgnList[%v] = %q, expected the new variant after the built-in ones", last, def.Description)
+	}
+
+	if _, def := PgnList.First(128267); def.FieldList[1].Resolution != 0.001 {
+		t.Errorf("128267 Depth resolution = %v, expected 0.001", def.FieldList[1].Resolution)
+	}
+
+	// Decode and encode a message using the user definition
+	data := []byte{0xE7, 0x9B, 0x01, 0x2C, 0x01, 0xFF, 0xFF, 0xFF}
+	msg := ParsePacket(&can.RawMessage{Pgn: 65285, Data: data})
+
+	if msg.Index != last || msg.Data[3] != "On" || msg.Data[4] != uint64(300) {
+		t.Errorf("ParsePacket() = %v %v, expected On and 300s", msg.Index, msg.Data)
+	}
+
+	b, err := def.Encode(DataMap{0: 999, 1: 3, 2: "Marine Industry", 3: "On", 4: 300})
+	if err != nil || !bytes.Equal(b, data) {
+		t.Errorf("Encode() = % x, %v, expected % x", b, err, data)
+	}
+}
+
+func TestReadDefinitionsInvalid(t *testing.T) {
+	f, err := ioutil.TempFile("", "argo*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString(`{"Pgns": [{"Pgn": 65000, "FieldList": [{"Name": "State", "Size": 2, "Resolution": "lookup"}]}]}`)
+	f.Close()
+
+	if _, err := ReadDefinitions(f.Name()); err == nil {
+		t.Error("ReadDefinitions() accepted a lookup without values")
+	}
+}
+
+func TestReadDefinitionsExplain(t *testing.T) {
+	f, err := ioutil.TempFile("", "argo*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	// As printed by argo -explain
+	b, _ := json.MarshalIndent(PgnList, "", "  ")
+	f.Write(b)
+	f.Close()
+
+	defs, err := ReadDefinitions(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The placeholder for unknown PGNs is skipped
+	if len(defs) != len(PgnList)-1 {
+		t.Fatalf("len(ReadDefinitions()) = %v, expected %v", len(defs), len(PgnList)-1)
+	}
+
+	for i, def := range defs {
+		p := PgnList[i+1]
+		p.FieldList = append([]Field(nil), p.FieldList...)
+
+		// Numeric units mean nothing and are not read back
+		for j := range p.FieldList {
+			if _, ok := p.FieldList[j].Units.(int); ok {
+				p.FieldList[j].Units = nil
+			}
+		}
+
+		if !reflect.DeepEqual(def, p) {
+			t.Errorf("ReadDefinitions()[%v] = %+v, expected %+v", i, def, p)
+		}
+	}
+}
+
+func TestReadDefinitionsPartial(t *testing.T) {
+	f, err := ioutil.TempFile("", "argo*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+
+	f.WriteString(`[
+  {"Pgn": 65000, "FieldList": [{"Name": "State", "Size": 2, "Resolution": "lookup"}]},
+  {"Description": "No PGN", "FieldList": [{"Name": "State", "Size": 8}]},
+  {"Pgn": 65001, "FieldList": [{"Name": "State", "Size": 8}]}
+]`)
+	f.Close()
+
+	defs, err := ReadDefinitions(f.Name())
+	if errs, ok := err.(DefinitionErrors); !ok || len(errs) != 2 || errs[0].Pgn != 65000 {
+		t.Errorf("ReadDefinitions() = %v, expected errors for two definitions", err)
+	}
+
+	if len(defs) != 1 || defs[0].Pgn != 65001 {
+		t.Errorf("ReadDefinitions() = %+v, expected PGN 65001", defs)
+	}
+}
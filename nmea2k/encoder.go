@@ -0,0 +1,374 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nmea2k
+
+import (
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+	"unicode/utf16"
+)
+
+type EncodeError struct {
+	Field string
+	Value interface{}
+	Why   string
+}
+
+func (e *EncodeError) Error() string {
+	return fmt.Sprintf("cannot encode %v as %s: %s", e.Value, e.Field, e.Why)
+}
+
+// Encode packs a DataMap into the payload of a PGN using this definition. It
+// is the inverse of ParsePacket: fixed fields are read from their index and
+// repeated sets from a RepeatingGroup stored under the first repeating field.
+// Missing fields are sent as "data not available".
+func (p *Pgn) Encode(data DataMap) ([]byte, error) {
+	var buf []byte
+	var pos uint32
+	var err error
+
+	rpt := p.FirstRepeatingField()
+	last := len(p.FieldList)
+	if rpt >= 0 {
+		last = rpt
+	}
+
+	for i := 0; i < last; i++ {
+		buf, pos, err = p.encodeField(buf, pos, i, data)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	if rpt >= 0 {
+		if grp, ok := data[rpt].(RepeatingGroup); ok {
+			for _, rec := range grp.Records {
+				fields := make(DataMap, len(data)+len(rec))
+				for k, v := range data {
+					if k < rpt {
+						fields[k] = v
+					}
+				}
+				for k, v := range rec {
+					fields[k] = v
+				}
+
+				for i := rpt; i < len(p.FieldList); i++ {
+					buf, pos, err = p.encodeField(buf, pos, i, fields)
+					if err != nil {
+						return nil, err
+					}
+				}
+			}
+		}
+	}
+
+	// Single frame PGNs are always sent as eight bytes, padded with ones,
+	// and so are the bits left over in the last byte
+	if pos%8 != 0 {
+		buf = putBits(buf, pos, 8-pos%8, 0xFF)
+	}
+	for len(buf) < 8 && p.Size <= 8 {
+		buf = append(buf, 0xFF)
+	}
+
+	return buf, nil
+}
+
+func (p *Pgn) encodeField(buf []byte, pos uint32, i int, data DataMap) ([]byte, uint32, error) {
+	field := &p.FieldList[i]
+	v := data[i]
+
+	switch field.Resolution {
+	case RES_STRINGLZ:
+		s := fmt.Sprintf("%v", v)
+		if v == nil {
+			s = ""
+		}
+		// The length byte counts itself
+		b := append([]byte{byte(len(s) + 1)}, s...)
+		buf = putBytes(buf, pos, b)
+		return buf, pos + uint32(len(b))*8, nil
+	case RES_STRINGLAU:
+		s := fmt.Sprintf("%v", v)
+		if v == nil {
+			s = ""
+		}
+		b := stringLAU(s)
+		buf = putBytes(buf, pos, b)
+		return buf, pos + uint32(len(b))*8, nil
+	case RES_ASCII, RES_STRING:
+		n := (field.Size + 7) / 8
+		b := make([]byte, n)
+		for j := range b {
+			b[j] = 0xFF
+		}
+		if s, ok := v.(string); ok {
+			copy(b, s)
+		}
+		buf = putBytes(buf, pos, b)
+		return buf, pos + field.Size, nil
+	case RES_BINARY:
+		if b, ok := v.([]byte); ok {
+			n := (field.Size + 7) / 8
+			if field.Size == LEN_VARIABLE {
+				n = uint32(len(b))
+			}
+			raw := make([]byte, n)
+			copy(raw, b)
+			buf = putBytes(buf, pos, raw)
+			return buf, pos + n*8, nil
+		}
+	}
+
+	if field.Size == LEN_VARIABLE {
+		return buf, pos, nil
+	}
+
+	if field.Size > 64 {
+		return nil, pos, &EncodeError{field.Name, v, "field too wide"}
+	}
+
+	if m, ok := field.Match(); ok && v == nil {
+		v = m
+	}
+
+	n, err := EncodeValue(field, v, data)
+	if err != nil {
+		return nil, pos, err
+	}
+
+	return putBits(buf, pos, field.Size, n), pos + field.Size, nil
+}
+
+// EncodeValue converts a decoded value back into the raw bits of a field. It
+// accepts the same types ParsePacket produces, as well as plain numbers and
+// lookup names. The DataMap is only used to resolve RES_LOOKUP2 fields, which
+// depend on the value of another field, and may be nil.
+func EncodeValue(field *Field, v interface{}, data DataMap) (uint64, error) {
+	mask := ^uint64(0) >> (64 - field.Size)
+
+	if v == nil {
+		if field.Signed {
+			return mask >> 1, nil
+		}
+		return mask, nil
+	}
+
+	// Integers as wide as a NAME do not survive a float64
+	if n, ok := v.(uint64); ok && (field.Resolution == RES_INTEGER || field.Resolution == 1) {
+		return n & mask, nil
+	}
+
+	var num float64
+	var err error
+
+	switch field.Resolution {
+	case RES_LOOKUP, RES_MANUFACTURER, RES_LOOKUP2:
+		num, err = lookupValue(field, v, data)
+	case RES_LATITUDE, RES_LONGITUDE:
+		num, err = toFloat(v)
+		if field.Size == 64 {
+			num *= 1e16
+		} else {
+			num *= 1e7
+		}
+	case RES_DATE:
+		if t, ok := v.(time.Time); ok {
+			num = float64(t.Unix() / 86400)
+		} else {
+			num, err = toFloat(v)
+		}
+	case RES_TIME:
+		if t, ok := v.(time.Time); ok {
+			s := t.Hour()*3600 + t.Minute()*60 + t.Second()
+			num = float64(s)*10000 + float64(t.Nanosecond()/10000)
+		} else {
+			num, err = toFloat(v)
+			num *= 10000
+		}
+	case RES_TEMPERATURE:
+		num, err = toFloat(v)
+		num *= 100
+	case RES_PRESSURE:
+		num, err = toFloat(v)
+		num *= 1000
+	case RES_FLOAT:
+		var f float64
+		f, err = toFloat(v)
+		return uint64(math.Float32bits(float32(f))) & mask, err
+	case RES_INTEGER, RES_BINARY, RES_NOTUSED, 1:
+		// Some integer fields carry a lookup table without being RES_LOOKUP
+		num, err = lookupValue(field, v, data)
+	default:
+		if field.Resolution < 0 {
+			return 0, &EncodeError{field.Name, v, "unsupported field type"}
+		}
+		num, err = toFloat(v)
+		num /= field.Resolution
+	}
+
+	if err != nil {
+		return 0, &EncodeError{field.Name, v, err.Error()}
+	}
+
+	num = math.Floor(num + 0.5)
+
+	if field.Signed {
+		return uint64(int64(num)) & mask, nil
+	}
+
+	if num < 0 {
+		return 0, &EncodeError{field.Name, v, "negative value for unsigned field"}
+	}
+
+	return uint64(num) & mask, nil
+}
+
+// lookupValue finds the numeric value of a lookup name. Numbers are passed
+// through unchanged.
+func lookupValue(field *Field, v interface{}, data DataMap) (float64, error) {
+	s, ok := v.(string)
+	if !ok {
+		return toFloat(v)
+	}
+
+	var table PgnLookup
+
+	switch u := field.Units.(type) {
+	case PgnLookup:
+		table = u
+	case PgnSubLookup:
+		super, err := toFloat(data[int(field.Offset)])
+		if err != nil {
+			return 0, err
+		}
+		table = u[int(super)]
+	}
+
+	if field.Resolution == RES_MANUFACTURER && table == nil {
+		table = lookupCompanyCode
+	}
+
+	for k, name := range table {
+		if strings.EqualFold(name, s) {
+			return float64(k), nil
+		}
+	}
+
+	return toFloat(s)
+}
+
+// toFloat converts any of the numeric types produced by the decoder, or a
+// numeric string, to a float64.
+func toFloat(v interface{}) (float64, error) {
+	switch n := v.(type) {
+	case float64:
+		return n, nil
+	case float32:
+		return float64(n), nil
+	case int:
+		return float64(n), nil
+	case int8:
+		return float64(n), nil
+	case int16:
+		return float64(n), nil
+	case int32:
+		return float64(n), nil
+	case int64:
+		return float64(n), nil
+	case uint:
+		return float64(n), nil
+	case uint8:
+		return float64(n), nil
+	case uint16:
+		return float64(n), nil
+	case uint32:
+		return float64(n), nil
+	case uint64:
+		return float64(n), nil
+	case bool:
+		if n {
+			return 1, nil
+		}
+		return 0, nil
+	case string:
+		return strconv.ParseFloat(strings.TrimSpace(n), 64)
+	}
+
+	return 0, fmt.Errorf("%T is not a number", v)
+}
+
+// putBits writes the low width bits of v into buf at bit offset pos, least
+// significant bit first, growing buf as needed.
+func putBits(buf []byte, pos, width uint32, v uint64) []byte {
+	for need := int((pos + width + 7) / 8); len(buf) < need; {
+		buf = append(buf, 0)
+	}
+
+	for i := uint32(0); i < width; i++ {
+		byt := (pos + i) / 8
+		bit := (pos + i) % 8
+		if v&(1<<i) != 0 {
+			buf[byt] |= 1 << bit
+		} else {
+			buf[byt] &^= 1 << bit
+		}
+	}
+
+	return buf
+}
+
+// putBytes writes b into buf at bit offset pos
+func putBytes(buf []byte, pos uint32, b []byte) []byte {
+	for i, byt := range b {
+		buf = putBits(buf, pos+uint32(i)*8, 8, uint64(byt))
+	}
+
+	return buf
+}
+
+// stringLAU encodes text with a length byte and an encoding byte. Text
+// which is all ASCII is sent as ASCII, anything else as UTF-16.
+func stringLAU(s string) []byte {
+	b := []byte{0, 1}
+
+	for _, r := range s {
+		if r > unicode.MaxASCII {
+			b[1] = 0
+			break
+		}
+	}
+
+	if b[1] == 1 {
+		b = append(b, s...)
+	} else {
+		for _, u := range utf16.Encode([]rune(s)) {
+			b = append(b, byte(u), byte(u>>8))
+		}
+	}
+	b[0] = byte(len(b))
+
+	return b
+}
@@ -0,0 +1,623 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nmea2k
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/timmathews/argo/can"
+)
+
+const GroupFunctionPgn = 126208
+
+// Group function codes
+const (
+	GroupFunctionRequest uint8 = iota
+	GroupFunctionCommand
+	GroupFunctionAcknowledge
+)
+
+// PGN error codes of the Acknowledge group function
+const (
+	PgnErrorNone uint8 = iota
+	PgnErrorNotSupported
+	PgnErrorNotAvailable
+	PgnErrorAccessDenied
+	PgnErrorRequestNotSupported
+	PgnErrorTagNotSupported
+	PgnErrorReadWriteNotSupported
+)
+
+// Transmission interval/priority error codes of the Acknowledge group function
+const (
+	IntervalErrorNone uint8 = iota
+	IntervalErrorNotSupported
+	IntervalErrorTooLow
+	IntervalErrorAccessDenied
+	IntervalErrorRequestNotSupported
+)
+
+// IsoAcknowledgementPgn is the PGN devices answer an ISO Request with when
+// they will not send the requested PGN.
+const IsoAcknowledgementPgn = 59392
+
+// Control codes of the ISO Acknowledgement
+const (
+	IsoAck uint8 = iota
+	IsoNak
+	IsoAccessDenied
+	IsoAddressBusy
+)
+
+// Parameter error codes of the Acknowledge group function
+const (
+	ParameterErrorNone uint8 = iota
+	ParameterErrorInvalidField
+	ParameterErrorTemporary
+	ParameterErrorOutOfRange
+	ParameterErrorAccessDenied
+	ParameterErrorNotSupported
+	ParameterErrorReadWriteNotSupported
+)
+
+// Leave the transmission interval or priority of a PGN unchanged
+const (
+	IntervalUnchanged = 0xFFFFFFFF
+	PriorityUnchanged = 8
+)
+
+// GroupFunctionParameter is one field of the target PGN in a Request or
+// Command group function. Field is the index of the field in the PGN
+// definition, the same as in a DataMap. On the bus fields are numbered from 1.
+type GroupFunctionParameter struct {
+	Field int
+	Value interface{}
+}
+
+// GroupFunction is a decoded NMEA 2000 group function (PGN 126208). Request
+// asks a device to send a PGN, optionally only if its fields match the
+// parameters. Command asks a device to change fields of a PGN, for example
+// an instance or an offset. Acknowledge is the reply to either, carrying an
+// error code for the PGN and one for each parameter.
+type GroupFunction struct {
+	Function        uint8
+	Pgn             uint32
+	Interval        uint32 // Request only, in milliseconds
+	IntervalOffset  uint16 // Request only, in milliseconds
+	Priority        uint8  // Command only
+	Parameters      []GroupFunctionParameter
+	PgnError        uint8   // Acknowledge only
+	IntervalError   uint8   // Acknowledge only
+	ParameterErrors []uint8 // Acknowledge only
+}
+
+// NewRequest builds a Request group function for pgn. If parameters are
+// given, the device only responds if the fields of the PGN match them.
+func NewRequest(pgn uint32, params ...GroupFunctionParameter) *GroupFunction {
+	return &GroupFunction{
+		Function:   GroupFunctionRequest,
+		Pgn:        pgn,
+		Interval:   IntervalUnchanged,
+		Parameters: params,
+	}
+}
+
+// NewCommand builds a Command group function which sets the given fields of
+// pgn on the receiving device.
+func NewCommand(pgn uint32, params ...GroupFunctionParameter) *GroupFunction {
+	return &GroupFunction{
+		Function:   GroupFunctionCommand,
+		Pgn:        pgn,
+		Priority:   PriorityUnchanged,
+		Parameters: params,
+	}
+}
+
+// Acknowledge builds a positive Acknowledge group function in response to a
+// Request or Command. Error codes can be set on the result before sending.
+func (gf *GroupFunction) Acknowledge() *GroupFunction {
+	return &GroupFunction{
+		Function:        GroupFunctionAcknowledge,
+		Pgn:             gf.Pgn,
+		ParameterErrors: make([]uint8, len(gf.Parameters)),
+	}
+}
+
+// Err returns nil if an Acknowledge group function reports success, or an
+// error describing the PGN and parameter error codes.
+func (gf *GroupFunction) Err() error {
+	if gf.Function != GroupFunctionAcknowledge {
+		return nil
+	}
+
+	msg := ""
+
+	if gf.PgnError != PgnErrorNone {
+		msg += fmt.Sprintf("; %v", lookupPgnErrorCode[int(gf.PgnError)])
+	}
+
+	if gf.IntervalError != IntervalErrorNone {
+		msg += fmt.Sprintf("; %v", lookupTransmissionIntervalErrorCode[int(gf.IntervalError)])
+	}
+
+	for i, e := range gf.ParameterErrors {
+		if e != ParameterErrorNone {
+			msg += fmt.Sprintf("; parameter %v: %v", i+1, lookupParameterErrorCode[int(e)])
+		}
+	}
+
+	if msg == "" {
+		return nil
+	}
+
+	return fmt.Errorf("PGN %v%s", gf.Pgn, msg)
+}
+
+// target returns the definition of the PGN the group function refers to,
+// using the parameters to pick a proprietary variant.
+func (gf *GroupFunction) target() Pgn {
+	data := make(DataMap, len(gf.Parameters))
+	for _, p := range gf.Parameters {
+		data[p.Field] = p.Value
+	}
+
+	_, def := PgnList.Resolve(gf.Pgn, data)
+
+	return def
+}
+
+// Encode packs the group function into the payload of PGN 126208.
+func (gf *GroupFunction) Encode() ([]byte, error) {
+	buf := []byte{gf.Function, byte(gf.Pgn), byte(gf.Pgn >> 8), byte(gf.Pgn >> 16)}
+
+	switch gf.Function {
+	case GroupFunctionRequest:
+		buf = append(buf,
+			byte(gf.Interval), byte(gf.Interval>>8), byte(gf.Interval>>16), byte(gf.Interval>>24),
+			byte(gf.IntervalOffset), byte(gf.IntervalOffset>>8))
+	case GroupFunctionCommand:
+		buf = append(buf, gf.Priority&0x0F|0xF0)
+	case GroupFunctionAcknowledge:
+		buf = append(buf, gf.PgnError&0x0F|gf.IntervalError<<4, byte(len(gf.ParameterErrors)))
+		for i, e := range gf.ParameterErrors {
+			if i%2 == 0 {
+				buf = append(buf, e&0x0F|0xF0)
+			} else {
+				buf[len(buf)-1] = buf[len(buf)-1]&0x0F | e<<4
+			}
+		}
+		return pad(buf), nil
+	default:
+		return nil, fmt.Errorf("unknown group function %v", gf.Function)
+	}
+
+	def := gf.target()
+
+	buf = append(buf, byte(len(gf.Parameters)))
+
+	for _, p := range gf.Parameters {
+		if p.Field < 0 || p.Field >= len(def.FieldList) {
+			return nil, fmt.Errorf("field %v out of range for PGN %v", p.Field, gf.Pgn)
+		}
+
+		b, err := encodeParameter(&def.FieldList[p.Field], p.Value)
+		if err != nil {
+			return nil, err
+		}
+
+		buf = append(buf, byte(p.Field+1))
+		buf = append(buf, b...)
+	}
+
+	return pad(buf), nil
+}
+
+// Message wraps the group function in a CAN message addressed to dst.
+func (gf *GroupFunction) Message(dst uint8) (*can.RawMessage, error) {
+	b, err := gf.Encode()
+	if err != nil {
+		return nil, err
+	}
+
+	return &can.RawMessage{
+		Timestamp:   time.Now(),
+		Priority:    3,
+		Pgn:         GroupFunctionPgn,
+		Destination: dst,
+		Length:      uint8(len(b)),
+		Data:        b,
+	}, nil
+}
+
+// DecodeGroupFunction unpacks the payload of PGN 126208. Parameter values are
+// decoded using the field definitions of the PGN they refer to.
+func DecodeGroupFunction(data []byte) (*GroupFunction, error) {
+	if len(data) < 5 {
+		return nil, &DecodeError{data, "Group function too short"}
+	}
+
+	gf := &GroupFunction{
+		Function: data[0],
+		Pgn:      uint32(data[1]) | uint32(data[2])<<8 | uint32(data[3])<<16,
+	}
+
+	var pos int
+
+	switch gf.Function {
+	case GroupFunctionRequest:
+		if len(data) < 11 {
+			return nil, &DecodeError{data, "Request group function too short"}
+		}
+		gf.Interval = uint32(data[4]) | uint32(data[5])<<8 | uint32(data[6])<<16 | uint32(data[7])<<24
+		gf.IntervalOffset = uint16(data[8]) | uint16(data[9])<<8
+		pos = 10
+	case GroupFunctionCommand:
+		gf.Priority = data[4] & 0x0F
+		pos = 5
+	case GroupFunctionAcknowledge:
+		gf.PgnError = data[4] & 0x0F
+		gf.IntervalError = data[4] >> 4
+		if len(data) < 6 {
+			return gf, nil
+		}
+		n := int(data[5])
+		for i := 0; i < n && 6+i/2 < len(data); i++ {
+			b := data[6+i/2]
+			if i%2 == 0 {
+				gf.ParameterErrors = append(gf.ParameterErrors, b&0x0F)
+			} else {
+				gf.ParameterErrors = append(gf.ParameterErrors, b>>4)
+			}
+		}
+		return gf, nil
+	default:
+		return nil, &DecodeError{data, "Unknown group function"}
+	}
+
+	if pos >= len(data) {
+		return nil, &DecodeError{data, "Group function parameter count missing"}
+	}
+
+	n := int(data[pos])
+	pos++
+
+	// Proprietary PGNs carry their match fields as the first parameters, so
+	// resolve the definition again as each parameter is decoded
+	_, def := PgnList.First(gf.Pgn)
+	values := make(DataMap, n)
+
+	for i := 0; i < n; i++ {
+		if pos >= len(data) {
+			return nil, &DecodeError{data, "Group function parameters truncated"}
+		}
+
+		idx := int(data[pos]) - 1
+		pos++
+
+		if idx < 0 || idx >= len(def.FieldList) {
+			return nil, &DecodeError{data, fmt.Sprintf("No field %v in PGN %v", idx+1, gf.Pgn)}
+		}
+
+		v, size, err := decodeParameter(&def, idx, data[pos:])
+		if err != nil {
+			return nil, err
+		}
+		pos += size
+
+		gf.Parameters = append(gf.Parameters, GroupFunctionParameter{idx, v})
+		values[idx] = v
+		_, def = PgnList.Resolve(gf.Pgn, values)
+	}
+
+	return gf, nil
+}
+
+// GroupFunctionFromMessage decodes the group function carried by a parsed 126208
+// message.
+func GroupFunctionFromMessage(msg *ParsedMessage) (*GroupFunction, error) {
+	if msg.Header.Pgn != GroupFunctionPgn {
+		return nil, fmt.Errorf("PGN %v is not a group function", msg.Header.Pgn)
+	}
+
+	return DecodeGroupFunction(msg.Header.Data)
+}
+
+// parameterSize is the number of bytes a field takes up as a group function
+// parameter. Values are always padded to whole bytes.
+func parameterSize(field *Field) int {
+	return int(field.Size+7) / 8
+}
+
+func encodeParameter(field *Field, v interface{}) ([]byte, error) {
+	switch field.Resolution {
+	case RES_ASCII, RES_STRING, RES_STRINGLZ, RES_STRINGLAU:
+		s, _ := v.(string)
+		if field.Resolution == RES_STRINGLZ {
+			return append([]byte{byte(len(s) + 1)}, s...), nil
+		}
+		if field.Resolution == RES_STRINGLAU {
+			return stringLAU(s), nil
+		}
+		b := make([]byte, parameterSize(field))
+		for i := range b {
+			b[i] = 0xFF
+		}
+		copy(b, s)
+		return b, nil
+	}
+
+	if field.Size == LEN_VARIABLE || field.Size > 64 {
+		return nil, &EncodeError{field.Name, v, "field cannot be used as a parameter"}
+	}
+
+	n, err := EncodeValue(field, v, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	b := make([]byte, parameterSize(field))
+	for i := range b {
+		b[i] = byte(n >> uint(8*i))
+	}
+
+	return b, nil
+}
+
+func decodeParameter(def *Pgn, idx int, data []byte) (interface{}, int, error) {
+	field := def.FieldList[idx]
+	size := parameterSize(&field)
+
+	if (field.Resolution == RES_STRINGLZ || field.Resolution == RES_STRINGLAU) && len(data) > 0 {
+		size = int(data[0])
+	}
+
+	if size == 0 || size > len(data) {
+		return nil, 0, &DecodeError{data, fmt.Sprintf("Parameter %v truncated", field.Name)}
+	}
+
+	raw := RawMessage{&can.RawMessage{Data: data[:size]}}
+
+	// RES_LOOKUP2 fields depend on another field, which is not part of the
+	// parameter, so pass them on as plain numbers
+	if field.Resolution == RES_LOOKUP2 {
+		field.Resolution = RES_INTEGER
+	}
+
+	bits := field.Size
+	if bits > uint32(size*8) {
+		bits = uint32(size * 8)
+	}
+
+	v, err := raw.extractField(def, &field, 0, uint32(size), 0, bits)
+
+	return v, size, err
+}
+
+// pad fills a group function out to a full single frame
+func pad(buf []byte) []byte {
+	for len(buf) < 8 {
+		buf = append(buf, 0xFF)
+	}
+
+	return buf
+}
+
+// IsoAcknowledgement is the answer of a device to an ISO Request for a PGN it
+// will not send.
+type IsoAcknowledgement struct {
+	Control uint8
+	Pgn     uint32
+}
+
+// DecodeIsoAcknowledgement decodes the data of an ISO Acknowledgement.
+func DecodeIsoAcknowledgement(data []byte) (*IsoAcknowledgement, error) {
+	if len(data) < 8 {
+		return nil, fmt.Errorf("ISO Acknowledgement is %v bytes long, expected 8", len(data))
+	}
+
+	return &IsoAcknowledgement{
+		Control: data[0],
+		Pgn:     uint32(data[5]) | uint32(data[6])<<8 | uint32(data[7])<<16,
+	}, nil
+}
+
+// Err returns an error describing a negative acknowledgement, nil otherwise.
+func (a *IsoAcknowledgement) Err() error {
+	if a.Control == IsoAck {
+		return nil
+	}
+
+	if s, ok := lookupIsoAckResults[int(a.Control)]; ok {
+		return fmt.Errorf("PGN %v; %v", a.Pgn, s)
+	}
+
+	return fmt.Errorf("PGN %v; control code %v", a.Pgn, a.Control)
+}
+
+// GroupFunctionResponse is how a device answered a group function. Devices
+// answer Commands, and failed Requests, with an Acknowledge group function.
+// A successful Request is answered with the requested PGN itself, a refused
+// ISO Request with an ISO Acknowledgement.
+type GroupFunctionResponse struct {
+	Acknowledge        *GroupFunction
+	IsoAcknowledgement *IsoAcknowledgement
+	Message            *ParsedMessage
+}
+
+// GroupFunctionTracker matches the responses of other devices with the group
+// functions Argo sent to them. Every received message should be passed to
+// Receive.
+type GroupFunctionTracker struct {
+	mu      sync.Mutex
+	pending map[*PendingGroupFunction]bool
+}
+
+// PendingGroupFunction is a group function awaiting its response.
+type PendingGroupFunction struct {
+	tracker *GroupFunctionTracker
+	dst     uint8
+	gf      *GroupFunction
+	ch      chan GroupFunctionResponse
+}
+
+var ErrGroupFunctionTimeout = errors.New("timed out waiting for group function response")
+
+func NewGroupFunctionTracker() *GroupFunctionTracker {
+	return &GroupFunctionTracker{
+		pending: make(map[*PendingGroupFunction]bool),
+	}
+}
+
+// Expect registers interest in the response of device dst to gf. It must be
+// called before the group function is sent, so the response cannot be missed.
+func (t *GroupFunctionTracker) Expect(dst uint8, gf *GroupFunction) *PendingGroupFunction {
+	p := &PendingGroupFunction{
+		tracker: t,
+		dst:     dst,
+		gf:      gf,
+		ch:      make(chan GroupFunctionResponse, 1),
+	}
+
+	t.mu.Lock()
+	t.pending[p] = true
+	t.mu.Unlock()
+
+	return p
+}
+
+// Receive checks a received message against the pending group functions.
+func (t *GroupFunctionTracker) Receive(msg *ParsedMessage) {
+	var ack *GroupFunction
+	var isoAck *IsoAcknowledgement
+
+	switch msg.Header.Pgn {
+	case GroupFunctionPgn:
+		gf, err := GroupFunctionFromMessage(msg)
+		if err != nil || gf.Function != GroupFunctionAcknowledge {
+			return
+		}
+		ack = gf
+	case IsoAcknowledgementPgn:
+		a, err := DecodeIsoAcknowledgement(msg.Header.Data)
+		if err != nil {
+			return
+		}
+		isoAck = a
+	}
+
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	for p := range t.pending {
+		if p.dst != msg.Header.Source && p.dst != 255 {
+			continue
+		}
+
+		var res GroupFunctionResponse
+
+		if ack != nil && ack.Pgn == p.gf.Pgn {
+			res.Acknowledge = ack
+		} else if isoAck != nil && p.gf.Function == GroupFunctionRequest && isoAck.Pgn == p.gf.Pgn {
+			res.IsoAcknowledgement = isoAck
+		} else if ack == nil && isoAck == nil && p.gf.Function == GroupFunctionRequest && msg.Header.Pgn == p.gf.Pgn {
+			res.Message = msg
+		} else {
+			continue
+		}
+
+		delete(t.pending, p)
+		p.ch <- res
+	}
+}
+
+// ReceiveDecoded is Receive for a decoded message. Only messages which may
+// answer a pending group function are converted to a ParsedMessage.
+func (t *GroupFunctionTracker) ReceiveDecoded(msg *DecodedMessage) {
+	pgn := msg.Header.Pgn
+
+	if pgn != GroupFunctionPgn && pgn != IsoAcknowledgementPgn {
+		t.mu.Lock()
+		awaited := false
+		for p := range t.pending {
+			if p.gf.Function == GroupFunctionRequest && p.gf.Pgn == pgn {
+				awaited = true
+				break
+			}
+		}
+		t.mu.Unlock()
+
+		if !awaited {
+			return
+		}
+	}
+
+	t.Receive(msg.Parsed())
+}
+
+// Wait blocks until the response arrives or the timeout expires.
+func (p *PendingGroupFunction) Wait(timeout time.Duration) (GroupFunctionResponse, error) {
+	select {
+	case res := <-p.ch:
+		return res, nil
+	case <-time.After(timeout):
+		p.Cancel()
+		return GroupFunctionResponse{}, ErrGroupFunctionTimeout
+	}
+}
+
+// Cancel stops waiting for the response.
+func (p *PendingGroupFunction) Cancel() {
+	p.tracker.mu.Lock()
+	delete(p.tracker.pending, p)
+	p.tracker.mu.Unlock()
+}
+
+// CommandHandler applies a Command group function received from another
+// device and returns the acknowledgement to send back.
+type CommandHandler func(gf *GroupFunction) *GroupFunction
+
+// CommandHandlers maps PGNs to the handlers for Commands which change them.
+type CommandHandlers map[uint32]CommandHandler
+
+// Respond builds the reply to a Request or Command group function addressed
+// to Argo. Commands for PGNs without a handler, and Requests, are answered
+// with "PGN not supported". Acknowledgements get no reply.
+func (h CommandHandlers) Respond(gf *GroupFunction) *GroupFunction {
+	switch gf.Function {
+	case GroupFunctionCommand:
+		if handler, ok := h[gf.Pgn]; ok {
+			return handler(gf)
+		}
+	case GroupFunctionRequest:
+	default:
+		return nil
+	}
+
+	ack := gf.Acknowledge()
+	ack.PgnError = PgnErrorNotSupported
+	for i := range ack.ParameterErrors {
+		ack.ParameterErrors[i] = ParameterErrorNotSupported
+	}
+
+	return ack
+}
@@ -0,0 +1,213 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package nmea2k
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/timmathews/argo/can"
+)
+
+func TestGroupFunctionCommandRoundTrip(t *testing.T) {
+	// Set the transducer offset of a depth sounder to -0.5m
+	gf := NewCommand(128267, GroupFunctionParameter{2, -0.5})
+
+	b, err := gf.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []byte{0x01, 0x0B, 0xF5, 0x01, 0xF8, 0x01, 0x03, 0x0C, 0xFE}
+	if !bytes.Equal(b, expected) {
+		t.Errorf("Encode() = % x, expected % x", b, expected)
+	}
+
+	res, err := DecodeGroupFunction(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Function != GroupFunctionCommand || res.Pgn != 128267 || res.Priority != PriorityUnchanged {
+		t.Errorf("DecodeGroupFunction() = %+v", res)
+	}
+
+	if len(res.Parameters) != 1 || res.Parameters[0].Field != 2 {
+		t.Fatalf("Parameters = %+v, expected field 2", res.Parameters)
+	}
+
+	if v, err := toFloat(res.Parameters[0].Value); err != nil || math.Abs(v+0.5) > 1e-9 {
+		t.Errorf("Parameters[0].Value = %v, expected -0.5", res.Parameters[0].Value)
+	}
+}
+
+func TestGroupFunctionAcknowledge(t *testing.T) {
+	cmd := NewCommand(60928, GroupFunctionParameter{2, 1}, GroupFunctionParameter{3, 200})
+
+	ack := cmd.Acknowledge()
+	if ack.Err() != nil {
+		t.Errorf("Err() = %v, expected nil", ack.Err())
+	}
+
+	ack.ParameterErrors[1] = ParameterErrorOutOfRange
+
+	b, err := ack.Encode()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []byte{0x02, 0x00, 0xEE, 0x00, 0x00, 0x02, 0x30, 0xFF}
+	if !bytes.Equal(b, expected) {
+		t.Errorf("Encode() = % x, expected % x", b, expected)
+	}
+
+	res, err := DecodeGroupFunction(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(res.ParameterErrors) != 2 || res.ParameterErrors[0] != ParameterErrorNone ||
+		res.ParameterErrors[1] != ParameterErrorOutOfRange {
+		t.Errorf("ParameterErrors = %v, expected [0 3]", res.ParameterErrors)
+	}
+
+	if res.Err() == nil {
+		t.Error("Err() = nil, expected a parameter error")
+	}
+}
+
+func TestGroupFunctionTracker(t *testing.T) {
+	tracker := NewGroupFunctionTracker()
+	cmd := NewCommand(128267, GroupFunctionParameter{2, 0.25})
+	pending := tracker.Expect(35, cmd)
+
+	ack, _ := cmd.Acknowledge().Message(221)
+	ack.Source = 35
+
+	// An acknowledgement from another device must be ignored
+	other := *ack
+	other.Source = 36
+	tracker.Receive(ParsePacket(&other))
+	tracker.Receive(ParsePacket(ack))
+
+	res, err := pending.Wait(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if res.Acknowledge == nil || res.Acknowledge.Pgn != 128267 || res.Acknowledge.Err() != nil {
+		t.Errorf("Wait() = %+v, expected a positive acknowledgement", res)
+	}
+
+	req := NewRequest(128267)
+	pending = tracker.Expect(35, req)
+	tracker.Receive(ParsePacket(&can.RawMessage{
+		Pgn:    128267,
+		Source: 35,
+		Data:   []byte{0x01, 0xE8, 0x03, 0x00, 0x00, 0xFF, 0x7F, 0xFF},
+	}))
+
+	res, err = pending.Wait(time.Second)
+	if err != nil || res.Message == nil || res.Message.Header.Pgn != 128267 {
+		t.Errorf("Wait() = %+v, %v, expected PGN 128267", res, err)
+	}
+
+	pending = tracker.Expect(35, req)
+	if _, err = pending.Wait(10 * time.Millisecond); err != ErrGroupFunctionTimeout {
+		t.Errorf("Wait() = %v, expected %v", err, ErrGroupFunctionTimeout)
+	}
+}
+
+func TestGroupFunctionTrackerDecoded(t *testing.T) {
+	tracker := NewGroupFunctionTracker()
+	pending := tracker.Expect(35, NewRequest(128267))
+
+	raw := &can.RawMessage{
+		Pgn:    128267,
+		Source: 35,
+		Data:   []byte{0x01, 0xE8, 0x03, 0x00, 0x00, 0xFF, 0x7F, 0xFF},
+	}
+
+	msg := NewDecodedMessage()
+	defer msg.Release()
+	DefaultDecoder().Decode(raw, msg)
+
+	// Messages nobody waits for are not converted
+	msg.Header.Pgn = 128259
+	if n := testing.AllocsPerRun(100, func() { tracker.ReceiveDecoded(msg) }); n != 0 {
+		t.Errorf("ReceiveDecoded(128259) made %v allocations, expected none", n)
+	}
+
+	msg.Header.Pgn = 128267
+	tracker.ReceiveDecoded(msg)
+
+	res, err := pending.Wait(time.Second)
+	if err != nil || res.Message == nil || res.Message.Header.Pgn != 128267 {
+		t.Errorf("Wait() = %+v, %v, expected PGN 128267", res, err)
+	}
+}
+
+func TestGroupFunctionTrackerIsoNak(t *testing.T) {
+	tracker := NewGroupFunctionTracker()
+	pending := tracker.Expect(35, NewRequest(126996))
+
+	// A NAK of another PGN must be ignored
+	tracker.Receive(ParsePacket(&can.RawMessage{
+		Pgn:    IsoAcknowledgementPgn,
+		Source: 35,
+		Data:   []byte{0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0x0F, 0xF0, 0x01},
+	}))
+	tracker.Receive(ParsePacket(&can.RawMessage{
+		Pgn:    IsoAcknowledgementPgn,
+		Source: 35,
+		Data:   []byte{0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0x14, 0xF0, 0x01},
+	}))
+
+	res, err := pending.Wait(time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	a := res.IsoAcknowledgement
+	if a == nil || a.Pgn != 126996 || a.Control != IsoNak || a.Err() == nil {
+		t.Errorf("Wait() = %+v, expected a NAK of PGN 126996", res)
+	}
+}
+
+func TestCommandHandlersRespond(t *testing.T) {
+	handlers := CommandHandlers{
+		128267: func(gf *GroupFunction) *GroupFunction { return gf.Acknowledge() },
+	}
+
+	if ack := handlers.Respond(NewCommand(128267, GroupFunctionParameter{2, 0})); ack.Err() != nil {
+		t.Errorf("Respond() = %v, expected success", ack.Err())
+	}
+
+	ack := handlers.Respond(NewCommand(127250, GroupFunctionParameter{1, 0}))
+	if ack.PgnError != PgnErrorNotSupported || ack.ParameterErrors[0] != ParameterErrorNotSupported {
+		t.Errorf("Respond() = %+v, expected PGN not supported", ack)
+	}
+
+	if handlers.Respond(ack) != nil {
+		t.Error("Respond() to an acknowledgement should be nil")
+	}
+}
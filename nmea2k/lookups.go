@@ -153,6 +153,57 @@ var lookupAlertState = PgnLookup{
 	255: "Data not available",
 }
 
+var lookupAlertResponseCommand = PgnLookup{
+	0: "Acknowledge",
+	1: "Temporary Silence",
+	2: "Test Command off",
+	3: "Test Command on",
+}
+
+var lookupAlertLanguage = PgnLookup{
+	0:  "English (US)",
+	1:  "English (UK)",
+	2:  "Arabic",
+	3:  "Chinese (simplified)",
+	4:  "Croatian",
+	5:  "Danish",
+	6:  "Dutch",
+	7:  "Finnish",
+	8:  "French",
+	9:  "German",
+	10: "Greek",
+	11: "Italian",
+	12: "Japanese",
+	13: "Korean",
+	14: "Norwegian",
+	15: "Polish",
+	16: "Portuguese",
+	17: "Russian",
+	18: "Spanish",
+	19: "Swedish",
+}
+
+var lookupAlertControl = PgnLookup{
+	0: "Disabled",
+	1: "Enabled",
+	2: "Reserved",
+	3: "Data not available",
+}
+
+var lookupAlertUserDefined = PgnLookup{
+	0: "Not user defined",
+	1: "User defined",
+	2: "Reserved",
+	3: "Data not available",
+}
+
+var lookupAlertTriggerMethod = PgnLookup{
+	0: "Trigger on greater than",
+	1: "Trigger on less than",
+	2: "Trigger on equal",
+	3: "Trigger on not equal",
+}
+
 var lookupAisAccuracy = PgnLookup{
 	0: "Low",
 	1: "High",
@@ -671,6 +722,34 @@ var lookupTideTendency = PgnLookup{
 	1: "Rising",
 }
 
+var lookupPgnErrorCode = PgnLookup{
+	0: "Acknowledge",
+	1: "PGN not supported",
+	2: "PGN not available",
+	3: "Access denied",
+	4: "Not supported",
+	5: "Tag not supported",
+	6: "Read or Write not supported",
+}
+
+var lookupTransmissionIntervalErrorCode = PgnLookup{
+	0: "Acknowledge",
+	1: "Transmit Interval/Priority not supported",
+	2: "Transmit Interval too low",
+	3: "Access denied",
+	4: "Not supported",
+}
+
+var lookupParameterErrorCode = PgnLookup{
+	0: "Acknowledge",
+	1: "Invalid parameter field",
+	2: "Temporary error",
+	3: "Parameter out of range",
+	4: "Access denied",
+	5: "Not supported",
+	6: "Read or Write not supported",
+}
+
 var lookupIsoAckResults = PgnLookup{
 	0: "ACK",
 	1: "NAK",
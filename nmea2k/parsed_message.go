@@ -23,9 +23,7 @@ import (
 	"encoding/json"
 	"fmt"
 	"strconv"
-	"time"
 
-	"github.com/timmathews/argo/can"
 	"gopkg.in/vmihailenco/msgpack.v2"
 )
 
@@ -43,57 +41,24 @@ func (inVal DataMap) MarshalJSON() ([]byte, error) {
 	return json.Marshal(outVal)
 }
 
+// RepeatingGroup holds the repeated sets of fields at the end of a PGN, such
+// as the satellites in 129540 or the switches in 127501. Each record is keyed
+// by the index of the field in the PGN definition, just like the fixed fields
+// of a DataMap.
+type RepeatingGroup struct {
+	Count   int
+	Records []DataMap
+}
+
 type ParsedMessage struct {
 	Header RawMessage
 	Index  int
 	Data   DataMap
-}
 
-type CanBoatMessage struct {
-	Timestamp   string                 `json:"timestamp"`
-	Priority    uint8                  `json:"prio"`
-	Source      uint8                  `json:"src"`
-	Destination uint8                  `json:"dst"`
-	Pgn         uint32                 `json:"pgn"`
-	Fields      map[string]interface{} `json:"fields"`
-}
-
-func FromCanBoat(data string) (*ParsedMessage, error) {
-	var cbm CanBoatMessage
-	json.Unmarshal(([]byte)(data), &cbm)
-
-	hdr := RawMessage{new(can.RawMessage)}
-
-	hdr.Timestamp, _ = time.Parse("2006-01-02T15:04:05.999", cbm.Timestamp)
-	hdr.Priority = cbm.Priority
-	hdr.Pgn = cbm.Pgn
-	hdr.Source = cbm.Source
-	hdr.Destination = cbm.Destination
-
-	f, fpgn := PgnList.First(cbm.Pgn)
-	l, _ := PgnList.Last(cbm.Pgn)
-
-	if f != l {
-		return nil, fmt.Errorf("(%v): f (%v) != l (%v)", cbm.Pgn, f, l)
-	}
-
-	dd := make(map[int]interface{})
-
-	for k, v := range cbm.Fields {
-		for kk, vv := range fpgn.FieldList {
-			if vv.Name == k {
-				dd[kk] = v
-			}
-		}
-	}
-
-	var p = ParsedMessage{
-		hdr,
-		f,
-		dd,
-	}
-
-	return &p, nil
+	// Name and type of the interface the message was received on, from the
+	// configuration
+	Interface     string `json:",omitempty"`
+	InterfaceType string `json:",omitempty"`
 }
 
 func (msg *ParsedMessage) Print(verbose bool) string {
@@ -105,23 +70,21 @@ func (msg *ParsedMessage) Print(verbose bool) string {
 
 	s := fmt.Sprintf("%s %v %v %v %v %s:", msg.Header.Timestamp.Format(layout), msg.Header.Priority, msg.Header.Source, msg.Header.Destination, msg.Header.Pgn, name)
 
-	for i, j := 0, 0; i < len(msg.Data); i, j = i+1, j+1 {
-		f := msg.Data[i]
-		if f != nil {
-			if _, ok := f.(float32); ok {
-				s += fmt.Sprintf(" %v.%s = %f;", i, pgnFields[j].Name, f)
-			} else if _, ok := f.(float64); ok {
-				s += fmt.Sprintf(" %v.%s = %f;", i, pgnFields[j].Name, f)
-			} else {
-				s += fmt.Sprintf(" %v.%s = %v;", i, pgnFields[j].Name, f)
+	rpt := pp.FirstRepeatingField()
+
+	for i := range pgnFields {
+		if i == rpt {
+			if grp, ok := msg.Data[i].(RepeatingGroup); ok {
+				for n, rec := range grp.Records {
+					for j := rpt; j < len(pgnFields); j++ {
+						s += printField(fmt.Sprintf("%v[%v]", j, n), pgnFields[j].Name, rec[j], rec.has(j), verbose)
+					}
+				}
 			}
-		} else if verbose {
-			s += fmt.Sprintf(" %v.%s = nil;", i, pgnFields[j].Name)
+			break
 		}
 
-		if pp.RepeatingFields > 0 && j == len(pgnFields)-1 {
-			j -= int(pp.RepeatingFields)
-		}
+		s += printField(strconv.Itoa(i), pgnFields[i].Name, msg.Data[i], msg.Data.has(i), verbose)
 	}
 
 	s = s[:len(s)-1]
@@ -129,6 +92,26 @@ func (msg *ParsedMessage) Print(verbose bool) string {
 	return s
 }
 
+func printField(id, name string, f interface{}, present, verbose bool) string {
+	if f != nil {
+		if _, ok := f.(float32); ok {
+			return fmt.Sprintf(" %v.%s = %f;", id, name, f)
+		} else if _, ok := f.(float64); ok {
+			return fmt.Sprintf(" %v.%s = %f;", id, name, f)
+		}
+		return fmt.Sprintf(" %v.%s = %v;", id, name, f)
+	} else if present && verbose {
+		return fmt.Sprintf(" %v.%s = nil;", id, name)
+	}
+
+	return ""
+}
+
+func (d DataMap) has(i int) bool {
+	_, ok := d[i]
+	return ok
+}
+
 // Pack a PGN into a MsgPack formatted byte array
 func (msg *ParsedMessage) MsgPack() []byte {
 	b, err := msgpack.Marshal(&msg)
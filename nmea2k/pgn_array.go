@@ -53,6 +53,7 @@ const RES_STRING = -13
 const RES_FLOAT = -14
 const RES_PRESSURE = -15
 const RES_STRINGLZ = -16
+const RES_STRINGLAU = -17
 const MAX_RES_LOOKUP = 16
 
 type Field struct {
@@ -489,10 +490,10 @@ var PgnList = PgnArray{
 	{"NMEA - Acknowledge group function", "General", 126208, true, 8, 1, []Field{
 		{"Function Code", 8, RES_INTEGER, false, "=2", "Acknowledge", "", 0},
 		{"PGN", 24, RES_INTEGER, false, nil, "Commanded or requested PGN", "", 0},
-		{"PGN error code", 4, 1, false, nil, "", "", 0},
-		{"Transmission interval/Priority error code", 4, 1, false, nil, "", "", 0},
+		{"PGN error code", 4, RES_LOOKUP, false, lookupPgnErrorCode, "", "", 0},
+		{"Transmission interval/Priority error code", 4, RES_LOOKUP, false, lookupTransmissionIntervalErrorCode, "", "", 0},
 		{"# of Commanded Parameters", 8, 1, false, nil, "", "", 0},
-		{"Parameter Error", 8, RES_INTEGER, false, nil, "", "", 0}},
+		{"Parameter Error", 4, RES_LOOKUP, false, lookupParameterErrorCode, "", "", 0}},
 	},
 
 	/////////////////////////// RESPONSE TO REQUEST PGNS ////////////////////////
@@ -692,8 +693,8 @@ var PgnList = PgnArray{
 	// http://www8.garmin.com/manuals/GPSMAP4008_NMEA2000NetworkFundamentals.pdf
 
 	{"Alert", "Alert", 126983, true, 27, 0, []Field{
-		{"Alert Type", 4, 1, false, lookupAlertType, "", "", 0},
-		{"Alert Category", 4, 1, false, lookupAlertCategory, "", "", 0},
+		{"Alert Type", 4, RES_LOOKUP, false, lookupAlertType, "", "", 0},
+		{"Alert Category", 4, RES_LOOKUP, false, lookupAlertCategory, "", "", 0},
 		{"Alert System", 8, 1, false, nil, "", "", 0},
 		{"Alert Sub-System", 8, 1, false, nil, "", "", 0},
 		{"Alert ID", 16, 1, false, nil, "", "", 0},
@@ -701,18 +702,99 @@ var PgnList = PgnArray{
 		{"Data Source Instance", 8, 1, false, nil, "", "", 0},
 		{"Data Source Index", 8, 1, false, nil, "", "", 0},
 		{"Alert Occurence Number", 8, 1, false, nil, "", "", 0},
-		{"Temporary Silence Status", 1, 1, false, lookupSilenceStatus, "", "", 0},
-		{"Acknowledge Status", 1, 1, false, lookupAcknowledgeStatus, "", "", 0},
-		{"Escalation Status", 1, 1, false, lookupEscalationStatus, "", "", 0},
-		{"Temporary Silence Support", 1, 1, false, lookupSupport, "", "", 0},
-		{"Acknowledge Support", 1, 1, false, lookupSupport, "", "", 0},
-		{"Escalation Support", 1, 1, false, lookupSupport, "", "", 0},
+		{"Temporary Silence Status", 1, RES_LOOKUP, false, lookupSilenceStatus, "", "", 0},
+		{"Acknowledge Status", 1, RES_LOOKUP, false, lookupAcknowledgeStatus, "", "", 0},
+		{"Escalation Status", 1, RES_LOOKUP, false, lookupEscalationStatus, "", "", 0},
+		{"Temporary Silence Support", 1, RES_LOOKUP, false, lookupSupport, "", "", 0},
+		{"Acknowledge Support", 1, RES_LOOKUP, false, lookupSupport, "", "", 0},
+		{"Escalation Support", 1, RES_LOOKUP, false, lookupSupport, "", "", 0},
 		{"Reserved", 2, RES_BINARY, false, nil, "Reserved", "", 0},
 		{"Acknowledge Source Network ID NAME", 64, 1, false, nil, "", "", 0},
-		{"Trigger Condition", 4, 1, false, lookupTriggerCondition, "", "", 0},
-		{"Threshold Status", 4, 1, false, lookupThresholdStatus, "", "", 0},
+		{"Trigger Condition", 4, RES_LOOKUP, false, lookupTriggerCondition, "", "", 0},
+		{"Threshold Status", 4, RES_LOOKUP, false, lookupThresholdStatus, "", "", 0},
 		{"Alert Priority", 8, 1, false, nil, "", "", 0},
-		{"Alert State", 8, 1, false, lookupAlertState, "", "", 0}},
+		{"Alert State", 8, RES_LOOKUP, false, lookupAlertState, "", "", 0}},
+	},
+
+	{"Alert Response", "Alert", 126984, true, 25, 0, []Field{
+		{"Alert Type", 4, RES_LOOKUP, false, lookupAlertType, "", "", 0},
+		{"Alert Category", 4, RES_LOOKUP, false, lookupAlertCategory, "", "", 0},
+		{"Alert System", 8, 1, false, nil, "", "", 0},
+		{"Alert Sub-System", 8, 1, false, nil, "", "", 0},
+		{"Alert ID", 16, 1, false, nil, "", "", 0},
+		{"Data Source Network ID NAME", 64, 1, false, nil, "", "", 0},
+		{"Data Source Instance", 8, 1, false, nil, "", "", 0},
+		{"Data Source Index", 8, 1, false, nil, "", "", 0},
+		{"Alert Occurence Number", 8, 1, false, nil, "", "", 0},
+		{"Acknowledge Source Network ID NAME", 64, 1, false, nil, "", "", 0},
+		{"Response Command", 2, RES_LOOKUP, false, lookupAlertResponseCommand, "", "", 0},
+		{"Reserved", 6, RES_BINARY, false, nil, "Reserved", "", 0}},
+	},
+
+	{"Alert Text", "Alert", 126985, true, 49, 0, []Field{
+		{"Alert Type", 4, RES_LOOKUP, false, lookupAlertType, "", "", 0},
+		{"Alert Category", 4, RES_LOOKUP, false, lookupAlertCategory, "", "", 0},
+		{"Alert System", 8, 1, false, nil, "", "", 0},
+		{"Alert Sub-System", 8, 1, false, nil, "", "", 0},
+		{"Alert ID", 16, 1, false, nil, "", "", 0},
+		{"Data Source Network ID NAME", 64, 1, false, nil, "", "", 0},
+		{"Data Source Instance", 8, 1, false, nil, "", "", 0},
+		{"Data Source Index", 8, 1, false, nil, "", "", 0},
+		{"Alert Occurence Number", 8, 1, false, nil, "", "", 0},
+		{"Language ID", 8, RES_LOOKUP, false, lookupAlertLanguage, "", "", 0},
+		{"Alert Text Description", 128, RES_STRINGLAU, false, nil, "", "", 0},
+		{"Alert Location Text Description", 128, RES_STRINGLAU, false, nil, "", "", 0}},
+	},
+
+	{"Alert Configuration", "Alert", 126986, true, 21, 0, []Field{
+		{"Alert Type", 4, RES_LOOKUP, false, lookupAlertType, "", "", 0},
+		{"Alert Category", 4, RES_LOOKUP, false, lookupAlertCategory, "", "", 0},
+		{"Alert System", 8, 1, false, nil, "", "", 0},
+		{"Alert Sub-System", 8, 1, false, nil, "", "", 0},
+		{"Alert ID", 16, 1, false, nil, "", "", 0},
+		{"Data Source Network ID NAME", 64, 1, false, nil, "", "", 0},
+		{"Data Source Instance", 8, 1, false, nil, "", "", 0},
+		{"Data Source Index", 8, 1, false, nil, "", "", 0},
+		{"Alert Occurence Number", 8, 1, false, nil, "", "", 0},
+		{"Alert Control", 2, RES_LOOKUP, false, lookupAlertControl, "", "", 0},
+		{"User Defined Alert Assignment", 2, RES_LOOKUP, false, lookupAlertUserDefined, "", "", 0},
+		{"Reserved", 4, RES_BINARY, false, nil, "Reserved", "", 0},
+		{"Reactivation Period", 8, 60, false, "s", "", "", 0},
+		{"Temporary Silence Period", 8, 30, false, "s", "", "", 0},
+		{"Escalation Period", 8, 60, false, "s", "", "", 0}},
+	},
+
+	{"Alert Threshold", "Alert", 126987, true, 0xff, 4, []Field{
+		{"Alert Type", 4, RES_LOOKUP, false, lookupAlertType, "", "", 0},
+		{"Alert Category", 4, RES_LOOKUP, false, lookupAlertCategory, "", "", 0},
+		{"Alert System", 8, 1, false, nil, "", "", 0},
+		{"Alert Sub-System", 8, 1, false, nil, "", "", 0},
+		{"Alert ID", 16, 1, false, nil, "", "", 0},
+		{"Data Source Network ID NAME", 64, 1, false, nil, "", "", 0},
+		{"Data Source Instance", 8, 1, false, nil, "", "", 0},
+		{"Data Source Index", 8, 1, false, nil, "", "", 0},
+		{"Alert Occurence Number", 8, 1, false, nil, "", "", 0},
+		{"Number of Parameters", 8, 1, false, nil, "", "", 0},
+		{"Parameter Number", 8, 1, false, nil, "", "", 0},
+		{"Trigger Method", 8, RES_LOOKUP, false, lookupAlertTriggerMethod, "", "", 0},
+		{"Threshold Data Format", 8, 1, false, nil, "", "", 0},
+		{"Threshold Level", 64, 1, false, nil, "", "", 0}},
+	},
+
+	{"Alert Value", "Alert", 126988, true, 0xff, 3, []Field{
+		{"Alert Type", 4, RES_LOOKUP, false, lookupAlertType, "", "", 0},
+		{"Alert Category", 4, RES_LOOKUP, false, lookupAlertCategory, "", "", 0},
+		{"Alert System", 8, 1, false, nil, "", "", 0},
+		{"Alert Sub-System", 8, 1, false, nil, "", "", 0},
+		{"Alert ID", 16, 1, false, nil, "", "", 0},
+		{"Data Source Network ID NAME", 64, 1, false, nil, "", "", 0},
+		{"Data Source Instance", 8, 1, false, nil, "", "", 0},
+		{"Data Source Index", 8, 1, false, nil, "", "", 0},
+		{"Alert Occurence Number", 8, 1, false, nil, "", "", 0},
+		{"Number of Parameters", 8, 1, false, nil, "", "", 0},
+		{"Value Parameter Number", 8, 1, false, nil, "", "", 0},
+		{"Value Data Format", 8, 1, false, nil, "", "", 0},
+		{"Value Data", 64, 1, false, nil, "", "", 0}},
 	},
 
 	{"Heading/Track Control", "Steering", 127237, true, 21, 0, []Field{
@@ -3326,3 +3408,59 @@ func (pp PgnArray) Last(id uint32) (int, Pgn) {
 
 	return 0, pp[0]
 }
+
+// Resolve returns the definition of a PGN whose match fields, such as the
+// manufacturer code of a proprietary PGN, agree with the values in data. A
+// generic definition without match fields is only used if no proprietary
+// variant matches. Failing that, the first definition of the PGN is returned.
+func (pp PgnArray) Resolve(id uint32, data DataMap) (int, Pgn) {
+	first, def := pp.First(id)
+	last, _ := pp.Last(id)
+	fallback := -1
+
+	for i := first; i <= last; i++ {
+		if !pp[i].Matches(data) {
+			continue
+		}
+		if pp[i].IsProprietary() {
+			return i, pp[i]
+		}
+		if fallback < 0 {
+			fallback = i
+		}
+	}
+
+	if fallback >= 0 {
+		return fallback, pp[fallback]
+	}
+
+	return first, def
+}
+
+// IsProprietary reports whether the definition only applies to messages whose
+// match fields have particular values.
+func (p *Pgn) IsProprietary() bool {
+	for i := range p.FieldList {
+		if _, ok := p.FieldList[i].Match(); ok {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Matches reports whether all of the match fields of the PGN have the
+// required value in data.
+func (p *Pgn) Matches(data DataMap) bool {
+	for i := range p.FieldList {
+		f := &p.FieldList[i]
+		if m, ok := f.Match(); ok {
+			n, err := EncodeValue(f, data[i], data)
+			if data[i] == nil || err != nil || n != m {
+				return false
+			}
+		}
+	}
+
+	return true
+}
@@ -24,6 +24,7 @@ import (
 	"fmt"
 	"math"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/timmathews/argo/can"
@@ -58,6 +59,49 @@ func max(x, y uint32) uint32 {
 	return y
 }
 
+// FirstRepeatingField returns the index of the first field in the repeating
+// set of the PGN, or -1 if the PGN has no repeating fields.
+func (p *Pgn) FirstRepeatingField() int {
+	if p.RepeatingFields == 0 || int(p.RepeatingFields) > len(p.FieldList) {
+		return -1
+	}
+
+	return len(p.FieldList) - int(p.RepeatingFields)
+}
+
+// FieldIndex returns the index of a field in the PGN. The field may be given
+// either as its index or as its name. Names are matched case-insensitively.
+func (p *Pgn) FieldIndex(field string) (int, error) {
+	field = strings.TrimSpace(field)
+
+	if i, err := strconv.Atoi(field); err == nil {
+		if i < 0 || i >= len(p.FieldList) {
+			return -1, fmt.Errorf("field %v out of range for PGN %v", i, p.Pgn)
+		}
+		return i, nil
+	}
+
+	for i, f := range p.FieldList {
+		if strings.EqualFold(f.Name, field) {
+			return i, nil
+		}
+	}
+
+	return -1, fmt.Errorf("no field named %q in PGN %v", field, p.Pgn)
+}
+
+// Match returns the value a field must have for a proprietary PGN definition
+// to apply, as given by a Units string of the form "=135".
+func (f *Field) Match() (uint64, bool) {
+	if v, ok := f.Units.(string); ok && len(v) > 1 && v[0] == '=' {
+		if value, err := strconv.ParseUint(v[1:], 10, 64); err == nil {
+			return value, true
+		}
+	}
+
+	return 0, false
+}
+
 func (p *Pgn) FieldOffsets(idx int32) (low_byte, high_byte, start_bit, bits uint32) {
 	bits = p.FieldList[idx].Size
 	bytes := (bits + 7) / 8
@@ -78,136 +122,83 @@ func (p *Pgn) FieldOffsets(idx int32) (low_byte, high_byte, start_bit, bits uint
 	return
 }
 
-func ParsePacket(cmsg *can.RawMessage) (pgnParsed *ParsedMessage) {
-	msg := &RawMessage{cmsg}
-
-	i, pgnDefinition := PgnList.First(msg.Pgn)
-	j, _ := PgnList.Last(msg.Pgn)
-
-	oneSolution := false
-
-	if i == j {
-		oneSolution = true
-	}
-
-	pgnParsed = new(ParsedMessage)
-	pgnParsed.Header = *msg
-	pgnParsed.Index = i
-	pgnParsed.Data = make(map[int]interface{})
-
-	data_len := len(msg.Data)
-
-	fields := pgnDefinition.FieldList
-
-	var start_byte uint32
-	var start_bit uint32
-
-	for idx, odx := 0, 0; idx < len(fields); idx, odx = idx+1, odx+1 {
-
-		field := fields[idx]
-		res := field.Resolution
-
-		bits := field.Size
-		bytes := (bits + 7) / 8
-		bytes = min(bytes, uint32(data_len))
-		bits = min(bytes*8, bits)
-
-		bytes += start_byte
+// ParsePacket decodes a CAN message into a ParsedMessage using the matching
+// definition from PgnList. Fixed fields are stored in the DataMap under their
+// index in the definition. If the PGN has repeating fields, the repeated sets
+// are stored as a RepeatingGroup under the index of the first repeating field.
+//
+// ParsePacket allocates a map and boxes every field. Use a Decoder where many
+// messages are decoded and only a few fields are needed.
+func ParsePacket(cmsg *can.RawMessage) *ParsedMessage {
+	msg := NewDecodedMessage()
+	defer msg.Release()
 
-		var data interface{}
-		var err error
+	DefaultDecoder().Decode(cmsg, msg)
 
-		// TODO: We should return an error
-		if int(start_byte) > len(msg.Data) || int(bytes) > len(msg.Data) {
-			return
-		}
+	return msg.parsed(cmsg)
+}
 
-		// Special fields
-		if field.Resolution < 0.0 {
-			switch field.Resolution {
-			case RES_LATITUDE:
-				fallthrough
-			case RES_LONGITUDE:
-				data, err = msg.extractLatLon(start_byte, bytes)
-			case RES_DATE:
-				data, err = msg.extractDate(start_byte, bytes)
-			case RES_TIME:
-				data, err = msg.extractTime(start_byte, bytes)
-			case RES_TEMPERATURE:
-				data, err = msg.extractTemperature(start_byte, bytes)
-			case RES_6BITASCII:
-				data, err = msg.extract6BitASCII(start_byte, bytes)
-			case RES_INTEGER:
-				data, err = msg.extractNumber(&field, start_byte, bytes, start_bit, bits)
-			case RES_LOOKUP:
-				data, err = msg.extractLookupField(&field, start_byte, bytes, start_bit, bits)
-			case RES_LOOKUP2:
-				superFieldId := field.Offset
-				superFieldVal := pgnParsed.Data[int(superFieldId)]
-				// The superField may not have been parsed yet
-				if superFieldVal == nil {
-					start_byte, bytes, start_bit, bits := pgnDefinition.FieldOffsets(superFieldId)
-					data, err = msg.extractNumber(&field, start_byte, bytes, start_bit, bits)
-					if err != nil {
-						break
-					}
-				} else {
-					data = uint32(superFieldVal.(float64))
-				}
-				data, err = msg.extractLookupSubfield(&field, uint32(data.(float64)), start_byte, bytes, start_bit, bits)
-			case RES_MANUFACTURER:
-				data, err = msg.extractManufacturer(&field, start_byte, bytes, start_bit, bits)
-			case RES_PRESSURE:
-				data, err = msg.extractPressure(start_byte, bytes)
-			case RES_STRINGLZ:
-				data, err = msg.extractStringLZ(start_byte)
-			case RES_STRING:
-				data = string(msg.Data[start_byte:bytes])
-			case RES_ASCII:
-				data, err = msg.extractString(start_byte, bytes)
-			default:
-				data = msg.Data[start_byte:bytes]
+// extractField decodes a single field according to its resolution. The PGN
+// definition is needed for RES_LOOKUP2 fields, whose lookup table depends on
+// the value of another field in the same message.
+func (msg *RawMessage) extractField(pgnDefinition *Pgn, field *Field, start_byte, bytes, start_bit, bits uint32) (data interface{}, err error) {
+	// Special fields
+	if field.Resolution < 0.0 {
+		switch field.Resolution {
+		case RES_LATITUDE:
+			fallthrough
+		case RES_LONGITUDE:
+			data, err = msg.extractLatLon(start_byte, bytes)
+		case RES_DATE:
+			data, err = msg.extractDate(start_byte, bytes)
+		case RES_TIME:
+			data, err = msg.extractTime(start_byte, bytes)
+		case RES_TEMPERATURE:
+			data, err = msg.extractTemperature(start_byte, bytes)
+		case RES_6BITASCII:
+			data, err = msg.extract6BitASCII(start_byte, bytes)
+		case RES_INTEGER:
+			data, err = msg.extractNumber(field, start_byte, bytes, start_bit, bits)
+		case RES_LOOKUP:
+			data, err = msg.extractLookupField(field, start_byte, bytes, start_bit, bits)
+		case RES_LOOKUP2:
+			// The superfield may come after this field, so always read it from
+			// the raw data rather than the parsed values
+			superField := &pgnDefinition.FieldList[field.Offset]
+			sb, se, sbit, sbits := pgnDefinition.FieldOffsets(field.Offset)
+			if int(se) > len(msg.Data) {
+				err = &DecodeError{msg.Data, "Superfield not present"}
+				break
 			}
-		} else if field.Resolution > 0.0 {
-			data, err = msg.extractNumber(&field, start_byte, bytes, start_bit, bits)
-		}
-
-		if err == nil {
-			pgnParsed.Data[odx] = data
-
-			if !oneSolution {
-				for i <= j {
-					if res == RES_MANUFACTURER {
-						data, _ = msg.extractNumber(&field, start_byte, bytes, start_bit, bits)
-					}
-					if v, ok := field.Units.(string); ok && v[0] == '=' {
-						value, _ := strconv.ParseUint(v[1:], 10, 64)
-						if value == data.(uint64) {
-							// We have a match, continue parsing
-							break
-						} else {
-							i++
-							pgnDefinition = PgnList[i]
-							fields = pgnDefinition.FieldList
-							field = fields[idx]
-						}
-					} else {
-						break
-					}
-				}
-				pgnParsed.Index = i
+			superFieldVal, e := msg.extractNumber(superField, sb, se, sbit, sbits)
+			if e != nil {
+				err = e
+				break
 			}
-		} else {
-			pgnParsed.Data[odx] = nil
-		}
-
-		start_byte = start_byte + ((bits + start_bit) / 8)
-		start_bit += bits
-		start_bit %= 8
-
-		if idx == len(fields)-1 && pgnDefinition.RepeatingFields > 0 && start_byte < uint32(data_len) {
-			idx -= int(pgnDefinition.RepeatingFields)
+			data, err = msg.extractLookupSubfield(field, uint32(superFieldVal.(uint64)), start_byte, bytes, start_bit, bits)
+		case RES_MANUFACTURER:
+			data, err = msg.extractManufacturer(field, start_byte, bytes, start_bit, bits)
+		case RES_PRESSURE:
+			data, err = msg.extractPressure(start_byte, bytes)
+		case RES_FLOAT:
+			if bytes-start_byte == 4 {
+				data = math.Float32frombits(binary.LittleEndian.Uint32(msg.Data[start_byte:bytes]))
+			} else {
+				data = msg.Data[start_byte:bytes]
+			}
+		case RES_STRINGLZ:
+			data, err = msg.extractStringLZ(start_byte)
+		case RES_STRINGLAU:
+			data, err = msg.extractStringLAU(start_byte)
+		case RES_STRING:
+			data = string(msg.Data[start_byte:bytes])
+		case RES_ASCII:
+			data, err = msg.extractString(start_byte, bytes)
+		default:
+			data = msg.Data[start_byte:bytes]
 		}
+	} else if field.Resolution > 0.0 {
+		data, err = msg.extractNumber(field, start_byte, bytes, start_bit, bits)
 	}
 
 	return
@@ -386,6 +377,30 @@ func (msg *RawMessage) extractStringLZ(start uint32) (s string, e error) {
 	return
 }
 
+// extractStringLAU decodes text with a length byte, which counts itself, and
+// an encoding byte, 0 for UTF-16 and 1 for ASCII
+func (msg *RawMessage) extractStringLAU(start uint32) (s string, e error) {
+	if int(start)+2 > len(msg.Data) {
+		e = &DecodeError{nil, "Data not present"}
+		return
+	}
+
+	end := int(start) + int(msg.Data[start])
+	if end <= int(start)+2 || end > len(msg.Data) {
+		e = &DecodeError{nil, "Data not present"}
+		return
+	}
+
+	data := msg.Data[start+2 : end]
+	if msg.Data[start+1] == 0 {
+		s = utf16String(data)
+	} else {
+		s = string(data)
+	}
+
+	return
+}
+
 func (msg *RawMessage) extractString(start, end uint32) (s string, e error) {
 
 	if int(start) >= len(msg.Data) || int(end) >= len(msg.Data) {
@@ -418,7 +433,6 @@ func (msg *RawMessage) extractString(start, end uint32) (s string, e error) {
 }
 
 func (msg *RawMessage) extractNumber(field *Field, start, end, offset, width uint32) (value interface{}, e error) {
-	data := make([]byte, 8)
 	bytes := end - start
 	res := field.Resolution
 	var num uint64
@@ -428,15 +442,10 @@ func (msg *RawMessage) extractNumber(field *Field, start, end, offset, width uin
 		return
 	}
 
-	copy(data, msg.Data[start:end])
-	mask := ^uint64(0) >> uint64(64-width)
-
-	num = binary.LittleEndian.Uint64(data)
-	num = num >> offset
-	num = num & mask
+	num = readBits(msg.Data[start:end], offset, width)
 
 	if (1<<width)&num != 0 {
-		e = &DecodeError{data, "Field not present"}
+		e = &DecodeError{msg.Data[start:end], "Field not present"}
 		return
 	}
 
@@ -458,7 +467,7 @@ func (msg *RawMessage) extractNumber(field *Field, start, end, offset, width uin
 	//		return
 	//	}
 
-	if res != 1 && res != RES_LOOKUP && res != RES_MANUFACTURER && res != RES_INTEGER {
+	if res != 1 && res != RES_LOOKUP && res != RES_LOOKUP2 && res != RES_MANUFACTURER && res != RES_INTEGER {
 		if field.Signed {
 			if field.Size <= 8 {
 				value = float64(int8(num)) * float64(res)
@@ -522,7 +531,10 @@ func (msg *RawMessage) extractLookupSubfield(f *Field, superId, start, end, star
 	}
 
 	if u, ok := f.Units.(PgnSubLookup); ok {
-		ret = u[int(superId)][int(n.(float64))]
+		ret = u[int(superId)][int(n.(uint64))]
+		if ret == "" {
+			ret = n
+		}
 	} else {
 		ret = n
 	}
@@ -211,3 +211,31 @@ func TestExtractNumber(t *testing.T) {
 		}
 	}
 }
+
+func TestParsePacketRepeatingGroup(t *testing.T) {
+	raw := &can.RawMessage{
+		Pgn:  127501,
+		Data: []byte{0x03, 0xC5, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF},
+	}
+
+	msg := ParsePacket(raw)
+
+	if msg.Data[0] != uint64(3) {
+		t.Errorf("Indicator Bank Instance = %v, expected 3", msg.Data[0])
+	}
+
+	grp, ok := msg.Data[1].(RepeatingGroup)
+	if !ok {
+		t.Fatalf("Data[1] = %#v, expected a RepeatingGroup", msg.Data[1])
+	}
+
+	if grp.Count != 28 || len(grp.Records) != 28 {
+		t.Errorf("Count = %v, len(Records) = %v, expected 28", grp.Count, len(grp.Records))
+	}
+
+	for i, e := range []interface{}{"On", "On", "Off"} {
+		if grp.Records[i][1] != e {
+			t.Errorf("Records[%v][1] = %v, expected %v", i, grp.Records[i][1], e)
+		}
+	}
+}
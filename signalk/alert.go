@@ -0,0 +1,293 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package signalk
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/timmathews/argo/can"
+	"github.com/timmathews/argo/nmea2k"
+)
+
+// The PGNs of the NMEA 2000 alert family all start with the fields which
+// identify an alert: its type, category, system, sub-system, ID, the NAME,
+// instance and index of the data source and the occurrence number
+const alertIdentFields = 9
+
+// Severity of each type of NMEA 2000 alert
+var alertStates = map[string]string{
+	"Energy Alarm": "emergency",
+	"Alarm":        "alarm",
+	"Warning":      "warn",
+	"Caution":      "alert",
+}
+
+// Response Command of an Alert Response for each action on a notification
+var alertCommands = map[string]string{
+	"silence":     "Temporary Silence",
+	"acknowledge": "Acknowledge",
+}
+
+// nmeaAlert is what is known of an alert raised by an NMEA 2000 device,
+// which is identified by the address of the device and its Alert ID
+type nmeaAlert struct {
+	ident      nmea2k.DataMap // The identifying fields, which a response repeats
+	iface      string         // Interface the alert came in on
+	name       string         // Category, type and ID
+	text       string         // From Alert Text
+	location   string
+	occurrence interface{}
+}
+
+// message is the text of the alert and where it is, if the device has sent
+// an Alert Text, and its category, type and ID if not
+func (al *nmeaAlert) message() string {
+	switch {
+	case al.text == "":
+		return al.name
+	case al.location == "":
+		return al.text
+	}
+
+	return fmt.Sprintf("%v (%v)", al.text, al.location)
+}
+
+// Alert turns the NMEA 2000 Alert and Alert Text PGNs, 126983 and 126985,
+// into a notification such as notifications.nmea2000.43.1001 for alert 1001
+// of the device at address 43. It returns false if the notification has not
+// changed. The other PGNs of the alert family are only decoded.
+func (n *Notifier) Alert(context string, msg *nmea2k.ParsedMessage) (Delta, bool) {
+	pgn := msg.Header.Pgn
+	if pgn != 126983 && pgn != 126985 {
+		return Delta{}, false
+	}
+
+	_, def := nmea2k.PgnList.First(pgn)
+	field := func(name string) interface{} {
+		i, err := def.FieldIndex(name)
+		if err != nil {
+			return nil
+		}
+		return msg.Data[i]
+	}
+
+	id := field("Alert ID")
+	if id == nil {
+		return Delta{}, false
+	}
+
+	src := messageSource(msg)
+	p := "notifications.nmea2000." + src.Src + "." + fmt.Sprint(id)
+
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	al := n.alerts[context+"/"+p]
+	if al == nil {
+		al = &nmeaAlert{name: fmt.Sprintf("Alert %v", id)}
+		n.alerts[context+"/"+p] = al
+	}
+
+	al.iface = msg.Interface
+	al.ident = make(nmea2k.DataMap, alertIdentFields)
+	for i := 0; i < alertIdentFields; i++ {
+		al.ident[i] = msg.Data[i]
+	}
+
+	if pgn == 126985 {
+		al.text, _ = field("Alert Text Description").(string)
+		al.location, _ = field("Alert Location Text Description").(string)
+
+		// The text changes the message of a raised alert
+		a := n.alarms[context+"/"+p]
+		if a == nil || zoneStates[a.State] == 0 || a.Message == al.message() {
+			return Delta{}, false
+		}
+		a.Message = al.message()
+
+		return Delta{
+			Context: context,
+			Updates: []update{{src, msg.Header.Timestamp, []value{{p, a.Notification}}, nil}},
+		}, true
+	}
+
+	return n.alertState(context, p, al, field, src, msg.Header.Timestamp)
+}
+
+// alertState updates the notification of an alert from an Alert PGN
+func (n *Notifier) alertState(context, p string, al *nmeaAlert, field func(string) interface{}, src source, ts time.Time) (Delta, bool) {
+	is := func(name, v string) bool {
+		return fmt.Sprint(field(name)) == v
+	}
+
+	state := "normal"
+	switch fmt.Sprint(field("Alert State")) {
+	case "Active", "Silenced", "Acknowleged", "Awaiting acknowlege":
+		var ok bool
+		if state, ok = alertStates[fmt.Sprint(field("Alert Type"))]; !ok {
+			state = "alert"
+		}
+	}
+
+	al.name = fmt.Sprintf("%v %v %v", field("Alert Category"), strings.ToLower(fmt.Sprint(field("Alert Type"))), field("Alert ID"))
+
+	nt := Notification{
+		State:   state,
+		Message: al.message(),
+		Status: NotificationStatus{
+			Silenced:       is("Temporary Silence Status", "Temporary status") || is("Alert State", "Silenced"),
+			Acknowledged:   is("Acknowledge Status", "Acknowledged") || is("Alert State", "Acknowleged"),
+			CanSilence:     is("Temporary Silence Support", "Supported"),
+			CanAcknowledge: is("Acknowledge Support", "Supported"),
+		},
+	}
+
+	nt.Method = (&Meta{}).methods(state)
+	if nt.Status.Silenced || nt.Status.Acknowledged {
+		nt.Method = withoutSound(nt.Method)
+	}
+
+	// A new occurrence of an alert which is still raised is raised again
+	occurrence := field("Alert Occurence Number")
+	renewed := al.occurrence != nil && al.occurrence != occurrence && state != "normal"
+	al.occurrence = occurrence
+
+	a := n.alarms[context+"/"+p]
+	if a == nil {
+		if state == "normal" {
+			return Delta{}, false
+		}
+		a = &alarm{zone: -1}
+		n.alarms[context+"/"+p] = a
+	}
+
+	if !renewed && a.State == nt.State && a.Status == nt.Status && a.Message == nt.Message {
+		return Delta{}, false
+	}
+
+	event := "state"
+	switch {
+	case a.State != nt.State, renewed:
+	case nt.Status.Acknowledged && !a.Status.Acknowledged:
+		event = "acknowledge"
+	case nt.Status.Silenced && !a.Status.Silenced:
+		event = "silence"
+	}
+
+	a.Notification = nt
+	a.src = src
+	n.record(ts, context, p, event, &a.Notification)
+
+	return Delta{
+		Context: context,
+		Updates: []update{{src, ts, []value{{p, nt}}, nil}},
+	}, true
+}
+
+// DecodedAlert is Alert for a decoded message. Only alerts are converted to
+// a ParsedMessage.
+func (n *Notifier) DecodedAlert(context string, msg *nmea2k.DecodedMessage) (Delta, bool) {
+	if pgn := msg.Header.Pgn; pgn != 126983 && pgn != 126985 {
+		return Delta{}, false
+	}
+
+	return n.Alert(context, msg.Parsed())
+}
+
+// AlertInterface returns the interface an NMEA 2000 alert, such as
+// notifications.nmea2000.43.1001, came in on. It returns false if the path is
+// not that of an alert.
+func (n *Notifier) AlertInterface(context, path string) (string, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	al := n.alerts[context+"/"+path]
+	if al == nil {
+		return "", false
+	}
+
+	return al.iface, true
+}
+
+// AlertResponse builds an Alert Response, PGN 126984, which asks the device
+// that raised an alert, such as notifications.nmea2000.43.1001, to silence or
+// acknowledge it. Name is the ISO NAME of the device which responds, or 0 if
+// it has none. The notification changes once the device sends the alert
+// again with its new state.
+func (n *Notifier) AlertResponse(context, path, action string, name uint64) (*can.RawMessage, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	al := n.alerts[context+"/"+path]
+	a := n.alarms[context+"/"+path]
+	if al == nil || a == nil || zoneStates[a.State] == 0 {
+		return nil, fmt.Errorf("%v is not raised", path)
+	}
+
+	switch {
+	case action == "silence" && !a.Status.CanSilence:
+		return nil, fmt.Errorf("%v cannot be silenced", path)
+	case action == "acknowledge" && !a.Status.CanAcknowledge:
+		return nil, fmt.Errorf("%v cannot be acknowledged", path)
+	case alertCommands[action] == "":
+		return nil, fmt.Errorf("cannot %v a notification", action)
+	}
+
+	_, def := nmea2k.PgnList.First(126984)
+	if def.Pgn != 126984 {
+		return nil, fmt.Errorf("unknown PGN 126984")
+	}
+
+	data := make(nmea2k.DataMap, len(def.FieldList))
+	for k, v := range al.ident {
+		data[k] = v
+	}
+
+	i, err := def.FieldIndex("Response Command")
+	if err != nil {
+		return nil, err
+	}
+	data[i] = alertCommands[action]
+
+	if name != 0 {
+		if i, err = def.FieldIndex("Acknowledge Source Network ID NAME"); err != nil {
+			return nil, err
+		}
+		data[i] = name
+	}
+
+	b, err := def.Encode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	// Alert Response is broadcast, the alert it answers is identified by
+	// its fields
+	return &can.RawMessage{
+		Timestamp:   time.Now(),
+		Priority:    2,
+		Pgn:         def.Pgn,
+		Destination: 255,
+		Length:      uint8(len(b)),
+		Data:        b,
+	}, nil
+}
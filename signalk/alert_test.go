@@ -0,0 +1,160 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package signalk
+
+import (
+	"testing"
+	"time"
+
+	"github.com/timmathews/argo/can"
+	"github.com/timmathews/argo/nmea2k"
+)
+
+// alertMessage returns a PGN of the alert family for alert 1001 of the
+// engine gateway, with its identifying fields
+func alertMessage(pgn uint32, fields nmea2k.DataMap) nmea2k.ParsedMessage {
+	data := nmea2k.DataMap{
+		0: "Alarm",
+		1: "Technical",
+		2: uint64(5),
+		3: uint64(2),
+		4: uint64(1001),
+		5: uint64(0xC0FFEE0123456789),
+		6: uint64(0),
+		7: uint64(1),
+		8: uint64(7),
+	}
+	for k, v := range fields {
+		data[k] = v
+	}
+
+	msg := newMessage(time.Now(), pgn, data)
+	msg.Interface = "can0"
+
+	return msg
+}
+
+func raised(state, silenced string) nmea2k.ParsedMessage {
+	return alertMessage(126983, nmea2k.DataMap{
+		9:  silenced,
+		10: "Not acknowledged",
+		12: "Supported",
+		13: "Not supported",
+		20: state,
+	})
+}
+
+func TestAlertText(t *testing.T) {
+	n := NewNotifier()
+
+	text := alertMessage(126985, nmea2k.DataMap{10: "Low oil pressure", 11: "Engine room"})
+	if _, ok := n.Alert(DefaultContext, &text); ok {
+		t.Error("Text of an alert which is not raised made a notification")
+	}
+
+	msg := raised("Active", "Not temporary status")
+	d, ok := n.Alert(DefaultContext, &msg)
+	if !ok {
+		t.Fatal("No notification")
+	}
+	if nt := d.Updates[0].Values[0].Value.(Notification); nt.Message != "Low oil pressure (Engine room)" {
+		t.Errorf("Got %+v", nt)
+	}
+
+	text = alertMessage(126985, nmea2k.DataMap{10: "Oil pressure very low"})
+	d, ok = n.Alert(DefaultContext, &text)
+	if !ok {
+		t.Fatal("No notification for new text")
+	}
+	if nt := d.Updates[0].Values[0].Value.(Notification); nt.Message != "Oil pressure very low" || nt.State != "alarm" {
+		t.Errorf("Got %+v", nt)
+	}
+}
+
+func TestAlertOccurrence(t *testing.T) {
+	n := NewNotifier()
+
+	msg := raised("Active", "Not temporary status")
+	n.Alert(DefaultContext, &msg)
+
+	if _, ok := n.Alert(DefaultContext, &msg); ok {
+		t.Error("Same alert raised twice")
+	}
+
+	msg.Data[8] = uint64(8)
+	if _, ok := n.Alert(DefaultContext, &msg); !ok {
+		t.Error("New occurrence not raised")
+	}
+
+	if h := n.History(); len(h) != 2 || h[1].Event != "state" {
+		t.Errorf("Got %+v", h)
+	}
+}
+
+func TestAlertResponse(t *testing.T) {
+	n := NewNotifier()
+	p := "notifications.nmea2000.1.1001"
+
+	if _, ok := n.AlertInterface(DefaultContext, p); ok {
+		t.Error("Unknown alert has an interface")
+	}
+	if _, err := n.AlertResponse(DefaultContext, p, "silence", 0); err == nil {
+		t.Error("Silenced an unknown alert")
+	}
+
+	msg := raised("Active", "Not temporary status")
+	n.Alert(DefaultContext, &msg)
+
+	if iface, ok := n.AlertInterface(DefaultContext, p); !ok || iface != "can0" {
+		t.Errorf("Got %v %v", iface, ok)
+	}
+
+	if _, err := n.AlertResponse(DefaultContext, p, "acknowledge", 0); err == nil {
+		t.Error("Acknowledged an alert which does not support it")
+	}
+
+	raw, err := n.AlertResponse(DefaultContext, p, "silence", 0x1234)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if raw.Pgn != 126984 || raw.Destination != 255 {
+		t.Errorf("Got %+v", raw)
+	}
+
+	res := nmea2k.ParsePacket(&can.RawMessage{Pgn: raw.Pgn, Length: raw.Length, Data: raw.Data})
+	for i, want := range []interface{}{
+		"Alarm", "Technical", uint64(5), uint64(2), uint64(1001), uint64(0xC0FFEE0123456789),
+		uint64(0), uint64(1), uint64(7), uint64(0x1234), "Temporary Silence",
+	} {
+		if res.Data[i] != want {
+			t.Errorf("Field %v is %#v, expected %#v", i, res.Data[i], want)
+		}
+	}
+
+	// The device says it is silenced
+	msg = raised("Silenced", "Temporary status")
+	d, ok := n.Alert(DefaultContext, &msg)
+	if !ok {
+		t.Fatal("No notification")
+	}
+	if nt := d.Updates[0].Values[0].Value.(Notification); !nt.Status.Silenced || len(nt.Method) != 1 {
+		t.Errorf("Got %+v", nt)
+	}
+}
@@ -0,0 +1,145 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package signalk
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/timmathews/argo/nmea2k"
+)
+
+// builtin says whether the SignalkPath of each field in the PGN definitions
+// is used as a mapping. It is unless the mapping file says
+// <mappings builtin="false">.
+func (m *Mappings) builtin() bool {
+	return m.Builtin == nil || *m.Builtin
+}
+
+// builtinGroups returns a parameter group for each field of a PGN definition
+// which has a SignalkPath, such as electrical.ac.utility.frequency, unless
+// the mapping file already maps the field or the path. Placeholders in the
+// path, such as electrical.ac.{instance}.frequency, are filled in from the
+// field of the same name. Fields in a repeating group and paths with a
+// placeholder which names no field are left out.
+func (m *Mappings) builtinGroups(def *nmea2k.Pgn, explicit []compiledGroup) []compiledGroup {
+	fields := make(map[int]bool)
+	paths := make(map[string]bool)
+
+	for i := range explicit {
+		cg := &explicit[i]
+		for _, n := range cg.fields() {
+			fields[n] = true
+		}
+		paths[pattern(cg.path)] = true
+	}
+
+	var groups []compiledGroup
+
+	rpt := def.FirstRepeatingField()
+
+	for i, f := range def.FieldList {
+		if f.SignalkPath == "" || fields[i] || (rpt >= 0 && i >= rpt) {
+			continue
+		}
+
+		slots := make(map[string]pathPart)
+		resolved := true
+		for _, p := range placeholderRegexp.FindAllStringSubmatch(f.SignalkPath, -1) {
+			n := placeholderField(def, p[1])
+			if n < 0 {
+				resolved = false
+				break
+			}
+			slots[p[0]] = pathPart{slot: slotClassifier, field: n}
+		}
+		if !resolved {
+			continue
+		}
+
+		path := template(f.SignalkPath, slots)
+		if paths[pattern(path)] {
+			continue
+		}
+
+		groups = append(groups, compiledGroup{
+			parameterGroup: &parameterGroup{Pgn: def.Pgn, Field: strconv.Itoa(i)},
+			path:           path,
+			field:          i,
+			builtin:        true,
+			meta:           fieldMeta(def, i, nil),
+		})
+	}
+
+	return groups
+}
+
+// placeholderField finds the field a placeholder of a SignalkPath names,
+// either by its name, as in {instance}, or by its name in camel case, as in
+// {batteryInstance}. It returns -1 if there is none.
+func placeholderField(def *nmea2k.Pgn, id string) int {
+	if n, err := def.FieldIndex(id); err == nil {
+		return n
+	}
+
+	for n, f := range def.FieldList {
+		if camelCase(f.Name) == id {
+			return n
+		}
+	}
+
+	return -1
+}
+
+// pattern is a path template with every placeholder written as *, to tell
+// whether two templates give the same paths
+func pattern(path []pathPart) string {
+	var b strings.Builder
+
+	for _, part := range path {
+		if part.slot == slotNone {
+			b.WriteString(part.text)
+		} else {
+			b.WriteByte('*')
+		}
+	}
+
+	return b.String()
+}
+
+// fields returns the fields of a message a group reads its value from
+func (cg *compiledGroup) fields() []int {
+	var fields []int
+
+	switch {
+	case cg.members != nil:
+		for _, m := range cg.members {
+			fields = append(fields, m.field)
+		}
+	case cg.fieldset:
+		for _, f := range cg.Fieldset.Fields {
+			fields = append(fields, f.Value)
+		}
+	case cg.field >= 0:
+		fields = append(fields, cg.field)
+	}
+
+	return fields
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package signalk
+
+import (
+	"encoding/xml"
+	"testing"
+	"time"
+
+	"github.com/timmathews/argo/nmea2k"
+)
+
+func TestBuiltin(t *testing.T) {
+	in := newMessage(time.Now(), 127258, nmea2k.DataMap{0: uint8(1), 4: -11.5})
+
+	got, err := mapdata.Delta(&in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if v := find(got, "navigation.magneticVariation"); v != -11.5 {
+		t.Errorf("Got %+v", got)
+	}
+}
+
+func TestBuiltinPrecedence(t *testing.T) {
+	// Yaw, pitch and roll are members of navigation.attitude in map.xml
+	in := newMessage(time.Now(), 127257, nmea2k.DataMap{0: uint8(1), 1: 10.0, 2: 2.0, 3: 3.0})
+
+	got, err := mapdata.Delta(&in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(got.Updates[0].Values) != 1 || find(got, "navigation.attitude") == nil {
+		t.Errorf("Got %+v", got)
+	}
+}
+
+func TestBuiltinOff(t *testing.T) {
+	var m Mappings
+	if err := xml.Unmarshal([]byte(`<mappings builtin="false"></mappings>`), &m); err != nil {
+		t.Fatal(err)
+	}
+
+	in := newMessage(time.Now(), 127258, nmea2k.DataMap{0: uint8(1), 4: -11.5})
+	if got, err := m.Delta(&in); err == nil {
+		t.Errorf("Got %+v", got)
+	}
+
+	for _, p := range m.Unmapped() {
+		if p.Pgn == 127258 {
+			return
+		}
+	}
+	t.Error("PGN 127258 is mapped")
+}
+
+func TestBuiltinPlaceholder(t *testing.T) {
+	saved := nmea2k.PgnList
+	nmea2k.PgnList = append(nmea2k.PgnArray(nil), saved...)
+	defer func() { nmea2k.PgnList = saved }()
+
+	idx, def := nmea2k.PgnList.First(127508)
+	def.FieldList = append([]nmea2k.Field(nil), def.FieldList...)
+	def.FieldList[1].SignalkPath = "electrical.batteries.{batteryInstance}.voltage"
+	def.FieldList[2].SignalkPath = "electrical.batteries.{bank}.current"
+	nmea2k.PgnList[idx] = def
+
+	var m Mappings
+	in := newMessage(time.Now(), 127508, nmea2k.DataMap{0: uint8(2), 1: 12.6, 2: 4.5})
+
+	got, err := m.Delta(&in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// {bank} names no field, so the current has no path
+	if len(got.Updates[0].Values) != 1 || find(got, "electrical.batteries.2.voltage") != 12.6 {
+		t.Errorf("Got %+v", got)
+	}
+
+	for _, p := range m.Unmapped() {
+		if p.Pgn == 127508 {
+			t.Error("PGN 127508 is not mapped")
+		}
+	}
+}
@@ -0,0 +1,264 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package signalk
+
+import (
+	"math"
+	"time"
+)
+
+// Calculations are the calculations argo can make. They are turned on in
+// the Calculators section of the configuration, by name. Every calculation
+// also takes a maxAge parameter, the number of seconds its inputs may be
+// apart.
+var Calculations = []Calculation{
+	{
+		Name:        "headingTrue",
+		Description: "True heading from magnetic heading and variation",
+		Inputs: []CalculationInput{
+			{Name: "heading", Path: "navigation.headingMagnetic"},
+			{Name: "variation", Path: "navigation.magneticVariation"},
+		},
+		Outputs: []CalculationOutput{
+			{"navigation.headingTrue", "rad", "True heading, from magnetic heading and variation"},
+		},
+		calc: func(c *activeCalculation, in map[string]float64, ts time.Time) []interface{} {
+			return []interface{}{wrapAngle(in["heading"] + in["variation"])}
+		},
+	},
+	{
+		Name:        "trueWind",
+		Description: "True wind over water from apparent wind, speed through water and heading",
+		Inputs: []CalculationInput{
+			{Name: "speed", Path: "environment.wind.speedApparent"},
+			{Name: "angle", Path: "environment.wind.angleApparent"},
+			{Name: "stw", Path: "navigation.speedThroughWater"},
+			{Name: "heading", Path: "navigation.headingTrue", Optional: true},
+		},
+		Outputs: []CalculationOutput{
+			{"environment.wind.speedTrue", "m/s", "True wind speed over water"},
+			{"environment.wind.angleTrueWater", "rad", "True wind angle over water, from the bow"},
+			{"environment.wind.directionTrue", "rad", "True wind direction over water, from true north"},
+		},
+		calc: func(c *activeCalculation, in map[string]float64, ts time.Time) []interface{} {
+			speed, angle := subtractVector(in["speed"], in["angle"], in["stw"], 0)
+
+			out := []interface{}{speed, angle, nil}
+			if heading, ok := in["heading"]; ok {
+				out[2] = wrapDirection(heading + angle)
+			}
+
+			return out
+		},
+	},
+	{
+		Name:        "groundWind",
+		Description: "Wind over ground from apparent wind, speed and course over ground and heading",
+		Inputs: []CalculationInput{
+			{Name: "speed", Path: "environment.wind.speedApparent"},
+			{Name: "angle", Path: "environment.wind.angleApparent"},
+			{Name: "sog", Path: "navigation.speedOverGround"},
+			{Name: "cog", Path: "navigation.courseOverGroundTrue"},
+			{Name: "heading", Path: "navigation.headingTrue"},
+		},
+		Outputs: []CalculationOutput{
+			{"environment.wind.speedOverGround", "m/s", "Wind speed over ground"},
+			{"environment.wind.angleTrueGround", "rad", "Wind angle over ground, from the bow"},
+		},
+		calc: func(c *activeCalculation, in map[string]float64, ts time.Time) []interface{} {
+			speed, angle := subtractVector(in["speed"], in["angle"], in["sog"], in["cog"]-in["heading"])
+			return []interface{}{speed, angle}
+		},
+	},
+	{
+		Name:        "setDrift",
+		Description: "Set and drift of the current from speed through water, heading and speed and course over ground",
+		Inputs: []CalculationInput{
+			{Name: "stw", Path: "navigation.speedThroughWater"},
+			{Name: "heading", Path: "navigation.headingTrue"},
+			{Name: "sog", Path: "navigation.speedOverGround"},
+			{Name: "cog", Path: "navigation.courseOverGroundTrue"},
+		},
+		Outputs: []CalculationOutput{
+			{"environment.current", "", "Set and drift of the current"},
+		},
+		calc: func(c *activeCalculation, in map[string]float64, ts time.Time) []interface{} {
+			// The current is the difference between the motion over ground
+			// and through the water
+			north := in["sog"]*math.Cos(in["cog"]) - in["stw"]*math.Cos(in["heading"])
+			east := in["sog"]*math.Sin(in["cog"]) - in["stw"]*math.Sin(in["heading"])
+
+			return []interface{}{map[string]interface{}{
+				"setTrue": wrapDirection(math.Atan2(east, north)),
+				"drift":   math.Hypot(north, east),
+			}}
+		},
+	},
+	{
+		Name:        "dewPoint",
+		Description: "Dew point from outside temperature and humidity",
+		Inputs: []CalculationInput{
+			{Name: "temperature", Path: "environment.outside.temperature"},
+			{Name: "humidity", Path: "environment.outside.relativeHumidity"},
+		},
+		Outputs: []CalculationOutput{
+			{"environment.outside.dewPointTemperature", "K", "Dew point, from outside temperature and humidity"},
+		},
+		calc: func(c *activeCalculation, in map[string]float64, ts time.Time) []interface{} {
+			if in["humidity"] <= 0 {
+				return []interface{}{nil}
+			}
+
+			// Magnus formula, with the constants of Sonntag
+			const b, c2 = 17.62, 243.12
+
+			t := in["temperature"] - 273.15
+			g := math.Log(in["humidity"]) + b*t/(c2+t)
+
+			return []interface{}{c2*g/(b-g) + 273.15}
+		},
+	},
+	{
+		Name:        "heatIndex",
+		Description: "Heat index from outside temperature and humidity",
+		Inputs: []CalculationInput{
+			{Name: "temperature", Path: "environment.outside.temperature"},
+			{Name: "humidity", Path: "environment.outside.relativeHumidity"},
+		},
+		Outputs: []CalculationOutput{
+			{"environment.outside.heatIndexTemperature", "K", "Heat index, from outside temperature and humidity"},
+		},
+		calc: func(c *activeCalculation, in map[string]float64, ts time.Time) []interface{} {
+			t := (in["temperature"]-273.15)*9/5 + 32
+			return []interface{}{(heatIndex(t, in["humidity"]*100)-32)*5/9 + 273.15}
+		},
+	},
+	{
+		Name:        "vmg",
+		Description: "Velocity made good to windward from speed through water and true wind angle",
+		Inputs: []CalculationInput{
+			{Name: "stw", Path: "navigation.speedThroughWater"},
+			{Name: "angle", Path: "environment.wind.angleTrueWater"},
+		},
+		Outputs: []CalculationOutput{
+			{"performance.velocityMadeGood", "m/s", "Velocity made good to windward"},
+		},
+		calc: func(c *activeCalculation, in map[string]float64, ts time.Time) []interface{} {
+			return []interface{}{in["stw"] * math.Cos(in["angle"])}
+		},
+	},
+	{
+		Name:        "leeway",
+		Description: "Estimated leeway from heel and speed through water",
+		Inputs: []CalculationInput{
+			{Name: "roll", Path: "navigation.attitude.roll"},
+			{Name: "stw", Path: "navigation.speedThroughWater"},
+		},
+		Outputs: []CalculationOutput{
+			{"performance.leeway", "rad", "Estimated leeway, from heel and speed through water"},
+		},
+		Parameters: map[string]float64{
+			"coefficient": 10,  // Of the hull, in kn²
+			"minSpeed":    0.5, // m/s below which leeway is not estimated
+		},
+		calc: func(c *activeCalculation, in map[string]float64, ts time.Time) []interface{} {
+			if in["stw"] < c.params["minSpeed"] {
+				return []interface{}{nil}
+			}
+
+			// leeway (deg) = coefficient × heel (deg) / STW (kn)²
+			heel := in["roll"] * 180 / math.Pi
+			kn := in["stw"] * 3600 / 1852
+
+			return []interface{}{c.params["coefficient"] * heel / (kn * kn) * math.Pi / 180}
+		},
+	},
+	{
+		Name:        "rateOfTurn",
+		Description: "Smoothed rate of turn",
+		Inputs: []CalculationInput{
+			{Name: "rate", Path: "navigation.rateOfTurn"},
+		},
+		Outputs: []CalculationOutput{
+			{"navigation.rateOfTurnSmoothed", "rad/s", "Rate of turn, smoothed"},
+		},
+		Parameters: map[string]float64{
+			"smoothing": 0.3, // Weight of each new value, from 0 to 1
+		},
+		calc: func(c *activeCalculation, in map[string]float64, ts time.Time) []interface{} {
+			// The average starts again after a gap in the input
+			if c.last.IsZero() || ts.Sub(c.last) > c.maxAge {
+				c.state = in["rate"]
+			} else {
+				c.state += c.params["smoothing"] * (in["rate"] - c.state)
+			}
+			c.last = ts
+
+			return []interface{}{c.state}
+		},
+	},
+}
+
+// subtractVector subtracts the motion of the boat, at speed s and angle b
+// from the bow, from a wind of speed a and angle alpha from the bow, and
+// returns the speed and angle of the wind which is left
+func subtractVector(a, alpha, s, b float64) (float64, float64) {
+	x := a*math.Cos(alpha) - s*math.Cos(b)
+	y := a*math.Sin(alpha) - s*math.Sin(b)
+
+	return math.Hypot(x, y), math.Atan2(y, x)
+}
+
+// wrapAngle wraps an angle to between -π and π
+func wrapAngle(a float64) float64 {
+	return math.Atan2(math.Sin(a), math.Cos(a))
+}
+
+// wrapDirection wraps an angle to between 0 and 2π
+func wrapDirection(a float64) float64 {
+	a = math.Mod(a, 2*math.Pi)
+	if a < 0 {
+		a += 2 * math.Pi
+	}
+
+	return a
+}
+
+// heatIndex is the heat index of the National Weather Service, in F, of a
+// temperature in F and a relative humidity in percent
+func heatIndex(t, rh float64) float64 {
+	hi := 0.5 * (t + 61 + (t-68)*1.2 + rh*0.094)
+	if (hi+t)/2 < 80 {
+		return hi
+	}
+
+	// Rothfusz regression
+	hi = -42.379 + 2.04901523*t + 10.14333127*rh - 0.22475541*t*rh -
+		0.00683783*t*t - 0.05481717*rh*rh + 0.00122874*t*t*rh +
+		0.00085282*t*rh*rh - 0.00000199*t*t*rh*rh
+
+	if rh < 13 && t >= 80 && t <= 112 {
+		hi -= (13 - rh) / 4 * math.Sqrt((17-math.Abs(t-95))/17)
+	} else if rh > 85 && t >= 80 && t <= 87 {
+		hi += (rh - 85) / 10 * (87 - t) / 5
+	}
+
+	return hi
+}
@@ -0,0 +1,342 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package signalk
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Label of the source of calculated values, whose $source is the label
+// and the name of the calculation, such as derived.trueWind
+const derivedLabel = "derived"
+
+// How far apart the inputs of a calculation may be, unless its maxAge
+// parameter says otherwise
+const defaultMaxAge = 5 * time.Second
+
+// How many times the outputs of calculations are fed back in, for
+// calculations which use the outputs of others
+const calculationDepth = 4
+
+// CalculatorConfig turns a calculation on. Inputs replace the paths of its
+// inputs, by name, and Parameters its options.
+type CalculatorConfig struct {
+	Enable     bool
+	Inputs     map[string]string  `toml:",omitempty"`
+	Parameters map[string]float64 `toml:",omitempty"`
+}
+
+// CalculationInput is a path a calculation reads. Values are converted to
+// Signal K units, such as rad and m/s, using the units of their meta. A
+// calculation is made without its optional inputs if they are missing.
+type CalculationInput struct {
+	Name     string
+	Path     string
+	Optional bool
+}
+
+// CalculationOutput is a path a calculation publishes, in Signal K units. It
+// is never one of the inputs, whose meta would then say other units.
+type CalculationOutput struct {
+	Path        string
+	Units       string
+	Description string
+}
+
+// Calculation derives paths, such as the true wind, from others
+type Calculation struct {
+	Name        string
+	Description string
+	Inputs      []CalculationInput
+	Outputs     []CalculationOutput
+	Parameters  map[string]float64 // Defaults of the options
+
+	// calc returns the value of each output, or nil for outputs it cannot
+	// work out. In holds the inputs by name.
+	calc func(c *activeCalculation, in map[string]float64, ts time.Time) []interface{}
+}
+
+// activeCalculation is a calculation which is turned on
+type activeCalculation struct {
+	*Calculation
+
+	paths  map[string]string  // Paths of the inputs, by name
+	params map[string]float64 // Options, with their defaults
+	src    source
+	maxAge time.Duration
+
+	// Kept between calculations by those which smooth
+	state float64
+	last  time.Time
+}
+
+// inputValue is the latest value of a path from one source
+type inputValue struct {
+	f  float64
+	ts time.Time
+}
+
+// Calculator makes the calculations which are turned on from the values of
+// our own vessel. Deltas are passed through Process, which returns the
+// values derived from them.
+type Calculator struct {
+	mu       sync.Mutex
+	self     string
+	active   []*activeCalculation
+	values   map[string]map[string]inputValue // By path and source
+	units    map[string]map[string]string     // Units by path and source, from their meta
+	metaSent map[string]bool
+}
+
+// NewCalculator sets up the calculations turned on in conf, by name
+func NewCalculator(self string, conf map[string]CalculatorConfig) (*Calculator, error) {
+	c := &Calculator{
+		self:     self,
+		values:   make(map[string]map[string]inputValue),
+		units:    make(map[string]map[string]string),
+		metaSent: make(map[string]bool),
+	}
+
+	var names []string
+	for name := range conf {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		cfg := conf[name]
+		calc := FindCalculation(name)
+		if calc == nil {
+			return nil, fmt.Errorf("unknown calculation %q", name)
+		}
+		if !cfg.Enable {
+			continue
+		}
+
+		a := &activeCalculation{
+			Calculation: calc,
+			paths:       make(map[string]string),
+			params:      make(map[string]float64),
+			src:         source{Label: derivedLabel, Type: "signalk", Src: calc.Name},
+			maxAge:      defaultMaxAge,
+		}
+
+		for _, in := range calc.Inputs {
+			a.paths[in.Name] = in.Path
+		}
+		for k, p := range cfg.Inputs {
+			if _, ok := a.paths[k]; !ok {
+				return nil, fmt.Errorf("%v has no input %q", name, k)
+			}
+			a.paths[k] = p
+		}
+		for _, o := range calc.Outputs {
+			for k, p := range a.paths {
+				if p == o.Path {
+					return nil, fmt.Errorf("%v input %q is its output %v", name, k, p)
+				}
+			}
+		}
+
+		for k, v := range calc.Parameters {
+			a.params[k] = v
+		}
+		for k, v := range cfg.Parameters {
+			if _, ok := a.params[k]; !ok && k != "maxAge" {
+				return nil, fmt.Errorf("%v has no parameter %q", name, k)
+			}
+			a.params[k] = v
+		}
+		if s, ok := a.params["maxAge"]; ok {
+			a.maxAge = time.Duration(s * float64(time.Second))
+		}
+
+		c.active = append(c.active, a)
+	}
+
+	return c, nil
+}
+
+// FindCalculation returns the calculation with a name, or nil
+func FindCalculation(name string) *Calculation {
+	for i := range Calculations {
+		if strings.EqualFold(Calculations[i].Name, name) {
+			return &Calculations[i]
+		}
+	}
+
+	return nil
+}
+
+// Process takes note of the values of our own vessel in a delta and returns
+// those the calculations derive from them. Derived values are fed back in,
+// for calculations which use the results of others.
+func (c *Calculator) Process(d Delta) (Delta, bool) {
+	out := Delta{Context: d.Context}
+
+	if d.Context != c.self || len(c.active) == 0 {
+		return out, false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for i := 0; i < calculationDepth && len(d.Updates) > 0; i++ {
+		changed := c.take(d)
+
+		d = Delta{Context: c.self}
+		for _, a := range c.active {
+			if u, ok := c.calculate(a, changed); ok {
+				d.Updates = append(d.Updates, u)
+			}
+		}
+
+		out.Updates = append(out.Updates, d.Updates...)
+	}
+
+	return out, len(out.Updates) > 0
+}
+
+// take records the numeric values of a delta and the units of their meta for
+// each source, and returns the time each path changed and by which source.
+// The members of objects, such as navigation.attitude.roll, are values of
+// their own.
+func (c *Calculator) take(d Delta) map[string]changedPath {
+	changed := make(map[string]changedPath)
+
+	store := func(path string, v interface{}, src string, ts time.Time) {
+		f, ok := number(v)
+		if !ok {
+			return
+		}
+		f = toBaseUnits(f, c.units[path][src])
+
+		if c.values[path] == nil {
+			c.values[path] = make(map[string]inputValue)
+		}
+		c.values[path][src] = inputValue{f, ts}
+		changed[path] = changedPath{src, ts}
+	}
+
+	for _, u := range d.Updates {
+		src := u.Source.label()
+
+		for _, mv := range u.Meta {
+			if c.units[mv.Path] == nil {
+				c.units[mv.Path] = make(map[string]string)
+			}
+			c.units[mv.Path][src] = mv.Value.Units
+		}
+
+		for _, v := range u.Values {
+			if obj, ok := v.Value.(map[string]interface{}); ok {
+				for k, m := range obj {
+					store(v.Path+"."+k, m, src, u.Timestamp)
+				}
+				continue
+			}
+			store(v.Path, v.Value, src, u.Timestamp)
+		}
+	}
+
+	return changed
+}
+
+// changedPath is when a path changed and which source changed it
+type changedPath struct {
+	src string
+	ts  time.Time
+}
+
+// toBaseUnits converts a value to the base units of its quantity, such as
+// deg to rad or C to K
+func toBaseUnits(f float64, u string) float64 {
+	if u == "%%" {
+		u = "%"
+	}
+
+	if un, ok := units[u]; ok {
+		return f*un.factor + un.shift
+	}
+
+	return f
+}
+
+// calculate makes a calculation if one of its inputs has changed, from
+// values which are recent enough, and returns its outputs. A calculation
+// never uses its own outputs.
+func (c *Calculator) calculate(a *activeCalculation, changed map[string]changedPath) (update, bool) {
+	own := a.src.label()
+
+	var ts time.Time
+	for _, p := range a.paths {
+		if ch, ok := changed[p]; ok && ch.src != own && ch.ts.After(ts) {
+			ts = ch.ts
+		}
+	}
+	if ts.IsZero() {
+		return update{}, false
+	}
+
+	in := make(map[string]float64, len(a.Inputs))
+
+	for _, input := range a.Inputs {
+		var best inputValue
+		found := false
+
+		for src, v := range c.values[a.paths[input.Name]] {
+			age := ts.Sub(v.ts)
+			if src == own || age > a.maxAge || age < -a.maxAge {
+				continue
+			}
+			if !found || v.ts.After(best.ts) {
+				best, found = v, true
+			}
+		}
+
+		if found {
+			in[input.Name] = best.f
+		} else if !input.Optional {
+			return update{}, false
+		}
+	}
+
+	u := update{Source: a.src, Timestamp: ts}
+
+	for i, v := range a.calc(a, in, ts) {
+		if v == nil {
+			continue
+		}
+
+		o := a.Outputs[i]
+		u.Values = append(u.Values, value{o.Path, v})
+
+		if !c.metaSent[own+"/"+o.Path] {
+			c.metaSent[own+"/"+o.Path] = true
+			u.Meta = append(u.Meta, metaValue{o.Path, Meta{Units: o.Units, Description: o.Description}})
+		}
+	}
+
+	return u, len(u.Values) > 0
+}
@@ -0,0 +1,321 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package signalk
+
+import (
+	"math"
+	"testing"
+	"time"
+
+	"github.com/timmathews/argo/nmea2k"
+)
+
+// newCalculator returns a calculator with the calculations turned on
+func newCalculator(t *testing.T, conf map[string]CalculatorConfig) *Calculator {
+	c, err := NewCalculator(DefaultContext, conf)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return c
+}
+
+// calculated returns the values of a delta by path, and their sources
+func calculated(d Delta) (map[string]interface{}, map[string]string) {
+	values := make(map[string]interface{})
+	sources := make(map[string]string)
+
+	for _, u := range d.Updates {
+		for _, v := range u.Values {
+			values[v.Path] = v.Value
+			sources[v.Path] = u.Source.label()
+		}
+	}
+
+	return values, sources
+}
+
+func near(v interface{}, want float64) bool {
+	f, ok := v.(float64)
+	return ok && math.Abs(f-want) < 1e-6
+}
+
+func TestCalculatorTrueWind(t *testing.T) {
+	c := newCalculator(t, map[string]CalculatorConfig{"trueWind": {Enable: true}})
+	ts := time.Now()
+
+	// Beating into 10 m/s of apparent wind 45° to starboard at 3 m/s
+	_, ok := c.Process(timedDelta(ts,
+		value{"environment.wind.speedApparent", 10.0},
+		value{"environment.wind.angleApparent", math.Pi / 4},
+	))
+	if ok {
+		t.Fatal("true wind calculated without speed through water")
+	}
+
+	d, ok := c.Process(timedDelta(ts, value{"navigation.speedThroughWater", 3.0}))
+	if !ok {
+		t.Fatal("true wind not calculated")
+	}
+
+	values, sources := calculated(d)
+
+	x, y := 10*math.Cos(math.Pi/4)-3, 10*math.Sin(math.Pi/4)
+	if !near(values["environment.wind.speedTrue"], math.Hypot(x, y)) {
+		t.Errorf("speedTrue %v, want %v", values["environment.wind.speedTrue"], math.Hypot(x, y))
+	}
+	if !near(values["environment.wind.angleTrueWater"], math.Atan2(y, x)) {
+		t.Errorf("angleTrueWater %v, want %v", values["environment.wind.angleTrueWater"], math.Atan2(y, x))
+	}
+	if _, ok := values["environment.wind.directionTrue"]; ok {
+		t.Error("directionTrue calculated without a heading")
+	}
+	if sources["environment.wind.speedTrue"] != "derived.trueWind" {
+		t.Errorf("source %q, want derived.trueWind", sources["environment.wind.speedTrue"])
+	}
+
+	if len(d.Updates[0].Meta) != 2 || d.Updates[0].Meta[0].Value.Units != "m/s" {
+		t.Errorf("meta %+v, want units of the outputs", d.Updates[0].Meta)
+	}
+
+	// Meta is sent once
+	d, _ = c.Process(timedDelta(ts, value{"navigation.speedThroughWater", 3.0}))
+	if len(d.Updates[0].Meta) != 0 {
+		t.Errorf("meta %+v sent again", d.Updates[0].Meta)
+	}
+}
+
+func TestCalculatorUnits(t *testing.T) {
+	c := newCalculator(t, map[string]CalculatorConfig{
+		"trueWind": {Enable: true, Inputs: map[string]string{"stw": "propulsion.speed.waterReferenced"}},
+	})
+	ts := time.Now()
+
+	// Angles in degrees are converted by the units of their meta
+	c.Process(MetaDelta(DefaultContext, "environment.wind.angleApparent", Meta{Units: "deg"}))
+	c.Process(MetaDelta(DefaultContext, "propulsion.speed.waterReferenced", Meta{Units: "kn"}))
+
+	d, ok := c.Process(timedDelta(ts,
+		value{"environment.wind.speedApparent", 5.0},
+		value{"environment.wind.angleApparent", 180.0},
+		value{"propulsion.speed.waterReferenced", 3600.0 / 1852},
+	))
+	if !ok {
+		t.Fatal("true wind not calculated")
+	}
+
+	values, _ := calculated(d)
+	if !near(values["environment.wind.speedTrue"], 6) {
+		t.Errorf("speedTrue %v, want 6", values["environment.wind.speedTrue"])
+	}
+	if !near(math.Abs(values["environment.wind.angleTrueWater"].(float64)), math.Pi) {
+		t.Errorf("angleTrueWater %v, want π", values["environment.wind.angleTrueWater"])
+	}
+}
+
+func TestCalculatorChain(t *testing.T) {
+	c := newCalculator(t, map[string]CalculatorConfig{
+		"headingTrue": {Enable: true},
+		"trueWind":    {Enable: true},
+		"vmg":         {Enable: true},
+	})
+	ts := time.Now()
+
+	c.Process(timedDelta(ts,
+		value{"navigation.magneticVariation", -0.1},
+		value{"environment.wind.speedApparent", 10.0},
+		value{"environment.wind.angleApparent", -math.Pi / 2},
+		value{"navigation.speedThroughWater", 0.0},
+	))
+
+	d, ok := c.Process(timedDelta(ts, value{"navigation.headingMagnetic", 0.6}))
+	if !ok {
+		t.Fatal("nothing calculated")
+	}
+
+	values, sources := calculated(d)
+	if !near(values["navigation.headingTrue"], 0.5) {
+		t.Errorf("headingTrue %v, want 0.5", values["navigation.headingTrue"])
+	}
+	if !near(values["environment.wind.directionTrue"], 0.5-math.Pi/2+2*math.Pi) {
+		t.Errorf("directionTrue %v, want %v", values["environment.wind.directionTrue"], 0.5-math.Pi/2+2*math.Pi)
+	}
+	if !near(values["performance.velocityMadeGood"], 0) {
+		t.Errorf("velocityMadeGood %v, want 0", values["performance.velocityMadeGood"])
+	}
+	if sources["navigation.headingTrue"] != "derived.headingTrue" {
+		t.Errorf("source %q, want derived.headingTrue", sources["navigation.headingTrue"])
+	}
+}
+
+func TestCalculatorMaxAge(t *testing.T) {
+	c := newCalculator(t, map[string]CalculatorConfig{"trueWind": {Enable: true}})
+	ts := time.Now()
+
+	c.Process(timedDelta(ts.Add(-time.Minute), value{"navigation.speedThroughWater", 3.0}))
+
+	if _, ok := c.Process(timedDelta(ts,
+		value{"environment.wind.speedApparent", 10.0},
+		value{"environment.wind.angleApparent", 1.0},
+	)); ok {
+		t.Error("true wind calculated from an old speed through water")
+	}
+}
+
+func TestCalculatorSetDrift(t *testing.T) {
+	c := newCalculator(t, map[string]CalculatorConfig{"setDrift": {Enable: true}})
+
+	// Heading north at 5 m/s and making 5 m/s east over ground
+	d, ok := c.Process(timedDelta(time.Now(),
+		value{"navigation.speedThroughWater", 5.0},
+		value{"navigation.headingTrue", 0.0},
+		value{"navigation.speedOverGround", 5.0},
+		value{"navigation.courseOverGroundTrue", math.Pi / 2},
+	))
+	if !ok {
+		t.Fatal("set and drift not calculated")
+	}
+
+	values, _ := calculated(d)
+	current := values["environment.current"].(map[string]interface{})
+	if !near(current["setTrue"], 3*math.Pi/4) || !near(current["drift"], 5*math.Sqrt2) {
+		t.Errorf("current %v, want set 3π/4 and drift 5√2", current)
+	}
+}
+
+func TestCalculatorWeather(t *testing.T) {
+	c := newCalculator(t, map[string]CalculatorConfig{
+		"dewPoint":  {Enable: true},
+		"heatIndex": {Enable: true},
+	})
+
+	d, _ := c.Process(timedDelta(time.Now(),
+		value{"environment.outside.temperature", 305.15},
+		value{"environment.outside.relativeHumidity", 0.7},
+	))
+
+	values, _ := calculated(d)
+
+	// 32°C at 70% has a dew point of 26°C and feels like 40.5°C
+	dp := values["environment.outside.dewPointTemperature"].(float64) - 273.15
+	if math.Abs(dp-26.0) > 0.2 {
+		t.Errorf("dew point %.2f°C, want 26°C", dp)
+	}
+	hi := values["environment.outside.heatIndexTemperature"].(float64) - 273.15
+	if math.Abs(hi-40.5) > 0.5 {
+		t.Errorf("heat index %.2f°C, want 40.5°C", hi)
+	}
+}
+
+func TestCalculatorLeeway(t *testing.T) {
+	c := newCalculator(t, map[string]CalculatorConfig{
+		"leeway": {Enable: true, Parameters: map[string]float64{"coefficient": 12}},
+	})
+
+	roll := map[string]interface{}{"roll": 20 * math.Pi / 180, "pitch": 0.0}
+	kn := 1852.0 / 3600
+
+	if _, ok := c.Process(timedDelta(time.Now(),
+		value{"navigation.attitude", roll},
+		value{"navigation.speedThroughWater", 0.2},
+	)); ok {
+		t.Error("leeway estimated below minSpeed")
+	}
+
+	d, ok := c.Process(timedDelta(time.Now(), value{"navigation.speedThroughWater", 4 * kn}))
+	if !ok {
+		t.Fatal("leeway not estimated")
+	}
+
+	values, _ := calculated(d)
+	if want := 12 * 20.0 / 16 * math.Pi / 180; !near(values["performance.leeway"], want) {
+		t.Errorf("leeway %v, want %v", values["performance.leeway"], want)
+	}
+}
+
+func TestCalculatorRateOfTurn(t *testing.T) {
+	c := newCalculator(t, map[string]CalculatorConfig{
+		"rateOfTurn": {Enable: true, Parameters: map[string]float64{"smoothing": 0.5}},
+	})
+	ts := time.Now()
+
+	var got []interface{}
+	for i, r := range []float64{0.1, 0.3, 0.3} {
+		d, ok := c.Process(timedDelta(ts.Add(time.Duration(i)*time.Second), value{"navigation.rateOfTurn", r}))
+		if !ok {
+			t.Fatal("rate of turn not smoothed")
+		}
+
+		values, sources := calculated(d)
+		if sources["navigation.rateOfTurnSmoothed"] != "derived.rateOfTurn" {
+			t.Errorf("source %q, want derived.rateOfTurn", sources["navigation.rateOfTurnSmoothed"])
+		}
+		got = append(got, values["navigation.rateOfTurnSmoothed"])
+	}
+
+	for i, want := range []float64{0.1, 0.2, 0.25} {
+		if !near(got[i], want) {
+			t.Errorf("rate of turn %v, want %v", got, []float64{0.1, 0.2, 0.25})
+			break
+		}
+	}
+}
+
+func TestCalculatorRateOfTurnMapped(t *testing.T) {
+	m := mapdata.WithMeta(nil)
+	c := newCalculator(t, map[string]CalculatorConfig{"rateOfTurn": {Enable: true}})
+	ts := time.Now()
+
+	// The rate of turn is in deg/s, as its meta says the first time
+	for i := 0; i < 5; i++ {
+		msg := newMessage(ts.Add(time.Duration(i)*time.Second), 127251, nmea2k.DataMap{1: 5.73})
+		in, err := m.Delta(&msg)
+		if err != nil {
+			t.Fatal(err)
+		}
+		in.Context = DefaultContext
+
+		d, ok := c.Process(in)
+		if !ok {
+			t.Fatal("rate of turn not smoothed")
+		}
+
+		values, _ := calculated(d)
+		if want := 5.73 * math.Pi / 180; !near(values["navigation.rateOfTurnSmoothed"], want) {
+			t.Fatalf("rate of turn %v at %v, want %v", values["navigation.rateOfTurnSmoothed"], i, want)
+		}
+		if _, ok := values["navigation.rateOfTurn"]; ok {
+			t.Error("Input was replaced")
+		}
+	}
+}
+
+func TestNewCalculatorErrors(t *testing.T) {
+	for _, conf := range []map[string]CalculatorConfig{
+		{"trueWnd": {Enable: true}},
+		{"trueWind": {Enable: true, Inputs: map[string]string{"sog": "navigation.speedOverGround"}}},
+		{"vmg": {Enable: true, Parameters: map[string]float64{"smoothing": 1}}},
+		{"rateOfTurn": {Enable: true, Inputs: map[string]string{"rate": "navigation.rateOfTurnSmoothed"}}},
+	} {
+		if _, err := NewCalculator(DefaultContext, conf); err == nil {
+			t.Errorf("%v accepted", conf)
+		}
+	}
+}
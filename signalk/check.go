@@ -0,0 +1,321 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package signalk
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/timmathews/argo/nmea2k"
+)
+
+// A path segment is a name, a {placeholder} or an element of an array, such
+// as satellites[{n}]
+var (
+	segmentRegexp     = regexp.MustCompile(`^([A-Za-z0-9_]+|\{[A-Za-z0-9_]+\}|[A-Za-z0-9_]+\[\{[A-Za-z0-9_]+\}\])$`)
+	placeholderRegexp = regexp.MustCompile(`\{([A-Za-z0-9_]+)\}`)
+)
+
+// Check cross-checks the mappings against the PGN definitions and returns
+// every mapping which could never produce a value: unknown PGNs, fields and
+// classifiers which do not exist, and malformed paths.
+func (m *Mappings) Check() []error {
+	var errs []error
+
+	for _, mapping := range m.Mappings {
+		placeholders, err := checkPath(mapping.Path)
+		if err != nil {
+			errs = append(errs, err)
+			continue
+		}
+
+		if len(mapping.ParameterGroups) == 0 && len(mapping.Puts) == 0 && len(mapping.Sentences) == 0 {
+			errs = append(errs, fmt.Errorf("%v: nothing is mapped", mapping.Path))
+		}
+
+		for i := range mapping.ParameterGroups {
+			for _, err := range mapping.ParameterGroups[i].check(placeholders) {
+				errs = append(errs, fmt.Errorf("%v: %v", mapping.Path, err))
+			}
+		}
+
+		for i := range mapping.Puts {
+			for _, err := range mapping.Puts[i].check(placeholders) {
+				errs = append(errs, fmt.Errorf("%v: put: %v", mapping.Path, err))
+			}
+		}
+	}
+
+	return errs
+}
+
+// checkPath checks the syntax of a mapping path, such as
+// ~/electrical/switches/bank/{instance}/{switch}/state, and returns its
+// placeholders
+func checkPath(p string) (map[string]bool, error) {
+	if !strings.HasPrefix(p, "~/") || len(p) < 3 {
+		return nil, fmt.Errorf("%q: paths start with ~/", p)
+	}
+
+	placeholders := make(map[string]bool)
+
+	for _, s := range strings.Split(p[2:], "/") {
+		if !segmentRegexp.MatchString(s) {
+			return nil, fmt.Errorf("%q: invalid path segment %q", p, s)
+		}
+		for _, m := range placeholderRegexp.FindAllStringSubmatch(s, -1) {
+			placeholders[m[1]] = true
+		}
+	}
+
+	return placeholders, nil
+}
+
+// variants returns every definition of a PGN
+func variants(pgn uint32) []nmea2k.Pgn {
+	var defs []nmea2k.Pgn
+
+	for _, def := range nmea2k.PgnList {
+		if def.Pgn == pgn {
+			defs = append(defs, def)
+		}
+	}
+
+	return defs
+}
+
+// check checks a parameter group against the definitions of its PGN. A field
+// need only exist in one variant of a proprietary PGN.
+func (parameterGroup *parameterGroup) check(placeholders map[string]bool) []error {
+	defs := variants(parameterGroup.Pgn)
+	if len(defs) == 0 {
+		return []error{fmt.Errorf("unknown PGN %v", parameterGroup.Pgn)}
+	}
+
+	var errs []error
+
+	// field finds a field by name or index in any variant
+	field := func(what, f string) (int, *nmea2k.Pgn) {
+		for i := range defs {
+			if n, err := defs[i].FieldIndex(f); err == nil {
+				return n, &defs[i]
+			}
+		}
+		errs = append(errs, fmt.Errorf("PGN %v has no %v %q", parameterGroup.Pgn, what, f))
+		return -1, nil
+	}
+
+	// index checks a field given by its index
+	index := func(what string, n int) {
+		for _, def := range defs {
+			if n >= 0 && n < len(def.FieldList) {
+				return
+			}
+		}
+		errs = append(errs, fmt.Errorf("PGN %v has no %v field %v", parameterGroup.Pgn, what, n))
+	}
+
+	switch parameterGroup.Fieldset.Type {
+	case "", "datetime", "object":
+	default:
+		errs = append(errs, fmt.Errorf("unknown fieldset type %q", parameterGroup.Fieldset.Type))
+	}
+
+	if fs := &parameterGroup.Fieldset; fs.Type == "object" {
+		if len(fs.Members) == 0 {
+			errs = append(errs, fmt.Errorf("object has no members"))
+		}
+		names := make(map[string]bool)
+		for _, m := range fs.Members {
+			if m.Name == "" || names[m.Name] {
+				errs = append(errs, fmt.Errorf("member %q is unnamed or repeated", m.Name))
+			}
+			names[m.Name] = true
+			if fld, def := field("member field", m.Field); def != nil {
+				if rpt := def.FirstRepeatingField(); rpt >= 0 && fld >= rpt {
+					errs = append(errs, fmt.Errorf("member %q is read from field %q, which repeats", m.Name, m.Field))
+				}
+			}
+			for _, t := range m.Transforms {
+				if t.Field != "" {
+					field("transform field", t.Field)
+				}
+			}
+		}
+	} else if len(parameterGroup.Fieldset.Fields) > 0 {
+		for _, f := range parameterGroup.Fieldset.Fields {
+			index("fieldset", f.Value)
+		}
+	} else if fld, def := field("field", parameterGroup.Field); def != nil {
+		if rpt := def.FirstRepeatingField(); (rpt < 0 || fld < rpt) && parameterGroup.Element.Id != "" {
+			errs = append(errs, fmt.Errorf("element %q of field %q, which does not repeat",
+				parameterGroup.Element.Id, parameterGroup.Field))
+		}
+	}
+
+	for _, p := range []struct{ what, id, field string }{
+		{"classifier", parameterGroup.Classifier.Id, parameterGroup.Classifier.Field},
+		{"multiplier", parameterGroup.Multiplier.Id, parameterGroup.Multiplier.Field},
+		{"element", parameterGroup.Element.Id, "-"},
+	} {
+		if p.id == "" {
+			continue
+		}
+		if !placeholders[p.id] {
+			errs = append(errs, fmt.Errorf("%v {%v} is not in the path", p.what, p.id))
+		}
+		if p.field == "" {
+			errs = append(errs, fmt.Errorf("%v {%v} has no field", p.what, p.id))
+		} else if p.field != "-" {
+			field(p.what+" field", p.field)
+		}
+	}
+
+	var conditions func([]condition)
+	conditions = func(cs []condition) {
+		for _, c := range cs {
+			if c.Operation == "and" || c.Operation == "or" {
+				conditions(c.Conditions)
+			} else {
+				index("condition", c.Field)
+			}
+		}
+	}
+	conditions(parameterGroup.Conditions)
+
+	for _, t := range parameterGroup.Transforms {
+		if t.Field != "" {
+			field("transform field", t.Field)
+		}
+	}
+
+	return errs
+}
+
+// PgnCoverage says which fields of a PGN are mapped to paths
+type PgnCoverage struct {
+	Pgn         uint32
+	Description string
+	Fields      int      // Fields other than reserved ones
+	Mapped      []string // Names of the mapped fields
+}
+
+// Coverage returns the PGNs the mappings read values from, by PGN. Fields
+// mapped through their SignalkPath count unless the mappings turn that off.
+func (m *Mappings) Coverage() []PgnCoverage {
+	mapped := make(map[uint32]map[string]bool)
+
+	for _, mapping := range m.Mappings {
+		for _, pg := range mapping.ParameterGroups {
+			defs := variants(pg.Pgn)
+			if len(defs) == 0 {
+				continue
+			}
+			if mapped[pg.Pgn] == nil {
+				mapped[pg.Pgn] = make(map[string]bool)
+			}
+
+			var fields []int
+			if pg.Fieldset.Type == "object" {
+				for _, m := range pg.Fieldset.Members {
+					if n, err := defs[0].FieldIndex(m.Field); err == nil {
+						fields = append(fields, n)
+					}
+				}
+			} else if len(pg.Fieldset.Fields) > 0 {
+				for _, f := range pg.Fieldset.Fields {
+					fields = append(fields, f.Value)
+				}
+			} else if n, err := defs[0].FieldIndex(pg.Field); err == nil {
+				fields = append(fields, n)
+			}
+
+			for _, n := range fields {
+				if n >= 0 && n < len(defs[0].FieldList) {
+					mapped[pg.Pgn][defs[0].FieldList[n].Name] = true
+				}
+			}
+		}
+	}
+
+	if m.builtin() {
+		idx := m.compiled()
+		for v, groups := range idx.groups {
+			def := &idx.pgns[v]
+			for _, cg := range groups {
+				if !cg.builtin {
+					continue
+				}
+				if mapped[def.Pgn] == nil {
+					mapped[def.Pgn] = make(map[string]bool)
+				}
+				mapped[def.Pgn][def.FieldList[cg.field].Name] = true
+			}
+		}
+	}
+
+	var cov []PgnCoverage
+
+	for pgn, names := range mapped {
+		def := variants(pgn)[0]
+		c := PgnCoverage{Pgn: pgn, Description: def.Description}
+
+		for _, f := range def.FieldList {
+			if f.Name == "Reserved" {
+				continue
+			}
+			c.Fields++
+			if names[f.Name] {
+				c.Mapped = append(c.Mapped, f.Name)
+			}
+		}
+
+		cov = append(cov, c)
+	}
+
+	sort.Slice(cov, func(i, j int) bool { return cov[i].Pgn < cov[j].Pgn })
+
+	return cov
+}
+
+// Unmapped returns the PGNs in PgnList which are given a path by neither the
+// mappings nor the SignalkPath of a field, by PGN
+func (m *Mappings) Unmapped() []nmea2k.Pgn {
+	// PGN 0 stands for every PGN which is not defined
+	covered := map[uint32]bool{0: true}
+	for _, c := range m.Coverage() {
+		covered[c.Pgn] = true
+	}
+
+	var pgns []nmea2k.Pgn
+
+	for _, def := range nmea2k.PgnList {
+		if !covered[def.Pgn] {
+			covered[def.Pgn] = true
+			pgns = append(pgns, def)
+		}
+	}
+
+	sort.SliceStable(pgns, func(i, j int) bool { return pgns[i].Pgn < pgns[j].Pgn })
+
+	return pgns
+}
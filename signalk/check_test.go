@@ -0,0 +1,120 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package signalk
+
+import (
+	"encoding/xml"
+	"strings"
+	"testing"
+)
+
+func TestCheckMapFile(t *testing.T) {
+	for _, err := range mapdata.Check() {
+		t.Error(err)
+	}
+}
+
+func TestCheckInvalid(t *testing.T) {
+	var m Mappings
+	err := xml.Unmarshal([]byte(`<mappings>
+		<mapping>
+			<path>~/a/b</path>
+			<parameter_group><pgn>99</pgn><field>0</field></parameter_group>
+		</mapping>
+		<mapping>
+			<path>~/a/c</path>
+			<parameter_group><pgn>128267</pgn><field>7</field></parameter_group>
+		</mapping>
+		<mapping>
+			<path>~/a/{x}/d</path>
+			<parameter_group>
+				<pgn>127501</pgn>
+				<field>Indicator</field>
+				<classifier><id>instance</id><field>Bank</field></classifier>
+				<condition><op>eq</op><field>40</field><value>1</value></condition>
+			</parameter_group>
+		</mapping>
+		<mapping>
+			<path>~/a/e</path>
+			<parameter_group>
+				<pgn>128267</pgn>
+				<field>Depth</field>
+				<element><id>n</id></element>
+				<transform><op>add</op><field>Keel</field></transform>
+			</parameter_group>
+		</mapping>
+		<mapping>
+			<path>a.f</path>
+			<parameter_group><pgn>128267</pgn><field>1</field></parameter_group>
+		</mapping>
+		<mapping>
+			<path>~/a/g h</path>
+			<parameter_group><pgn>128267</pgn><field>1</field></parameter_group>
+		</mapping>
+	</mappings>`), &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got []string
+	for _, err := range m.Check() {
+		got = append(got, err.Error())
+	}
+
+	for _, want := range []string{
+		"~/a/b: unknown PGN 99",
+		"~/a/c: PGN 128267 has no field \"7\"",
+		"~/a/{x}/d: classifier {instance} is not in the path",
+		"~/a/{x}/d: PGN 127501 has no classifier field \"Bank\"",
+		"~/a/{x}/d: PGN 127501 has no condition field 40",
+		"~/a/e: element \"n\" of field \"Depth\", which does not repeat",
+		"~/a/e: element {n} is not in the path",
+		"~/a/e: PGN 128267 has no transform field \"Keel\"",
+		"\"a.f\": paths start with ~/",
+		"\"~/a/g h\": invalid path segment \"g h\"",
+	} {
+		found := false
+		for _, s := range got {
+			found = found || s == want
+		}
+		if !found {
+			t.Errorf("Expected %q in\n%v", want, strings.Join(got, "\n"))
+		}
+	}
+
+	if len(got) != 10 {
+		t.Errorf("Expected 10 problems, got %v", len(got))
+	}
+}
+
+func TestCoverage(t *testing.T) {
+	for _, c := range mapdata.Coverage() {
+		if c.Pgn != 128267 {
+			continue
+		}
+		// SID is not mapped
+		if c.Fields != 3 || len(c.Mapped) != 2 {
+			t.Errorf("Got %+v", c)
+		}
+		return
+	}
+
+	t.Error("PGN 128267 is not covered")
+}
@@ -0,0 +1,318 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package signalk
+
+import (
+	"encoding/xml"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/timmathews/argo/nmea2k"
+)
+
+// condition restricts a parameter group to messages whose fields have certain
+// values. The operators are:
+//
+//	eq, ne, lt, gt, le, ge  compare the field with one value
+//	in                      the field equals one of several values
+//	between                 the field lies between two values, inclusive
+//	bits                    all bits of the mask given as the value are set
+//	regex                   the field, as text, matches a regular expression
+//	and, or                 combine the nested conditions
+//
+// Numbers are compared as numbers, lookup fields by their code so either the
+// name or the number may be given, and times as times, written as RFC 3339,
+// 2006-01-02 or 15:04:05.
+type condition struct {
+	Operation  string      `xml:"op"`
+	Field      int         `xml:"field"`
+	Values     []string    `xml:"value"`
+	Conditions []condition `xml:"condition"`
+
+	re   *regexp.Regexp
+	mask uint64
+}
+
+// UnmarshalXML checks a condition as the mapping file is read, so that a
+// mistake is reported when the file loads rather than ignored later.
+func (c *condition) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	type plain condition
+
+	var p plain
+	if err := d.DecodeElement(&p, &start); err != nil {
+		return err
+	}
+
+	*c = condition(p)
+	c.Operation = strings.ToLower(strings.TrimSpace(c.Operation))
+
+	return c.compile()
+}
+
+func (c *condition) compile() error {
+	want := 1
+
+	switch c.Operation {
+	case "and", "or":
+		if len(c.Conditions) == 0 {
+			return fmt.Errorf("condition %v without nested conditions", c.Operation)
+		}
+		want = 0
+	case "in":
+		if len(c.Values) == 0 {
+			return fmt.Errorf("condition in without values")
+		}
+		want = len(c.Values)
+	case "between":
+		want = 2
+	case "eq", "ne", "lt", "gt", "le", "ge", "bits", "regex":
+	default:
+		return fmt.Errorf("unknown condition operator %q", c.Operation)
+	}
+
+	if len(c.Values) != want {
+		return fmt.Errorf("condition %v takes %v values, not %v", c.Operation, want, len(c.Values))
+	}
+
+	var err error
+
+	switch c.Operation {
+	case "bits":
+		c.mask, err = strconv.ParseUint(strings.TrimSpace(c.Values[0]), 0, 64)
+	case "regex":
+		c.re, err = regexp.Compile(c.Values[0])
+	}
+
+	if err != nil {
+		return fmt.Errorf("condition %v: %v", c.Operation, err)
+	}
+
+	return nil
+}
+
+// conditionsMatch checks that the fields of a message satisfy every one of
+// the conditions. Def is the definition of the message, which says how its
+// fields are compared.
+func conditionsMatch(def *nmea2k.Pgn, conditions []condition, fields nmea2k.DataMap) bool {
+	for i := range conditions {
+		if !conditions[i].match(def, fields) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (c *condition) match(def *nmea2k.Pgn, fields nmea2k.DataMap) bool {
+	switch c.Operation {
+	case "and":
+		return conditionsMatch(def, c.Conditions, fields)
+	case "or":
+		for i := range c.Conditions {
+			if c.Conditions[i].match(def, fields) {
+				return true
+			}
+		}
+		return false
+	}
+
+	v := fields[c.Field]
+	if v == nil {
+		return false
+	}
+
+	var field *nmea2k.Field
+	if def != nil && c.Field >= 0 && c.Field < len(def.FieldList) {
+		field = &def.FieldList[c.Field]
+	}
+
+	switch c.Operation {
+	case "regex":
+		return c.re.MatchString(fmt.Sprintf("%v", v))
+	case "bits":
+		n, ok := integer(field, v, fields)
+		return ok && n&c.mask == c.mask
+	case "in":
+		for _, s := range c.Values {
+			if n, ok := compare(field, v, s, fields); ok && n == 0 {
+				return true
+			}
+		}
+		return false
+	case "between":
+		lo, ok1 := compare(field, v, c.Values[0], fields)
+		hi, ok2 := compare(field, v, c.Values[1], fields)
+		return ok1 && ok2 && lo >= 0 && hi <= 0
+	}
+
+	n, ok := compare(field, v, c.Values[0], fields)
+
+	return ok && compared(c.Operation, n)
+}
+
+// compared says whether the result of a comparison satisfies an operator
+// which compares with one value
+func compared(op string, n int) bool {
+	switch op {
+	case "eq":
+		return n == 0
+	case "ne":
+		return n != 0
+	case "lt":
+		return n < 0
+	case "gt":
+		return n > 0
+	case "le":
+		return n <= 0
+	case "ge":
+		return n >= 0
+	}
+
+	return false
+}
+
+// isLookup reports whether the values of a field are names from a table
+func isLookup(field *nmea2k.Field) bool {
+	if field == nil {
+		return false
+	}
+
+	switch field.Units.(type) {
+	case nmea2k.PgnLookup, nmea2k.PgnSubLookup:
+		return true
+	}
+
+	return field.Resolution == nmea2k.RES_LOOKUP ||
+		field.Resolution == nmea2k.RES_LOOKUP2 ||
+		field.Resolution == nmea2k.RES_MANUFACTURER
+}
+
+// compare returns -1, 0 or 1 as the value of a field is less than, equal to
+// or greater than the value of a condition, and false if they cannot be
+// compared.
+func compare(field *nmea2k.Field, v interface{}, s string, fields nmea2k.DataMap) (int, bool) {
+	s = strings.TrimSpace(s)
+
+	if isLookup(field) {
+		a, err1 := nmea2k.EncodeValue(field, v, fields)
+		b, err2 := nmea2k.EncodeValue(field, s, fields)
+		if err1 == nil && err2 == nil {
+			return sign(float64(a) - float64(b)), true
+		}
+	}
+
+	switch t := v.(type) {
+	case time.Time:
+		return compareTime(t, s)
+	case []byte:
+		a, _ := integer(field, t, fields)
+		b, err := strconv.ParseUint(s, 0, 64)
+		return sign(float64(a) - float64(b)), err == nil
+	case string:
+		// Text which happens to be a number is compared as one
+		a, err1 := strconv.ParseFloat(strings.TrimSpace(t), 64)
+		b, err2 := strconv.ParseFloat(s, 64)
+		if err1 == nil && err2 == nil {
+			return sign(a - b), true
+		}
+		return strings.Compare(t, s), true
+	}
+
+	a, ok := number(v)
+	if !ok {
+		return 0, false
+	}
+
+	b, err := strconv.ParseFloat(s, 64)
+
+	return sign(a - b), err == nil
+}
+
+// compareTime compares a time with a date and time, a date or a time of day
+func compareTime(t time.Time, s string) (int, bool) {
+	if u, err := time.Parse(time.RFC3339, s); err == nil {
+		return sign(t.Sub(u).Seconds()), true
+	}
+
+	if u, err := time.Parse("2006-01-02", s); err == nil {
+		y, m, d := t.Date()
+		return sign(time.Date(y, m, d, 0, 0, 0, 0, time.UTC).Sub(u).Seconds()), true
+	}
+
+	if u, err := time.Parse("15:04:05", s); err == nil {
+		t = t.UTC()
+		a := t.Hour()*3600 + t.Minute()*60 + t.Second()
+		b := u.Hour()*3600 + u.Minute()*60 + u.Second()
+		return sign(float64(a - b)), true
+	}
+
+	return 0, false
+}
+
+// integer returns the raw bits of a field, for bit masks
+func integer(field *nmea2k.Field, v interface{}, fields nmea2k.DataMap) (uint64, bool) {
+	if b, ok := v.([]byte); ok {
+		var n uint64
+		for i := len(b) - 1; i >= 0; i-- {
+			n = n<<8 | uint64(b[i])
+		}
+		return n, true
+	}
+
+	if isLookup(field) {
+		n, err := nmea2k.EncodeValue(field, v, fields)
+		return n, err == nil
+	}
+
+	f, ok := number(v)
+
+	return uint64(f), ok && f >= 0
+}
+
+// number converts any of the numeric types of a decoded field to a float64
+func number(v interface{}) (float64, bool) {
+	r := reflect.ValueOf(v)
+
+	switch r.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return float64(r.Int()), true
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return float64(r.Uint()), true
+	case reflect.Float32, reflect.Float64:
+		return r.Float(), true
+	}
+
+	return 0, false
+}
+
+func sign(f float64) int {
+	switch {
+	case f < 0:
+		return -1
+	case f > 0:
+		return 1
+	}
+
+	return 0
+}
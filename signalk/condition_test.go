@@ -0,0 +1,142 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package signalk
+
+import (
+	"encoding/xml"
+	"testing"
+	"time"
+
+	"github.com/timmathews/argo/nmea2k"
+)
+
+func mustCondition(t *testing.T, s string) condition {
+	var c condition
+	if err := xml.Unmarshal([]byte(s), &c); err != nil {
+		t.Fatalf("%v: %v", s, err)
+	}
+
+	return c
+}
+
+func TestConditionOperators(t *testing.T) {
+	_, cog := nmea2k.PgnList.First(129026)
+	_, fusion := nmea2k.PgnList.First(130820)
+
+	// SID, COG Reference, Reserved, COG, SOG
+	fields := nmea2k.DataMap{0: uint8(9), 1: "Magnetic", 2: []byte{0x2A}, 3: 123.4, 4: 5.3}
+
+	tests := []struct {
+		def      *nmea2k.Pgn
+		cond     string
+		expected bool
+	}{
+		// Numbers are not compared as text, where "9" > "10"
+		{&cog, `<condition><op>lt</op><field>0</field><value>10</value></condition>`, true},
+		{&cog, `<condition><op>gt</op><field>3</field><value>99.5</value></condition>`, true},
+		{&cog, `<condition><op>ge</op><field>4</field><value>5.30</value></condition>`, true},
+		{&cog, `<condition><op>ne</op><field>0</field><value>9</value></condition>`, false},
+		// Lookups by name or code
+		{&cog, `<condition><op>eq</op><field>1</field><value>Magnetic</value></condition>`, true},
+		{&cog, `<condition><op>eq</op><field>1</field><value>1</value></condition>`, true},
+		{&cog, `<condition><op>gt</op><field>1</field><value>True</value></condition>`, true},
+		{&cog, `<condition><op>in</op><field>1</field><value>True</value><value>Error</value></condition>`, false},
+		{&cog, `<condition><op>in</op><field>1</field><value>True</value><value>Magnetic</value></condition>`, true},
+		{&cog, `<condition><op>between</op><field>3</field><value>90</value><value>180</value></condition>`, true},
+		{&cog, `<condition><op>between</op><field>3</field><value>180</value><value>270</value></condition>`, false},
+		{&cog, `<condition><op>bits</op><field>2</field><value>0x0A</value></condition>`, true},
+		{&cog, `<condition><op>bits</op><field>2</field><value>0x05</value></condition>`, false},
+		{&cog, `<condition><op>regex</op><field>1</field><value>^Mag</value></condition>`, true},
+		{&cog, `<condition><op>or</op>
+			<condition><op>eq</op><field>1</field><value>True</value></condition>
+			<condition><op>and</op>
+				<condition><op>gt</op><field>4</field><value>5</value></condition>
+				<condition><op>lt</op><field>4</field><value>6</value></condition>
+			</condition>
+		</condition>`, true},
+		{&cog, `<condition><op>and</op>
+			<condition><op>eq</op><field>1</field><value>Magnetic</value></condition>
+			<condition><op>lt</op><field>4</field><value>5</value></condition>
+		</condition>`, false},
+		// Missing fields match nothing
+		{&cog, `<condition><op>ne</op><field>5</field><value>1</value></condition>`, false},
+		// A manufacturer code matches its name
+		{&fusion, `<condition><op>eq</op><field>0</field><value>419</value></condition>`, true},
+	}
+
+	for _, tt := range tests {
+		c := mustCondition(t, tt.cond)
+		data := fields
+		if tt.def == &fusion {
+			data = nmea2k.DataMap{0: "Fusion"}
+		}
+
+		if got := conditionsMatch(tt.def, []condition{c}, data); got != tt.expected {
+			t.Errorf("%v: expected %v, got %v", tt.cond, tt.expected, got)
+		}
+	}
+}
+
+func TestConditionTime(t *testing.T) {
+	ts := time.Date(2016, 5, 10, 14, 30, 0, 0, time.UTC)
+	fields := nmea2k.DataMap{0: ts}
+
+	for _, tt := range []struct {
+		cond     string
+		expected bool
+	}{
+		{`<condition><op>gt</op><field>0</field><value>2016-05-10T14:00:00Z</value></condition>`, true},
+		{`<condition><op>eq</op><field>0</field><value>2016-05-10</value></condition>`, true},
+		{`<condition><op>between</op><field>0</field><value>08:00:00</value><value>12:00:00</value></condition>`, false},
+		{`<condition><op>lt</op><field>0</field><value>yesterday</value></condition>`, false},
+	} {
+		c := mustCondition(t, tt.cond)
+		if got := conditionsMatch(nil, []condition{c}, fields); got != tt.expected {
+			t.Errorf("%v: expected %v, got %v", tt.cond, tt.expected, got)
+		}
+	}
+}
+
+func TestConditionInvalid(t *testing.T) {
+	for _, s := range []string{
+		`<condition><op>like</op><field>0</field><value>1</value></condition>`,
+		`<condition><op>eq</op><field>0</field></condition>`,
+		`<condition><op>between</op><field>0</field><value>1</value></condition>`,
+		`<condition><op>bits</op><field>0</field><value>x</value></condition>`,
+		`<condition><op>regex</op><field>0</field><value>(</value></condition>`,
+		`<condition><op>or</op></condition>`,
+	} {
+		var c condition
+		if err := xml.Unmarshal([]byte(s), &c); err == nil {
+			t.Errorf("%v: expected an error", s)
+		}
+	}
+
+	// A nested mistake fails the whole mapping file
+	var m Mappings
+	err := xml.Unmarshal([]byte(`<mappings><mapping><path>~/a/b</path><parameter_group>
+		<pgn>129026</pgn>
+		<field>3</field>
+		<condition><op>or</op><condition><op>eqq</op><field>1</field><value>1</value></condition></condition>
+	</parameter_group></mapping></mappings>`), &m)
+	if err == nil {
+		t.Error("expected an error from the mapping file")
+	}
+}
@@ -0,0 +1,406 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package signalk
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/timmathews/argo/nmea2k"
+)
+
+// errUnmapped rejects messages of PGNs without mappings. Most messages on a
+// busy bus are, so it is not formatted for each one.
+var errUnmapped = errors.New("PGN is not mapped")
+
+// valueCondition is a condition resolved against a PGN definition, so it
+// compares the decoded value of a field with numbers: the codes of lookups
+// and the values of other fields. Values which are not numbers are NaN,
+// which never compare.
+type valueCondition struct {
+	op     string
+	field  int
+	values []float64
+	nested []valueCondition
+}
+
+// DecodedDelta is Delta for a decoded message. The values of the message are
+// read as they are, without converting the message to a ParsedMessage, for
+// PGNs whose mappings allow it. Mappings of repeating groups, of datetime
+// fieldsets, with enum transforms or with regex or bits conditions are
+// converted as before, as are messages given to nmea2k.DecodedFrom. Messages
+// of PGNs without mappings are rejected without either.
+func (m *Mappings) DecodedDelta(msg *nmea2k.DecodedMessage) (Delta, error) {
+	idx := m.compiled()
+
+	groups := idx.groups[msg.Index]
+	if len(groups) == 0 {
+		return Delta{}, errUnmapped
+	}
+	if msg.From != nil || !idx.direct[msg.Index] || idx.pgns[msg.Index].Pgn != msg.Header.Pgn {
+		return m.Delta(msg.Parsed())
+	}
+
+	upd := update{
+		Source:    decodedSource(msg),
+		Timestamp: time.Now(),
+	}
+
+	for i := range groups {
+		cg := &groups[i]
+
+		if !valueConditionsMatch(msg, cg.conds) {
+			continue
+		}
+
+		if cg.members != nil {
+			if obj := cg.decodedObject(msg); obj != nil {
+				m.emit(idx, &upd, cg, value{cg.renderDecoded(msg), obj})
+			}
+			continue
+		}
+
+		v, ok := decodedValue(msg, cg.field, cg.Transforms, cg.operands)
+		if !ok {
+			continue
+		}
+		if path := cg.renderDecoded(msg); path != "" {
+			m.emit(idx, &upd, cg, value{path, v})
+		}
+	}
+
+	if len(upd.Values) == 0 {
+		return Delta{}, fmt.Errorf("unknown PGN %v from %v", upd.Source.Pgn, upd.Source.label())
+	}
+
+	return Delta{Context: m.context(), Updates: []update{upd}}, nil
+}
+
+// compileDirect resolves what DecodedDelta needs to map a group from the
+// values of a decoded message, and says whether it can
+func (cg *compiledGroup) compileDirect(def *nmea2k.Pgn) bool {
+	rpt := def.FirstRepeatingField()
+	fixed := func(i int) bool {
+		return i >= 0 && i < len(def.FieldList) && (rpt < 0 || i < rpt)
+	}
+
+	if cg.repeating || cg.fieldset {
+		return false
+	}
+	for _, part := range cg.path {
+		if part.slot != slotNone && (part.slot == slotElement || !fixed(part.field)) {
+			return false
+		}
+	}
+
+	var ok bool
+	if cg.conds, ok = compileValueConditions(def, cg.Conditions, fixed); !ok {
+		return false
+	}
+
+	if cg.members != nil {
+		for i := range cg.members {
+			m := &cg.members[i]
+			if m.operands, ok = compileOperands(def, m.field, m.Transforms, fixed); !ok {
+				return false
+			}
+		}
+		return true
+	}
+
+	cg.operands, ok = compileOperands(def, cg.field, cg.Transforms, fixed)
+
+	return ok
+}
+
+// compileOperands returns the field each transform adds or subtracts, or
+// -1. Only numbers are transformed directly.
+func compileOperands(def *nmea2k.Pgn, field int, ts []transform, fixed func(int) bool) ([]int, bool) {
+	if len(ts) == 0 {
+		return nil, true
+	}
+	if !numericKind(def.FieldList[field].Kind()) {
+		return nil, false
+	}
+
+	operands := make([]int, len(ts))
+
+	for i := range ts {
+		operands[i] = -1
+
+		switch ts[i].Operation {
+		case "enum":
+			return nil, false
+		case "add", "subtract":
+			n, err := def.FieldIndex(ts[i].Field)
+			if err != nil || !fixed(n) || !numericKind(def.FieldList[n].Kind()) {
+				return nil, false
+			}
+			operands[i] = n
+		}
+	}
+
+	return operands, true
+}
+
+// compileValueConditions resolves conditions against a definition. Lookups
+// are compared by their codes, and other fields as numbers.
+func compileValueConditions(def *nmea2k.Pgn, conditions []condition, fixed func(int) bool) ([]valueCondition, bool) {
+	if len(conditions) == 0 {
+		return nil, true
+	}
+
+	out := make([]valueCondition, len(conditions))
+
+	for i := range conditions {
+		c := &conditions[i]
+		vc := &out[i]
+		vc.op, vc.field = c.Operation, c.Field
+
+		switch c.Operation {
+		case "and", "or":
+			var ok bool
+			if vc.nested, ok = compileValueConditions(def, c.Conditions, fixed); !ok {
+				return nil, false
+			}
+			continue
+		case "regex", "bits":
+			return nil, false
+		}
+
+		if !fixed(c.Field) {
+			return nil, false
+		}
+
+		f := &def.FieldList[c.Field]
+		lookup := isLookup(f)
+
+		switch k := f.Kind(); {
+		case lookup && (k == nmea2k.KindLookup || k == nmea2k.KindManufacturer || k == nmea2k.KindInteger && !f.Signed):
+		case !lookup && numericKind(k):
+		default:
+			return nil, false
+		}
+
+		for _, s := range c.Values {
+			s = strings.TrimSpace(s)
+
+			if lookup {
+				n, err := nmea2k.EncodeValue(f, s, nil)
+				if err != nil {
+					return nil, false
+				}
+				vc.values = append(vc.values, float64(n))
+				continue
+			}
+
+			n, err := strconv.ParseFloat(s, 64)
+			if err != nil {
+				n = math.NaN()
+			}
+			vc.values = append(vc.values, n)
+		}
+	}
+
+	return out, true
+}
+
+// numericKind says whether the values of a kind are numbers
+func numericKind(k nmea2k.ValueKind) bool {
+	switch k {
+	case nmea2k.KindNumber, nmea2k.KindInteger, nmea2k.KindPosition,
+		nmea2k.KindTemperature, nmea2k.KindPressure, nmea2k.KindFloat:
+		return true
+	}
+
+	return false
+}
+
+// decodedField returns the value of a field outside the repeating group of a
+// message, or nil if it is missing or not available
+func decodedField(msg *nmea2k.DecodedMessage, i int) *nmea2k.Value {
+	// Fields before the repeating group are decoded in order
+	if i < 0 || i >= len(msg.Values) {
+		return nil
+	}
+
+	v := &msg.Values[i]
+	if v.Index != i || v.Record >= 0 || !v.Valid {
+		return nil
+	}
+
+	return v
+}
+
+// valueNumber is the number a field has once it is in a DataMap, which keeps
+// some fields as float32
+func valueNumber(v *nmea2k.Value) float64 {
+	switch v.Kind {
+	case nmea2k.KindInteger:
+		if v.Field.Signed {
+			return float64(v.Int())
+		}
+		return float64(v.Uint)
+	case nmea2k.KindPosition:
+		if v.Field.Size == 64 {
+			return v.Float
+		}
+		return float64(float32(v.Float))
+	case nmea2k.KindTemperature, nmea2k.KindPressure, nmea2k.KindFloat:
+		return float64(float32(v.Float))
+	case nmea2k.KindLookup, nmea2k.KindManufacturer:
+		return float64(v.Uint)
+	}
+
+	return v.Float
+}
+
+// decodedValue returns the value of a field with transforms applied, and
+// false if the field or a field it is added to is missing
+func decodedValue(msg *nmea2k.DecodedMessage, field int, ts []transform, operands []int) (interface{}, bool) {
+	v := decodedField(msg, field)
+	if v == nil {
+		return nil, false
+	}
+	if len(ts) == 0 {
+		return v.Interface(), true
+	}
+
+	f := valueNumber(v)
+
+	for i := range ts {
+		var g float64
+		if operands[i] >= 0 {
+			o := decodedField(msg, operands[i])
+			if o == nil {
+				return nil, false
+			}
+			g = valueNumber(o)
+		}
+		f = ts[i].number(f, g)
+	}
+
+	return f, true
+}
+
+// decodedObject is object for a decoded message
+func (cg *compiledGroup) decodedObject(msg *nmea2k.DecodedMessage) map[string]interface{} {
+	obj := make(map[string]interface{}, len(cg.members))
+
+	for _, m := range cg.members {
+		v, ok := decodedValue(msg, m.field, m.Transforms, m.operands)
+		if !ok {
+			if m.Required {
+				return nil
+			}
+			continue
+		}
+
+		obj[m.Name] = v
+	}
+
+	if len(obj) == 0 {
+		return nil
+	}
+
+	return obj
+}
+
+// renderDecoded is render for a decoded message
+func (cg *compiledGroup) renderDecoded(msg *nmea2k.DecodedMessage) string {
+	if len(cg.path) == 1 && cg.path[0].slot == slotNone {
+		return cg.path[0].text
+	}
+
+	var b strings.Builder
+
+	for _, part := range cg.path {
+		if part.slot == slotNone {
+			b.WriteString(part.text)
+			continue
+		}
+
+		var v interface{}
+		if f := decodedField(msg, part.field); f != nil {
+			v = f.Interface()
+		}
+		fmt.Fprintf(&b, "%v", v)
+	}
+
+	return b.String()
+}
+
+// valueConditionsMatch checks that a decoded message satisfies every one of
+// the conditions
+func valueConditionsMatch(msg *nmea2k.DecodedMessage, conditions []valueCondition) bool {
+	for i := range conditions {
+		if !conditions[i].match(msg) {
+			return false
+		}
+	}
+
+	return true
+}
+
+func (c *valueCondition) match(msg *nmea2k.DecodedMessage) bool {
+	switch c.op {
+	case "and":
+		return valueConditionsMatch(msg, c.nested)
+	case "or":
+		for i := range c.nested {
+			if c.nested[i].match(msg) {
+				return true
+			}
+		}
+		return false
+	}
+
+	v := decodedField(msg, c.field)
+	if v == nil {
+		return false
+	}
+	a := valueNumber(v)
+
+	cmp := func(b float64) (int, bool) {
+		return sign(a - b), !math.IsNaN(b)
+	}
+
+	switch c.op {
+	case "in":
+		for _, b := range c.values {
+			if n, ok := cmp(b); ok && n == 0 {
+				return true
+			}
+		}
+		return false
+	case "between":
+		lo, ok1 := cmp(c.values[0])
+		hi, ok2 := cmp(c.values[1])
+		return ok1 && ok2 && lo >= 0 && hi <= 0
+	}
+
+	n, ok := cmp(c.values[0])
+
+	return ok && compared(c.op, n)
+}
@@ -0,0 +1,354 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package signalk
+
+import (
+	"fmt"
+	"math"
+	"reflect"
+	"regexp"
+	"sync"
+	"time"
+)
+
+// EmissionPolicy decides when values of the paths which match Path, where *
+// matches anything, are sent to an output. A value is sent when it differs
+// from the one last sent by more than Deadband, or by more than
+// RelativeDeadband times the one last sent, and at most every MinInterval.
+// Without a deadband every change is sent. A value which has not changed is
+// sent again after MaxSilence, if it is still being received.
+type EmissionPolicy struct {
+	Path             string
+	Deadband         float64
+	RelativeDeadband float64
+	MinInterval      time.Duration
+	MaxSilence       time.Duration
+}
+
+// Emitter applies emission policies to the deltas of an output. Values of
+// paths without a policy are sent as they come. With a batch interval the
+// values are held and sent together, in one delta for each context. Tick
+// must be called regularly to send values which are held. Intervals are
+// measured by the times given to Process and Tick, not the timestamps of
+// the values, which may come from clocks of their own.
+type Emitter struct {
+	mu       sync.Mutex
+	policies []EmissionPolicy
+	patterns []*regexp.Regexp
+	batch    time.Duration
+
+	states  map[emissionKey]*emission
+	waiting map[emissionKey]bool // States with a value to send later
+
+	queued  map[emissionKey]*queuedValue
+	order   []emissionKey
+	meta    []queuedMeta
+	flushed time.Time
+}
+
+// emissionKey is a path of a context from one source
+type emissionKey struct {
+	context, path, source string
+}
+
+// emission is what was last sent and last received of a path. SentAt is
+// when the value was sent, and latestAt the timestamp of the latest value.
+type emission struct {
+	policy *EmissionPolicy
+	src    source
+
+	sent   interface{}
+	sentAt time.Time
+
+	latest   interface{}
+	latestAt time.Time
+	received bool // The latest value has not been sent
+	pending  bool // The latest value is due once MinInterval has passed
+}
+
+// queuedValue is a value held for the next batch
+type queuedValue struct {
+	src source
+	ts  time.Time
+	v   interface{}
+}
+
+// queuedMeta is meta held for the next batch
+type queuedMeta struct {
+	context string
+	src     source
+	ts      time.Time
+	meta    metaValue
+}
+
+// NewEmitter returns an emitter which applies policies, the first which
+// matches a path, and sends values every batch if batch is not 0
+func NewEmitter(policies []EmissionPolicy, batch time.Duration) (*Emitter, error) {
+	if batch < 0 {
+		return nil, fmt.Errorf("negative batch interval %v", batch)
+	}
+
+	e := &Emitter{
+		policies: policies,
+		batch:    batch,
+		states:   make(map[emissionKey]*emission),
+		waiting:  make(map[emissionKey]bool),
+		queued:   make(map[emissionKey]*queuedValue),
+	}
+
+	for _, p := range policies {
+		if p.Deadband < 0 || p.RelativeDeadband < 0 || p.MinInterval < 0 || p.MaxSilence < 0 {
+			return nil, fmt.Errorf("emission of %v: negative deadband or interval", p.Path)
+		}
+		e.patterns = append(e.patterns, globRegexp(p.Path))
+	}
+
+	return e, nil
+}
+
+// policy returns the policy of a path, or nil if its values are always sent
+func (e *Emitter) policy(path string) *EmissionPolicy {
+	for i := range e.policies {
+		if e.patterns[i].MatchString(path) {
+			return &e.policies[i]
+		}
+	}
+
+	return nil
+}
+
+// Process returns the deltas to send for a delta received now, with the
+// values which are due. Nothing is returned while values are batched.
+func (e *Emitter) Process(d Delta, now time.Time) []Delta {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	out := Delta{Context: d.Context}
+
+	for _, u := range d.Updates {
+		nu := update{Source: u.Source, Timestamp: u.Timestamp, Meta: u.Meta}
+
+		for _, v := range u.Values {
+			if e.due(d.Context, u, v, now) {
+				nu.Values = append(nu.Values, v)
+			}
+		}
+
+		if len(nu.Values) > 0 || len(nu.Meta) > 0 {
+			out.Updates = append(out.Updates, nu)
+		}
+	}
+
+	if len(out.Updates) == 0 {
+		return nil
+	}
+
+	if e.batch > 0 {
+		e.queue(out)
+		return nil
+	}
+
+	return []Delta{out}
+}
+
+// due decides whether a value is sent now, and takes note of it
+func (e *Emitter) due(context string, u update, v value, now time.Time) bool {
+	p := e.policy(v.Path)
+	if p == nil {
+		return true
+	}
+
+	k := emissionKey{context, v.Path, u.Source.label()}
+
+	s, ok := e.states[k]
+	if !ok {
+		e.states[k] = &emission{policy: p, src: u.Source, sent: v.Value, sentAt: now, latest: v.Value, latestAt: u.Timestamp}
+		return true
+	}
+
+	s.src, s.latest, s.latestAt = u.Source, v.Value, u.Timestamp
+
+	switch {
+	case !changed(p, s.sent, v.Value):
+		if p.MaxSilence > 0 && now.Sub(s.sentAt) >= p.MaxSilence {
+			break
+		}
+		s.received, s.pending = true, false
+		e.wait(k, s)
+		return false
+	case p.MinInterval > 0 && now.Sub(s.sentAt) < p.MinInterval:
+		s.received, s.pending = true, true
+		e.wait(k, s)
+		return false
+	}
+
+	s.sent, s.sentAt, s.received, s.pending = v.Value, now, false, false
+	delete(e.waiting, k)
+
+	return true
+}
+
+// wait keeps track of a state which may have a value to send later
+func (e *Emitter) wait(k emissionKey, s *emission) {
+	if s.policy.MinInterval > 0 || s.policy.MaxSilence > 0 {
+		e.waiting[k] = true
+	}
+}
+
+// Tick returns the deltas due by now: values held back by MinInterval,
+// values resent after MaxSilence and the batch
+func (e *Emitter) Tick(now time.Time) []Delta {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	// Batches are counted from the first tick
+	if e.flushed.IsZero() {
+		e.flushed = now
+	}
+
+	var held []emissionKey
+
+	for k := range e.waiting {
+		s := e.states[k]
+		p := s.policy
+
+		if s.pending && now.Sub(s.sentAt) >= p.MinInterval ||
+			!s.pending && s.received && p.MaxSilence > 0 && now.Sub(s.sentAt) >= p.MaxSilence {
+			s.sent, s.sentAt, s.received, s.pending = s.latest, now, false, false
+			delete(e.waiting, k)
+			held = append(held, k)
+		} else if !s.received {
+			delete(e.waiting, k)
+		}
+	}
+
+	if len(held) == 0 && (e.batch == 0 || len(e.order) == 0 && len(e.meta) == 0) {
+		return nil
+	}
+
+	for _, k := range held {
+		s := e.states[k]
+		e.queueValue(k, s.src, s.latestAt, s.latest)
+	}
+
+	if e.batch > 0 && now.Sub(e.flushed) < e.batch {
+		return nil
+	}
+	e.flushed = now
+
+	return e.flush()
+}
+
+// queue holds the values and meta of a delta for the next batch. A value
+// replaces one of the same path and source which is already held.
+func (e *Emitter) queue(d Delta) {
+	for _, u := range d.Updates {
+		for _, m := range u.Meta {
+			e.meta = append(e.meta, queuedMeta{d.Context, u.Source, u.Timestamp, m})
+		}
+		for _, v := range u.Values {
+			e.queueValue(emissionKey{d.Context, v.Path, u.Source.label()}, u.Source, u.Timestamp, v.Value)
+		}
+	}
+}
+
+func (e *Emitter) queueValue(k emissionKey, src source, ts time.Time, v interface{}) {
+	if _, ok := e.queued[k]; !ok {
+		e.order = append(e.order, k)
+	}
+	e.queued[k] = &queuedValue{src, ts, v}
+}
+
+// flush returns the values and meta which are held, in a delta for each
+// context with an update for each source and time
+func (e *Emitter) flush() []Delta {
+	var out []Delta
+	deltas := make(map[string]int)
+	updates := make(map[string]int)
+
+	add := func(context string, src source, ts time.Time) *update {
+		i, ok := deltas[context]
+		if !ok {
+			i = len(out)
+			deltas[context] = i
+			out = append(out, Delta{Context: context})
+		}
+
+		d := &out[i]
+		uk := context + "/" + src.label() + "/" + ts.String()
+		j, ok := updates[uk]
+		if !ok {
+			j = len(d.Updates)
+			updates[uk] = j
+			d.Updates = append(d.Updates, update{Source: src, Timestamp: ts, Values: []value{}})
+		}
+
+		return &d.Updates[j]
+	}
+
+	for _, m := range e.meta {
+		u := add(m.context, m.src, m.ts)
+		u.Meta = append(u.Meta, m.meta)
+	}
+
+	for _, k := range e.order {
+		q := e.queued[k]
+		u := add(k.context, q.src, q.ts)
+		u.Values = append(u.Values, value{k.path, q.v})
+	}
+
+	e.queued = make(map[emissionKey]*queuedValue)
+	e.order = nil
+	e.meta = nil
+
+	return out
+}
+
+// changed tells whether a value differs from the one last sent by more than
+// either deadband of a policy, or at all if it has neither. Objects, such as
+// a position, have changed if any of their members has.
+func changed(p *EmissionPolicy, sent, v interface{}) bool {
+	if a, ok := number(sent); ok {
+		if b, ok := number(v); ok {
+			diff := math.Abs(b - a)
+			if p.Deadband == 0 && p.RelativeDeadband == 0 {
+				return diff > 0
+			}
+			return p.Deadband > 0 && diff > p.Deadband ||
+				p.RelativeDeadband > 0 && diff > p.RelativeDeadband*math.Abs(a)
+		}
+	}
+
+	a, ok1 := sent.(map[string]interface{})
+	b, ok2 := v.(map[string]interface{})
+	if ok1 && ok2 {
+		if len(a) != len(b) {
+			return true
+		}
+		for k := range b {
+			if _, ok := a[k]; !ok || changed(p, a[k], b[k]) {
+				return true
+			}
+		}
+		return false
+	}
+
+	return !reflect.DeepEqual(sent, v)
+}
@@ -0,0 +1,215 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package signalk
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newEmitter returns an emitter with the policies
+func newEmitter(t *testing.T, batch time.Duration, policies ...EmissionPolicy) *Emitter {
+	e, err := NewEmitter(policies, batch)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return e
+}
+
+// emitted returns the values of deltas, in order
+func emitted(ds []Delta) []interface{} {
+	var values []interface{}
+
+	for _, d := range ds {
+		for _, u := range d.Updates {
+			for _, v := range u.Values {
+				values = append(values, v.Value)
+			}
+		}
+	}
+
+	return values
+}
+
+func TestEmitterChangeOnly(t *testing.T) {
+	e := newEmitter(t, 0, EmissionPolicy{Path: "environment.*"})
+	ts := time.Now()
+
+	var got []interface{}
+	for i, v := range []interface{}{1.0, 1.0, 2.0, 2.0, "a", "a", "b"} {
+		got = append(got, emitted(e.Process(timedDelta(ts.Add(time.Duration(i)*time.Second), value{"environment.depth.belowKeel", v}), ts.Add(time.Duration(i)*time.Second)))...)
+	}
+
+	if want := []interface{}{1.0, 2.0, "a", "b"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("emitted %v, want %v", got, want)
+	}
+
+	// Paths without a policy are always sent
+	for i := 0; i < 2; i++ {
+		if got := emitted(e.Process(timedDelta(ts, value{"navigation.speedOverGround", 1.0}), ts)); len(got) != 1 {
+			t.Errorf("emitted %v, want the value", got)
+		}
+	}
+}
+
+func TestEmitterDeadband(t *testing.T) {
+	e := newEmitter(t, 0,
+		EmissionPolicy{Path: "environment.depth.*", Deadband: 0.5},
+		EmissionPolicy{Path: "navigation.position", RelativeDeadband: 0.001},
+	)
+	ts := time.Now()
+
+	var got []interface{}
+	for _, v := range []float64{10, 10.3, 10.5, 10.6, 9.9} {
+		got = append(got, emitted(e.Process(timedDelta(ts, value{"environment.depth.belowKeel", v}), ts))...)
+	}
+	if want := []interface{}{10.0, 10.6, 9.9}; !reflect.DeepEqual(got, want) {
+		t.Errorf("emitted %v, want %v", got, want)
+	}
+
+	got = nil
+	for _, lat := range []float64{42, 42.01, 42.05} {
+		pos := map[string]interface{}{"latitude": lat, "longitude": -71.0}
+		got = append(got, emitted(e.Process(timedDelta(ts, value{"navigation.position", pos}), ts))...)
+	}
+	if len(got) != 2 {
+		t.Errorf("emitted %v, want the first and last position", got)
+	}
+}
+
+func TestEmitterMinInterval(t *testing.T) {
+	e := newEmitter(t, 0, EmissionPolicy{Path: "*", MinInterval: time.Second})
+	ts := time.Now()
+
+	var got []interface{}
+	for i, v := range []float64{1, 2, 3} {
+		at := ts.Add(time.Duration(i) * 100 * time.Millisecond)
+		got = append(got, emitted(e.Process(timedDelta(at, value{"navigation.rateOfTurn", v}), at))...)
+	}
+	if want := []interface{}{1.0}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("emitted %v, want %v", got, want)
+	}
+
+	if got := emitted(e.Tick(ts.Add(500 * time.Millisecond))); len(got) != 0 {
+		t.Errorf("emitted %v before the interval", got)
+	}
+
+	// The latest value is sent once the interval has passed
+	if got := emitted(e.Tick(ts.Add(time.Second))); !reflect.DeepEqual(got, []interface{}{3.0}) {
+		t.Errorf("emitted %v, want [3]", got)
+	}
+	if got := emitted(e.Tick(ts.Add(3 * time.Second))); len(got) != 0 {
+		t.Errorf("emitted %v again", got)
+	}
+}
+
+func TestEmitterDeadbands(t *testing.T) {
+	// Either deadband is enough for a value to be sent
+	e := newEmitter(t, 0, EmissionPolicy{Path: "*", Deadband: 1, RelativeDeadband: 0.1})
+	ts := time.Now()
+
+	var got []interface{}
+	for _, v := range []float64{100, 101, 101.5, 2, 2.15, 2.3} {
+		got = append(got, emitted(e.Process(timedDelta(ts, value{"environment.depth.belowKeel", v}), ts))...)
+	}
+	if want := []interface{}{100.0, 101.5, 2.0, 2.3}; !reflect.DeepEqual(got, want) {
+		t.Errorf("emitted %v, want %v", got, want)
+	}
+}
+
+func TestEmitterClock(t *testing.T) {
+	e := newEmitter(t, 0, EmissionPolicy{Path: "*", MinInterval: time.Second})
+	now := time.Now()
+
+	// The values are stamped by a clock an hour behind
+	stamped := func(v float64, at time.Time) []Delta {
+		return e.Process(timedDelta(at.Add(-time.Hour), value{"navigation.rateOfTurn", v}), at)
+	}
+
+	stamped(1, now)
+	stamped(2, now.Add(100*time.Millisecond))
+	if got := emitted(e.Tick(now.Add(time.Second))); !reflect.DeepEqual(got, []interface{}{2.0}) {
+		t.Fatalf("emitted %v, want [2]", got)
+	}
+
+	if got := emitted(stamped(3, now.Add(1500*time.Millisecond))); len(got) != 0 {
+		t.Errorf("emitted %v within the interval", got)
+	}
+	if got := emitted(stamped(4, now.Add(2*time.Second))); !reflect.DeepEqual(got, []interface{}{4.0}) {
+		t.Errorf("emitted %v, want [4]", got)
+	}
+}
+
+func TestEmitterMaxSilence(t *testing.T) {
+	e := newEmitter(t, 0, EmissionPolicy{Path: "*", Deadband: 1, MaxSilence: 10 * time.Second})
+	ts := time.Now()
+
+	e.Process(timedDelta(ts, value{"environment.water.temperature", 290.0}), ts)
+	e.Process(timedDelta(ts.Add(time.Second), value{"environment.water.temperature", 290.2}), ts.Add(time.Second))
+
+	if got := emitted(e.Tick(ts.Add(5 * time.Second))); len(got) != 0 {
+		t.Errorf("emitted %v before the silence", got)
+	}
+	if got := emitted(e.Tick(ts.Add(10 * time.Second))); !reflect.DeepEqual(got, []interface{}{290.2}) {
+		t.Errorf("emitted %v, want [290.2]", got)
+	}
+
+	// Nothing is resent once the value stops coming
+	if got := emitted(e.Tick(ts.Add(30 * time.Second))); len(got) != 0 {
+		t.Errorf("emitted %v without a new value", got)
+	}
+}
+
+func TestEmitterBatch(t *testing.T) {
+	e := newEmitter(t, 5*time.Second)
+	ts := time.Now()
+
+	e.Tick(ts)
+
+	other := Delta{Context: "vessels.urn:mrn:imo:mmsi:230099999", Updates: []update{{
+		Source: source{Label: "n2k", Src: "2"}, Timestamp: ts, Values: []value{{"navigation.speedOverGround", 2.0}},
+	}}}
+
+	for _, d := range []Delta{
+		timedDelta(ts, value{"navigation.speedOverGround", 1.0}, value{"navigation.courseOverGroundTrue", 1.0}),
+		timedDelta(ts, value{"navigation.speedOverGround", 1.5}),
+		other,
+	} {
+		if got := e.Process(d, ts); got != nil {
+			t.Fatalf("emitted %v before the batch", got)
+		}
+	}
+
+	if got := e.Tick(ts.Add(time.Second)); got != nil {
+		t.Errorf("emitted %v before the batch", got)
+	}
+
+	got := e.Tick(ts.Add(5 * time.Second))
+	if len(got) != 2 || len(got[0].Updates) != 1 || len(got[1].Updates) != 1 {
+		t.Fatalf("emitted %+v, want a delta for each context with one update", got)
+	}
+
+	// The latest value of a path is sent
+	if values := emitted(got[:1]); !reflect.DeepEqual(values, []interface{}{1.5, 1.0}) {
+		t.Errorf("emitted %v, want [1.5 1]", values)
+	}
+}
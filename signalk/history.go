@@ -0,0 +1,718 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package signalk
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Segments hold the values of an hour and are named after it, in UTC
+const segmentLayout = "2006-01-02T15"
+
+// A segment is closed once nothing has been written to it for historyIdle,
+// and the least recently written is closed if more than historyOpen are open,
+// so values of other hours, such as from a source with a wrong clock, do not
+// close and open a segment over and over
+const (
+	historyIdle = 5 * time.Minute
+	historyOpen = 16
+)
+
+// HistoryRule says how often the values of the paths which match Path are
+// kept, and for how long. A * in Path matches anything, as in a
+// subscription. Values closer together than Interval are dropped; a
+// Retention of 0 keeps them for good.
+type HistoryRule struct {
+	Path      string
+	Retention time.Duration
+	Interval  time.Duration
+}
+
+// History keeps the values of deltas on disk, so they can be looked up and
+// played back later. Values are written to segments of an hour, one JSON
+// record per line, in a directory for each retention. A segment is removed
+// once all of its values are older than the retention.
+type History struct {
+	mu       sync.Mutex
+	dir      string
+	rules    []HistoryRule // The first which matches a path applies
+	patterns []*regexp.Regexp
+	last     map[string]time.Time
+	segments map[segmentKey]*segment
+	closed   []string // Segments done with, to be sorted
+	pruned   time.Time
+	swept    time.Time
+}
+
+// segmentKey is the retention and hour of a segment
+type segmentKey struct {
+	retention time.Duration
+	hour      time.Time
+}
+
+// segment is the file values of one hour and retention are written to
+type segment struct {
+	hour    time.Time
+	file    string
+	f       *os.File
+	w       *bufio.Writer
+	size    int64
+	index   map[string]*openEntry
+	written time.Time // When it was last written to
+}
+
+// historyRecord is a value as it is kept on disk
+type historyRecord struct {
+	Time    time.Time   `json:"t"`
+	Context string      `json:"c"`
+	Path    string      `json:"p"`
+	Source  source      `json:"s"`
+	Value   interface{} `json:"v"`
+}
+
+// NewHistory opens the history in dir, creating the directory if need be.
+// Rules are tried in order, and the last rule should match every path.
+func NewHistory(dir string, rules []HistoryRule) (*History, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	h := &History{
+		dir:      dir,
+		rules:    rules,
+		last:     make(map[string]time.Time),
+		segments: make(map[segmentKey]*segment),
+	}
+
+	for _, r := range rules {
+		if r.Retention < 0 || r.Interval < 0 {
+			return nil, fmt.Errorf("history of %v: negative retention or interval", r.Path)
+		}
+		if r.Retention > 0 && r.Retention < time.Hour {
+			return nil, fmt.Errorf("history of %v: retention of less than an hour", r.Path)
+		}
+		h.patterns = append(h.patterns, globRegexp(r.Path))
+	}
+
+	h.prune(time.Now())
+	h.sortClosed()
+
+	return h, nil
+}
+
+// rule returns the rule for a path, or nil if the path is not kept
+func (h *History) rule(path string) *HistoryRule {
+	for i := range h.rules {
+		if h.patterns[i].MatchString(path) {
+			return &h.rules[i]
+		}
+	}
+
+	return nil
+}
+
+// tier is the name of the directory of the values kept for a retention
+func tier(retention time.Duration) string {
+	if retention == 0 {
+		return "forever"
+	}
+
+	if retention%time.Hour == 0 {
+		return strconv.FormatInt(int64(retention/time.Hour), 10) + "h"
+	}
+
+	return strconv.FormatInt(int64(retention/time.Minute), 10) + "m"
+}
+
+// Record writes the values of a delta which are due to be kept
+func (h *History) Record(d Delta) error {
+	h.mu.Lock()
+	err := h.record(d)
+	h.mu.Unlock()
+
+	h.sortClosed()
+
+	return err
+}
+
+func (h *History) record(d Delta) error {
+	now := time.Now()
+	if now.Sub(h.pruned) >= time.Hour {
+		h.prune(now)
+	}
+	if now.Sub(h.swept) >= time.Minute {
+		h.sweep(now)
+	}
+
+	written := make(map[*segment]bool)
+
+	for _, u := range d.Updates {
+		for _, v := range u.Values {
+			r := h.rule(v.Path)
+			if r == nil {
+				continue
+			}
+
+			key := d.Context + "/" + v.Path
+			if last, ok := h.last[key]; ok && r.Interval > 0 &&
+				!u.Timestamp.Before(last) && u.Timestamp.Sub(last) < r.Interval {
+				continue
+			}
+			h.last[key] = u.Timestamp
+
+			b, err := json.Marshal(historyRecord{u.Timestamp, d.Context, v.Path, u.Source, v.Value})
+			if err != nil {
+				return err
+			}
+
+			s, err := h.segment(r.Retention, u.Timestamp)
+			if err != nil {
+				return err
+			}
+			s.w.Write(b)
+			s.w.WriteByte('\n')
+			s.add(d.Context, v.Path, u.Timestamp, int64(len(b)+1))
+			s.written = now
+			written[s] = true
+		}
+	}
+
+	// Flushed at once, so queries see every value
+	for s := range written {
+		if err := s.w.Flush(); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// segment returns the open segment of a retention for the hour of t
+func (h *History) segment(retention time.Duration, t time.Time) (*segment, error) {
+	hour := t.UTC().Truncate(time.Hour)
+
+	key := segmentKey{retention, hour}
+	if s := h.segments[key]; s != nil {
+		return s, nil
+	}
+
+	if len(h.segments) >= historyOpen {
+		var oldest segmentKey
+		var at time.Time
+		for k, s := range h.segments {
+			if at.IsZero() || s.written.Before(at) {
+				oldest, at = k, s.written
+			}
+		}
+		h.closeSegment(oldest, time.Now())
+	}
+
+	dir := filepath.Join(h.dir, tier(retention))
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	file := filepath.Join(dir, hour.Format(segmentLayout)+".json")
+
+	// Values are added to a sorted segment out of order, so its index is
+	// no longer of use
+	if err := os.Remove(indexFile(file)); err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	f, err := os.OpenFile(file, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+
+	s := &segment{hour: hour, file: file, f: f, w: bufio.NewWriter(f), index: make(map[string]*openEntry)}
+	if err := s.reindex(); err != nil {
+		f.Close()
+		return nil, err
+	}
+	h.segments[key] = s
+
+	return s, nil
+}
+
+// sweep closes the segments which have not been written to for historyIdle
+func (h *History) sweep(now time.Time) {
+	h.swept = now
+
+	for k, s := range h.segments {
+		if now.Sub(s.written) >= historyIdle {
+			h.closeSegment(k, now)
+		}
+	}
+}
+
+// closeSegment closes an open segment. Once its hour is over it is left to
+// be sorted; a late value opens it again, and removes its index.
+func (h *History) closeSegment(k segmentKey, now time.Time) {
+	s := h.segments[k]
+	s.w.Flush()
+	s.f.Close()
+	delete(h.segments, k)
+
+	if !now.Before(s.hour.Add(time.Hour)) {
+		h.closed = append(h.closed, s.file)
+	}
+}
+
+// sortClosed sorts the segments which were closed, without holding the
+// lock. A segment which could not be sorted is still read in full, and is
+// sorted by prune later on.
+func (h *History) sortClosed() {
+	h.mu.Lock()
+	files := h.closed
+	h.closed = nil
+	h.mu.Unlock()
+
+	for _, file := range files {
+		h.sortSegment(file)
+	}
+}
+
+// Close writes out and closes the open segments
+func (h *History) Close() error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	var err error
+
+	for k, s := range h.segments {
+		if e := s.w.Flush(); e != nil {
+			err = e
+		}
+		if e := s.f.Close(); e != nil {
+			err = e
+		}
+		delete(h.segments, k)
+	}
+
+	return err
+}
+
+// prune removes the segments which are past their retention, and leaves
+// those which are done with but were not sorted to sortClosed
+func (h *History) prune(now time.Time) {
+	h.pruned = now
+
+	open := make(map[string]bool, len(h.segments))
+	for _, s := range h.segments {
+		open[s.file] = true
+	}
+
+	for _, d := range h.tiers() {
+		for _, s := range d.segments {
+			if d.retention > 0 && s.hour.Add(time.Hour).Before(now.Add(-d.retention)) {
+				os.Remove(s.file)
+				os.Remove(indexFile(s.file))
+				continue
+			}
+
+			if open[s.file] || now.Before(s.hour.Add(time.Hour)) {
+				continue
+			}
+			if _, err := os.Stat(indexFile(s.file)); os.IsNotExist(err) {
+				h.closed = append(h.closed, s.file)
+			}
+		}
+	}
+}
+
+// segmentFile is a segment on disk
+type segmentFile struct {
+	hour time.Time
+	file string
+}
+
+// tierDir is a directory of segments, oldest first
+type tierDir struct {
+	retention time.Duration
+	segments  []segmentFile
+}
+
+// tiers lists the segments on disk
+func (h *History) tiers() []tierDir {
+	var out []tierDir
+
+	dirs, _ := ioutil.ReadDir(h.dir)
+	for _, d := range dirs {
+		if !d.IsDir() {
+			continue
+		}
+
+		var retention time.Duration
+		if d.Name() != "forever" {
+			r, err := time.ParseDuration(d.Name())
+			if err != nil || r <= 0 || tier(r) != d.Name() {
+				continue
+			}
+			retention = r
+		}
+
+		td := tierDir{retention: retention}
+
+		files, _ := ioutil.ReadDir(filepath.Join(h.dir, d.Name()))
+		for _, f := range files {
+			hour, err := time.Parse(segmentLayout, strings.TrimSuffix(f.Name(), ".json"))
+			if err != nil || !strings.HasSuffix(f.Name(), ".json") {
+				continue
+			}
+			td.segments = append(td.segments, segmentFile{hour, filepath.Join(h.dir, d.Name(), f.Name())})
+		}
+
+		out = append(out, td)
+	}
+
+	return out
+}
+
+// hours returns the segments holding values from..to, grouped by hour,
+// oldest first
+func (h *History) hours(from, to time.Time) [][]string {
+	byHour := make(map[time.Time][]string)
+	var hours []time.Time
+
+	for _, d := range h.tiers() {
+		for _, s := range d.segments {
+			if s.hour.Add(time.Hour).Before(from) || s.hour.After(to) {
+				continue
+			}
+			if _, ok := byHour[s.hour]; !ok {
+				hours = append(hours, s.hour)
+			}
+			byHour[s.hour] = append(byHour[s.hour], s.file)
+		}
+	}
+
+	sort.Slice(hours, func(i, j int) bool { return hours[i].Before(hours[j]) })
+
+	out := make([][]string, len(hours))
+	for i, t := range hours {
+		out[i] = byHour[t]
+	}
+
+	return out
+}
+
+// readRecords returns the records in files from..to, oldest first
+func readRecords(files []string, from, to time.Time) []historyRecord {
+	var out []historyRecord
+
+	for _, file := range files {
+		f, err := os.Open(file)
+		if err != nil {
+			continue
+		}
+
+		sc := bufio.NewScanner(f)
+		sc.Buffer(make([]byte, 64*1024), 1024*1024)
+		for sc.Scan() {
+			var r historyRecord
+			if json.Unmarshal(sc.Bytes(), &r) != nil {
+				continue
+			}
+			if r.Time.Before(from) || r.Time.After(to) {
+				continue
+			}
+			out = append(out, r)
+		}
+
+		f.Close()
+	}
+
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Time.Before(out[j].Time) })
+
+	return out
+}
+
+// Aggregation methods of a history query
+var historyMethods = map[string]bool{
+	"average": true,
+	"min":     true,
+	"max":     true,
+	"first":   true,
+	"last":    true,
+}
+
+// HistoryQuery asks for the values of paths of a context from..to. Values
+// are aggregated over each Resolution by the method of their path, or
+// returned as they are if Resolution is 0.
+type HistoryQuery struct {
+	Context    string
+	Paths      []HistoryValue
+	From, To   time.Time
+	Resolution time.Duration
+}
+
+// HistoryValue is a path of a history query and how its values are
+// aggregated: average, min, max, first or last
+type HistoryValue struct {
+	Path   string `json:"path"`
+	Method string `json:"method"`
+}
+
+// HistoryResult is the answer to a history query. Each row of Data is a
+// timestamp followed by a value of each path, or nil where there is none.
+type HistoryResult struct {
+	Context string `json:"context"`
+	Range   struct {
+		From time.Time `json:"from"`
+		To   time.Time `json:"to"`
+	} `json:"range"`
+	Values []HistoryValue  `json:"values"`
+	Data   [][]interface{} `json:"data"`
+}
+
+// ParseHistoryPaths reads the paths of a history query, such as
+// "navigation.speedOverGround:max,propulsion.port.temperature", where the
+// method defaults to average
+func ParseHistoryPaths(s string) ([]HistoryValue, error) {
+	var out []HistoryValue
+
+	for _, p := range strings.Split(s, ",") {
+		v := HistoryValue{Path: strings.TrimSpace(p), Method: "average"}
+		if i := strings.IndexByte(v.Path, ':'); i >= 0 {
+			v.Path, v.Method = v.Path[:i], v.Path[i+1:]
+		}
+		if v.Path == "" {
+			continue
+		}
+		if !historyMethods[v.Method] {
+			return nil, fmt.Errorf("unknown method %q of %v", v.Method, v.Path)
+		}
+		out = append(out, v)
+	}
+
+	if len(out) == 0 {
+		return nil, fmt.Errorf("no paths")
+	}
+
+	return out, nil
+}
+
+// bucket aggregates the values of a path over one row of a query
+type bucket struct {
+	first, last   interface{}
+	min, max, sum float64
+	n             int
+}
+
+func (b *bucket) add(v interface{}) {
+	if b.first == nil {
+		b.first = v
+	}
+	b.last = v
+
+	f, ok := number(v)
+	if !ok {
+		return
+	}
+	if b.n == 0 || f < b.min {
+		b.min = f
+	}
+	if b.n == 0 || f > b.max {
+		b.max = f
+	}
+	b.sum += f
+	b.n++
+}
+
+// value is the aggregate of a bucket. Methods other than first and last
+// give the last value of paths which are not numbers.
+func (b *bucket) value(method string) interface{} {
+	if b == nil {
+		return nil
+	}
+
+	switch {
+	case method == "first":
+		return b.first
+	case method == "last" || b.n == 0:
+		return b.last
+	case method == "min":
+		return b.min
+	case method == "max":
+		return b.max
+	}
+
+	return b.sum / float64(b.n)
+}
+
+// Query looks up the values of paths over a time range
+func (h *History) Query(q HistoryQuery) (HistoryResult, error) {
+	var res HistoryResult
+
+	if q.To.Before(q.From) {
+		return res, fmt.Errorf("%v is before %v", q.To, q.From)
+	}
+	if q.Resolution < 0 {
+		return res, fmt.Errorf("negative resolution")
+	}
+
+	res.Context = q.Context
+	res.Range.From, res.Range.To = q.From, q.To
+	res.Values = q.Paths
+	res.Data = [][]interface{}{}
+
+	// A path may be asked for with more than one method
+	columns := make(map[string][]int, len(q.Paths))
+	for i, p := range q.Paths {
+		columns[p.Path] = append(columns[p.Path], i)
+	}
+
+	rows := make(map[time.Time][]*bucket)
+	var times []time.Time
+
+	keys := make(map[string]bool, len(columns))
+	for p := range columns {
+		keys[historyKey(q.Context, p)] = true
+	}
+	open := h.openIndexes(keys)
+
+	for _, files := range h.hours(q.From, q.To) {
+		for _, r := range keyRecords(files, open, keys, q.From, q.To) {
+			cols := columns[r.Path]
+
+			t := r.Time
+			if q.Resolution > 0 {
+				t = q.From.Add(t.Sub(q.From) / q.Resolution * q.Resolution)
+			}
+
+			row, ok := rows[t]
+			if !ok {
+				row = make([]*bucket, len(q.Paths))
+				rows[t] = row
+				times = append(times, t)
+			}
+			for _, i := range cols {
+				if row[i] == nil {
+					row[i] = &bucket{}
+				}
+				row[i].add(r.Value)
+			}
+		}
+	}
+
+	sort.Slice(times, func(i, j int) bool { return times[i].Before(times[j]) })
+
+	for _, t := range times {
+		data := []interface{}{t}
+		for i, b := range rows[t] {
+			data = append(data, b.value(q.Paths[i].Method))
+		}
+		res.Data = append(res.Data, data)
+	}
+
+	return res, nil
+}
+
+// Paths returns the paths of a context which have values from..to
+func (h *History) Paths(context string, from, to time.Time) []string {
+	seen := make(map[string]bool)
+	out := []string{}
+
+	add := func(c, p string) {
+		if c == context && !seen[p] {
+			seen[p] = true
+			out = append(out, p)
+		}
+	}
+
+	open := h.openIndexes(nil)
+
+	for _, files := range h.hours(from, to) {
+		for _, file := range files {
+			if entries, ok := open[file]; ok {
+				for _, e := range entries {
+					if overlaps(e.from, e.to, from, to) {
+						add(e.context, e.path)
+					}
+				}
+			} else if index, ok := readIndex(file); ok {
+				for _, e := range index {
+					if overlaps(e.From, e.To, from, to) {
+						add(e.Context, e.Path)
+					}
+				}
+			} else {
+				for _, r := range readRecords([]string{file}, from, to) {
+					add(r.Context, r.Path)
+				}
+			}
+		}
+	}
+
+	sort.Strings(out)
+
+	return out
+}
+
+// Replay passes the deltas recorded from a time onwards to fn, oldest
+// first, until fn returns false or there are no more. The values of a
+// context at one time are one delta, with an update for each source.
+func (h *History) Replay(from time.Time, fn func(Delta) bool) {
+	end := time.Now().Add(time.Hour)
+
+	for _, files := range h.hours(from, end) {
+		var d Delta
+		var at time.Time
+
+		for _, r := range readRecords(files, from, end) {
+			if len(d.Updates) > 0 && (!r.Time.Equal(at) || r.Context != d.Context) {
+				if !fn(d) {
+					return
+				}
+				d = Delta{}
+			}
+
+			d.Context, at = r.Context, r.Time
+
+			var u *update
+			for i := range d.Updates {
+				if d.Updates[i].Source == r.Source {
+					u = &d.Updates[i]
+				}
+			}
+			if u == nil {
+				d.Updates = append(d.Updates, update{r.Source, r.Time, nil, nil})
+				u = &d.Updates[len(d.Updates)-1]
+			}
+			u.Values = append(u.Values, value{r.Path, r.Value})
+		}
+
+		if len(d.Updates) > 0 && !fn(d) {
+			return
+		}
+	}
+}
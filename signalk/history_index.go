@@ -0,0 +1,396 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package signalk
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// Once a segment is closed and its hour is over its records are sorted by
+// context and path, and an index of where the records of each are is written
+// next to it, so that a query only reads the records of the paths it asks
+// for. The open
+// segments are indexed in memory as they are written. A segment without an
+// index, such as one left open by a crash, is read in full until prune
+// sorts it.
+
+// indexEntry locates the records of a context and path in a sorted segment
+type indexEntry struct {
+	Context string    `json:"c"`
+	Path    string    `json:"p"`
+	From    time.Time `json:"from"`
+	To      time.Time `json:"to"`
+	Start   int64     `json:"start"`
+	End     int64     `json:"end"`
+}
+
+// openEntry locates the records of a context and path in an open segment
+type openEntry struct {
+	context, path string
+	from, to      time.Time
+	spans         []recordSpan
+}
+
+// recordSpan is the offset and length of a record
+type recordSpan struct {
+	off, n int64
+}
+
+// historyKey identifies the values of a path of a context
+func historyKey(context, path string) string {
+	return context + "/" + path
+}
+
+// indexFile is the name of the index of a segment
+func indexFile(segment string) string {
+	return strings.TrimSuffix(segment, ".json") + ".idx"
+}
+
+// overlaps says whether from..to and the times of an entry overlap
+func overlaps(first, last, from, to time.Time) bool {
+	return !last.Before(from) && !first.After(to)
+}
+
+// add indexes a record written to an open segment
+func (s *segment) add(context, path string, t time.Time, n int64) {
+	k := historyKey(context, path)
+
+	e := s.index[k]
+	if e == nil {
+		e = &openEntry{context: context, path: path, from: t, to: t}
+		s.index[k] = e
+	}
+	if t.Before(e.from) {
+		e.from = t
+	}
+	if t.After(e.to) {
+		e.to = t
+	}
+
+	e.spans = append(e.spans, recordSpan{s.size, n})
+	s.size += n
+}
+
+// reindex indexes the records already in a segment which is opened again
+func (s *segment) reindex() error {
+	f, err := os.Open(s.file)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// A partly written record is left where it is
+			s.size += int64(len(line))
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		var rec historyRecord
+		if json.Unmarshal(line, &rec) != nil {
+			s.size += int64(len(line))
+			continue
+		}
+		s.add(rec.Context, rec.Path, rec.Time, int64(len(line)))
+	}
+}
+
+// sortSegment sorts the records of a closed segment by context and path, and
+// by time within each, and writes its index. The lock is only held to put
+// them in place, which is not done if the segment was written to meanwhile.
+func (h *History) sortSegment(file string) error {
+	b, err := ioutil.ReadFile(file)
+	if err != nil {
+		return err
+	}
+
+	data, idx, err := sortRecords(b)
+	if err != nil {
+		return err
+	}
+
+	dataTemp, err := writeTemp(file, data)
+	if err != nil {
+		return err
+	}
+	idxTemp, err := writeTemp(indexFile(file), idx)
+	if err != nil {
+		os.Remove(dataTemp)
+		return err
+	}
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	fi, err := os.Stat(file)
+	if err != nil || fi.Size() != int64(len(b)) || h.isOpen(file) {
+		os.Remove(dataTemp)
+		os.Remove(idxTemp)
+		return err
+	}
+
+	// The index is put in place after the segment, so an index is never
+	// read with the segment it does not belong to
+	if err := os.Rename(dataTemp, file); err != nil {
+		os.Remove(dataTemp)
+		os.Remove(idxTemp)
+		return err
+	}
+	if err := os.Rename(idxTemp, indexFile(file)); err != nil {
+		os.Remove(idxTemp)
+		return err
+	}
+
+	return nil
+}
+
+// isOpen says whether file is an open segment
+func (h *History) isOpen(file string) bool {
+	for _, s := range h.segments {
+		if s.file == file {
+			return true
+		}
+	}
+	return false
+}
+
+// sortRecords sorts the records of a segment, and returns them with their
+// index
+func sortRecords(b []byte) ([]byte, []byte, error) {
+
+	type line struct {
+		t time.Time
+		b []byte
+	}
+	groups := make(map[string][]line)
+	entries := make(map[string]*indexEntry)
+
+	for _, l := range bytes.SplitAfter(b, []byte{'\n'}) {
+		var rec historyRecord
+		if len(l) == 0 || l[len(l)-1] != '\n' || json.Unmarshal(l, &rec) != nil {
+			continue
+		}
+
+		k := historyKey(rec.Context, rec.Path)
+		e := entries[k]
+		if e == nil {
+			e = &indexEntry{Context: rec.Context, Path: rec.Path, From: rec.Time, To: rec.Time}
+			entries[k] = e
+		}
+		if rec.Time.Before(e.From) {
+			e.From = rec.Time
+		}
+		if rec.Time.After(e.To) {
+			e.To = rec.Time
+		}
+		groups[k] = append(groups[k], line{rec.Time, l})
+	}
+
+	keys := make([]string, 0, len(groups))
+	for k := range groups {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var buf bytes.Buffer
+	index := make([]indexEntry, 0, len(keys))
+
+	for _, k := range keys {
+		lines := groups[k]
+		sort.SliceStable(lines, func(i, j int) bool { return lines[i].t.Before(lines[j].t) })
+
+		e := entries[k]
+		e.Start = int64(buf.Len())
+		for _, l := range lines {
+			buf.Write(l.b)
+		}
+		e.End = int64(buf.Len())
+		index = append(index, *e)
+	}
+
+	idx, err := json.Marshal(index)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return buf.Bytes(), idx, nil
+}
+
+// readIndex reads the index of a sorted segment
+func readIndex(file string) ([]indexEntry, bool) {
+	b, err := ioutil.ReadFile(indexFile(file))
+	if err != nil {
+		return nil, false
+	}
+
+	var index []indexEntry
+	if json.Unmarshal(b, &index) != nil {
+		return nil, false
+	}
+
+	return index, true
+}
+
+// openIndexes copies the entries of the open segments for keys, or every
+// entry if keys is nil
+func (h *History) openIndexes(keys map[string]bool) map[string]map[string]openEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	out := make(map[string]map[string]openEntry, len(h.segments))
+
+	for _, s := range h.segments {
+		entries := make(map[string]openEntry)
+		for k, e := range s.index {
+			if keys == nil || keys[k] {
+				c := *e
+				c.spans = append([]recordSpan(nil), e.spans...)
+				entries[k] = c
+			}
+		}
+		out[s.file] = entries
+	}
+
+	return out
+}
+
+// keyRecords returns the records of keys in segments from..to, oldest first
+func keyRecords(files []string, open map[string]map[string]openEntry, keys map[string]bool, from, to time.Time) []historyRecord {
+	var out []historyRecord
+
+	for _, file := range files {
+		if entries, ok := open[file]; ok {
+			var spans []recordSpan
+			for _, e := range entries {
+				if overlaps(e.from, e.to, from, to) {
+					spans = append(spans, e.spans...)
+				}
+			}
+			out = append(out, readSpans(file, spans, from, to)...)
+			continue
+		}
+
+		if index, ok := readIndex(file); ok {
+			var spans []recordSpan
+			for _, e := range index {
+				if keys[historyKey(e.Context, e.Path)] && overlaps(e.From, e.To, from, to) {
+					spans = append(spans, recordSpan{e.Start, e.End - e.Start})
+				}
+			}
+			out = append(out, readSpans(file, spans, from, to)...)
+			continue
+		}
+
+		for _, r := range readRecords([]string{file}, from, to) {
+			if keys[historyKey(r.Context, r.Path)] {
+				out = append(out, r)
+			}
+		}
+	}
+
+	sort.SliceStable(out, func(i, j int) bool { return out[i].Time.Before(out[j].Time) })
+
+	return out
+}
+
+// readSpans returns the records from..to in parts of a segment, each of one
+// or more whole records
+func readSpans(file string, spans []recordSpan, from, to time.Time) []historyRecord {
+	if len(spans) == 0 {
+		return nil
+	}
+
+	f, err := os.Open(file)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+
+	var out []historyRecord
+
+	for _, sp := range spans {
+		sc := bufio.NewScanner(io.NewSectionReader(f, sp.off, sp.n))
+		sc.Buffer(make([]byte, 64*1024), 1024*1024)
+		for sc.Scan() {
+			var r historyRecord
+			if json.Unmarshal(sc.Bytes(), &r) != nil {
+				continue
+			}
+			if r.Time.Before(from) || r.Time.After(to) {
+				continue
+			}
+			out = append(out, r)
+		}
+	}
+
+	return out
+}
+
+// replaceFile replaces the file at path with b, through a temporary file so
+// the file is never left half written
+func replaceFile(path string, b []byte) error {
+	tmp, err := writeTemp(path, b)
+	if err != nil {
+		return err
+	}
+
+	if err := os.Rename(tmp, path); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+
+	return nil
+}
+
+// writeTemp writes b to a temporary file next to path, and returns its name
+func writeTemp(path string, b []byte) (string, error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), filepath.Base(path)+".*")
+	if err != nil {
+		return "", err
+	}
+
+	_, err = f.Write(b)
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		return "", err
+	}
+
+	return f.Name(), nil
+}
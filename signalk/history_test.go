@@ -0,0 +1,369 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package signalk
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// newHistory returns a history in a new temporary directory
+func newHistory(t *testing.T, rules []HistoryRule) *History {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	h, err := NewHistory(dir, rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return h
+}
+
+// timedDelta returns a delta of our own vessel with values at a time
+func timedDelta(ts time.Time, values ...value) Delta {
+	return Delta{
+		Context: DefaultContext,
+		Updates: []update{{Source: serverSource, Timestamp: ts, Values: values}},
+	}
+}
+
+func TestHistoryQuery(t *testing.T) {
+	h := newHistory(t, []HistoryRule{
+		{Path: "propulsion.*.temperature", Interval: 5 * time.Second},
+		{Path: "*"},
+	})
+	defer os.RemoveAll(h.dir)
+	defer h.Close()
+
+	start := time.Now().UTC().Truncate(time.Minute)
+	for i := 0; i < 10; i++ {
+		err := h.Record(timedDelta(start.Add(time.Duration(i)*time.Second),
+			value{"propulsion.port.temperature", 350.0 + float64(i)},
+			value{"navigation.speedOverGround", float64(i)},
+		))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Every value of the speed, and every fifth of the temperature
+	res, err := h.Query(HistoryQuery{
+		Context: DefaultContext,
+		Paths:   []HistoryValue{{"navigation.speedOverGround", "last"}, {"propulsion.port.temperature", "last"}},
+		From:    start,
+		To:      start.Add(time.Minute),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Data) != 10 {
+		t.Fatalf("Got %v rows", len(res.Data))
+	}
+	if !reflect.DeepEqual(res.Data[5], []interface{}{start.Add(5 * time.Second), 5.0, 355.0}) ||
+		res.Data[4][2] != nil {
+		t.Errorf("Got %v and %v", res.Data[4], res.Data[5])
+	}
+
+	res, err = h.Query(HistoryQuery{
+		Context:    DefaultContext,
+		Paths:      []HistoryValue{{"navigation.speedOverGround", "average"}, {"navigation.speedOverGround", "max"}},
+		From:       start,
+		To:         start.Add(time.Minute),
+		Resolution: 5 * time.Second,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := [][]interface{}{
+		{start, 2.0, 4.0},
+		{start.Add(5 * time.Second), 7.0, 9.0},
+	}
+	if !reflect.DeepEqual(res.Data, want) {
+		t.Errorf("Got %v", res.Data)
+	}
+
+	if p := h.Paths(DefaultContext, start, start.Add(time.Minute)); !reflect.DeepEqual(p,
+		[]string{"navigation.speedOverGround", "propulsion.port.temperature"}) {
+		t.Errorf("Got %v", p)
+	}
+}
+
+func TestHistoryAggregate(t *testing.T) {
+	h := newHistory(t, []HistoryRule{{Path: "*"}})
+	defer os.RemoveAll(h.dir)
+	defer h.Close()
+
+	start := time.Now().UTC().Truncate(time.Minute)
+	for i, f := range []float64{3, 1, 4, 1, 5} {
+		h.Record(timedDelta(start.Add(time.Duration(i)*time.Second), value{"a", f}))
+	}
+
+	for method, want := range map[string]float64{"average": 2.8, "min": 1, "max": 5, "first": 3, "last": 5} {
+		res, err := h.Query(HistoryQuery{
+			Context:    DefaultContext,
+			Paths:      []HistoryValue{{"a", method}},
+			From:       start,
+			To:         start.Add(time.Minute),
+			Resolution: time.Minute,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(res.Data) != 1 || res.Data[0][1] != want {
+			t.Errorf("%v: got %v", method, res.Data)
+		}
+	}
+}
+
+func TestHistoryReplay(t *testing.T) {
+	h := newHistory(t, []HistoryRule{{Path: "*"}})
+	defer os.RemoveAll(h.dir)
+	defer h.Close()
+
+	start := time.Now().UTC().Add(-time.Hour)
+	h.Record(timedDelta(start, value{"a", 1.0}, value{"b", 2.0}))
+	h.Record(timedDelta(start.Add(time.Second), value{"a", 3.0}))
+	h.Record(timedDelta(start.Add(90*time.Minute), value{"a", 4.0}))
+
+	var got []Delta
+	h.Replay(start.Add(-time.Minute), func(d Delta) bool {
+		got = append(got, d)
+		return true
+	})
+
+	if len(got) != 3 || len(got[0].Updates[0].Values) != 2 || got[1].Updates[0].Values[0].Value != 3.0 ||
+		!got[2].Updates[0].Timestamp.Equal(start.Add(90*time.Minute)) {
+		t.Errorf("Got %+v", got)
+	}
+
+	n := 0
+	h.Replay(start.Add(time.Millisecond), func(d Delta) bool {
+		n++
+		return false
+	})
+	if n != 1 {
+		t.Errorf("Replay went on after false")
+	}
+}
+
+func TestHistoryPrune(t *testing.T) {
+	h := newHistory(t, []HistoryRule{
+		{Path: "a", Retention: 24 * time.Hour},
+		{Path: "*"},
+	})
+	defer os.RemoveAll(h.dir)
+	defer h.Close()
+
+	old := time.Now().UTC().Add(-48 * time.Hour)
+	h.Record(timedDelta(old, value{"a", 1.0}, value{"b", 1.0}))
+	h.Record(timedDelta(time.Now(), value{"a", 2.0}))
+	h.Close()
+
+	h.prune(time.Now())
+
+	files, _ := filepath.Glob(filepath.Join(h.dir, "*", "*.json"))
+	if len(files) != 2 {
+		t.Errorf("Got %v", files)
+	}
+	if _, err := os.Stat(filepath.Join(h.dir, "24h", old.Truncate(time.Hour).Format(segmentLayout)+".json")); err == nil {
+		t.Error("Old segment was kept")
+	}
+}
+
+func TestHistoryIndex(t *testing.T) {
+	h := newHistory(t, []HistoryRule{{Path: "*"}})
+	defer os.RemoveAll(h.dir)
+	defer h.Close()
+
+	start := time.Now().UTC().Add(-2 * time.Hour).Truncate(time.Hour)
+	for i := 0; i < 10; i++ {
+		d := timedDelta(start.Add(time.Duration(i)*time.Minute),
+			value{"b", float64(i)},
+			value{"a", float64(10 * i)},
+		)
+		d.Updates = append(d.Updates, update{Source: serverSource, Timestamp: d.Updates[0].Timestamp,
+			Values: []value{{"c", float64(i)}}})
+		h.Record(d)
+		h.Record(Delta{Context: "vessels.other", Updates: d.Updates})
+	}
+
+	q := HistoryQuery{
+		Context: DefaultContext,
+		Paths:   []HistoryValue{{"a", "last"}, {"b", "first"}},
+		From:    start,
+		To:      start.Add(2 * time.Hour),
+	}
+	before, err := h.Query(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(before.Data) != 10 || before.Data[3][1] != 30.0 || before.Data[3][2] != 3.0 {
+		t.Fatalf("Got %v", before.Data)
+	}
+
+	// The segment of the hour before is sorted once it is idle
+	h.Record(timedDelta(start.Add(time.Hour), value{"d", 1.0}))
+	h.mu.Lock()
+	h.segments[segmentKey{0, start}].written = time.Now().Add(-historyIdle)
+	h.sweep(time.Now())
+	h.mu.Unlock()
+	h.sortClosed()
+
+	file := filepath.Join(h.dir, "forever", start.Format(segmentLayout)+".json")
+	index, ok := readIndex(file)
+	if !ok || len(index) != 6 {
+		t.Fatalf("Got index %+v", index)
+	}
+
+	after, err := h.Query(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(after, before) {
+		t.Errorf("Got %v, want %v", after.Data, before.Data)
+	}
+
+	if p := h.Paths(DefaultContext, start, start.Add(2*time.Hour)); !reflect.DeepEqual(p, []string{"a", "b", "c", "d"}) {
+		t.Errorf("Got %v", p)
+	}
+	if p := h.Paths(DefaultContext, start.Add(30*time.Minute), start.Add(2*time.Hour)); !reflect.DeepEqual(p, []string{"d"}) {
+		t.Errorf("Got %v", p)
+	}
+
+	var n int
+	h.Replay(start, func(d Delta) bool {
+		n++
+		return true
+	})
+	if n != 21 {
+		t.Errorf("Replayed %v deltas", n)
+	}
+
+	// A late value leaves the segment to be read in full until it is sorted
+	h.Record(timedDelta(start.Add(30*time.Second), value{"a", 5.0}))
+	h.Close()
+	if _, ok := readIndex(file); ok {
+		t.Error("Index of a segment with a late value was kept")
+	}
+
+	h, err = NewHistory(h.dir, h.rules)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := readIndex(file); !ok {
+		t.Error("Segment was not sorted when opened")
+	}
+	res, err := h.Query(q)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res.Data) != 11 || res.Data[1][1] != 5.0 || res.Data[1][2] != nil {
+		t.Errorf("Got %v", res.Data)
+	}
+}
+
+func TestHistorySegments(t *testing.T) {
+	h := newHistory(t, []HistoryRule{{Path: "*"}})
+	defer os.RemoveAll(h.dir)
+	defer h.Close()
+
+	now := time.Now().UTC()
+	old := now.Add(-2 * time.Hour)
+	h.Record(timedDelta(old, value{"a", 1.0}))
+	h.Record(timedDelta(now, value{"a", 2.0}))
+
+	oldKey := segmentKey{0, old.Truncate(time.Hour)}
+	nowKey := segmentKey{0, now.Truncate(time.Hour)}
+	s, t0 := h.segments[oldKey], h.segments[nowKey]
+
+	// Values of two hours in turn keep both open
+	for i := 0; i < 10; i++ {
+		h.Record(timedDelta(old.Add(time.Duration(i)*time.Second), value{"a", 1.0}))
+		h.Record(timedDelta(now.Add(time.Duration(i)*time.Second), value{"a", 2.0}))
+	}
+	if len(h.segments) != 2 || h.segments[oldKey] != s || h.segments[nowKey] != t0 {
+		t.Fatalf("Got %v", h.segments)
+	}
+	if _, ok := readIndex(s.file); ok {
+		t.Error("Open segment was sorted")
+	}
+
+	// The least recently written is closed past historyOpen
+	for i := 1; i <= historyOpen; i++ {
+		h.Record(timedDelta(old.Add(-time.Duration(i)*time.Hour), value{"a", 3.0}))
+	}
+	if len(h.segments) != historyOpen || h.segments[oldKey] != nil {
+		t.Errorf("Got %v open", len(h.segments))
+	}
+	if _, ok := readIndex(s.file); !ok {
+		t.Error("Closed segment was not sorted")
+	}
+}
+
+func TestHistoryRetention(t *testing.T) {
+	dir, err := ioutil.TempDir("", "history")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if _, err := NewHistory(dir, []HistoryRule{{Path: "*", Retention: 30 * time.Minute}}); err == nil {
+		t.Error("Retention of 30m was taken")
+	}
+
+	h, err := NewHistory(dir, []HistoryRule{{Path: "*", Retention: 90 * time.Minute}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer h.Close()
+
+	h.Record(timedDelta(time.Now(), value{"a", 1.0}))
+
+	tiers := h.tiers()
+	if len(tiers) != 1 || tiers[0].retention != 90*time.Minute || len(tiers[0].segments) != 1 {
+		t.Errorf("Got %+v", tiers)
+	}
+}
+
+func TestParseHistoryPaths(t *testing.T) {
+	p, err := ParseHistoryPaths("navigation.speedOverGround:max, propulsion.port.temperature")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p, []HistoryValue{
+		{"navigation.speedOverGround", "max"},
+		{"propulsion.port.temperature", "average"},
+	}) {
+		t.Errorf("Got %v", p)
+	}
+
+	for _, s := range []string{"", "a:median"} {
+		if _, err := ParseHistoryPaths(s); err == nil {
+			t.Errorf("%q: no error", s)
+		}
+	}
+}
@@ -0,0 +1,247 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package signalk
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/timmathews/argo/nmea2k"
+)
+
+// mappingIndex is the mappings compiled for the PGN definitions in use: the
+// parameter groups of each definition in mapping order, with their fields
+// resolved and their paths split into templates. Delta then only looks at
+// the parameter groups of the message it is given.
+type mappingIndex struct {
+	pgns   nmea2k.PgnArray
+	groups map[int][]compiledGroup // By index in PgnList
+	direct map[int]bool            // Whether DecodedDelta reads the values of a PGN directly
+
+	// Paths whose meta has been sent
+	metaMu   sync.Mutex
+	metaSent map[string]bool
+}
+
+// compiledGroup is a parameter group resolved against one PGN definition
+type compiledGroup struct {
+	*parameterGroup
+
+	path      []pathPart
+	fieldset  bool
+	members   []compiledMember // Of an object fieldset
+	field     int
+	repeating bool
+	builtin   bool // From the SignalkPath of the field
+	meta      *Meta
+
+	// For DecodedDelta, the conditions resolved against the definition and
+	// the fields added or subtracted by each transform, or -1
+	conds    []valueCondition
+	operands []int
+}
+
+// Slots of a path template
+const (
+	slotNone = iota
+	slotClassifier
+	slotMultiplier
+	slotElement
+)
+
+// pathPart is literal text or a placeholder filled in from the fields of a
+// message
+type pathPart struct {
+	text  string
+	slot  int
+	field int
+}
+
+// Compile builds the index of the mappings for the PGN definitions in use.
+// Mappings are compiled when they are loaded, so Delta only has to read the
+// index. If PgnList changes later they are compiled again on first use.
+func (m *Mappings) Compile() {
+	m.index.Store(m.compile(nmea2k.PgnList))
+}
+
+// compiled returns the index of the mappings, compiling them if they have
+// not been yet or PgnList has changed since. Two goroutines may both compile
+// stale mappings, which does no harm as their indexes are the same.
+func (m *Mappings) compiled() *mappingIndex {
+	idx, _ := m.index.Load().(*mappingIndex)
+	if idx == nil || len(idx.pgns) != len(nmea2k.PgnList) || &idx.pgns[0] != &nmea2k.PgnList[0] {
+		idx = m.compile(nmea2k.PgnList)
+		m.index.Store(idx)
+	}
+
+	return idx
+}
+
+func (m *Mappings) compile(pgns nmea2k.PgnArray) *mappingIndex {
+	idx := &mappingIndex{
+		pgns:     pgns,
+		groups:   make(map[int][]compiledGroup),
+		direct:   make(map[int]bool),
+		metaSent: make(map[string]bool),
+	}
+
+	byPgn := make(map[uint32][]int)
+	for i := range pgns {
+		byPgn[pgns[i].Pgn] = append(byPgn[pgns[i].Pgn], i)
+	}
+
+	for i := range m.Mappings {
+		mapping := &m.Mappings[i]
+		if !strings.HasPrefix(mapping.Path, "~/") {
+			continue
+		}
+
+		for j := range mapping.ParameterGroups {
+			pg := &mapping.ParameterGroups[j]
+
+			for _, v := range byPgn[pg.Pgn] {
+				if cg, ok := compileGroup(mapping.Path, pg, &pgns[v]); ok {
+					idx.groups[v] = append(idx.groups[v], cg)
+				}
+			}
+		}
+	}
+
+	if m.builtin() {
+		for v := range pgns {
+			idx.groups[v] = append(idx.groups[v], m.builtinGroups(&pgns[v], idx.groups[v])...)
+		}
+	}
+
+	for v, groups := range idx.groups {
+		direct := true
+		for i := range groups {
+			direct = groups[i].compileDirect(&pgns[v]) && direct
+		}
+		idx.direct[v] = direct
+	}
+
+	return idx
+}
+
+// compileGroup resolves a parameter group against a PGN definition. It fails
+// if the field of the group, or a required member of its object, is not in
+// the definition.
+func compileGroup(p string, pg *parameterGroup, def *nmea2k.Pgn) (compiledGroup, bool) {
+	cg := compiledGroup{parameterGroup: pg, field: -1}
+
+	if pg.Fieldset.Type == "object" {
+		members, ok := compileMembers(&pg.Fieldset, def)
+		if !ok {
+			return cg, false
+		}
+		cg.members = members
+		cg.meta = &Meta{Description: def.Description}
+	} else if len(pg.Fieldset.Fields) > 0 {
+		cg.fieldset = true
+		cg.meta = &Meta{Description: def.Description}
+	} else {
+		fld, err := def.FieldIndex(pg.Field)
+		if err != nil {
+			return cg, false
+		}
+		rpt := def.FirstRepeatingField()
+		cg.field = fld
+		cg.repeating = rpt >= 0 && fld >= rpt
+		cg.meta = fieldMeta(def, fld, pg.Transforms)
+	}
+
+	// Placeholders whose field is unknown are left in the path as they are
+	slots := make(map[string]pathPart)
+	for _, s := range []struct {
+		slot      int
+		id, field string
+	}{
+		{slotClassifier, pg.Classifier.Id, pg.Classifier.Field},
+		{slotMultiplier, pg.Multiplier.Id, pg.Multiplier.Field},
+	} {
+		if s.id == "" || s.field == "" {
+			continue
+		}
+		if i, err := def.FieldIndex(s.field); err == nil {
+			slots["{"+s.id+"}"] = pathPart{slot: s.slot, field: i}
+		}
+	}
+	if pg.Element.Id != "" && cg.repeating {
+		slots["{"+pg.Element.Id+"}"] = pathPart{slot: slotElement}
+	}
+
+	cg.path = template(toDotNotation(p), slots)
+
+	return cg, true
+}
+
+// template splits a path in dot notation into literal text and the
+// placeholders given in slots. Other placeholders are left as they are.
+func template(path string, slots map[string]pathPart) []pathPart {
+	var parts []pathPart
+
+	for len(path) > 0 {
+		open := strings.IndexByte(path, '{')
+		end := strings.IndexByte(path[open+1:], '}')
+		if open < 0 || end < 0 {
+			parts = append(parts, pathPart{text: path})
+			break
+		}
+		end += open + 2
+
+		if open > 0 {
+			parts = append(parts, pathPart{text: path[:open]})
+		}
+		if part, ok := slots[path[open:end]]; ok {
+			parts = append(parts, part)
+		} else {
+			parts = append(parts, pathPart{text: path[open:end]})
+		}
+		path = path[end:]
+	}
+
+	return parts
+}
+
+// render fills in the path template of a group from the fields of a message
+// and the number of the record of its repeating group
+func (cg *compiledGroup) render(fields nmea2k.DataMap, n int) string {
+	if len(cg.path) == 1 && cg.path[0].slot == slotNone {
+		return cg.path[0].text
+	}
+
+	var b strings.Builder
+
+	for _, part := range cg.path {
+		switch part.slot {
+		case slotNone:
+			b.WriteString(part.text)
+		case slotElement:
+			b.WriteString(strconv.Itoa(n + cg.Element.Start))
+		default:
+			fmt.Fprintf(&b, "%v", fields[part.field])
+		}
+	}
+
+	return b.String()
+}
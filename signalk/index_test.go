@@ -0,0 +1,314 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package signalk
+
+import (
+	"fmt"
+	"math/rand"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/timmathews/argo/can"
+	"github.com/timmathews/argo/nmea2k"
+)
+
+func TestIndexPathTemplate(t *testing.T) {
+	idx := mapdata.compiled()
+	i, _ := nmea2k.PgnList.First(127501)
+
+	var cg *compiledGroup
+	for j := range idx.groups[i] {
+		if idx.groups[i][j].Field == "Indicator" {
+			cg = &idx.groups[i][j]
+		}
+	}
+	if cg == nil {
+		t.Fatal("127501 Indicator is not indexed")
+	}
+
+	if got := cg.render(nmea2k.DataMap{0: 7}, 2); got != "electrical.switches.bank.7.3.state" {
+		t.Errorf("Got %v", got)
+	}
+
+	// Only the parameter groups of the PGN are looked at
+	for _, cg := range idx.groups[i] {
+		if cg.Pgn != 127501 {
+			t.Errorf("PGN %v indexed under 127501", cg.Pgn)
+		}
+	}
+}
+
+func TestIndexRebuilt(t *testing.T) {
+	before := mapdata.compiled()
+	if mapdata.compiled() != before {
+		t.Error("index rebuilt without a change to PgnList")
+	}
+
+	// As LoadDefinitions does
+	saved := nmea2k.PgnList
+	nmea2k.PgnList = append(nmea2k.PgnArray(nil), saved...)
+	defer func() { nmea2k.PgnList = saved }()
+
+	if mapdata.compiled() == before {
+		t.Error("index not rebuilt for a new PgnList")
+	}
+}
+
+// benchmarkMessages are a mix of common messages
+func benchmarkMessages() []nmea2k.ParsedMessage {
+	ts := time.Now()
+
+	records := make([]nmea2k.DataMap, 28)
+	for i := range records {
+		records[i] = nmea2k.DataMap{1: "On"}
+	}
+
+	return []nmea2k.ParsedMessage{
+		newMessage(ts, 129026, nmea2k.DataMap{0: 0, 1: "True", 2: 0xF, 3: 123.4, 4: 5.3}),
+		newMessage(ts, 127250, nmea2k.DataMap{0: 0, 1: 181.5, 2: 0.0, 3: -2.1, 4: "Magnetic"}),
+		newMessage(ts, 128267, nmea2k.DataMap{0: 1, 1: 12.5, 2: 0.5}),
+		newMessage(ts, 127501, nmea2k.DataMap{0: 3, 1: nmea2k.RepeatingGroup{Count: 28, Records: records}}),
+		newMessage(ts, 130306, nmea2k.DataMap{0: 0, 1: 7.2, 2: 45.0, 3: "Apparent"}),
+	}
+}
+
+func benchmarkDelta(b *testing.B, m *Mappings) {
+	msgs := benchmarkMessages()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		msg := &msgs[i%len(msgs)]
+		if _, err := m.Delta(msg); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// benchmarkFrames are the benchmark messages as they arrive from the bus,
+// followed by a heartbeat, which is not mapped
+func benchmarkFrames(tb testing.TB) []*can.RawMessage {
+	var frames []*can.RawMessage
+
+	for _, msg := range benchmarkMessages() {
+		def := nmea2k.PgnList[msg.Index]
+		b, err := def.Encode(msg.Data)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		frames = append(frames, &can.RawMessage{Pgn: def.Pgn, Source: 1, Length: uint8(len(b)), Data: b})
+	}
+
+	return append(frames, &can.RawMessage{
+		Pgn:    126993,
+		Source: 1,
+		Length: 8,
+		Data:   []byte{0x60, 0xEA, 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF},
+	})
+}
+
+func TestDecodedDelta(t *testing.T) {
+	d := nmea2k.DefaultDecoder()
+	frames := benchmarkFrames(t)
+
+	for _, raw := range frames[:len(frames)-1] {
+		msg := nmea2k.NewDecodedMessage()
+		d.Decode(raw, msg)
+
+		got, err := mapdata.DecodedDelta(msg)
+		expected, _ := mapdata.Delta(nmea2k.ParsePacket(raw))
+		msg.Release()
+
+		if err != nil || !reflect.DeepEqual(got.Updates[0].Values, expected.Updates[0].Values) {
+			t.Errorf("DecodedDelta(%v) = %v, %v, expected %v", raw.Pgn, got, err, expected)
+		}
+	}
+
+	// Unmapped messages are rejected without being converted
+	msg := nmea2k.NewDecodedMessage()
+	defer msg.Release()
+	d.Decode(frames[len(frames)-1], msg)
+
+	if n := testing.AllocsPerRun(100, func() { mapdata.DecodedDelta(msg) }); n != 0 {
+		t.Errorf("DecodedDelta(126993) made %v allocations, expected none", n)
+	}
+}
+
+// TestDecodedDeltaFrom maps a message read from a log, whose payload could
+// not be rebuilt, from its fields
+func TestDecodedDeltaFrom(t *testing.T) {
+	in := newMessage(time.Now(), 128259, nmea2k.DataMap{0: 0, 1: 3.2, 2: 3.4})
+	in.Header.Data, in.Header.Length = nil, 0
+
+	msg := nmea2k.DecodedFrom(&in)
+	defer msg.Release()
+
+	got, err := mapdata.DecodedDelta(msg)
+	expected, _ := mapdata.Delta(&in)
+
+	if err != nil || !reflect.DeepEqual(got.Updates[0].Values, expected.Updates[0].Values) {
+		t.Errorf("DecodedDelta() = %v, %v, expected %v", got, err, expected)
+	}
+}
+
+// TestDecodedDeltaDirect maps random data of every PGN whose values are
+// read directly, and checks they are mapped as a ParsedMessage would be
+func TestDecodedDeltaDirect(t *testing.T) {
+	d := nmea2k.DefaultDecoder()
+	idx := mapdata.compiled()
+	r := rand.New(rand.NewSource(1))
+
+	direct := 0
+	for i, ok := range idx.direct {
+		if !ok {
+			continue
+		}
+		direct++
+
+		def := &nmea2k.PgnList[i]
+		n := int(def.Size)
+		if n < 8 {
+			n = 8
+		}
+
+		for j := 0; j < 50; j++ {
+			data := make([]byte, n)
+			r.Read(data)
+			raw := &can.RawMessage{Pgn: def.Pgn, Source: 1, Length: uint8(n), Data: data}
+
+			msg := nmea2k.NewDecodedMessage()
+			d.Decode(raw, msg)
+			if msg.Index != i {
+				msg.Release()
+				continue
+			}
+
+			got, err1 := mapdata.DecodedDelta(msg)
+			expected, err2 := mapdata.Delta(nmea2k.ParsePacket(raw))
+			msg.Release()
+
+			// NaN is not equal to itself, but prints the same
+			if (err1 == nil) != (err2 == nil) ||
+				err1 == nil && fmt.Sprint(got.Updates[0].Values) != fmt.Sprint(expected.Updates[0].Values) {
+				t.Fatalf("DecodedDelta(%v % x) = %v, %v, expected %v, %v", def.Pgn, data, got, err1, expected, err2)
+			}
+		}
+	}
+
+	if direct < len(idx.direct)*3/4 {
+		t.Errorf("%v of %v PGNs read directly", direct, len(idx.direct))
+	}
+}
+
+// BenchmarkDecodedDelta decodes and maps messages as they arrive from the
+// bus, as the live pipeline does
+func BenchmarkDecodedDelta(b *testing.B) {
+	d := nmea2k.DefaultDecoder()
+	frames := benchmarkFrames(b)
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	for i := 0; i < b.N; i++ {
+		msg := nmea2k.NewDecodedMessage()
+		d.Decode(frames[i%len(frames)], msg)
+		mapdata.DecodedDelta(msg)
+		msg.Release()
+	}
+
+	b.ReportMetric(float64(b.N)/b.Elapsed().Seconds(), "frames/s")
+}
+
+// BenchmarkDecodedDeltaMapped maps the speed through water and the course
+// and speed over ground, which are read without a ParsedMessage
+func BenchmarkDecodedDeltaMapped(b *testing.B) {
+	ts := time.Now()
+
+	for _, in := range []nmea2k.ParsedMessage{
+		newMessage(ts, 128259, nmea2k.DataMap{0: 0, 1: 3.2, 2: 3.4}),
+		newMessage(ts, 129026, nmea2k.DataMap{0: 0, 1: "True", 2: 0xF, 3: 123.4, 4: 5.3}),
+	} {
+		def := nmea2k.PgnList[in.Index]
+		data, err := def.Encode(in.Data)
+		if err != nil {
+			b.Fatal(err)
+		}
+		raw := &can.RawMessage{Pgn: def.Pgn, Source: 1, Length: uint8(len(data)), Data: data}
+
+		b.Run(strconv.Itoa(int(def.Pgn)), func(b *testing.B) {
+			d := nmea2k.DefaultDecoder()
+
+			b.ReportAllocs()
+			b.ResetTimer()
+
+			for i := 0; i < b.N; i++ {
+				msg := nmea2k.NewDecodedMessage()
+				d.Decode(raw, msg)
+				if _, err := mapdata.DecodedDelta(msg); err != nil {
+					b.Fatal(err)
+				}
+				msg.Release()
+			}
+		})
+	}
+}
+
+func BenchmarkDelta(b *testing.B) {
+	benchmarkDelta(b, &mapdata)
+}
+
+// BenchmarkDeltaParallel maps messages from several goroutines at once,
+// which read the compiled index without taking a lock
+func BenchmarkDeltaParallel(b *testing.B) {
+	msgs := benchmarkMessages()
+	mapdata.Compile()
+
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	b.RunParallel(func(pb *testing.PB) {
+		for i := 0; pb.Next(); i++ {
+			if _, err := mapdata.Delta(&msgs[i%len(msgs)]); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkDeltaLargeMap adds a thousand mappings for PGNs which are not in
+// the messages. They should make no difference.
+func BenchmarkDeltaLargeMap(b *testing.B) {
+	m := Mappings{Mappings: append([]mapping(nil), mapdata.Mappings...)}
+
+	for i := 0; i < 1000; i++ {
+		m.Mappings = append(m.Mappings, mapping{
+			Path: fmt.Sprintf("~/test/path%v", i),
+			ParameterGroups: []parameterGroup{{
+				Pgn:   130312,
+				Field: "Temperature",
+			}},
+		})
+	}
+
+	benchmarkDelta(b, &m)
+}
@@ -0,0 +1,377 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package signalk
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/timmathews/argo/nmea2k"
+)
+
+// Meta describes the value at a path for clients, such as the units a gauge
+// shows and the zones in which it warns. The units and description of a
+// mapped path come from the PGN definition of its field. The rest is given
+// in the configuration or by a PUT, which take precedence.
+type Meta struct {
+	DisplayName  string        `json:"displayName,omitempty" toml:",omitempty"`
+	ShortName    string        `json:"shortName,omitempty" toml:",omitempty"`
+	Description  string        `json:"description,omitempty" toml:",omitempty"`
+	Units        string        `json:"units,omitempty" toml:",omitempty"`
+	DisplayScale *DisplayScale `json:"displayScale,omitempty" toml:",omitempty"`
+	Zones        []Zone        `json:"zones,omitempty" toml:",omitempty"`
+
+	// How a notification in each state is given: visual, sound or both
+	AlertMethod     []string `json:"alertMethod,omitempty" toml:",omitempty"`
+	WarnMethod      []string `json:"warnMethod,omitempty" toml:",omitempty"`
+	AlarmMethod     []string `json:"alarmMethod,omitempty" toml:",omitempty"`
+	EmergencyMethod []string `json:"emergencyMethod,omitempty" toml:",omitempty"`
+}
+
+// DisplayScale is the range a gauge shows. Type is linear, logarithmic,
+// squareroot or power, which uses Power.
+type DisplayScale struct {
+	Lower float64 `json:"lower"`
+	Upper float64 `json:"upper"`
+	Type  string  `json:"type,omitempty" toml:",omitempty"`
+	Power float64 `json:"power,omitempty" toml:",omitzero"`
+}
+
+// Zone is a range of values with a state, such as a depth below 2 m being an
+// alarm. A zone without a lower or upper bound is open at that end. A value
+// only leaves a zone once it is Hysteresis beyond it, so that a value
+// hovering at a bound does not raise a notification each time it crosses.
+type Zone struct {
+	Lower      *float64 `json:"lower,omitempty" toml:",omitempty"`
+	Upper      *float64 `json:"upper,omitempty" toml:",omitempty"`
+	State      string   `json:"state"`
+	Message    string   `json:"message,omitempty" toml:",omitempty"`
+	Hysteresis float64  `json:"hysteresis,omitempty" toml:",omitzero"`
+}
+
+// serverSource is the source of values which argo makes itself, such as meta
+// and notifications
+var serverSource = source{Label: "argo", Type: "signalk"}
+
+// metaValue is the meta of a path in a delta
+type metaValue struct {
+	Path  string `json:"path"`
+	Value Meta   `json:"value"`
+}
+
+// Zone states, by severity
+var zoneStates = map[string]int{
+	"nominal":   0,
+	"normal":    0,
+	"alert":     1,
+	"warn":      2,
+	"alarm":     3,
+	"emergency": 4,
+}
+
+// Check returns an error if the display scale or a zone of the meta makes no
+// sense
+func (meta *Meta) Check() error {
+	if s := meta.DisplayScale; s != nil {
+		if s.Lower >= s.Upper {
+			return fmt.Errorf("display scale lower %v is not below upper %v", s.Lower, s.Upper)
+		}
+		switch s.Type {
+		case "", "linear", "logarithmic", "squareroot":
+		case "power":
+			if s.Power == 0 {
+				return fmt.Errorf("power display scale without a power")
+			}
+		default:
+			return fmt.Errorf("unknown display scale type %q", s.Type)
+		}
+	}
+
+	for _, z := range meta.Zones {
+		if _, ok := zoneStates[z.State]; !ok {
+			return fmt.Errorf("unknown zone state %q", z.State)
+		}
+		if z.Lower != nil && z.Upper != nil && *z.Lower > *z.Upper {
+			return fmt.Errorf("zone lower %v is above upper %v", *z.Lower, *z.Upper)
+		}
+		if z.Hysteresis < 0 {
+			return fmt.Errorf("zone hysteresis %v is negative", z.Hysteresis)
+		}
+	}
+
+	for _, methods := range [][]string{meta.AlertMethod, meta.WarnMethod, meta.AlarmMethod, meta.EmergencyMethod} {
+		for _, m := range methods {
+			if m != "visual" && m != "sound" {
+				return fmt.Errorf("unknown notification method %q", m)
+			}
+		}
+	}
+
+	return nil
+}
+
+// isZero says whether the meta says nothing at all
+func (meta *Meta) isZero() bool {
+	return meta.DisplayName == "" && meta.ShortName == "" && meta.Description == "" &&
+		meta.Units == "" && meta.DisplayScale == nil && meta.Zones == nil &&
+		meta.AlertMethod == nil && meta.WarnMethod == nil && meta.AlarmMethod == nil &&
+		meta.EmergencyMethod == nil
+}
+
+// merge returns the meta with what o says in place of what it says
+func (meta Meta) merge(o Meta) Meta {
+	if o.DisplayName != "" {
+		meta.DisplayName = o.DisplayName
+	}
+	if o.ShortName != "" {
+		meta.ShortName = o.ShortName
+	}
+	if o.Description != "" {
+		meta.Description = o.Description
+	}
+	if o.Units != "" {
+		meta.Units = o.Units
+	}
+	if o.DisplayScale != nil {
+		meta.DisplayScale = o.DisplayScale
+	}
+	if o.Zones != nil {
+		meta.Zones = o.Zones
+	}
+	if o.AlertMethod != nil {
+		meta.AlertMethod = o.AlertMethod
+	}
+	if o.WarnMethod != nil {
+		meta.WarnMethod = o.WarnMethod
+	}
+	if o.AlarmMethod != nil {
+		meta.AlarmMethod = o.AlarmMethod
+	}
+	if o.EmergencyMethod != nil {
+		meta.EmergencyMethod = o.EmergencyMethod
+	}
+
+	return meta
+}
+
+// Set changes one property of the meta, by its name in JSON, such as
+// displayName. A nil value removes the property.
+func (meta *Meta) Set(key string, v interface{}) error {
+	var obj map[string]interface{}
+
+	b, _ := json.Marshal(meta)
+	json.Unmarshal(b, &obj)
+
+	switch key {
+	case "displayName", "shortName", "description", "units", "displayScale", "zones",
+		"alertMethod", "warnMethod", "alarmMethod", "emergencyMethod":
+	default:
+		return fmt.Errorf("unknown meta property %q", key)
+	}
+
+	if v == nil {
+		delete(obj, key)
+	} else {
+		obj[key] = v
+	}
+
+	b, _ = json.Marshal(obj)
+
+	var m Meta
+	if err := json.Unmarshal(b, &m); err != nil {
+		return fmt.Errorf("invalid %v: %v", key, err)
+	}
+
+	*meta = m
+
+	return nil
+}
+
+// MetaPath splits the path of a PUT to meta, such as
+// environment.depth.belowKeel.meta.displayName, into the path the meta is
+// for and the property, which is empty for the whole meta. It returns false
+// for the path of a value.
+func MetaPath(p string) (path, key string, ok bool) {
+	keys := strings.Split(p, ".")
+
+	for i := len(keys) - 1; i > 0 && i >= len(keys)-2; i-- {
+		if keys[i] == "meta" {
+			if i < len(keys)-1 {
+				key = keys[i+1]
+			}
+			return strings.Join(keys[:i], "."), key, true
+		}
+	}
+
+	return "", "", false
+}
+
+// MetaDelta returns a delta which gives the meta of a path of a vessel
+func MetaDelta(context, path string, meta Meta) Delta {
+	return Delta{
+		Context: context,
+		Updates: []update{{
+			Source:    serverSource,
+			Timestamp: time.Now(),
+			Values:    []value{},
+			Meta:      []metaValue{{path, meta}},
+		}},
+	}
+}
+
+// fieldMeta returns the meta of a path which is read from a field: the units
+// of the field, or those its transforms convert it to, and a description
+func fieldMeta(def *nmea2k.Pgn, field int, ts []transform) *Meta {
+	f := &def.FieldList[field]
+
+	// A transformed value, such as the depth below the keel, is no longer
+	// what the field describes
+	meta := &Meta{Description: f.Description}
+	if meta.Description == "" || len(ts) > 0 {
+		meta.Description = def.Description + ", " + f.Name
+	}
+
+	// Lookups have no units, and proprietary matches are not units
+	if u, ok := f.Units.(string); ok && !strings.HasPrefix(u, "=") {
+		meta.Units = u
+	}
+
+	for _, t := range ts {
+		switch t.Operation {
+		case "convert":
+			meta.Units = t.To
+		case "ratio":
+			meta.Units = "ratio"
+		case "scale", "offset", "enum":
+			// The units of the result are not known
+			meta.Units = ""
+		}
+	}
+
+	return meta
+}
+
+// metaPattern turns a path given in the configuration, where * stands for
+// any one segment, into a regular expression
+func metaPattern(p string) *regexp.Regexp {
+	s := regexp.QuoteMeta(p)
+	s = strings.Replace(s, `\*`, `[^.]+`, -1)
+
+	return regexp.MustCompile("^" + s + "$")
+}
+
+// WithMeta returns the mappings with the meta of paths given in the
+// configuration replaced. The meta of each path is sent again.
+func (m *Mappings) WithMeta(meta map[string]Meta) *Mappings {
+	c := &Mappings{
+		XMLName:  m.XMLName,
+		Mappings: m.Mappings,
+		Builtin:  m.Builtin,
+		Context:  m.Context,
+		Meta:     meta,
+	}
+	c.Compile()
+
+	return c
+}
+
+// configMeta returns the meta the configuration gives a path. A path given
+// exactly comes before one given with *.
+func (m *Mappings) configMeta(path string) (Meta, bool) {
+	if meta, ok := m.Meta[path]; ok {
+		return meta, true
+	}
+
+	for p, meta := range m.Meta {
+		if strings.Contains(p, "*") && metaPattern(p).MatchString(path) {
+			return meta, true
+		}
+	}
+
+	return Meta{}, false
+}
+
+// MetaOf returns the meta of a path: that of the field it is mapped from, if
+// any, with that of the configuration in its place
+func (m *Mappings) MetaOf(path string) Meta {
+	var meta Meta
+
+	idx := m.compiled()
+
+found:
+	for _, groups := range idx.groups {
+		for i := range groups {
+			cg := &groups[i]
+			if cg.meta != nil && cg.matches(path) {
+				meta = *cg.meta
+				break found
+			}
+		}
+	}
+
+	if c, ok := m.configMeta(path); ok {
+		meta = meta.merge(c)
+	}
+
+	return meta
+}
+
+// newMeta returns the meta of a path the first time a value is sent for it,
+// and false after that or if there is no meta
+func (m *Mappings) newMeta(idx *mappingIndex, cg *compiledGroup, path string) (Meta, bool) {
+	idx.metaMu.Lock()
+	defer idx.metaMu.Unlock()
+
+	if idx.metaSent[path] {
+		return Meta{}, false
+	}
+	idx.metaSent[path] = true
+
+	var meta Meta
+	if cg.meta != nil {
+		meta = *cg.meta
+	}
+
+	if c, ok := m.configMeta(path); ok {
+		meta = meta.merge(c)
+	}
+
+	return meta, !meta.isZero()
+}
+
+// matches says whether the path template of a group gives a path
+func (cg *compiledGroup) matches(path string) bool {
+	var b strings.Builder
+
+	b.WriteByte('^')
+	for _, part := range cg.path {
+		if part.slot == slotNone {
+			b.WriteString(regexp.QuoteMeta(part.text))
+		} else {
+			b.WriteString(`[^.]+`)
+		}
+	}
+	b.WriteByte('$')
+
+	return regexp.MustCompile(b.String()).MatchString(path)
+}
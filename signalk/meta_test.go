@@ -0,0 +1,170 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package signalk
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/timmathews/argo/nmea2k"
+)
+
+func TestMetaDelta(t *testing.T) {
+	m := mapdata.WithMeta(map[string]Meta{
+		"environment.depth.belowKeel": {DisplayName: "Depth"},
+		"environment.depth.*":         {ShortName: "DPT"},
+	})
+
+	in := newMessage(time.Now(), 128267, nmea2k.DataMap{0: 1, 1: 12.5, 2: -1.5})
+
+	got, err := m.Delta(&in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	meta := make(map[string]Meta)
+	for _, mv := range got.Updates[0].Meta {
+		meta[mv.Path] = mv.Value
+	}
+
+	expected := map[string]Meta{
+		"environment.depth.belowTransducer": {ShortName: "DPT", Description: "Depth below transducer", Units: "m"},
+		"environment.depth.belowKeel":       {DisplayName: "Depth", Description: "Water Depth, Depth", Units: "m"},
+	}
+	for p, e := range expected {
+		if !reflect.DeepEqual(meta[p], e) {
+			t.Errorf("%v:\nExpected: %+v\n     Got: %+v", p, e, meta[p])
+		}
+	}
+
+	// Meta is only sent with the first value of a path
+	got, _ = m.Delta(&in)
+	if len(got.Updates[0].Meta) != 0 {
+		t.Errorf("Got %+v", got.Updates[0].Meta)
+	}
+
+	if meta := m.MetaOf("environment.depth.belowKeel"); !reflect.DeepEqual(meta, expected["environment.depth.belowKeel"]) {
+		t.Errorf("Got %+v", meta)
+	}
+}
+
+func TestMetaUnits(t *testing.T) {
+	m := mapdata.WithMeta(nil)
+
+	in := newMessage(time.Now(), 127257, nmea2k.DataMap{0: uint8(1), 3: 2.0})
+	got, err := m.Delta(&in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// An object has no units of its own
+	if meta := got.Updates[0].Meta; len(meta) != 1 || meta[0].Value.Units != "" {
+		t.Errorf("Got %+v", meta)
+	}
+
+	// Angles which are converted to radians are in radians
+	_, def := nmea2k.PgnList.First(127257)
+	if meta := fieldMeta(&def, 3, []transform{{Operation: "convert", To: "rad"}}); meta.Units != "rad" {
+		t.Errorf("Got %+v", meta)
+	}
+}
+
+func TestMetaPath(t *testing.T) {
+	tests := []struct {
+		in, path, key string
+		ok            bool
+	}{
+		{"environment.depth.belowKeel.meta", "environment.depth.belowKeel", "", true},
+		{"environment.depth.belowKeel.meta.displayName", "environment.depth.belowKeel", "displayName", true},
+		{"environment.depth.belowKeel", "", "", false},
+		{"meta", "", "", false},
+		{"a.meta.b.c", "", "", false},
+	}
+
+	for _, tt := range tests {
+		path, key, ok := MetaPath(tt.in)
+		if path != tt.path || key != tt.key || ok != tt.ok {
+			t.Errorf("%v: got %q %q %v", tt.in, path, key, ok)
+		}
+	}
+}
+
+func TestMetaSet(t *testing.T) {
+	var meta Meta
+
+	if err := meta.Set("displayName", "Depth"); err != nil || meta.DisplayName != "Depth" {
+		t.Errorf("Got %+v, %v", meta, err)
+	}
+
+	var zones interface{}
+	json.Unmarshal([]byte(`[{"upper": 2, "state": "alarm", "message": "Shallow"}]`), &zones)
+	if err := meta.Set("zones", zones); err != nil || len(meta.Zones) != 1 || *meta.Zones[0].Upper != 2 {
+		t.Errorf("Got %+v, %v", meta, err)
+	}
+	if err := meta.Check(); err != nil {
+		t.Error(err)
+	}
+
+	if err := meta.Set("displayName", nil); err != nil || meta.DisplayName != "" || meta.Zones == nil {
+		t.Errorf("Got %+v, %v", meta, err)
+	}
+
+	if err := meta.Set("colour", "red"); err == nil {
+		t.Error("Set an unknown property")
+	}
+	if err := meta.Set("displayScale", "wide"); err == nil {
+		t.Error("Set an invalid display scale")
+	}
+}
+
+func TestMetaCheck(t *testing.T) {
+	one, two := 1.0, 2.0
+
+	for _, meta := range []Meta{
+		{DisplayScale: &DisplayScale{Lower: 10, Upper: 0}},
+		{DisplayScale: &DisplayScale{Lower: 0, Upper: 10, Type: "power"}},
+		{DisplayScale: &DisplayScale{Lower: 0, Upper: 10, Type: "cubic"}},
+		{Zones: []Zone{{State: "panic"}}},
+		{Zones: []Zone{{Lower: &two, Upper: &one, State: "warn"}}},
+	} {
+		if err := meta.Check(); err == nil {
+			t.Errorf("%+v: expected an error", meta)
+		}
+	}
+}
+
+func TestMetaModel(t *testing.T) {
+	model := NewModel(DefaultContext)
+	model.Apply(MetaDelta(DefaultContext, "environment.depth.belowKeel", Meta{DisplayName: "Depth", Units: "m"}))
+
+	b, ok := model.Get("vessels/self/environment/depth/belowKeel/meta")
+	if !ok || string(b) != `{"displayName":"Depth","units":"m"}` {
+		t.Errorf("Got %s", b)
+	}
+
+	// Meta goes to clients which subscribe to its path
+	s, _ := NewSubscriber(DefaultContext, "self")
+	d, ok := s.Filter(MetaDelta(DefaultContext, "environment.depth.belowKeel", Meta{Units: "m"}), time.Now())
+	if !ok || len(d.Updates[0].Meta) != 1 {
+		t.Errorf("Got %+v", d)
+	}
+}
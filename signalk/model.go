@@ -0,0 +1,353 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package signalk
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/timmathews/argo/nmea2k"
+)
+
+// Version of the Signal K specification the model follows
+const Version = "1.0.0"
+
+// Model is the Signal K full data model, built up from deltas. Every value
+// keeps its timestamp and source, and the latest value from each source is
+// kept under "values" when a path has more than one source.
+type Model struct {
+	mu      sync.RWMutex
+	self    string
+	vessels map[string]interface{}
+	sources map[string]interface{}
+}
+
+// leaf is a value in the model
+type leaf struct {
+	Value     interface{}             `json:"value"`
+	Timestamp time.Time               `json:"timestamp"`
+	Source    string                  `json:"$source"`
+	Pgn       uint32                  `json:"pgn,omitempty"`
+	Values    map[string]*sourceValue `json:"values,omitempty"`
+	Meta      *Meta                   `json:"meta,omitempty"`
+
+	sources map[string]*sourceValue
+}
+
+// MarshalJSON writes only the meta of a leaf whose path has meta but has not
+// been given a value yet
+func (l *leaf) MarshalJSON() ([]byte, error) {
+	if len(l.sources) == 0 {
+		return json.Marshal(struct {
+			Meta *Meta `json:"meta,omitempty"`
+		}{l.Meta})
+	}
+
+	type plain leaf
+	return json.Marshal((*plain)(l))
+}
+
+type sourceValue struct {
+	Value     interface{} `json:"value"`
+	Timestamp time.Time   `json:"timestamp"`
+	Pgn       uint32      `json:"pgn,omitempty"`
+}
+
+// NewModel returns an empty model. Self is the context of our own vessel,
+// such as vessels.urn:mrn:signalk:uuid:c0d79334-4e25-4245-8892-54e8ccc8021d.
+func NewModel(self string) *Model {
+	return &Model{
+		self:    self,
+		vessels: make(map[string]interface{}),
+		sources: make(map[string]interface{}),
+	}
+}
+
+// Self returns the context of our own vessel.
+func (m *Model) Self() string {
+	return m.self
+}
+
+// Apply updates the model with the values of a delta.
+func (m *Model) Apply(d Delta) {
+	ctx := strings.Split(d.Context, ".")
+	if len(ctx) != 2 || ctx[0] != "vessels" || ctx[1] == "" {
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	vessel, ok := m.vessels[ctx[1]].(map[string]interface{})
+	if !ok {
+		vessel = make(map[string]interface{})
+		m.vessels[ctx[1]] = vessel
+	}
+
+	for _, u := range d.Updates {
+		label := u.Source.label()
+
+		for _, mv := range u.Meta {
+			meta := mv.Value
+			pathLeaf(vessel, strings.Split(mv.Path, ".")).Meta = &meta
+		}
+
+		for _, v := range u.Values {
+			// Values for the vessel itself, such as its name, come as an
+			// object with an empty path
+			if v.Path == "" {
+				if obj, ok := v.Value.(map[string]interface{}); ok {
+					for k, x := range obj {
+						vessel[k] = x
+					}
+				}
+				continue
+			}
+
+			setValue(vessel, strings.Split(v.Path, "."), label, u, v.Value)
+		}
+	}
+}
+
+// device returns the entry of a device in the sources tree, creating it and
+// its interface if they are new
+func (m *Model) device(s source) map[string]interface{} {
+	iface, ok := m.sources[s.Label].(map[string]interface{})
+	if !ok {
+		iface = map[string]interface{}{"label": s.Label, "type": s.Type}
+		m.sources[s.Label] = iface
+	}
+
+	dev, ok := iface[s.Src].(map[string]interface{})
+	if !ok {
+		dev = map[string]interface{}{
+			"n2k": map[string]interface{}{
+				"src":  s.Src,
+				"pgns": make(map[string]interface{}),
+			},
+		}
+		iface[s.Src] = dev
+	}
+
+	return dev["n2k"].(map[string]interface{})
+}
+
+// Device records a message in the sources tree: when the device last sent
+// its PGN, and what the device says about itself in its address claim and
+// product information, PGNs 60928 and 126996.
+func (m *Model) Device(msg *nmea2k.ParsedMessage) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	n2k := m.sent(messageSource(msg), msg.InterfaceType, msg.Header.Timestamp)
+
+	if msg.Header.Pgn != 60928 && msg.Header.Pgn != 126996 {
+		return
+	}
+
+	def := nmea2k.PgnList[msg.Index]
+
+	for i, f := range def.FieldList {
+		v := msg.Data[i]
+		if v == nil || f.Name == "Reserved" {
+			continue
+		}
+
+		switch t := v.(type) {
+		case string:
+			v = strings.TrimSpace(t)
+		case []byte:
+			// The unique number is not a whole number of bytes
+			var n uint64
+			for j := len(t) - 1; j >= 0; j-- {
+				n = n<<8 | uint64(t[j])
+			}
+			v = n & (1<<f.Size - 1)
+		}
+
+		n2k[camelCase(f.Name)] = v
+	}
+
+	if msg.Header.Pgn == 60928 && len(msg.Header.Data) == 8 {
+		n2k["canName"] = strconv.FormatUint(binary.LittleEndian.Uint64(msg.Header.Data), 10)
+	}
+}
+
+// DecodedDevice is Device for a decoded message. Only the address claim and
+// product information are converted to a ParsedMessage.
+func (m *Model) DecodedDevice(msg *nmea2k.DecodedMessage) {
+	if msg.Header.Pgn == 60928 || msg.Header.Pgn == 126996 {
+		m.Device(msg.Parsed())
+		return
+	}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.sent(decodedSource(msg), msg.InterfaceType, msg.Header.Timestamp)
+}
+
+// sent records when a device last sent a PGN and returns its n2k branch
+func (m *Model) sent(src source, ifaceType string, ts time.Time) map[string]interface{} {
+	n2k := m.device(src)
+	n2k["pgns"].(map[string]interface{})[strconv.Itoa(int(src.Pgn))] = ts
+
+	if ifaceType != "" {
+		m.sources[src.Label].(map[string]interface{})["interfaceType"] = ifaceType
+	}
+
+	return n2k
+}
+
+// camelCase converts a field name such as Model ID to modelId
+func camelCase(name string) string {
+	words := strings.Fields(name)
+
+	for i, w := range words {
+		w = strings.ToLower(w)
+		if i > 0 {
+			w = strings.ToUpper(w[:1]) + w[1:]
+		}
+		words[i] = w
+	}
+
+	return strings.Join(words, "")
+}
+
+// pathLeaf returns the leaf at the end of a path, creating it and the
+// branches on the way
+func pathLeaf(node map[string]interface{}, keys []string) *leaf {
+	for _, k := range keys[:len(keys)-1] {
+		next, ok := node[k].(map[string]interface{})
+		if !ok {
+			next = make(map[string]interface{})
+			node[k] = next
+		}
+		node = next
+	}
+
+	k := keys[len(keys)-1]
+
+	l, ok := node[k].(*leaf)
+	if !ok {
+		l = &leaf{sources: make(map[string]*sourceValue)}
+		node[k] = l
+	}
+
+	return l
+}
+
+// setValue stores a value at the end of a path
+func setValue(node map[string]interface{}, keys []string, label string, u update, v interface{}) {
+	// JSON has no NaN or infinity, and one would spoil the whole model
+	switch f := v.(type) {
+	case float64:
+		if math.IsNaN(f) || math.IsInf(f, 0) {
+			v = nil
+		}
+	case float32:
+		if math.IsNaN(float64(f)) || math.IsInf(float64(f), 0) {
+			v = nil
+		}
+	}
+
+	l := pathLeaf(node, keys)
+
+	l.Value = v
+	l.Timestamp = u.Timestamp
+	l.Source = label
+	l.Pgn = u.Source.Pgn
+	l.sources[label] = &sourceValue{v, u.Timestamp, u.Source.Pgn}
+
+	if len(l.sources) > 1 {
+		l.Values = l.sources
+	}
+}
+
+// MarshalJSON writes the full model
+func (m *Model) MarshalJSON() ([]byte, error) {
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	return json.Marshal(struct {
+		Version string                 `json:"version"`
+		Self    string                 `json:"self"`
+		Vessels map[string]interface{} `json:"vessels"`
+		Sources map[string]interface{} `json:"sources"`
+	}{Version, m.self, m.vessels, m.sources})
+}
+
+// Get returns the JSON of the part of the model at a path, such as
+// vessels/self/navigation/speedOverGround. The path may be given with slashes
+// or dots, and self stands for our own vessel. Get returns false if there is
+// nothing at the path.
+func (m *Model) Get(p string) ([]byte, bool) {
+	keys := strings.FieldsFunc(p, func(r rune) bool { return r == '/' || r == '.' })
+	if len(keys) == 0 {
+		b, err := json.Marshal(m)
+		return b, err == nil
+	}
+
+	if len(keys) > 1 && keys[0] == "vessels" && keys[1] == "self" {
+		keys[1] = strings.TrimPrefix(m.self, "vessels.")
+	}
+
+	m.mu.RLock()
+	defer m.mu.RUnlock()
+
+	var node interface{}
+
+	switch keys[0] {
+	case "vessels":
+		node = m.vessels
+	case "sources":
+		node = m.sources
+	default:
+		return nil, false
+	}
+
+	for _, k := range keys[1:] {
+		switch n := node.(type) {
+		case map[string]interface{}:
+			node = n[k]
+		case *leaf:
+			// Reach into a value, for example .../value or .../values
+			var obj map[string]interface{}
+			b, _ := json.Marshal(n)
+			json.Unmarshal(b, &obj)
+			node = obj[k]
+		default:
+			node = nil
+		}
+
+		if node == nil {
+			return nil, false
+		}
+	}
+
+	b, err := json.Marshal(node)
+
+	return b, err == nil
+}
@@ -0,0 +1,151 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package signalk
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/timmathews/argo/nmea2k"
+)
+
+func TestModelApply(t *testing.T) {
+	model := NewModel(DefaultContext)
+
+	ts := time.Date(2016, 3, 14, 15, 9, 26, 0, time.UTC)
+
+	in := newMessage(ts, 129026, nmea2k.DataMap{0: 0, 1: "True", 2: 0xF, 3: 123.4, 4: 5.3})
+	in.Interface = "actisense"
+	d, err := mapdata.Delta(&in)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.Updates[0].Timestamp = ts
+	model.Apply(d)
+
+	// The same value from another source
+	d.Updates[0].Source.Src = "2"
+	d.Updates[0].Timestamp = ts.Add(time.Second)
+	d.Updates[0].Values[0].Value = 124.0
+	model.Apply(d)
+
+	b, ok := model.Get("/vessels/self/navigation/courseOverGroundTrue")
+	if !ok {
+		t.Fatalf("Get() found nothing, model is %s", mustMarshal(model))
+	}
+
+	var got struct {
+		Value     float64
+		Timestamp time.Time
+		Source    string `json:"$source"`
+		Pgn       uint32
+		Values    map[string]struct{ Value float64 }
+	}
+	json.Unmarshal(b, &got)
+
+	if got.Value != 124.0 || got.Source != "actisense.2" || got.Pgn != 129026 || !got.Timestamp.Equal(ts.Add(time.Second)) {
+		t.Errorf("Get() = %s, expected the latest value from actisense.2", b)
+	}
+
+	if len(got.Values) != 2 || got.Values["actisense.1"].Value != 123.4 {
+		t.Errorf("Get() = %s, expected values from two sources", b)
+	}
+
+	if b, ok := model.Get("vessels/self/navigation/courseOverGroundTrue/value"); !ok || string(b) != "124" {
+		t.Errorf("Get(.../value) = %s, expected 124", b)
+	}
+
+	if _, ok := model.Get("vessels/self/navigation/headingTrue"); ok {
+		t.Error("Get() found a path that was never set")
+	}
+}
+
+func TestModelMetaWithoutValue(t *testing.T) {
+	model := NewModel(DefaultContext)
+	model.Apply(MetaDelta(DefaultContext, "environment.depth.belowKeel", Meta{DisplayName: "Depth"}))
+
+	b, ok := model.Get("vessels/self/environment/depth/belowKeel")
+	if !ok || string(b) != `{"meta":{"displayName":"Depth"}}` {
+		t.Errorf("Get() = %s, expected only the meta", b)
+	}
+
+	if b, ok := model.Get("vessels/self/environment/depth/belowKeel/value"); ok {
+		t.Errorf("Get(.../value) = %s, expected nothing", b)
+	}
+
+	// The value joins the meta once it arrives
+	model.Apply(valueDelta("environment.depth.belowKeel", 4.2))
+
+	if b, ok := model.Get("vessels/self/environment/depth/belowKeel/value"); !ok || string(b) != "4.2" {
+		t.Errorf("Get(.../value) = %s, expected 4.2", b)
+	}
+	if b, ok := model.Get("vessels/self/environment/depth/belowKeel/meta/displayName"); !ok || string(b) != `"Depth"` {
+		t.Errorf("Get(.../meta/displayName) = %s, expected Depth", b)
+	}
+}
+
+func TestModelSources(t *testing.T) {
+	model := NewModel(DefaultContext)
+
+	ts := time.Date(2016, 3, 14, 15, 9, 26, 0, time.UTC)
+
+	in := newMessage(ts, 126996, nmea2k.DataMap{0: uint64(2100), 1: uint64(1234), 2: "GPS 200    ", 3: "1.2.3"})
+	in.Interface, in.InterfaceType = "n2k-port", "canusb"
+	model.Device(&in)
+
+	for p, expected := range map[string]string{
+		"sources/n2k-port/type":                  `"NMEA2000"`,
+		"sources/n2k-port/interfaceType":         `"canusb"`,
+		"sources/n2k-port/1/n2k/modelId":         `"GPS 200"`,
+		"sources/n2k-port/1/n2k/productCode":     `1234`,
+		"sources/n2k-port/1/n2k/pgns/126996":     `"2016-03-14T15:09:26Z"`,
+		"sources/n2k-port/1/n2k/nmea2000Version": `2100`,
+	} {
+		if b, ok := model.Get(p); !ok || string(b) != expected {
+			t.Errorf("Get(%v) = %s, expected %v", p, b, expected)
+		}
+	}
+
+	// Deltas refer to the source by interface and address
+	in = newMessage(ts, 129026, nmea2k.DataMap{0: 0, 1: "True", 2: 0xF, 3: 123.4, 4: 5.3})
+	in.Interface = "n2k-port"
+	d, err := mapdata.Delta(&in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var got struct {
+		Updates []struct {
+			Source map[string]interface{}
+			Ref    string `json:"$source"`
+		}
+	}
+	json.Unmarshal(mustMarshal(d), &got)
+
+	if got.Updates[0].Ref != "n2k-port.1" || got.Updates[0].Source["label"] != "n2k-port" || got.Updates[0].Source["src"] != "1" {
+		t.Errorf("Delta() = %s, expected $source n2k-port.1", mustMarshal(d))
+	}
+}
+
+func mustMarshal(v interface{}) []byte {
+	b, _ := json.Marshal(v)
+	return b
+}
@@ -0,0 +1,316 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package signalk
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// How many changes to notifications are kept
+const notificationHistory = 1000
+
+// Notification is the value of a path under notifications, such as
+// notifications.environment.depth.belowKeel
+type Notification struct {
+	State   string             `json:"state"`
+	Method  []string           `json:"method"`
+	Message string             `json:"message"`
+	Status  NotificationStatus `json:"status"`
+}
+
+// NotificationStatus says whether a notification has been silenced or
+// acknowledged, and whether it can be
+type NotificationStatus struct {
+	Silenced       bool `json:"silenced"`
+	Acknowledged   bool `json:"acknowledged"`
+	CanSilence     bool `json:"canSilence"`
+	CanAcknowledge bool `json:"canAcknowledge"`
+	CanClear       bool `json:"canClear"`
+}
+
+// NotificationEvent is a change to a notification, kept in the history
+type NotificationEvent struct {
+	Timestamp time.Time `json:"timestamp"`
+	Context   string    `json:"context"`
+	Path      string    `json:"path"`
+	Event     string    `json:"event"` // state, silence or acknowledge
+	State     string    `json:"state"`
+	Message   string    `json:"message"`
+}
+
+// alarm is a notification which is being raised
+type alarm struct {
+	Notification
+
+	zone int // Index of the zone the value is in, -1 for none
+	src  source
+}
+
+// Notifier raises notifications when values enter the zones of their meta,
+// and for NMEA 2000 alerts. It keeps the state of each notification, so that
+// one is only sent when it changes, and a history of the changes.
+type Notifier struct {
+	mu      sync.Mutex
+	meta    map[string]Meta       // By context and path
+	alarms  map[string]*alarm     // By context and notification path
+	alerts  map[string]*nmeaAlert // By context and notification path
+	history []NotificationEvent
+}
+
+func NewNotifier() *Notifier {
+	return &Notifier{
+		meta:   make(map[string]Meta),
+		alarms: make(map[string]*alarm),
+		alerts: make(map[string]*nmeaAlert),
+	}
+}
+
+// Process takes note of the meta in a delta and returns the notifications
+// raised or cleared by its values
+func (n *Notifier) Process(d Delta) (Delta, bool) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	out := Delta{Context: d.Context}
+	upd := update{Source: serverSource, Timestamp: time.Now(), Values: []value{}}
+
+	for _, u := range d.Updates {
+		for _, mv := range u.Meta {
+			n.meta[d.Context+"/"+mv.Path] = mv.Value
+		}
+
+		for _, v := range u.Values {
+			meta, ok := n.meta[d.Context+"/"+v.Path]
+			if !ok || len(meta.Zones) == 0 {
+				continue
+			}
+
+			f, ok := number(v.Value)
+			if !ok {
+				continue
+			}
+
+			if val, ok := n.evaluate(d.Context, v.Path, &meta, f, u.Timestamp); ok {
+				upd.Values = append(upd.Values, val)
+			}
+		}
+	}
+
+	if len(upd.Values) == 0 {
+		return out, false
+	}
+
+	out.Updates = []update{upd}
+
+	return out, true
+}
+
+// evaluate finds the zone a value is in and returns a notification if that
+// changes its state. The most severe zone wins where zones overlap. A value
+// stays in its zone until it is past the hysteresis of the zone.
+func (n *Notifier) evaluate(context, path string, meta *Meta, f float64, ts time.Time) (value, bool) {
+	p := "notifications." + path
+	a := n.alarms[context+"/"+p]
+
+	zone, severity := -1, 0
+	for i, z := range meta.Zones {
+		if inZone(&z, f, 0) && zoneStates[z.State] > severity {
+			zone, severity = i, zoneStates[z.State]
+		}
+	}
+
+	if a != nil && a.zone >= 0 && a.zone < len(meta.Zones) && a.zone != zone {
+		z := &meta.Zones[a.zone]
+		if zoneStates[z.State] > severity && inZone(z, f, z.Hysteresis) {
+			zone = a.zone
+		}
+	}
+
+	state, message := "normal", ""
+	if zone >= 0 {
+		state, message = meta.Zones[zone].State, meta.Zones[zone].Message
+	}
+	if message == "" {
+		name := meta.DisplayName
+		if name == "" {
+			name = path
+		}
+		message = fmt.Sprintf("%v is %v", name, state)
+	}
+
+	if a == nil {
+		if zoneStates[state] == 0 {
+			return value{}, false
+		}
+		a = &alarm{zone: -1}
+		n.alarms[context+"/"+p] = a
+	}
+
+	if a.zone == zone && a.State == state {
+		return value{}, false
+	}
+
+	status := NotificationStatus{CanSilence: true, CanAcknowledge: true}
+	method := meta.methods(state)
+
+	// Silencing or acknowledging still holds when the state becomes less
+	// severe, but not when it becomes more severe
+	if zoneStates[state] > 0 && zoneStates[state] < zoneStates[a.State] {
+		status.Silenced, status.Acknowledged = a.Status.Silenced, a.Status.Acknowledged
+		if status.Silenced || status.Acknowledged {
+			method = withoutSound(method)
+		}
+	}
+
+	a.zone = zone
+	a.src = serverSource
+	a.Notification = Notification{
+		State:   state,
+		Method:  method,
+		Message: message,
+		Status:  status,
+	}
+
+	n.record(ts, context, p, "state", &a.Notification)
+
+	return value{p, a.Notification}, true
+}
+
+// inZone says whether a value is in a zone widened by h at either end
+func inZone(z *Zone, f, h float64) bool {
+	return (z.Lower == nil || f >= *z.Lower-h) && (z.Upper == nil || f <= *z.Upper+h)
+}
+
+// methods returns how a notification in a state is given, by default visual
+// for an alert or warning and visual and sound for an alarm or emergency
+func (meta *Meta) methods(state string) []string {
+	var m []string
+
+	switch state {
+	case "alert":
+		m = meta.AlertMethod
+	case "warn":
+		m = meta.WarnMethod
+	case "alarm":
+		m = meta.AlarmMethod
+	case "emergency":
+		m = meta.EmergencyMethod
+	default:
+		return []string{}
+	}
+
+	if m != nil {
+		return m
+	}
+
+	if zoneStates[state] >= zoneStates["alarm"] {
+		return []string{"visual", "sound"}
+	}
+
+	return []string{"visual"}
+}
+
+// record adds a change to a notification to the history
+func (n *Notifier) record(ts time.Time, context, path, event string, nt *Notification) {
+	if len(n.history) >= notificationHistory {
+		n.history = append(n.history[:0], n.history[1:]...)
+	}
+
+	n.history = append(n.history, NotificationEvent{ts, context, path, event, nt.State, nt.Message})
+}
+
+// History returns the changes to notifications, oldest first
+func (n *Notifier) History() []NotificationEvent {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	return append([]NotificationEvent{}, n.history...)
+}
+
+// Respond silences or acknowledges a notification, such as
+// notifications.environment.depth.belowKeel, and returns its new value. A
+// silenced notification is no longer sounded; an acknowledged one is also
+// not sounded again when it changes to a less severe state.
+func (n *Notifier) Respond(context, path, action string) (Delta, error) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	a := n.alarms[context+"/"+path]
+	if a == nil || zoneStates[a.State] == 0 {
+		return Delta{}, fmt.Errorf("%v is not raised", path)
+	}
+
+	switch action {
+	case "silence":
+		if !a.Status.CanSilence {
+			return Delta{}, fmt.Errorf("%v cannot be silenced", path)
+		}
+		a.Status.Silenced = true
+	case "acknowledge":
+		if !a.Status.CanAcknowledge {
+			return Delta{}, fmt.Errorf("%v cannot be acknowledged", path)
+		}
+		a.Status.Acknowledged = true
+	default:
+		return Delta{}, fmt.Errorf("cannot %v a notification", action)
+	}
+
+	a.Method = withoutSound(a.Method)
+
+	n.record(time.Now(), context, path, action, &a.Notification)
+
+	return Delta{
+		Context: context,
+		Updates: []update{{a.src, time.Now(), []value{{path, a.Notification}}, nil}},
+	}, nil
+}
+
+// withoutSound returns methods other than sound
+func withoutSound(methods []string) []string {
+	out := []string{}
+
+	for _, m := range methods {
+		if m != "sound" {
+			out = append(out, m)
+		}
+	}
+
+	return out
+}
+
+// NotificationAction splits the path of a PUT to a notification, such as
+// notifications.environment.depth.belowKeel.acknowledge, into the path of
+// the notification and the action. It returns false for other paths.
+func NotificationAction(p string) (path, action string, ok bool) {
+	i := strings.LastIndexByte(p, '.')
+	if !strings.HasPrefix(p, "notifications.") || i < len("notifications.") {
+		return "", "", false
+	}
+
+	switch p[i+1:] {
+	case "silence", "acknowledge":
+		return p[:i], p[i+1:], true
+	}
+
+	return "", "", false
+}
@@ -0,0 +1,237 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package signalk
+
+import (
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/timmathews/argo/nmea2k"
+)
+
+// valueDelta returns a delta with one value
+func valueDelta(path string, v interface{}) Delta {
+	return Delta{
+		Context: DefaultContext,
+		Updates: []update{{Source: serverSource, Timestamp: time.Now(), Values: []value{{path, v}}}},
+	}
+}
+
+func TestNotifierZones(t *testing.T) {
+	high, higher := 0.3, 0.6
+
+	n := NewNotifier()
+	n.Process(MetaDelta(DefaultContext, "tanks.bilge.0.currentLevel", Meta{
+		DisplayName: "Bilge",
+		Zones: []Zone{
+			{Lower: &high, State: "alarm", Message: "Bilge water is high", Hysteresis: 0.05},
+			{Lower: &higher, State: "emergency"},
+		},
+		AlarmMethod: []string{"sound"},
+	}))
+
+	tests := []struct {
+		level   float64
+		state   string
+		method  []string
+		message string
+	}{
+		{0.1, "", nil, ""},
+		{0.35, "alarm", []string{"sound"}, "Bilge water is high"},
+		{0.7, "emergency", []string{"visual", "sound"}, "Bilge is emergency"},
+		{0.5, "alarm", []string{"sound"}, "Bilge water is high"},
+		// Within the hysteresis of the alarm zone
+		{0.27, "", nil, ""},
+		{0.2, "normal", []string{}, "Bilge is normal"},
+		{0.2, "", nil, ""},
+	}
+
+	for _, tt := range tests {
+		d, ok := n.Process(valueDelta("tanks.bilge.0.currentLevel", tt.level))
+		if tt.state == "" {
+			if ok {
+				t.Errorf("%v: got %+v", tt.level, d)
+			}
+			continue
+		}
+
+		expected := value{"notifications.tanks.bilge.0.currentLevel", Notification{
+			State:   tt.state,
+			Method:  tt.method,
+			Message: tt.message,
+			Status:  NotificationStatus{CanSilence: true, CanAcknowledge: true},
+		}}
+		if !ok || !reflect.DeepEqual(d.Updates[0].Values, []value{expected}) {
+			t.Errorf("%v:\nExpected: %+v\n     Got: %+v", tt.level, expected, d)
+		}
+	}
+
+	if h := n.History(); len(h) != 4 || h[0].State != "alarm" || h[3].State != "normal" {
+		t.Errorf("Got %+v", h)
+	}
+}
+
+func TestNotifierRespond(t *testing.T) {
+	low := 2.0
+
+	n := NewNotifier()
+	n.Process(MetaDelta(DefaultContext, "environment.depth.belowKeel", Meta{
+		Zones: []Zone{{Upper: &low, State: "alarm"}},
+	}))
+
+	path := "notifications.environment.depth.belowKeel"
+	if _, err := n.Respond(DefaultContext, path, "silence"); err == nil {
+		t.Error("silenced a notification which is not raised")
+	}
+
+	n.Process(valueDelta("environment.depth.belowKeel", 1.5))
+
+	d, err := n.Respond(DefaultContext, path, "silence")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	nt := d.Updates[0].Values[0].Value.(Notification)
+	if !nt.Status.Silenced || nt.Status.Acknowledged || !reflect.DeepEqual(nt.Method, []string{"visual"}) {
+		t.Errorf("Got %+v", nt)
+	}
+
+	if _, err := n.Respond(DefaultContext, path, "clear"); err == nil {
+		t.Error("cleared a notification")
+	}
+
+	if h := n.History(); len(h) != 2 || h[1].Event != "silence" {
+		t.Errorf("Got %+v", h)
+	}
+}
+
+func TestNotifierAcknowledgeLessSevere(t *testing.T) {
+	alarm, warn := 2.0, 4.0
+
+	n := NewNotifier()
+	n.Process(MetaDelta(DefaultContext, "environment.depth.belowKeel", Meta{
+		WarnMethod: []string{"visual", "sound"},
+		Zones: []Zone{
+			{Upper: &alarm, State: "alarm"},
+			{Lower: &alarm, Upper: &warn, State: "warn"},
+		},
+	}))
+
+	path := "notifications.environment.depth.belowKeel"
+	n.Process(valueDelta("environment.depth.belowKeel", 1.5))
+	if _, err := n.Respond(DefaultContext, path, "acknowledge"); err != nil {
+		t.Fatal(err)
+	}
+
+	// The acknowledgement holds as the alarm becomes a warning
+	d, ok := n.Process(valueDelta("environment.depth.belowKeel", 3.0))
+	if !ok {
+		t.Fatal("no notification for the warning")
+	}
+
+	nt := d.Updates[0].Values[0].Value.(Notification)
+	if nt.State != "warn" || !nt.Status.Acknowledged || !reflect.DeepEqual(nt.Method, []string{"visual"}) {
+		t.Errorf("Got %+v, expected an acknowledged warning which is not sounded", nt)
+	}
+
+	// But not once it is an alarm again
+	d, _ = n.Process(valueDelta("environment.depth.belowKeel", 1.5))
+
+	nt = d.Updates[0].Values[0].Value.(Notification)
+	if nt.State != "alarm" || nt.Status.Acknowledged || nt.Status.Silenced {
+		t.Errorf("Got %+v, expected a new alarm", nt)
+	}
+}
+
+func TestNotificationAction(t *testing.T) {
+	tests := []struct {
+		in, path, action string
+		ok               bool
+	}{
+		{"notifications.environment.depth.belowKeel.acknowledge", "notifications.environment.depth.belowKeel", "acknowledge", true},
+		{"notifications.nmea2000.43.1001.silence", "notifications.nmea2000.43.1001", "silence", true},
+		{"notifications.silence", "", "", false},
+		{"environment.depth.belowKeel.silence", "", "", false},
+		{"notifications.environment.depth.belowKeel", "", "", false},
+	}
+
+	for _, tt := range tests {
+		path, action, ok := NotificationAction(tt.in)
+		if path != tt.path || action != tt.action || ok != tt.ok {
+			t.Errorf("%v: got %q %q %v", tt.in, path, action, ok)
+		}
+	}
+}
+
+func TestNotifierAlert(t *testing.T) {
+	alert := func(state, ack string) nmea2k.ParsedMessage {
+		return newMessage(time.Now(), 126983, nmea2k.DataMap{
+			0:  "Alarm",
+			1:  "Technical",
+			4:  uint16(1001),
+			9:  "Not temporary status",
+			10: ack,
+			12: "Supported",
+			13: "Supported",
+			14: "Not supported",
+			20: state,
+		})
+	}
+
+	n := NewNotifier()
+
+	tests := []struct {
+		msg    nmea2k.ParsedMessage
+		state  string
+		method []string
+		acked  bool
+	}{
+		{alert("Active", "Not acknowledged"), "alarm", []string{"visual", "sound"}, false},
+		{alert("Active", "Not acknowledged"), "", nil, false},
+		{alert("Acknowleged", "Acknowledged"), "alarm", []string{"visual"}, true},
+		{alert("Normal", "Acknowledged"), "normal", []string{}, true},
+	}
+
+	for i, tt := range tests {
+		d, ok := n.Alert(DefaultContext, &tt.msg)
+		if tt.state == "" {
+			if ok {
+				t.Errorf("%v: got %+v", i, d)
+			}
+			continue
+		}
+		if !ok {
+			t.Fatalf("%v: no notification", i)
+		}
+
+		v := d.Updates[0].Values[0]
+		nt := v.Value.(Notification)
+		if v.Path != "notifications.nmea2000.1.1001" || nt.State != tt.state ||
+			!reflect.DeepEqual(nt.Method, tt.method) || nt.Status.Acknowledged != tt.acked ||
+			!nt.Status.CanSilence || nt.Message != "Technical alarm 1001" {
+			t.Errorf("%v: got %v %+v", i, v.Path, nt)
+		}
+	}
+
+	if h := n.History(); len(h) != 3 || h[1].Event != "acknowledge" {
+		t.Errorf("Got %+v", h)
+	}
+}
@@ -0,0 +1,101 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package signalk
+
+import (
+	"github.com/timmathews/argo/nmea2k"
+)
+
+// member is a member of an object assembled by a fieldset, such as the
+// latitude of navigation.position. Each member is read from its own field
+// and has its own transforms. An object is only sent when each of its
+// required members is present, and members which are not present are left
+// out of it, so a position without an altitude is still a position.
+type member struct {
+	Name       string      `xml:"name,attr"`
+	Required   bool        `xml:"required,attr"`
+	Field      string      `xml:"field"`
+	Transforms []transform `xml:"transform"`
+}
+
+// compiledMember is a member resolved against one PGN definition
+type compiledMember struct {
+	*member
+
+	field    int
+	operands []int // For DecodedDelta, as those of a compiledGroup
+}
+
+// compileMembers resolves the members of an object fieldset. It fails if a
+// required member is not in the definition or a member is in its repeating
+// group; optional members which are not in the definition are left out.
+func compileMembers(fs *fieldset, def *nmea2k.Pgn) ([]compiledMember, bool) {
+	var members []compiledMember
+
+	rpt := def.FirstRepeatingField()
+
+	for i := range fs.Members {
+		m := &fs.Members[i]
+
+		fld, err := def.FieldIndex(m.Field)
+		if err != nil || (rpt >= 0 && fld >= rpt) {
+			if m.Required {
+				return nil, false
+			}
+			continue
+		}
+
+		members = append(members, compiledMember{member: m, field: fld})
+	}
+
+	return members, len(members) > 0
+}
+
+// object assembles the value of an object fieldset from the fields of a
+// message. It returns nil if a required member is missing or no member is
+// present.
+func (cg *compiledGroup) object(def *nmea2k.Pgn, fields nmea2k.DataMap) map[string]interface{} {
+	obj := make(map[string]interface{}, len(cg.members))
+
+	for _, m := range cg.members {
+		v := fields[m.field]
+		if v != nil {
+			var err error
+			if v, err = applyTransforms(m.Transforms, v, def, fields); err != nil {
+				v = nil
+			}
+		}
+
+		if v == nil {
+			if m.Required {
+				return nil
+			}
+			continue
+		}
+
+		obj[m.Name] = v
+	}
+
+	if len(obj) == 0 {
+		return nil
+	}
+
+	return obj
+}
@@ -0,0 +1,171 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package signalk
+
+import (
+	"encoding/xml"
+	"math"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/timmathews/argo/nmea2k"
+)
+
+// find returns the value of a path in a delta, or nil
+func find(d Delta, p string) interface{} {
+	for _, u := range d.Updates {
+		for _, v := range u.Values {
+			if v.Path == p {
+				return v.Value
+			}
+		}
+	}
+
+	return nil
+}
+
+func TestObjectPosition(t *testing.T) {
+	tests := []struct {
+		pgn      uint32
+		data     nmea2k.DataMap
+		expected interface{}
+	}{
+		{129025, nmea2k.DataMap{0: 39.2, 1: -76.5},
+			map[string]interface{}{"latitude": 39.2, "longitude": -76.5}},
+		// Altitude is optional and left out when it is not available
+		{129029, nmea2k.DataMap{0: uint8(1), 3: 39.2, 4: -76.5},
+			map[string]interface{}{"latitude": 39.2, "longitude": -76.5}},
+		{129029, nmea2k.DataMap{0: uint8(1), 3: 39.2, 4: -76.5, 5: 12.25},
+			map[string]interface{}{"latitude": 39.2, "longitude": -76.5, "altitude": 12.25}},
+		// Half a position is no position
+		{129029, nmea2k.DataMap{0: uint8(1), 3: 39.2, 5: 12.25}, nil},
+	}
+
+	for _, tt := range tests {
+		in := newMessage(time.Now(), tt.pgn, tt.data)
+		got, _ := mapdata.Delta(&in)
+
+		if v := find(got, "navigation.position"); !reflect.DeepEqual(v, tt.expected) {
+			t.Errorf("PGN %v %v:\nExpected: %v\n     Got: %v", tt.pgn, tt.data, tt.expected, v)
+		}
+	}
+}
+
+func TestObjectTransforms(t *testing.T) {
+	in := newMessage(time.Now(), 127257, nmea2k.DataMap{0: uint8(1), 2: 90.0, 3: -45.0})
+
+	got, err := mapdata.Delta(&in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	obj, ok := find(got, "navigation.attitude").(map[string]interface{})
+	if !ok {
+		t.Fatalf("Got %+v", got)
+	}
+
+	if len(obj) != 2 || obj["pitch"] != math.Pi/2 || obj["roll"] != -math.Pi/4 {
+		t.Errorf("Got %v", obj)
+	}
+}
+
+func TestObjectCondition(t *testing.T) {
+	in := newMessage(time.Now(), 129284, nmea2k.DataMap{5: "Rhumb Line", 12: 39.2, 13: -76.5})
+
+	got, err := mapdata.Delta(&in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if find(got, "navigation.courseRhumbline.nextPoint.position") == nil ||
+		find(got, "navigation.courseGreatCircle.nextPoint.position") != nil {
+		t.Errorf("Got %+v", got)
+	}
+}
+
+func TestObjectCheck(t *testing.T) {
+	var m Mappings
+	err := xml.Unmarshal([]byte(`<mappings>
+		<mapping>
+			<path>~/a/b</path>
+			<parameter_group>
+				<pgn>129025</pgn>
+				<fieldset type="object">
+					<member name="latitude"><field>Latitude</field></member>
+					<member name="latitude"><field>Altitude</field></member>
+				</fieldset>
+			</parameter_group>
+		</mapping>
+		<mapping>
+			<path>~/a/c</path>
+			<parameter_group>
+				<pgn>129025</pgn>
+				<fieldset type="struct"></fieldset>
+			</parameter_group>
+		</mapping>
+	</mappings>`), &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		`~/a/b: member "latitude" is unnamed or repeated`,
+		`~/a/b: PGN 129025 has no member field "Altitude"`,
+		`~/a/c: unknown fieldset type "struct"`,
+		`~/a/c: PGN 129025 has no field ""`,
+	}
+
+	var got []string
+	for _, err := range m.Check() {
+		got = append(got, err.Error())
+	}
+
+	if !reflect.DeepEqual(got, expected) {
+		t.Errorf("\nExpected: %q\n     Got: %q", expected, got)
+	}
+}
+
+func TestObjectCurrentReference(t *testing.T) {
+	for _, tt := range []struct {
+		ref, member string
+	}{
+		{"True", "setTrue"},
+		{"Magnetic", "setMagnetic"},
+	} {
+		in := newMessage(time.Now(), 130577, nmea2k.DataMap{1: tt.ref, 8: 90.0, 9: 1.5})
+
+		got, err := mapdata.Delta(&in)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		obj, ok := find(got, "environment.current").(map[string]interface{})
+		if !ok || len(obj) != 2 || obj[tt.member] != math.Pi/2 || obj["drift"] != 1.5 {
+			t.Errorf("COG Reference %v: got %v, expected %v and drift", tt.ref, obj, tt.member)
+		}
+	}
+
+	// A set with no reference is not mapped
+	in := newMessage(time.Now(), 130577, nmea2k.DataMap{1: "Error", 8: 90.0, 9: 1.5})
+	if got, _ := mapdata.Delta(&in); find(got, "environment.current") != nil {
+		t.Errorf("COG Reference Error: got %v", got)
+	}
+}
@@ -0,0 +1,196 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package signalk
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/timmathews/argo/can"
+	"github.com/timmathews/argo/nmea2k"
+)
+
+// States of a PUT request
+const (
+	StatePending   = "PENDING"
+	StateCompleted = "COMPLETED"
+	StateFailed    = "FAILED"
+)
+
+// PutRequest asks for a value to be changed, such as a switch to be turned
+// on. Source optionally names the device to send it to, as n2k-port.43.
+type PutRequest struct {
+	RequestId string `json:"requestId"`
+	Context   string `json:"context"`
+	Put       struct {
+		Path   string      `json:"path"`
+		Value  interface{} `json:"value"`
+		Source string      `json:"source,omitempty"`
+	} `json:"put"`
+}
+
+// PutResponse reports the state of a PUT request to the client. Status codes
+// are those of HTTP.
+type PutResponse struct {
+	RequestId  string `json:"requestId,omitempty"`
+	State      string `json:"state"`
+	StatusCode int    `json:"statusCode"`
+	Message    string `json:"message,omitempty"`
+}
+
+// Pack finds the mapping which can set a path, such as
+// electrical.switches.bank.1.3.state, and returns the message which sets it
+// to a value. The message is broadcast unless the caller addresses it.
+//
+// Placeholders in the mapping path are filled with the parts of the path
+// they stand for: a classifier or multiplier sets its field, and an element
+// is the record of the repeating group the value goes in. Records before it
+// are left empty, which is "no change" for fields such as switches. Fields
+// named by eq conditions are set to the value of the condition, and the
+// transforms of the put are undone before the value is sent.
+func (m *Mappings) Pack(path string, v interface{}) (*can.RawMessage, error) {
+	for _, mapping := range m.Mappings {
+		if len(mapping.Puts) == 0 {
+			continue
+		}
+
+		vars, ok := matchPath(toDotNotation(mapping.Path), path)
+		if !ok {
+			continue
+		}
+
+		msg, err := mapping.Puts[0].pack(vars, v)
+		if err != nil {
+			return nil, fmt.Errorf("%v: %v", path, err)
+		}
+
+		return msg, nil
+	}
+
+	return nil, fmt.Errorf("%v cannot be set", path)
+}
+
+// matchPath compares a path to a mapping path and returns the parts of the
+// path which stand in for its {placeholders}
+func matchPath(pattern, path string) (map[string]string, bool) {
+	want := strings.Split(pattern, ".")
+	have := strings.Split(path, ".")
+
+	if len(want) != len(have) {
+		return nil, false
+	}
+
+	vars := make(map[string]string)
+
+	for i, w := range want {
+		if strings.HasPrefix(w, "{") && strings.HasSuffix(w, "}") {
+			vars[w[1:len(w)-1]] = have[i]
+		} else if w != have[i] {
+			return nil, false
+		}
+	}
+
+	return vars, true
+}
+
+// pack builds the message of a put parameter group
+func (put *parameterGroup) pack(vars map[string]string, v interface{}) (*can.RawMessage, error) {
+	_, def := nmea2k.PgnList.First(put.Pgn)
+	if def.Pgn != put.Pgn {
+		return nil, fmt.Errorf("unknown PGN %v", put.Pgn)
+	}
+
+	v, err := put.untransform(v)
+	if err != nil {
+		return nil, err
+	}
+
+	data := make(nmea2k.DataMap)
+
+	for _, c := range put.Conditions {
+		if c.Operation == "eq" {
+			data[c.Field] = c.Values[0]
+		}
+	}
+
+	for _, p := range []struct{ id, field string }{
+		{put.Classifier.Id, put.Classifier.Field},
+		{put.Multiplier.Id, put.Multiplier.Field},
+	} {
+		if p.id == "" || p.field == "" {
+			continue
+		}
+		i, err := def.FieldIndex(p.field)
+		if err != nil {
+			return nil, err
+		}
+		data[i] = vars[p.id]
+	}
+
+	fld, err := def.FieldIndex(put.Field)
+	if err != nil {
+		return nil, err
+	}
+
+	if rpt := def.FirstRepeatingField(); rpt >= 0 && fld >= rpt {
+		n, err := strconv.Atoi(vars[put.Element.Id])
+		if err != nil || n < put.Element.Start {
+			return nil, fmt.Errorf("invalid %v %q", put.Element.Id, vars[put.Element.Id])
+		}
+		n -= put.Element.Start
+
+		records := make([]nmea2k.DataMap, n+1)
+		for i := range records {
+			records[i] = make(nmea2k.DataMap)
+		}
+		records[n][fld] = v
+
+		data[rpt] = nmea2k.RepeatingGroup{Count: n + 1, Records: records}
+	} else {
+		data[fld] = v
+	}
+
+	_, def = nmea2k.PgnList.Resolve(put.Pgn, data)
+
+	b, err := def.Encode(data)
+	if err != nil {
+		return nil, err
+	}
+
+	if def.Size <= 8 && len(b) > 8 {
+		return nil, fmt.Errorf("too many fields for PGN %v", def.Pgn)
+	}
+
+	priority := put.Priority
+	if priority == 0 {
+		priority = 3
+	}
+
+	return &can.RawMessage{
+		Timestamp:   time.Now(),
+		Priority:    priority,
+		Pgn:         def.Pgn,
+		Destination: 255,
+		Length:      uint8(len(b)),
+		Data:        b,
+	}, nil
+}
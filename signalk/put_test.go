@@ -0,0 +1,76 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package signalk
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestPack(t *testing.T) {
+	tests := []struct {
+		path     string
+		value    interface{}
+		pgn      uint32
+		priority uint8
+		data     []byte
+	}{
+		// Bank 3, switch 2 on and the others unchanged
+		{"electrical.switches.bank.3.2.state", "On", 127502, 3,
+			[]byte{0x03, 0xF7, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}},
+		{"electrical.switches.bank.3.1.state", 0, 127502, 3,
+			[]byte{0x03, 0xFC, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}},
+		// Magnetic heading reference, heading to steer 90 degrees
+		{"steering.autopilot.target.headingMagnetic", 90.0, 127237, 3,
+			[]byte{0xFF, 0x7F, 0xFF, 0xFF, 0x7F, 0x5C, 0x3D}},
+		{"communication.nmea2000.isoRequest", 126996, 59904, 6,
+			[]byte{0x14, 0xF0, 0x01, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF}},
+	}
+
+	for _, tt := range tests {
+		msg, err := mapdata.Pack(tt.path, tt.value)
+		if err != nil {
+			t.Errorf("%v: %v", tt.path, err)
+			continue
+		}
+
+		if msg.Pgn != tt.pgn || msg.Priority != tt.priority || msg.Destination != 255 {
+			t.Errorf("%v: PGN %v priority %v destination %v", tt.path, msg.Pgn, msg.Priority, msg.Destination)
+		}
+
+		if len(msg.Data) < len(tt.data) || !bytes.Equal(msg.Data[:len(tt.data)], tt.data) {
+			t.Errorf("%v:\nExpected: % x\n     Got: % x", tt.path, tt.data, msg.Data)
+		}
+	}
+}
+
+func TestPackInvalid(t *testing.T) {
+	for _, p := range []string{
+		"navigation.speedOverGround",          // Read only
+		"electrical.switches.bank.3.0.state",  // Switches start at 1
+		"electrical.switches.bank.3.29.state", // More switches than fit
+		"electrical.switches.bank.x.1.state",
+		"steering.autopilot.target",
+	} {
+		if _, err := mapdata.Pack(p, "On"); err == nil {
+			t.Errorf("%v: expected an error", p)
+		}
+	}
+}
@@ -0,0 +1,329 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package signalk
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// Size at which the queue starts a new file
+const queueSegmentSize = 1 << 20
+
+// How many deltas are popped between saves of the position. The position is
+// also saved when a file is done with, when the queue is empty and when it
+// is closed, so at most this many deltas are delivered again after a crash.
+const queuePositionEvery = 100
+
+// DeltaQueue keeps deltas on disk until they are delivered, so they survive
+// a restart. Deltas are written to numbered files of one delta per line, and
+// the position of the next delta to deliver is kept in the file position,
+// which is replaced whole so a crash never leaves half of it.
+// Deltas are delivered in order, at least once: Peek returns the next delta
+// and Pop removes it once it has been delivered.
+type DeltaQueue struct {
+	mu          sync.Mutex
+	dir         string
+	limit       int64
+	segmentSize int64
+
+	segments []uint64 // Numbers of the files, oldest first
+	sizes    map[uint64]int64
+	w        *os.File // The newest file
+
+	// The next delta to deliver, in file rseg at roff
+	rseg    uint64
+	roff    int64
+	r       *os.File
+	rb      *bufio.Reader
+	next    *Delta
+	nextLen int64
+	popped  int // Since the position was saved
+
+	ready   chan struct{}
+	dropped int
+}
+
+// OpenDeltaQueue opens the queue in dir, creating the directory if need be.
+// The oldest deltas are dropped when the queue grows beyond limit bytes,
+// unless limit is 0.
+func OpenDeltaQueue(dir string, limit int64) (*DeltaQueue, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	q := &DeltaQueue{
+		dir:         dir,
+		limit:       limit,
+		segmentSize: queueSegmentSize,
+		sizes:       make(map[uint64]int64),
+		ready:       make(chan struct{}, 1),
+	}
+
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, fi := range files {
+		name := fi.Name()
+		if !strings.HasSuffix(name, ".json") {
+			continue
+		}
+		n, err := strconv.ParseUint(strings.TrimSuffix(name, ".json"), 10, 64)
+		if err != nil {
+			continue
+		}
+		q.segments = append(q.segments, n)
+		q.sizes[n] = fi.Size()
+	}
+	sort.Slice(q.segments, func(i, j int) bool { return q.segments[i] < q.segments[j] })
+
+	if b, err := ioutil.ReadFile(q.positionFile()); err == nil {
+		fmt.Sscan(string(b), &q.rseg, &q.roff)
+	}
+
+	// Files before the position have been delivered
+	for len(q.segments) > 0 && q.segments[0] < q.rseg {
+		os.Remove(q.segmentFile(q.segments[0]))
+		delete(q.sizes, q.segments[0])
+		q.segments = q.segments[1:]
+	}
+
+	if len(q.segments) == 0 {
+		q.segments = []uint64{q.rseg + 1}
+	}
+	if q.rseg != q.segments[0] {
+		q.rseg, q.roff = q.segments[0], 0
+	}
+
+	last := q.segments[len(q.segments)-1]
+	if q.w, err = os.OpenFile(q.segmentFile(last), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+		return nil, err
+	}
+
+	return q, nil
+}
+
+func (q *DeltaQueue) segmentFile(n uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%020d.json", n))
+}
+
+func (q *DeltaQueue) positionFile() string {
+	return filepath.Join(q.dir, "position")
+}
+
+// Push adds a delta to the end of the queue
+func (q *DeltaQueue) Push(d Delta) error {
+	b, err := json.Marshal(d)
+	if err != nil {
+		return err
+	}
+	b = append(b, '\n')
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	last := q.segments[len(q.segments)-1]
+	if q.sizes[last] >= q.segmentSize {
+		if err := q.w.Close(); err != nil {
+			return err
+		}
+		last++
+		if q.w, err = os.OpenFile(q.segmentFile(last), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+			return err
+		}
+		q.segments = append(q.segments, last)
+	}
+
+	if _, err := q.w.Write(b); err != nil {
+		return err
+	}
+	q.sizes[last] += int64(len(b))
+
+	// The oldest deltas make way for new ones
+	for q.limit > 0 && q.size() > q.limit && len(q.segments) > 1 {
+		q.dropped++
+		if q.segments[0] == q.rseg {
+			q.closeReader()
+			q.rseg, q.roff = q.segments[1], 0
+		}
+		q.removeSegment()
+	}
+
+	select {
+	case q.ready <- struct{}{}:
+	default:
+	}
+
+	return nil
+}
+
+// size is the number of bytes in the queue
+func (q *DeltaQueue) size() int64 {
+	var n int64
+	for _, s := range q.segments {
+		n += q.sizes[s]
+	}
+
+	return n - q.roff
+}
+
+// removeSegment deletes the oldest file
+func (q *DeltaQueue) removeSegment() {
+	os.Remove(q.segmentFile(q.segments[0]))
+	delete(q.sizes, q.segments[0])
+	q.segments = q.segments[1:]
+}
+
+func (q *DeltaQueue) closeReader() {
+	if q.r != nil {
+		q.r.Close()
+		q.r, q.rb = nil, nil
+	}
+	q.next = nil
+}
+
+// Peek returns the next delta to deliver, if there is one
+func (q *DeltaQueue) Peek() (Delta, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for q.next == nil {
+		if q.r == nil {
+			f, err := os.Open(q.segmentFile(q.rseg))
+			if err != nil {
+				return Delta{}, false, err
+			}
+			if _, err := f.Seek(q.roff, io.SeekStart); err != nil {
+				f.Close()
+				return Delta{}, false, err
+			}
+			q.r, q.rb = f, bufio.NewReader(f)
+		}
+
+		line, err := q.rb.ReadBytes('\n')
+		if err == io.EOF {
+			if q.rseg == q.segments[len(q.segments)-1] {
+				// Read again from the position once more is written
+				if _, err := q.r.Seek(q.roff, io.SeekStart); err != nil {
+					return Delta{}, false, err
+				}
+				q.rb.Reset(q.r)
+				return Delta{}, false, nil
+			}
+
+			// What is left of an older file was cut short
+			q.closeReader()
+			q.removeSegment()
+			q.rseg, q.roff = q.segments[0], 0
+			continue
+		} else if err != nil {
+			return Delta{}, false, err
+		}
+
+		var d Delta
+		if err := json.Unmarshal(line, &d); err != nil {
+			q.roff += int64(len(line))
+			continue
+		}
+		q.next, q.nextLen = &d, int64(len(line))
+	}
+
+	return *q.next, true, nil
+}
+
+// Pop removes the delta returned by Peek, once it has been delivered
+func (q *DeltaQueue) Pop() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.next == nil {
+		return nil
+	}
+	q.next = nil
+	q.roff += q.nextLen
+	q.popped++
+
+	last := q.segments[len(q.segments)-1]
+	if q.rseg != last && q.roff >= q.sizes[q.rseg] {
+		q.closeReader()
+		q.removeSegment()
+		q.rseg, q.roff = q.segments[0], 0
+		return q.savePosition()
+	}
+
+	if q.popped >= queuePositionEvery || q.rseg == last && q.roff >= q.sizes[last] {
+		return q.savePosition()
+	}
+
+	return nil
+}
+
+// savePosition writes the position of the next delta to deliver
+func (q *DeltaQueue) savePosition() error {
+	q.popped = 0
+
+	return replaceFile(q.positionFile(), []byte(fmt.Sprintln(q.rseg, q.roff)))
+}
+
+// Ready is signalled when a delta is pushed
+func (q *DeltaQueue) Ready() <-chan struct{} {
+	return q.ready
+}
+
+// Dropped returns the number of files of deltas dropped to stay within the
+// limit since the last call
+func (q *DeltaQueue) Dropped() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	n := q.dropped
+	q.dropped = 0
+
+	return n
+}
+
+// Close closes the files of the queue
+func (q *DeltaQueue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.closeReader()
+
+	var err error
+	if q.popped > 0 {
+		err = q.savePosition()
+	}
+	if e := q.w.Close(); e != nil {
+		err = e
+	}
+
+	return err
+}
@@ -0,0 +1,225 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package signalk
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// openQueue returns a queue in dir, or in a new temporary directory if dir
+// is empty
+func openQueue(t *testing.T, dir string, limit int64) *DeltaQueue {
+	if dir == "" {
+		var err error
+		if dir, err = ioutil.TempDir("", "queue"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	q, err := OpenDeltaQueue(dir, limit)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return q
+}
+
+// depth returns the depth of the next delta in a queue, or -1 if it is empty
+func depth(t *testing.T, q *DeltaQueue) float64 {
+	d, ok, err := q.Peek()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !ok {
+		return -1
+	}
+
+	return d.Updates[0].Values[0].Value.(float64)
+}
+
+func TestDeltaQueueOrder(t *testing.T) {
+	q := openQueue(t, "", 0)
+	defer os.RemoveAll(q.dir)
+
+	if got := depth(t, q); got != -1 {
+		t.Fatalf("empty queue returned %v", got)
+	}
+
+	for i := 1; i <= 3; i++ {
+		q.Push(valueDelta("environment.depth.belowKeel", float64(i)))
+	}
+
+	select {
+	case <-q.Ready():
+	default:
+		t.Error("queue not ready after a push")
+	}
+
+	// A delta stays at the head until it is popped
+	for _, want := range []float64{1, 1} {
+		if got := depth(t, q); got != want {
+			t.Errorf("peeked %v, want %v", got, want)
+		}
+	}
+	q.Pop()
+
+	if got := depth(t, q); got != 2 {
+		t.Errorf("peeked %v, want 2", got)
+	}
+	q.Close()
+
+	// Delivered deltas stay delivered after the queue is opened again
+	q = openQueue(t, q.dir, 0)
+	defer q.Close()
+
+	for _, want := range []float64{2, 3, -1} {
+		if got := depth(t, q); got != want {
+			t.Errorf("peeked %v, want %v", got, want)
+		}
+		q.Pop()
+	}
+
+	q.Push(valueDelta("environment.depth.belowKeel", 4.0))
+	if got := depth(t, q); got != 4 {
+		t.Errorf("peeked %v after a push, want 4", got)
+	}
+}
+
+func TestDeltaQueueSegments(t *testing.T) {
+	q := openQueue(t, "", 0)
+	defer os.RemoveAll(q.dir)
+	q.segmentSize = 1
+
+	ts := time.Now()
+	for i := 1; i <= 5; i++ {
+		q.Push(timedDelta(ts, value{"environment.depth.belowKeel", float64(i)}))
+	}
+	if len(q.segments) != 5 {
+		t.Fatalf("%v files, want 5", len(q.segments))
+	}
+
+	for _, want := range []float64{1, 2, 3} {
+		if got := depth(t, q); got != want {
+			t.Errorf("peeked %v, want %v", got, want)
+		}
+		q.Pop()
+	}
+
+	// Delivered files are removed
+	if len(q.segments) != 2 {
+		t.Errorf("%v files, want 2", len(q.segments))
+	}
+	if files, _ := ioutil.ReadDir(q.dir); len(files) != 3 {
+		t.Errorf("%v files in the directory, want 2 and the position", len(files))
+	}
+	q.Close()
+
+	q = openQueue(t, q.dir, 0)
+	defer q.Close()
+
+	if got := depth(t, q); got != 4 {
+		t.Errorf("peeked %v after opening again, want 4", got)
+	}
+}
+
+func TestDeltaQueueLimit(t *testing.T) {
+	q := openQueue(t, "", 1000)
+	defer os.RemoveAll(q.dir)
+	defer q.Close()
+	q.segmentSize = 1
+
+	ts := time.Now()
+	for i := 1; i <= 20; i++ {
+		q.Push(timedDelta(ts, value{"environment.depth.belowKeel", float64(i)}))
+	}
+
+	if q.size() > 1000 {
+		t.Errorf("queue of %v bytes, over the limit", q.size())
+	}
+	if q.Dropped() == 0 {
+		t.Error("no deltas dropped")
+	}
+
+	// The newest deltas are kept, in order
+	last := 0.0
+	for {
+		got := depth(t, q)
+		if got == -1 {
+			break
+		}
+		if got <= last {
+			t.Errorf("peeked %v after %v", got, last)
+		}
+		last = got
+		q.Pop()
+	}
+	if last != 20 {
+		t.Errorf("last delta %v, want 20", last)
+	}
+}
+
+func TestDeltaQueuePosition(t *testing.T) {
+	q := openQueue(t, "", 0)
+	defer os.RemoveAll(q.dir)
+
+	for i := 1; i <= 5; i++ {
+		q.Push(valueDelta("environment.depth.belowKeel", float64(i)))
+	}
+	for i := 0; i < 2; i++ {
+		depth(t, q)
+		q.Pop()
+	}
+
+	// After a crash, deltas popped since the position was saved are
+	// delivered again
+	crashed := openQueue(t, q.dir, 0)
+	if got := depth(t, crashed); got != 1 {
+		t.Errorf("peeked %v after a crash, want 1", got)
+	}
+	crashed.Close()
+	q.Close()
+
+	q = openQueue(t, q.dir, 0)
+	if got := depth(t, q); got != 3 {
+		t.Errorf("peeked %v after closing, want 3", got)
+	}
+	for depth(t, q) != -1 {
+		q.Pop()
+	}
+
+	// The position is saved once every delta is delivered
+	crashed = openQueue(t, q.dir, 0)
+	defer crashed.Close()
+	if got := depth(t, crashed); got != -1 {
+		t.Errorf("peeked %v after delivering every delta, want none", got)
+	}
+	q.Close()
+
+	files, _ := ioutil.ReadDir(q.dir)
+	for _, f := range files {
+		if f.Name() != "position" && filepath.Ext(f.Name()) != ".json" {
+			t.Errorf("%v left in the directory", f.Name())
+		}
+	}
+}
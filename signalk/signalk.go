@@ -20,30 +20,31 @@
 package signalk
 
 import (
+	"encoding/json"
 	"encoding/xml"
 	"fmt"
 	"io/ioutil"
 	"strconv"
 	"strings"
+	"sync/atomic"
 	"time"
 
+	"github.com/timmathews/argo/can"
 	"github.com/timmathews/argo/nmea2k"
 )
 
-type condition struct {
-	Operation string `xml:"op"`
-	Field     int    `xml:"field"`
-	Value     string `xml:"value"`
-}
-
 type field struct {
 	Key   string `xml:"type,attr"`
 	Value int    `xml:",chardata"`
 }
 
+// fieldset combines several fields into one value. A datetime fieldset
+// joins a date and a time field into a timestamp, and an object fieldset
+// assembles an object, such as a position, from its members.
 type fieldset struct {
-	Type   string  `xml:"type,attr"`
-	Fields []field `xml:"field"`
+	Type    string   `xml:"type,attr"`
+	Fields  []field  `xml:"field"`
+	Members []member `xml:"member"`
 }
 
 type parameterGroup struct {
@@ -52,7 +53,12 @@ type parameterGroup struct {
 	Field      string      `xml:"field"`
 	Multiplier multiplier  `xml:"multiplier"`
 	Classifier classifier  `xml:"classifier"`
+	Element    element     `xml:"element"`
 	Conditions []condition `xml:"condition"`
+	Transforms []transform `xml:"transform"`
+
+	// Priority of the message sent for a PUT, 3 if not given
+	Priority uint8 `xml:"priority"`
 }
 
 type sentence struct {
@@ -70,21 +76,83 @@ type classifier struct {
 	Field string `xml:"field"`
 }
 
+// element names the placeholder in a path which is replaced by the position
+// of a record in a repeating group. Start is the number given to the first
+// record, so that switches can be numbered from 1 as they are on the bus.
+type element struct {
+	Id    string `xml:"id"`
+	Start int    `xml:"start"`
+}
+
 type mapping struct {
 	Path            string           `xml:"path"`
 	ParameterGroups []parameterGroup `xml:"parameter_group"`
 	Sentences       []sentence       `xml:"sentence"`
+
+	// How a PUT to the path is sent, which is often a different PGN from
+	// the one the value is read from
+	Puts []parameterGroup `xml:"put"`
 }
 
+// DefaultContext is the context of our own vessel in deltas
+const DefaultContext = "vessels.urn:mrn:signalk:uuid:c0d79334-4e25-4245-8892-54e8ccc8021d"
+
 type Mappings struct {
 	XMLName  xml.Name  `xml:"mappings"`
 	Mappings []mapping `xml:"mapping"`
+
+	// Whether fields are also mapped to their SignalkPath, true if not given
+	Builtin *bool `xml:"builtin,attr"`
+
+	// Context of the deltas, DefaultContext if empty
+	Context string `xml:"-"`
+
+	// Meta of paths given by the configuration, where * in a path stands
+	// for any one segment
+	Meta map[string]Meta `xml:"-"`
+
+	index atomic.Value // *mappingIndex
 }
 
+// source says where the values of an update came from. Label is the name of
+// the interface in the configuration and Src the address of the device on
+// the bus.
 type source struct {
-	Pgn    uint32 `json:"pgn"`
-	Device string `json:"device"`
-	Src    uint8  `json:"src"`
+	Label string `json:"label"`
+	Type  string `json:"type,omitempty"`
+	Pgn   uint32 `json:"pgn,omitempty"`
+	Src   string `json:"src,omitempty"`
+}
+
+// label is how a source is referred to by $source, such as n2k-port.43
+func (s *source) label() string {
+	if s.Src == "" {
+		return s.Label
+	}
+
+	return s.Label + "." + s.Src
+}
+
+// messageSource returns the source of a message from the bus
+func messageSource(msg *nmea2k.ParsedMessage) source {
+	return headerSource(msg.Interface, msg.Header.RawMessage)
+}
+
+func decodedSource(msg *nmea2k.DecodedMessage) source {
+	return headerSource(msg.Interface, &msg.Header)
+}
+
+func headerSource(iface string, hdr *can.RawMessage) source {
+	if iface == "" {
+		iface = "nmea2k"
+	}
+
+	return source{
+		Label: iface,
+		Type:  "NMEA2000",
+		Pgn:   hdr.Pgn,
+		Src:   strconv.Itoa(int(hdr.Source)),
+	}
 }
 
 type value struct {
@@ -93,16 +161,51 @@ type value struct {
 }
 
 type update struct {
-	Source    source    `json:"source"`
-	Timestamp time.Time `json:"timestamp"`
-	Values    []value   `json:"values"`
+	Source    source      `json:"source"`
+	Timestamp time.Time   `json:"timestamp"`
+	Values    []value     `json:"values"`
+	Meta      []metaValue `json:"meta,omitempty"`
+}
+
+// MarshalJSON adds the $source reference to the update
+func (u update) MarshalJSON() ([]byte, error) {
+	type plain update
+
+	return json.Marshal(struct {
+		plain
+		Ref string `json:"$source"`
+	}{plain(u), u.Source.label()})
 }
 
-type delta struct {
+// Delta is a Signal K delta message: updates to the values of one context
+type Delta struct {
 	Context string   `json:"context"`
 	Updates []update `json:"updates"`
 }
 
+// PathValue is one value of a delta on its own, such as the latest value of
+// a path on a topic of its own
+type PathValue struct {
+	Context   string      `json:"-"`
+	Path      string      `json:"-"`
+	Value     interface{} `json:"value"`
+	Timestamp time.Time   `json:"timestamp"`
+	Source    string      `json:"$source"`
+}
+
+// PathValues returns the values of a delta one by one
+func (d Delta) PathValues() []PathValue {
+	var values []PathValue
+
+	for _, u := range d.Updates {
+		for _, v := range u.Values {
+			values = append(values, PathValue{d.Context, v.Path, v.Value, u.Timestamp, u.Source.label()})
+		}
+	}
+
+	return values
+}
+
 func ParseMappings(filename string) (Mappings, error) {
 	output := Mappings{}
 
@@ -115,74 +218,110 @@ func ParseMappings(filename string) (Mappings, error) {
 	return output, err
 }
 
-func (m *Mappings) Delta(msg *nmea2k.ParsedMessage) (delta, error) {
-	context := "vessels.urn:mrn:signalk:uuid:c0d79334-4e25-4245-8892-54e8ccc8021d"
-
-	src := source{
-		Pgn:    msg.Header.Pgn,
-		Device: "/dev/actisense",
-		Src:    msg.Header.Source,
+// context is the context of the deltas of the mappings
+func (m *Mappings) context() string {
+	if m.Context == "" {
+		return DefaultContext
 	}
 
+	return m.Context
+}
+
+func (m *Mappings) Delta(msg *nmea2k.ParsedMessage) (Delta, error) {
+	context := m.context()
+
 	upd := update{
-		Source:    src,
+		Source:    messageSource(msg),
 		Timestamp: time.Now(),
 		Values:    *new([]value),
 	}
 
+	idx := m.compiled()
+	if msg.Index < 0 || msg.Index >= len(idx.pgns) || idx.pgns[msg.Index].Pgn != msg.Header.Pgn {
+		return Delta{}, fmt.Errorf("unknown PGN %v from %v", upd.Source.Pgn, upd.Source.label())
+	}
+
+	pgnDef := &idx.pgns[msg.Index]
+	rpt := pgnDef.FirstRepeatingField()
+	groups := idx.groups[msg.Index]
+
 	var usedFields = make(map[int]bool, len(msg.Data))
 
-	for fieldId, field := range msg.Data {
-		for _, mapping := range m.Mappings {
-			for _, parameterGroup := range mapping.ParameterGroups {
-				if parameterGroup.Pgn == msg.Header.Pgn {
-					path := toDotNotation(mapping.Path)
-					mlt := int64(-1)
-
-					rpt := int64(nmea2k.PgnList[msg.Index].RepeatingFields)
-
-					if parameterGroup.Classifier.Id != "" && parameterGroup.Classifier.Field != "" {
-						cid, _ := strconv.ParseInt(parameterGroup.Classifier.Field, 10, 32)
-						path = strings.Replace(path, fmt.Sprintf("{%v}", parameterGroup.Classifier.Id),
-							fmt.Sprintf("%v", msg.Data[int(cid)]), 1)
-					}
-
-					if parameterGroup.Multiplier.Id != "" && parameterGroup.Multiplier.Field != "" {
-						mlt, _ = strconv.ParseInt(parameterGroup.Multiplier.Field, 10, 32)
-
-						sub := (((int64(fieldId) - mlt) / rpt) * rpt) + mlt
-
-						path = strings.Replace(path, fmt.Sprintf("{%v}", parameterGroup.Multiplier.Id),
-							fmt.Sprintf("%v", msg.Data[int(sub)]), 1)
-					}
-
-					fld, err := strconv.ParseInt(parameterGroup.Field, 10, 64)
-					fid := int64(fieldId)
-
-					if err == nil && ((fld > mlt && mlt > -1 && fld == fid%rpt) || fld == fid) && !usedFields[fieldId] {
-						if conditionsMatch(parameterGroup.Conditions, msg.Data) {
-							usedFields[fieldId] = true
-							val := value{
-								Path:  path,
-								Value: field,
-							}
-							if val.Path != "" && val.Value != nil {
-								upd.Values = append(upd.Values, val)
-							}
-						}
-					} else if len(parameterGroup.Fieldset.Fields) > 0 {
-						if parameterGroup.Fieldset.hasAll(msg.Data, usedFields) {
-							s, u := parameterGroup.Fieldset.parse(msg.Data)
-							val := value{
-								Path:  toDotNotation(mapping.Path),
-								Value: s,
-							}
-							if val.Path != "" && val.Value != nil {
-								upd.Values = append(upd.Values, val)
-							}
-							usedFields = merge(usedFields, u)
-						}
-					}
+	for i := range groups {
+		cg := &groups[i]
+
+		if cg.members != nil {
+			if !conditionsMatch(pgnDef, cg.Conditions, msg.Data) {
+				continue
+			}
+			if obj := cg.object(pgnDef, msg.Data); obj != nil {
+				for _, m := range cg.members {
+					usedFields[m.field] = true
+				}
+				m.emit(idx, &upd, cg, value{
+					Path:  cg.render(msg.Data, 0),
+					Value: obj,
+				})
+			}
+			continue
+		}
+
+		if cg.fieldset {
+			if cg.Fieldset.hasAll(msg.Data, usedFields) {
+				s, u := cg.Fieldset.parse(msg.Data)
+				val := value{
+					Path:  cg.render(msg.Data, 0),
+					Value: s,
+				}
+				if val.Path != "" && val.Value != nil {
+					m.emit(idx, &upd, cg, val)
+				}
+				usedFields = merge(usedFields, u)
+			}
+			continue
+		}
+
+		fld := cg.field
+
+		if cg.repeating {
+			grp, ok := msg.Data[rpt].(nmea2k.RepeatingGroup)
+			if !ok {
+				continue
+			}
+
+			for n, rec := range grp.Records {
+				if rec[fld] == nil {
+					continue
+				}
+
+				fields := withRecord(msg.Data, rec)
+				if !conditionsMatch(pgnDef, cg.Conditions, fields) {
+					continue
+				}
+
+				v, err := cg.transform(rec[fld], pgnDef, fields)
+				if err != nil {
+					continue
+				}
+
+				m.emit(idx, &upd, cg, value{
+					Path:  cg.render(fields, n),
+					Value: v,
+				})
+			}
+		} else if msg.Data[fld] != nil {
+			// A field may be mapped to more than one path, such as the
+			// depth below the transducer and, with the offset added,
+			// below the surface
+			if conditionsMatch(pgnDef, cg.Conditions, msg.Data) {
+				usedFields[fld] = true
+				v, err := cg.transform(msg.Data[fld], pgnDef, msg.Data)
+				val := value{
+					Path:  cg.render(msg.Data, 0),
+					Value: v,
+				}
+				if val.Path != "" && err == nil {
+					m.emit(idx, &upd, cg, val)
 				}
 			}
 		}
@@ -190,7 +329,7 @@ func (m *Mappings) Delta(msg *nmea2k.ParsedMessage) (delta, error) {
 
 	if len(upd.Values) > 0 {
 		updates := []update{upd}
-		delta := delta{
+		delta := Delta{
 			Context: context,
 			Updates: updates,
 		}
@@ -198,14 +337,36 @@ func (m *Mappings) Delta(msg *nmea2k.ParsedMessage) (delta, error) {
 		return delta, nil
 
 	} else {
-		return delta{}, fmt.Errorf("unknown PGN %v from %v on %v", upd.Source.Pgn, upd.Source.Src, upd.Source.Device)
+		return Delta{}, fmt.Errorf("unknown PGN %v from %v", upd.Source.Pgn, upd.Source.label())
+	}
+}
+
+// emit adds a value to an update, along with the meta of its path the first
+// time the path is given a value
+func (m *Mappings) emit(idx *mappingIndex, upd *update, cg *compiledGroup, val value) {
+	upd.Values = append(upd.Values, val)
+
+	if meta, ok := m.newMeta(idx, cg, val.Path); ok {
+		upd.Meta = append(upd.Meta, metaValue{val.Path, meta})
 	}
 }
 
-// Pack searches the mapping database for a matching path, then generates the PGN for that. This may
-//func (m *Mappings) Pack(msg *update) (nmea2k.ParsedMessage, error) {
-//
-//}
+// withRecord returns the fixed fields of a message overlaid with the fields
+// of one record of its repeating group, so that conditions, classifiers and
+// multipliers can refer to either.
+func withRecord(fields, record nmea2k.DataMap) nmea2k.DataMap {
+	var ret = make(nmea2k.DataMap, len(fields)+len(record))
+
+	for k, v := range fields {
+		ret[k] = v
+	}
+
+	for k, v := range record {
+		ret[k] = v
+	}
+
+	return ret
+}
 
 // merge takes two maps and returns a new map containing the values of both
 // maps. The right map takes precedence over the left map if both contain the
@@ -270,42 +431,6 @@ func (fieldset fieldset) hasAll(dataFields nmea2k.DataMap, usedFields map[int]bo
 	return true
 }
 
-// conditionsMatch iterates through an array of conditions and checks if the
-// value of the referenced intermediate format field equates to the expected
-// value using the operation provided.
-func conditionsMatch(conditions []condition, fields nmea2k.DataMap) bool {
-	for _, x := range conditions {
-		ls := fmt.Sprintf("%v", fields[x.Field])
-
-		switch x.Operation {
-		case "eq":
-			if ls != x.Value {
-				return false
-			}
-		case "lt":
-			if ls >= x.Value {
-				return false
-			}
-		case "gt":
-			if ls <= x.Value {
-				return false
-			}
-		case "le":
-			if ls > x.Value {
-				return false
-			}
-		case "ge":
-			if ls < x.Value {
-				return false
-			}
-		default:
-			return true
-		}
-	}
-
-	return true
-}
-
 func toDotNotation(in string) string {
 	return strings.Replace(in, "/", ".", -1)[2:]
 }
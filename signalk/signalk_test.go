@@ -33,6 +33,24 @@ import (
 
 var mapdata Mappings
 
+func newMessage(ts time.Time, pgn uint32, data nmea2k.DataMap) nmea2k.ParsedMessage {
+	idx, _ := nmea2k.PgnList.First(pgn)
+
+	return nmea2k.ParsedMessage{
+		Header: nmea2k.RawMessage{RawMessage: &can.RawMessage{
+			Timestamp:   ts,
+			Priority:    3,
+			Pgn:         pgn,
+			Source:      1,
+			Destination: 255,
+			Length:      8,
+			Data:        []byte{0x0, 0xF, 0xC2, 0x40, 0xD0, 0x89, 0x00, 0x00},
+		}},
+		Index: idx,
+		Data:  data,
+	}
+}
+
 func MakeSet(s []value) set.Set {
 	a := set.NewSet()
 	for _, item := range s {
@@ -58,19 +76,12 @@ func TestMain(m *testing.M) {
 
 func TestFieldsetValidDate(t *testing.T) {
 	ts := time.Now()
-	in := nmea2k.ParsedMessage{
-		nmea2k.RawMessage{&can.RawMessage{
-			ts,
-			3, 126992, 1, 255, 8, []byte{0x0, 0xF, 0xC2, 0x40, 0xD0, 0x89, 0x00, 0x00},
-		}},
-		68,
-		nmea2k.DataMap{0: 0, 1: "GPS", 2: 0xF, 3: time.Unix(16578*86400, 0).UTC(), 4: time.Unix(43200, 0).UTC()},
-	}
+	in := newMessage(ts, 126992, nmea2k.DataMap{0: 0, 1: "GPS", 2: 0xF, 3: time.Unix(16578*86400, 0).UTC(), 4: time.Unix(43200, 0).UTC()})
 
 	expected := update{
-		source{126992, "/dev/actisense", 1},
-		ts,
-		[]value{{"system.currentTime", "2015-05-23T12:00:00Z"}, {"system.currentTimeSource", "GPS"}},
+		Source:    source{Pgn: 126992, Label: "actisense", Type: "NMEA2000", Src: "1"},
+		Timestamp: ts,
+		Values:    []value{{"system.currentTime", "2015-05-23T12:00:00Z"}, {"system.currentTimeSource", "GPS"}},
 	}
 
 	got, err := mapdata.Delta(&in)
@@ -85,19 +96,12 @@ func TestFieldsetValidDate(t *testing.T) {
 
 func TestFieldsetMissingDate(t *testing.T) {
 	ts := time.Now()
-	in := nmea2k.ParsedMessage{
-		nmea2k.RawMessage{&can.RawMessage{
-			ts,
-			3, 126992, 1, 255, 8, []byte{0x0, 0xF, 0xC2, 0x40, 0xD0, 0x89, 0x00, 0x00},
-		}},
-		68,
-		nmea2k.DataMap{0: 0, 1: "GPS", 2: 0xF, 4: time.Unix(43200, 0).UTC()},
-	}
+	in := newMessage(ts, 126992, nmea2k.DataMap{0: 0, 1: "GPS", 2: 0xF, 4: time.Unix(43200, 0).UTC()})
 
 	expected := update{
-		source{126992, "/dev/actisense", 1},
-		ts,
-		[]value{{"system.currentTimeSource", "GPS"}},
+		Source:    source{Pgn: 126992, Label: "actisense", Type: "NMEA2000", Src: "1"},
+		Timestamp: ts,
+		Values:    []value{{"system.currentTimeSource", "GPS"}},
 	}
 
 	got, err := mapdata.Delta(&in)
@@ -112,19 +116,12 @@ func TestFieldsetMissingDate(t *testing.T) {
 
 func TestConditions(t *testing.T) {
 	ts := time.Now()
-	in := nmea2k.ParsedMessage{
-		nmea2k.RawMessage{&can.RawMessage{
-			ts,
-			3, 129026, 1, 255, 8, []byte{0x0, 0xF, 0xC2, 0x40, 0xD0, 0x89, 0x00, 0x00},
-		}},
-		68,
-		nmea2k.DataMap{0: 0, 1: "True", 2: 0xF, 3: 123.4, 4: 5.3},
-	}
+	in := newMessage(ts, 129026, nmea2k.DataMap{0: 0, 1: "True", 2: 0xF, 3: 123.4, 4: 5.3})
 
 	expected := update{
-		source{129026, "/dev/actisense", 1},
-		ts,
-		[]value{{"navigation.courseOverGroundTrue", 123.4}},
+		Source:    source{Pgn: 129026, Label: "actisense", Type: "NMEA2000", Src: "1"},
+		Timestamp: ts,
+		Values:    []value{{"navigation.courseOverGroundTrue", 123.4}, {"navigation.speedOverGround", 5.3}},
 	}
 
 	got, err := mapdata.Delta(&in)
@@ -139,23 +136,18 @@ func TestConditions(t *testing.T) {
 
 func TestRepeatingFields(t *testing.T) {
 	ts := time.Now()
-	in := nmea2k.ParsedMessage{
-		nmea2k.RawMessage{&can.RawMessage{
-			ts,
-			3, 127503, 1, 255, 8, []byte{0x0, 0xF, 0xC2, 0x40, 0xD0, 0x89, 0x00, 0x00},
+	in := newMessage(ts, 127503, nmea2k.DataMap{0: 0, 1: 3,
+		2: nmea2k.RepeatingGroup{Count: 3, Records: []nmea2k.DataMap{
+			{2: "line1", 3: "Good", 5: 120.1, 6: 11, 7: 60, 8: 30, 9: 1321.1, 10: 1294.678, 11: 0.98},
+			{2: "line2", 3: "Bad Level", 5: 120.1, 6: 11, 7: 60, 8: 30, 9: 1321.1, 10: 1293.678, 11: 0.98},
+			{2: "line3", 3: "Bad Frequency", 5: 120.1, 6: 11, 7: 60, 8: 30, 9: 1321.1, 10: 1293.678, 11: 0.98},
 		}},
-		85,
-		nmea2k.DataMap{0: 0, 1: 3,
-			2: "line1", 3: "Good", 5: 120.1, 6: 11, 7: 60, 8: 30, 9: 1321.1, 10: 1294.678, 11: 0.98,
-			12: "line2", 13: "Bad Level", 15: 120.1, 16: 11, 17: 60, 18: 30, 19: 1321.1, 20: 1293.678, 21: 0.98,
-			22: "line3", 23: "Bad Frequency", 25: 120.1, 26: 11, 27: 60, 28: 30, 29: 1321.1, 30: 1293.678, 31: 0.98,
-		},
-	}
+	})
 
 	expected := update{
-		source{127503, "/dev/actisense", 1},
-		ts,
-		[]value{
+		Source:    source{Pgn: 127503, Label: "actisense", Type: "NMEA2000", Src: "1"},
+		Timestamp: ts,
+		Values: []value{
 			{"electric.ac.0.numberOfLines", 3},
 			{"electric.ac.0.line1.acceptability", "Good"},
 			{"electric.ac.0.line2.acceptability", "Bad Level"},
@@ -172,3 +164,90 @@ func TestRepeatingFields(t *testing.T) {
 		t.Errorf("\nExpected: %+v\n     Got: %+v\n     Err: %v", expected, got, err)
 	}
 }
+
+func TestRepeatingElements(t *testing.T) {
+	ts := time.Now()
+	in := newMessage(ts, 129540, nmea2k.DataMap{0: 1, 1: "Range residuals used", 3: uint64(2),
+		4: nmea2k.RepeatingGroup{Count: 2, Records: []nmea2k.DataMap{
+			{4: 12.0, 5: 45.2, 6: 120.5, 7: 40.0},
+			{4: 17.0, 5: 10.1, 6: 275.3, 7: 31.5},
+		}},
+	})
+
+	expected := []value{
+		{"navigation.gnss.almanac.mode", "Range residuals used"},
+		{"navigation.gnss.satellitesInView.count", uint64(2)},
+		{"navigation.gnss.satellitesInView.satellites[0].id", 12.0},
+		{"navigation.gnss.satellitesInView.satellites[0].elevation", 45.2},
+		{"navigation.gnss.satellitesInView.satellites[0].azimuth", 120.5},
+		{"navigation.gnss.satellitesInView.satellites[0].SNR", 40.0},
+		{"navigation.gnss.satellitesInView.satellites[1].id", 17.0},
+		{"navigation.gnss.satellitesInView.satellites[1].elevation", 10.1},
+		{"navigation.gnss.satellitesInView.satellites[1].azimuth", 275.3},
+		{"navigation.gnss.satellitesInView.satellites[1].SNR", 31.5},
+	}
+
+	got, err := mapdata.Delta(&in)
+
+	x := MakeSet(got.Updates[0].Values)
+	y := MakeSet(expected)
+
+	if !x.Equal(y) {
+		t.Errorf("\nExpected: %+v\n     Got: %+v\n     Err: %v", expected, got, err)
+	}
+}
+
+func TestRepeatingElementsFromPacket(t *testing.T) {
+	// Switch bank 3, switches 1 and 2 on, 3 off, the rest not available
+	raw := &can.RawMessage{
+		Timestamp:   time.Now(),
+		Priority:    3,
+		Pgn:         127501,
+		Source:      1,
+		Destination: 255,
+		Length:      8,
+		Data:        []byte{0x03, 0xC5, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF},
+	}
+
+	got, err := mapdata.Delta(nmea2k.ParsePacket(raw))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []value{
+		{"electrical.switches.bank.3.1.state", "On"},
+		{"electrical.switches.bank.3.2.state", "On"},
+		{"electrical.switches.bank.3.3.state", "Off"},
+	}
+
+	x := MakeSet(got.Updates[0].Values)
+	y := MakeSet(expected)
+
+	if !x.IsSuperset(y) {
+		t.Errorf("\nExpected: %+v\n     Got: %+v", expected, got.Updates[0].Values)
+	}
+}
+
+func TestPathValues(t *testing.T) {
+	ts := time.Now()
+	in := newMessage(ts, 129026, nmea2k.DataMap{0: 0, 1: "True", 2: 0xF, 3: 123.4, 4: 5.3})
+
+	d, err := mapdata.Delta(&in)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := d.PathValues()
+	if len(got) != 2 {
+		t.Fatalf("got %+v, want course and speed", got)
+	}
+
+	for _, v := range got {
+		if v.Context != d.Context || v.Source != "nmea2k.1" || !v.Timestamp.Equal(d.Updates[0].Timestamp) {
+			t.Errorf("got %+v, want the context, source and time of the delta", v)
+		}
+	}
+	if got[0].Path != "navigation.courseOverGroundTrue" || got[0].Value != 123.4 {
+		t.Errorf("got %+v, want the course", got[0])
+	}
+}
@@ -0,0 +1,314 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package signalk
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Subscription policies
+const (
+	PolicyInstant = "instant" // Send every change, no faster than minPeriod
+	PolicyIdeal   = "ideal"   // Like instant, and resend after period without a change
+	PolicyFixed   = "fixed"   // Send the latest value every period
+)
+
+// Subscriber keeps the subscriptions of one stream client and decides which
+// values the client is sent, and when. Deltas are passed through Filter as
+// they arrive, and Tick is called regularly to send values which are due.
+type Subscriber struct {
+	mu     sync.Mutex
+	self   string
+	subs   []*subscription
+	latest map[string]*latestValue
+}
+
+type subscription struct {
+	contextGlob string
+	pathGlob    string
+	context     *regexp.Regexp
+	path        *regexp.Regexp
+	period      time.Duration
+	minPeriod   time.Duration
+	policy      string
+}
+
+// latestValue is the last value received from one source for one path
+type latestValue struct {
+	context   string
+	source    source
+	timestamp time.Time
+	value     value
+	sent      time.Time
+	changed   bool // Received but not sent yet
+}
+
+// subscribeMessage is sent by clients to change their subscriptions
+type subscribeMessage struct {
+	Context   string `json:"context"`
+	Subscribe []struct {
+		Path      string `json:"path"`
+		Period    int    `json:"period"`
+		MinPeriod int    `json:"minPeriod"`
+		Format    string `json:"format"`
+		Policy    string `json:"policy"`
+	} `json:"subscribe"`
+	Unsubscribe []struct {
+		Path string `json:"path"`
+	} `json:"unsubscribe"`
+}
+
+// NewSubscriber returns the subscriptions of a new client. Mode is the value
+// of the subscribe query parameter: none, self or all. Self, the default,
+// sends every change to our own vessel.
+func NewSubscriber(self, mode string) (*Subscriber, error) {
+	s := &Subscriber{
+		self:   self,
+		latest: make(map[string]*latestValue),
+	}
+
+	switch mode {
+	case "none":
+	case "", "self":
+		s.add("vessels.self", "*", 0, 0, PolicyInstant)
+	case "all":
+		s.add("*", "*", 0, 0, PolicyInstant)
+	default:
+		return nil, fmt.Errorf("invalid subscribe mode %q", mode)
+	}
+
+	return s, nil
+}
+
+// globRegexp converts a context or path pattern, in which * matches
+// anything including dots, to a regular expression.
+func globRegexp(glob string) *regexp.Regexp {
+	return regexp.MustCompile("^" + strings.Replace(regexp.QuoteMeta(glob), `\*`, ".*", -1) + "$")
+}
+
+func (s *Subscriber) add(context, path string, period, minPeriod time.Duration, policy string) {
+	if context == "vessels.self" {
+		context = s.self
+	}
+
+	s.subs = append(s.subs, &subscription{
+		contextGlob: context,
+		pathGlob:    path,
+		context:     globRegexp(context),
+		path:        globRegexp(path),
+		period:      period,
+		minPeriod:   minPeriod,
+		policy:      policy,
+	})
+}
+
+// Handle applies a subscribe or unsubscribe message from the client.
+func (s *Subscriber) Handle(msg []byte) error {
+	var m subscribeMessage
+	if err := json.Unmarshal(msg, &m); err != nil {
+		return err
+	}
+
+	if m.Context == "" {
+		return fmt.Errorf("subscription without a context")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, sub := range m.Subscribe {
+		if sub.Path == "" {
+			return fmt.Errorf("subscription without a path")
+		}
+
+		if sub.Format != "" && sub.Format != "delta" {
+			return fmt.Errorf("unsupported format %q", sub.Format)
+		}
+
+		policy := sub.Policy
+		switch policy {
+		case "":
+			policy = PolicyIdeal
+		case PolicyInstant, PolicyIdeal, PolicyFixed:
+		default:
+			return fmt.Errorf("invalid policy %q", sub.Policy)
+		}
+
+		period := time.Second
+		if sub.Period > 0 {
+			period = time.Duration(sub.Period) * time.Millisecond
+		}
+
+		s.add(m.Context, sub.Path, period, time.Duration(sub.MinPeriod)*time.Millisecond, policy)
+	}
+
+	// A subscription is removed if its context and path are matched by those
+	// of the unsubscribe message, so * and * remove everything
+	context := m.Context
+	if context == "vessels.self" {
+		context = s.self
+	}
+
+	for _, unsub := range m.Unsubscribe {
+		cre, pre := globRegexp(context), globRegexp(unsub.Path)
+
+		subs := s.subs[:0]
+		for _, sub := range s.subs {
+			if !cre.MatchString(sub.contextGlob) || !pre.MatchString(sub.pathGlob) {
+				subs = append(subs, sub)
+			}
+		}
+		s.subs = subs
+	}
+
+	// Forget values nothing is subscribed to any more
+	for k, v := range s.latest {
+		if s.match(v.context, v.value.Path) == nil {
+			delete(s.latest, k)
+		}
+	}
+
+	return nil
+}
+
+// match returns the most recent subscription to a path, or nil
+func (s *Subscriber) match(context, path string) *subscription {
+	for i := len(s.subs) - 1; i >= 0; i-- {
+		sub := s.subs[i]
+		if sub.context.MatchString(context) && sub.path.MatchString(path) {
+			return sub
+		}
+	}
+
+	return nil
+}
+
+// Filter returns the part of a delta which should be sent to the client now.
+// Values which are held back by a period or minimum period are sent by Tick.
+func (s *Subscriber) Filter(d Delta, now time.Time) (Delta, bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := Delta{Context: d.Context}
+
+	for _, u := range d.Updates {
+		var values []value
+
+		for _, v := range u.Values {
+			sub := s.match(d.Context, v.Path)
+			if sub == nil {
+				continue
+			}
+
+			key := d.Context + "/" + v.Path + "/" + u.Source.label()
+			lv, ok := s.latest[key]
+			if !ok {
+				lv = &latestValue{context: d.Context}
+				s.latest[key] = lv
+			}
+
+			lv.source = u.Source
+			lv.timestamp = u.Timestamp
+			lv.value = v
+			lv.changed = true
+
+			if sub.policy != PolicyFixed && now.Sub(lv.sent) >= sub.minPeriod {
+				lv.sent = now
+				lv.changed = false
+				values = append(values, v)
+			}
+		}
+
+		// Meta is sent whatever the policy, as it is only sent once
+		var meta []metaValue
+		for _, mv := range u.Meta {
+			if s.match(d.Context, mv.Path) != nil {
+				meta = append(meta, mv)
+			}
+		}
+
+		if len(values) > 0 || len(meta) > 0 {
+			if values == nil {
+				values = []value{}
+			}
+			out.Updates = append(out.Updates, update{u.Source, u.Timestamp, values, meta})
+		}
+	}
+
+	return out, len(out.Updates) > 0
+}
+
+// Tick returns the values which have become due since they were last sent,
+// one delta per context.
+func (s *Subscriber) Tick(now time.Time) []Delta {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	byContext := make(map[string]*Delta)
+
+	for _, lv := range s.latest {
+		sub := s.match(lv.context, lv.value.Path)
+		if sub == nil {
+			continue
+		}
+
+		since := now.Sub(lv.sent)
+		due := false
+
+		switch sub.policy {
+		case PolicyFixed:
+			due = since >= sub.period
+		case PolicyIdeal:
+			due = (lv.changed && since >= sub.minPeriod) || since >= sub.period
+		default:
+			due = lv.changed && since >= sub.minPeriod
+		}
+
+		if !due {
+			continue
+		}
+
+		lv.sent = now
+		lv.changed = false
+
+		d, ok := byContext[lv.context]
+		if !ok {
+			d = &Delta{Context: lv.context}
+			byContext[lv.context] = d
+		}
+		d.Updates = append(d.Updates, update{lv.source, lv.timestamp, []value{lv.value}, nil})
+	}
+
+	deltas := make([]Delta, 0, len(byContext))
+	for _, d := range byContext {
+		sort.Slice(d.Updates, func(i, j int) bool {
+			return d.Updates[i].Values[0].Path < d.Updates[j].Values[0].Path
+		})
+		deltas = append(deltas, *d)
+	}
+
+	return deltas
+}
@@ -0,0 +1,145 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package signalk
+
+import (
+	"testing"
+	"time"
+)
+
+func testDelta(context string, values ...value) Delta {
+	return Delta{
+		Context: context,
+		Updates: []update{{
+			Source:    source{Pgn: 128259, Label: "actisense", Type: "NMEA2000", Src: "1"},
+			Timestamp: time.Now(),
+			Values:    values,
+		}},
+	}
+}
+
+func TestSubscriberModes(t *testing.T) {
+	self := testDelta(DefaultContext, value{"navigation.speedThroughWater", 3.2})
+	other := testDelta("vessels.urn:mrn:imo:mmsi:230099999", value{"navigation.speedOverGround", 5.1})
+	now := time.Now()
+
+	for _, tc := range []struct {
+		mode        string
+		self, other bool
+	}{
+		{"none", false, false},
+		{"self", true, false},
+		{"", true, false},
+		{"all", true, true},
+	} {
+		s, err := NewSubscriber(DefaultContext, tc.mode)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if _, ok := s.Filter(self, now); ok != tc.self {
+			t.Errorf("subscribe=%v sent self = %v, expected %v", tc.mode, ok, tc.self)
+		}
+		if _, ok := s.Filter(other, now); ok != tc.other {
+			t.Errorf("subscribe=%v sent other vessel = %v, expected %v", tc.mode, ok, tc.other)
+		}
+	}
+
+	if _, err := NewSubscriber(DefaultContext, "some"); err == nil {
+		t.Error("NewSubscriber() accepted an invalid mode")
+	}
+}
+
+func TestSubscriberPolicies(t *testing.T) {
+	s, _ := NewSubscriber(DefaultContext, "none")
+
+	err := s.Handle([]byte(`{"context": "vessels.self", "subscribe": [
+		{"path": "navigation.*", "policy": "instant", "minPeriod": 200},
+		{"path": "environment.depth.belowTransducer", "policy": "fixed", "period": 1000},
+		{"path": "electrical.*.voltage", "period": 500}
+	]}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	d := testDelta(DefaultContext,
+		value{"navigation.speedThroughWater", 3.2},
+		value{"environment.depth.belowTransducer", 12.5},
+		value{"electrical.batteries.1.voltage", 12.6},
+		value{"environment.wind.speedApparent", 7.0})
+
+	out, ok := s.Filter(d, now)
+	if !ok || len(out.Updates[0].Values) != 2 {
+		t.Fatalf("Filter() = %+v, expected speed and voltage", out)
+	}
+
+	// Too soon for instant, the change is held back until minPeriod is over
+	d.Updates[0].Values[0].Value = 3.3
+	if out, ok := s.Filter(d, now.Add(100*time.Millisecond)); ok && len(out.Updates[0].Values) != 0 {
+		for _, v := range out.Updates[0].Values {
+			if v.Path == "navigation.speedThroughWater" {
+				t.Errorf("Filter() sent %v before minPeriod", v)
+			}
+		}
+	}
+
+	// The first depth goes out with the first tick
+	ticks := s.Tick(now.Add(250 * time.Millisecond))
+	if len(ticks) != 1 || len(ticks[0].Updates) != 2 || ticks[0].Updates[1].Values[0].Value != 3.3 {
+		t.Errorf("Tick() = %+v, expected depth and the held back speed", ticks)
+	}
+
+	// Fixed sends the depth every second, ideal resends the voltage without
+	// a change
+	ticks = s.Tick(now.Add(1300 * time.Millisecond))
+	if len(ticks) != 1 || len(ticks[0].Updates) != 2 {
+		t.Fatalf("Tick() = %+v, expected depth and voltage", ticks)
+	}
+	if p := ticks[0].Updates[0].Values[0].Path; p != "electrical.batteries.1.voltage" {
+		t.Errorf("Tick() sent %v first, expected the voltage", p)
+	}
+
+	// Unsubscribe from everything
+	if err := s.Handle([]byte(`{"context": "*", "unsubscribe": [{"path": "*"}]}`)); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := s.Filter(d, now.Add(2*time.Second)); ok {
+		t.Error("Filter() sent values after unsubscribing")
+	}
+	if ticks := s.Tick(now.Add(3 * time.Second)); len(ticks) != 0 {
+		t.Errorf("Tick() = %+v after unsubscribing", ticks)
+	}
+}
+
+func TestSubscriberInvalid(t *testing.T) {
+	s, _ := NewSubscriber(DefaultContext, "none")
+
+	for _, msg := range []string{
+		`{"subscribe": [{"path": "*"}]}`,
+		`{"context": "*", "subscribe": [{"path": "*", "policy": "sometimes"}]}`,
+		`{"context": "*", "subscribe": [{"path": "*", "format": "full"}]}`,
+		`{"context": "*", "subscribe": [`,
+	} {
+		if err := s.Handle([]byte(msg)); err == nil {
+			t.Errorf("Handle(%v) succeeded, expected an error", msg)
+		}
+	}
+}
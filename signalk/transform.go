@@ -0,0 +1,299 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package signalk
+
+import (
+	"encoding/xml"
+	"fmt"
+	"math"
+	"strings"
+
+	"github.com/timmathews/argo/nmea2k"
+)
+
+// transform changes a decoded field on its way to a path. The transforms of a
+// parameter group are applied in order. The operations are:
+//
+//	scale      multiply by the value
+//	offset     add the value
+//	convert    convert from one unit to another, such as deg to rad
+//	enum       replace names, such as a lookup name with a Signal K enum
+//	ratio      convert a percentage to a ratio
+//	negate     invert the sign
+//	clamp      limit to min and max, either of which may be left out
+//	add        add the value of another field
+//	subtract   subtract the value of another field
+//
+// A put reverses its transforms, so they are written in the direction a
+// value is read, like those of a parameter group. Transforms which combine
+// fields cannot be reversed.
+type transform struct {
+	Operation string   `xml:"op"`
+	Value     *float64 `xml:"value"`
+	From      string   `xml:"from"`
+	To        string   `xml:"to"`
+	Min       *float64 `xml:"min"`
+	Max       *float64 `xml:"max"`
+	Field     string   `xml:"field"`
+	Names     []struct {
+		From string `xml:"from,attr"`
+		To   string `xml:",chardata"`
+	} `xml:"name"`
+
+	// A conversion is a linear function, like scale and offset
+	factor, shift float64
+}
+
+// unit is a unit as a multiple of the base unit of its quantity, plus an
+// offset for temperatures
+type unit struct {
+	quantity      string
+	factor, shift float64
+}
+
+var units = map[string]unit{
+	"rad":   {"angle", 1, 0},
+	"deg":   {"angle", math.Pi / 180, 0},
+	"rad/s": {"angular velocity", 1, 0},
+	"deg/s": {"angular velocity", math.Pi / 180, 0},
+	"deg/m": {"angular velocity", math.Pi / 180 / 60, 0},
+	"K":     {"temperature", 1, 0},
+	"C":     {"temperature", 1, 273.15},
+	"F":     {"temperature", 5.0 / 9, 273.15 - 32*5.0/9},
+	"m/s":   {"speed", 1, 0},
+	"kn":    {"speed", 1852.0 / 3600, 0},
+	"km/h":  {"speed", 1 / 3.6, 0},
+	"Pa":    {"pressure", 1, 0},
+	"hPa":   {"pressure", 100, 0},
+	"mbar":  {"pressure", 100, 0},
+	"kPa":   {"pressure", 1000, 0},
+	"bar":   {"pressure", 100000, 0},
+	"m":     {"length", 1, 0},
+	"ft":    {"length", 0.3048, 0},
+	"NM":    {"length", 1852, 0},
+	"km":    {"length", 1000, 0},
+	"s":     {"time", 1, 0},
+	"min":   {"time", 60, 0},
+	"h":     {"time", 3600, 0},
+	"m3":    {"volume", 1, 0},
+	"L":     {"volume", 0.001, 0},
+	"gal":   {"volume", 0.003785411784, 0},
+	"m3/s":  {"flow", 1, 0},
+	"L/h":   {"flow", 0.001 / 3600, 0},
+	"Hz":    {"frequency", 1, 0},
+	"rpm":   {"frequency", 1.0 / 60, 0},
+	"J":     {"energy", 1, 0},
+	"kWh":   {"energy", 3600000, 0},
+	"ratio": {"ratio", 1, 0},
+	"%":     {"ratio", 0.01, 0},
+}
+
+// UnmarshalXML checks a transform as the mapping file is read
+func (t *transform) UnmarshalXML(d *xml.Decoder, start xml.StartElement) error {
+	type plain transform
+
+	var p plain
+	if err := d.DecodeElement(&p, &start); err != nil {
+		return err
+	}
+
+	*t = transform(p)
+	t.Operation = strings.ToLower(strings.TrimSpace(t.Operation))
+
+	return t.compile()
+}
+
+func (t *transform) compile() error {
+	switch t.Operation {
+	case "scale":
+		if t.Value == nil || *t.Value == 0 {
+			return fmt.Errorf("transform scale needs a value other than 0")
+		}
+	case "offset":
+		if t.Value == nil {
+			return fmt.Errorf("transform offset needs a value")
+		}
+	case "convert":
+		from, ok1 := units[t.From]
+		to, ok2 := units[t.To]
+		if !ok1 || !ok2 {
+			return fmt.Errorf("cannot convert from %q to %q", t.From, t.To)
+		}
+		if from.quantity != to.quantity {
+			return fmt.Errorf("cannot convert %v to %v", from.quantity, to.quantity)
+		}
+		// to = (from*f1 + s1 - s2) / f2
+		t.factor = from.factor / to.factor
+		t.shift = (from.shift - to.shift) / to.factor
+	case "clamp":
+		if t.Min == nil && t.Max == nil {
+			return fmt.Errorf("transform clamp needs a min or a max")
+		}
+		if t.Min != nil && t.Max != nil && *t.Min > *t.Max {
+			return fmt.Errorf("transform clamp min %v is greater than max %v", *t.Min, *t.Max)
+		}
+	case "add", "subtract":
+		if t.Field == "" {
+			return fmt.Errorf("transform %v needs a field", t.Operation)
+		}
+	case "enum":
+		if len(t.Names) == 0 {
+			return fmt.Errorf("transform enum needs names")
+		}
+	case "ratio", "negate":
+	default:
+		return fmt.Errorf("unknown transform %q", t.Operation)
+	}
+
+	return nil
+}
+
+// apply transforms the value of a field. Def and fields are those of the
+// message, for transforms which combine fields.
+func (t *transform) apply(v interface{}, def *nmea2k.Pgn, fields nmea2k.DataMap) (interface{}, error) {
+	if t.Operation == "enum" {
+		for _, n := range t.Names {
+			if fmt.Sprintf("%v", v) == n.From {
+				return n.To, nil
+			}
+		}
+		return v, nil
+	}
+
+	f, ok := number(v)
+	if !ok {
+		return nil, fmt.Errorf("cannot %v %v", t.Operation, v)
+	}
+
+	var g float64
+	if t.Operation == "add" || t.Operation == "subtract" {
+		i, err := def.FieldIndex(t.Field)
+		if err != nil {
+			return nil, err
+		}
+		if g, ok = number(fields[i]); !ok {
+			return nil, fmt.Errorf("cannot %v %v", t.Operation, fields[i])
+		}
+	}
+
+	return t.number(f, g), nil
+}
+
+// number transforms a number. G is the value of the other field of add and
+// subtract.
+func (t *transform) number(f, g float64) float64 {
+	switch t.Operation {
+	case "scale":
+		f *= *t.Value
+	case "offset":
+		f += *t.Value
+	case "convert":
+		f = f*t.factor + t.shift
+	case "ratio":
+		f /= 100
+	case "negate":
+		f = -f
+	case "clamp":
+		if t.Min != nil && f < *t.Min {
+			f = *t.Min
+		}
+		if t.Max != nil && f > *t.Max {
+			f = *t.Max
+		}
+	case "add":
+		f += g
+	case "subtract":
+		f -= g
+	}
+
+	return f
+}
+
+// reverse undoes a transform, for a value which is put
+func (t *transform) reverse(v interface{}) (interface{}, error) {
+	if t.Operation == "enum" {
+		for _, n := range t.Names {
+			if fmt.Sprintf("%v", v) == n.To {
+				return n.From, nil
+			}
+		}
+		return v, nil
+	}
+
+	f, ok := number(v)
+	if !ok {
+		return nil, fmt.Errorf("cannot %v %v", t.Operation, v)
+	}
+
+	switch t.Operation {
+	case "scale":
+		f /= *t.Value
+	case "offset":
+		f -= *t.Value
+	case "convert":
+		f = (f - t.shift) / t.factor
+	case "ratio":
+		f *= 100
+	case "negate":
+		f = -f
+	case "clamp":
+		// Values out of range are sent as they are, for the device to refuse
+	default:
+		return nil, fmt.Errorf("transform %v cannot be reversed", t.Operation)
+	}
+
+	return f, nil
+}
+
+// transform applies the transforms of a parameter group to a value
+func (parameterGroup *parameterGroup) transform(v interface{}, def *nmea2k.Pgn, fields nmea2k.DataMap) (interface{}, error) {
+	return applyTransforms(parameterGroup.Transforms, v, def, fields)
+}
+
+// untransform reverses the transforms of a parameter group
+func (parameterGroup *parameterGroup) untransform(v interface{}) (interface{}, error) {
+	return reverseTransforms(parameterGroup.Transforms, v)
+}
+
+// applyTransforms applies transforms to a value in order
+func applyTransforms(ts []transform, v interface{}, def *nmea2k.Pgn, fields nmea2k.DataMap) (interface{}, error) {
+	var err error
+
+	for i := range ts {
+		if v, err = ts[i].apply(v, def, fields); err != nil {
+			return nil, err
+		}
+	}
+
+	return v, nil
+}
+
+// reverseTransforms undoes transforms, last first
+func reverseTransforms(ts []transform, v interface{}) (interface{}, error) {
+	var err error
+
+	for i := len(ts) - 1; i >= 0; i-- {
+		if v, err = ts[i].reverse(v); err != nil {
+			return nil, err
+		}
+	}
+
+	return v, nil
+}
@@ -0,0 +1,161 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package signalk
+
+import (
+	"encoding/xml"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/timmathews/argo/nmea2k"
+)
+
+func TestTransforms(t *testing.T) {
+	_, depth := nmea2k.PgnList.First(128267)
+	fields := nmea2k.DataMap{0: 1, 1: 12.5, 2: -0.75}
+
+	tests := []struct {
+		xml      string
+		in       interface{}
+		expected interface{}
+	}{
+		{`<transform><op>scale</op><value>0.01</value></transform>`, 250, 2.5},
+		{`<transform><op>offset</op><value>273.15</value></transform>`, float32(20), 293.15},
+		{`<transform><op>convert</op><from>deg</from><to>rad</to></transform>`, 180.0, math.Pi},
+		{`<transform><op>convert</op><from>C</from><to>K</to></transform>`, 25, 298.15},
+		{`<transform><op>convert</op><from>F</from><to>C</to></transform>`, 212, 100.0},
+		{`<transform><op>convert</op><from>kn</from><to>m/s</to></transform>`, 10, 5.144444444},
+		{`<transform><op>ratio</op></transform>`, uint8(85), 0.85},
+		{`<transform><op>negate</op></transform>`, int16(-3), 3.0},
+		{`<transform><op>clamp</op><min>0</min><max>1</max></transform>`, 1.2, 1.0},
+		{`<transform><op>clamp</op><min>0</min></transform>`, -0.2, 0.0},
+		{`<transform><op>add</op><field>Offset</field></transform>`, 12.5, 11.75},
+		{`<transform><op>subtract</op><field>2</field></transform>`, 12.5, 13.25},
+		{`<transform><op>enum</op><name from="Magnetic">magnetic</name><name from="True">true</name></transform>`,
+			"True", "true"},
+		{`<transform><op>enum</op><name from="Magnetic">magnetic</name></transform>`, "Error", "Error"},
+	}
+
+	for _, tt := range tests {
+		var tr transform
+		if err := xml.Unmarshal([]byte(tt.xml), &tr); err != nil {
+			t.Fatalf("%v: %v", tt.xml, err)
+		}
+
+		got, err := tr.apply(tt.in, &depth, fields)
+		if err != nil {
+			t.Errorf("%v: %v", tt.xml, err)
+			continue
+		}
+
+		if f, ok := tt.expected.(float64); ok {
+			if g, ok := got.(float64); !ok || math.Abs(f-g) > 1e-6 {
+				t.Errorf("%v: expected %v, got %v", tt.xml, tt.expected, got)
+			}
+		} else if got != tt.expected {
+			t.Errorf("%v: expected %v, got %v", tt.xml, tt.expected, got)
+		}
+
+		// Every transform which does not combine fields can be undone,
+		// except clamp, which only limits values
+		if tr.Operation == "add" || tr.Operation == "subtract" || tr.Operation == "clamp" {
+			continue
+		}
+
+		back, err := tr.reverse(got)
+		if err != nil {
+			t.Errorf("%v: %v", tt.xml, err)
+			continue
+		}
+		if f, ok := number(tt.in); ok {
+			if g, _ := number(back); math.Abs(f-g) > 1e-6 {
+				t.Errorf("%v: reversed %v to %v", tt.xml, got, back)
+			}
+		} else if back != tt.in {
+			t.Errorf("%v: reversed %v to %v", tt.xml, got, back)
+		}
+	}
+}
+
+func TestTransformInvalid(t *testing.T) {
+	for _, s := range []string{
+		`<transform><op>square</op></transform>`,
+		`<transform><op>scale</op></transform>`,
+		`<transform><op>convert</op><from>deg</from><to>m</to></transform>`,
+		`<transform><op>convert</op><from>deg</from><to>furlong</to></transform>`,
+		`<transform><op>clamp</op></transform>`,
+		`<transform><op>clamp</op><min>2</min><max>1</max></transform>`,
+		`<transform><op>add</op></transform>`,
+		`<transform><op>enum</op></transform>`,
+	} {
+		var tr transform
+		if err := xml.Unmarshal([]byte(s), &tr); err == nil {
+			t.Errorf("%v: expected an error", s)
+		}
+	}
+}
+
+func TestTransformDepth(t *testing.T) {
+	for _, tt := range []struct {
+		offset   float64
+		expected value
+	}{
+		{0.5, value{"environment.depth.belowSurface", 13.0}},
+		{-1.5, value{"environment.depth.belowKeel", 11.0}},
+	} {
+		in := newMessage(time.Now(), 128267, nmea2k.DataMap{0: 1, 1: 12.5, 2: tt.offset})
+
+		got, err := mapdata.Delta(&in)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		x := MakeSet(got.Updates[0].Values)
+		if !x.Contains(tt.expected) || !x.Contains(value{"environment.depth.belowTransducer", 12.5}) {
+			t.Errorf("\nExpected: %+v\n     Got: %+v", tt.expected, got.Updates[0].Values)
+		}
+	}
+}
+
+func TestTransformPut(t *testing.T) {
+	var m Mappings
+	err := xml.Unmarshal([]byte(`<mappings><mapping>
+		<path>~/steering/autopilot/target/headingTrue</path>
+		<put>
+			<pgn>127237</pgn>
+			<field>Heading-To-Steer (Course)</field>
+			<transform><op>convert</op><from>deg</from><to>rad</to></transform>
+		</put>
+	</mapping></mappings>`), &m)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Pi/2 radians is sent as 90 degrees
+	msg, err := m.Pack("steering.autopilot.target.headingTrue", math.Pi/2)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if msg.Data[5] != 0x5C || msg.Data[6] != 0x3D {
+		t.Errorf("Got % x", msg.Data)
+	}
+}
@@ -0,0 +1,105 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package signalk
+
+import (
+	"fmt"
+	"strings"
+	"time"
+)
+
+// Vessel is the static data of a vessel, which does not come from the bus.
+// Lengths are in meters, zero if unknown.
+type Vessel struct {
+	Name      string
+	Mmsi      int
+	Uuid      string
+	Callsign  string
+	Length    float64
+	Beam      float64
+	Draft     float64
+	AirHeight float64
+}
+
+// Context returns the Signal K context of the vessel, using its MMSI if it
+// has one and its UUID otherwise.
+func (v Vessel) Context() string {
+	if v.Mmsi != 0 {
+		return fmt.Sprintf("vessels.urn:mrn:imo:mmsi:%09d", v.Mmsi)
+	}
+
+	if v.Uuid != "" {
+		return "vessels.urn:mrn:signalk:uuid:" + strings.ToLower(v.Uuid)
+	}
+
+	return DefaultContext
+}
+
+// Delta returns the static data of the vessel as a delta.
+func (v Vessel) Delta() Delta {
+	root := make(map[string]interface{})
+	if v.Name != "" {
+		root["name"] = v.Name
+	}
+	if v.Mmsi != 0 {
+		root["mmsi"] = fmt.Sprintf("%09d", v.Mmsi)
+	}
+	if v.Uuid != "" {
+		root["uuid"] = "urn:mrn:signalk:uuid:" + strings.ToLower(v.Uuid)
+	}
+
+	var values []value
+	if len(root) > 0 {
+		values = append(values, value{"", root})
+	}
+
+	if v.Callsign != "" {
+		values = append(values, value{"communication.callsignVhf", v.Callsign})
+	}
+
+	for _, d := range []struct {
+		path  string
+		key   string
+		value float64
+	}{
+		{"design.length", "overall", v.Length},
+		{"design.beam", "", v.Beam},
+		{"design.draft", "maximum", v.Draft},
+		{"design.airHeight", "", v.AirHeight},
+	} {
+		if d.value == 0 {
+			continue
+		}
+		if d.key == "" {
+			values = append(values, value{d.path, d.value})
+		} else {
+			values = append(values, value{d.path, map[string]interface{}{d.key: d.value}})
+		}
+	}
+
+	return Delta{
+		Context: v.Context(),
+		Updates: []update{{
+			Source:    source{Label: "defaults"},
+			Timestamp: time.Now().UTC(),
+			Values:    values,
+		}},
+	}
+}
@@ -0,0 +1,59 @@
+/*
+ * Copyright (C) 2016 Tim Mathews <tim@signalk.org>
+ *
+ * This file is part of Argo.
+ *
+ * Argo is free software: you can redistribute it and/or modify it under the
+ * terms of the GNU General Public License as published by the Free Software
+ * Foundation, either version 3 of the License, or (at your option) any later
+ * version.
+ *
+ * Argo is distributed in the hope that it will be useful, but WITHOUT ANY
+ * WARRANTY; without even the implied warranty of MERCHANTABILITY or FITNESS
+ * FOR A PARTICULAR PURPOSE. See the GNU General Public License for more
+ * details.
+ *
+ * You should have received a copy of the GNU General Public License along with
+ * this program. If not, see <http://www.gnu.org/licenses/>.
+ */
+
+package signalk
+
+import (
+	"testing"
+)
+
+func TestVesselContext(t *testing.T) {
+	v := Vessel{Uuid: "C0D79334-4E25-4245-8892-54E8CCC8021E"}
+	if c := v.Context(); c != "vessels.urn:mrn:signalk:uuid:c0d79334-4e25-4245-8892-54e8ccc8021e" {
+		t.Errorf("Context() = %v, expected the UUID URN", c)
+	}
+
+	v.Mmsi = 23099999
+	if c := v.Context(); c != "vessels.urn:mrn:imo:mmsi:023099999" {
+		t.Errorf("Context() = %v, expected the MMSI URN", c)
+	}
+}
+
+func TestVesselDelta(t *testing.T) {
+	v := Vessel{Name: "SS Minnow", Mmsi: 123456789, Callsign: "KD123A", Length: 8.5, Draft: 0.9}
+
+	model := NewModel(v.Context())
+	model.Apply(v.Delta())
+
+	for p, expected := range map[string]string{
+		"vessels/self/name":                            `"SS Minnow"`,
+		"vessels/self/mmsi":                            `"123456789"`,
+		"vessels/self/communication/callsignVhf/value": `"KD123A"`,
+		"vessels/self/design/length/value/overall":     `8.5`,
+		"vessels/self/design/draft/value/maximum":      `0.9`,
+	} {
+		if b, ok := model.Get(p); !ok || string(b) != expected {
+			t.Errorf("Get(%v) = %s, expected %v", p, b, expected)
+		}
+	}
+
+	if _, ok := model.Get("vessels/self/design/beam"); ok {
+		t.Error("Get(vessels/self/design/beam) found a beam that was never set")
+	}
+}